@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+)
+
+// startControlSocket 在 Unix 套接字上接受管理命令，每个连接发送一行命令并收到一行响应。
+// 支持的命令：
+//
+//	reload           重新读取配置文件，替换访问策略与设置并重新绑定监听器，失败时恢复
+//	maintenance on   进入维护模式，拒绝新连接，已建立的连接不受影响
+//	maintenance off  退出维护模式
+//	udp export PATH  将当前UDP会话表以 JSON 写入文件
+//	udp import PATH  从文件读取UDP会话表并重新建立会话
+//
+// 命令不做认证，能连接套接字即可执行，且 udp export/import 以服务器的权限读写任意文件，
+// 因此套接字在 umask 0177 下创建，权限从一开始就是 0600，只有运行服务器的用户（及 root）可以连接。
+// 路径上已存在的文件只有是套接字（上次运行遗留）时才会删除，否则启动失败。
+func startControlSocket(server *Server, path, configPath string) error {
+	// 清理上次运行遗留的套接字文件，不删除其他类型的文件
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode().Type() != os.ModeSocket {
+			return fmt.Errorf("启动控制套接字失败: %s 已存在且不是套接字", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("删除遗留的控制套接字失败: %w", err)
+		}
+	}
+	ln, err := listenUnixPrivate(path)
+	if err != nil {
+		return fmt.Errorf("启动控制套接字失败: %w", err)
+	}
+	log.Printf("控制套接字正在监听 %s", path)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				log.Printf("控制套接字已停止: %v", err)
+				return
+			}
+			go handleControlConn(server, conn, configPath)
+		}
+	}()
+	return nil
+}
+
+// handleControlConn 读取并执行一条管理命令
+func handleControlConn(server *Server, conn net.Conn, configPath string) {
+	defer conn.Close()
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && line == "" {
+		return
+	}
+
+	cmd := strings.TrimSpace(line)
+	log.Printf("收到管理命令: %s", cmd)
+	if err := runControlCommand(server, cmd, configPath); err != nil {
+		log.Printf("管理命令 %s 执行失败: %v", cmd, err)
+		fmt.Fprintf(conn, "error: %v\n", err)
+		return
+	}
+	fmt.Fprintln(conn, "ok")
+}
+
+// runControlCommand 执行管理命令
+func runControlCommand(server *Server, cmd, configPath string) error {
+	switch cmd {
+	case "reload":
+		cfg, err := LoadConfig(configPath)
+		if err != nil {
+			return fmt.Errorf("加载配置文件失败: %w", err)
+		}
+		return server.ReloadConfig(cfg)
+	case "maintenance on":
+		server.SetMaintenance(true)
+		return nil
+	case "maintenance off":
+		server.SetMaintenance(false)
+		return nil
+	}
+
+	if path, ok := strings.CutPrefix(cmd, "udp export "); ok {
+		states, err := server.ExportUDPSessions()
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(states)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			return fmt.Errorf("写入UDP会话文件失败: %w", err)
+		}
+		log.Printf("已导出 %d 个UDP会话到 %s", len(states), path)
+		return nil
+	}
+	if path, ok := strings.CutPrefix(cmd, "udp import "); ok {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("读取UDP会话文件失败: %w", err)
+		}
+		var states []UDPSessionState
+		if err := json.Unmarshal(data, &states); err != nil {
+			return fmt.Errorf("解析UDP会话文件失败: %w", err)
+		}
+		n, err := server.ImportUDPSessions(states)
+		if err != nil {
+			return err
+		}
+		log.Printf("已从 %s 导入 %d/%d 个UDP会话", path, n, len(states))
+		return nil
+	}
+	return fmt.Errorf("未知命令: %s", cmd)
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// freeAddr 返回一个当前未被占用的回环地址
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// writeConfig 写入配置文件并返回解析后的配置
+func writeConfig(t *testing.T, path, js string) *Config {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(js), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("加载配置失败: %v", err)
+	}
+	return cfg
+}
+
+// connectAddr 连接 addr 上的服务器，以 username 认证后请求 CONNECT target，返回回复码
+func connectAddr(t *testing.T, addr, username, password, target string) uint8 {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatalf("连接 %s 失败: %v", addr, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	greet(t, conn, username, password)
+	host, port, _ := net.SplitHostPort(target)
+	p, _ := strconv.Atoi(port)
+	mustWrite(t, conn, requestBytes(CmdConnect, host, uint16(p)))
+	rep, _ := readReply(t, conn)
+	return rep
+}
+
+// expectRefused 等待 addr 不再接受连接
+func expectRefused(t *testing.T, addr string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err != nil {
+			return
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatalf("%s 仍在接受连接", addr)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReloadCommand(t *testing.T) {
+	echo := startEcho(t)
+	path := filepath.Join(t.TempDir(), "config.json")
+	oldAddr := freeAddr(t)
+	s := startServer(t, writeConfig(t, path, `{"address": "`+oldAddr+`", "users": {"alice": {"password": "secret"}}}`))
+	if rep := connectAddr(t, oldAddr, "alice", "secret", echo); rep != RepSuccess {
+		t.Fatalf("重新加载前回复码 %#x", rep)
+	}
+
+	t.Run("配置无效", func(t *testing.T) {
+		before := s.settings.Load()
+		// 不存在的用户文件使访问策略无法构建，parseConfig 不检查
+		os.WriteFile(path, []byte(`{"address": "`+freeAddr(t)+`", "users_file": "/nonexistent/htpasswd"}`), 0o600)
+		if err := runControlCommand(s, "reload", path); err == nil {
+			t.Fatal("reload 成功, 期望失败")
+		}
+		if s.settings.Load() != before || s.Addr().String() != oldAddr {
+			t.Fatal("重新加载失败后配置或监听器被修改")
+		}
+	})
+
+	t.Run("端口被占用", func(t *testing.T) {
+		busy, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer busy.Close()
+		before := s.settings.Load()
+		writeConfig(t, path, `{"address": "`+busy.Addr().String()+`", "request_timeout": 5000, "users": {"bob": {"password": "hunter2"}}}`)
+		err = runControlCommand(s, "reload", path)
+		if err == nil || !strings.Contains(err.Error(), "已恢复原来的配置") {
+			t.Fatalf("reload 错误 %v, 期望绑定失败并恢复", err)
+		}
+		if s.settings.Load() != before || s.cfg().RequestTimeout != 0 {
+			t.Fatal("绑定失败后配置未恢复")
+		}
+		// 旧监听器与旧的用户仍然可用
+		if rep := connectAddr(t, oldAddr, "alice", "secret", echo); rep != RepSuccess {
+			t.Fatalf("绑定失败后旧端口回复码 %#x", rep)
+		}
+	})
+
+	t.Run("修改端口", func(t *testing.T) {
+		newAddr := freeAddr(t)
+		writeConfig(t, path, `{"address": "`+newAddr+`", "request_timeout": 5000, "users": {"bob": {"password": "hunter2"}}}`)
+		if err := runControlCommand(s, "reload", path); err != nil {
+			t.Fatalf("reload 失败: %v", err)
+		}
+		// 新端口接受连接并使用新的用户，旧端口停止监听，其他设置一起生效
+		if rep := connectAddr(t, newAddr, "bob", "hunter2", echo); rep != RepSuccess {
+			t.Fatalf("新端口回复码 %#x", rep)
+		}
+		expectRefused(t, oldAddr)
+		if got := s.cfg().RequestTimeout; got != 5000 {
+			t.Fatalf("request_timeout 为 %d, 期望 5000", got)
+		}
+	})
+}
+
+func TestMaintenanceMode(t *testing.T) {
+	echo := startEcho(t)
+	logs := captureLog(t)
+	s := startServer(t, testConfig(t, ""))
+	existing, rep, _ := connect(t, s, "", "", CmdConnect, echo)
+	if rep != RepSuccess {
+		t.Fatalf("回复码 %#x", rep)
+	}
+
+	steps := []struct {
+		command  string
+		accepted bool // 新连接是否被服务
+	}{
+		{"maintenance on", false},
+		{"maintenance on", false},
+		{"maintenance off", true},
+		{"maintenance on", false},
+		{"maintenance off", true},
+	}
+	for i, step := range steps {
+		if err := runControlCommand(s, step.command, ""); err != nil {
+			t.Fatalf("第 %d 步 %s 失败: %v", i+1, step.command, err)
+		}
+		if got := greetFrom(t, s.Addr().String(), net.IPv4(127, 0, 0, 1)); got != step.accepted {
+			t.Fatalf("第 %d 步 %s 后新连接被服务为 %v, 期望 %v", i+1, step.command, got, step.accepted)
+		}
+		if !step.accepted {
+			waitLog(t, logs, "维护模式, 拒绝来自")
+		}
+		// 已建立的会话不受影响
+		mustWrite(t, existing, []byte("ping"))
+		expectBytes(t, existing, []byte("ping"))
+	}
+
+	if err := runControlCommand(s, "maintenance maybe", ""); err == nil {
+		t.Fatal("未知命令应返回错误")
+	}
+}
+
+func TestTransferSurvivesListenerReload(t *testing.T) {
+	const size = 16 << 20
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	want := sha256.Sum256(data)
+	echo := startEcho(t)
+
+	tests := []struct {
+		name     string
+		moveAddr bool // 重新加载时是否更换监听地址
+	}{
+		{"更换端口", true},
+		{"保留端口", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 目标发送完整数据后关闭
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				conn.Write(data)
+			}()
+
+			path := filepath.Join(t.TempDir(), "config.json")
+			oldAddr := freeAddr(t)
+			s := startServer(t, writeConfig(t, path, `{"address": "`+oldAddr+`"}`))
+			conn, rep, _ := connect(t, s, "", "", CmdConnect, ln.Addr().String())
+			if rep != RepSuccess {
+				t.Fatalf("回复码 %#x", rep)
+			}
+			conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+			// 先读取一部分，其余数据因背压停留在转发途中
+			h := sha256.New()
+			if _, err := io.CopyN(h, conn, 1<<20); err != nil {
+				t.Fatalf("重新加载前读取失败: %v", err)
+			}
+			newAddr := oldAddr
+			if tt.moveAddr {
+				newAddr = freeAddr(t)
+			}
+			writeConfig(t, path, `{"address": "`+newAddr+`"}`)
+			if err := runControlCommand(s, "reload", path); err != nil {
+				t.Fatalf("reload 失败: %v", err)
+			}
+			if tt.moveAddr {
+				expectRefused(t, oldAddr)
+			}
+
+			// 已建立的会话不受影响，数据完整到达
+			n, err := io.Copy(h, conn)
+			if err != nil || n != size-1<<20 {
+				t.Fatalf("重新加载后读取 %d 字节 (%v), 期望 %d", n, err, size-1<<20)
+			}
+			if got := h.Sum(nil); !bytes.Equal(got, want[:]) {
+				t.Fatal("重新加载后收到的数据与目标发送的不一致")
+			}
+			// 新的连接由新监听器接受
+			if rep := connectAddr(t, newAddr, "", "", echo); rep != RepSuccess {
+				t.Fatalf("重新加载后新连接回复码 %#x", rep)
+			}
+		})
+	}
+}
+
+func TestControlSocketPath(t *testing.T) {
+	s := startServer(t, testConfig(t, ``))
+	dir := t.TempDir()
+
+	t.Run("不删除普通文件", func(t *testing.T) {
+		path := filepath.Join(dir, "file")
+		os.WriteFile(path, []byte("keep"), 0o600)
+		if err := startControlSocket(s, path, ""); err == nil || !strings.Contains(err.Error(), "不是套接字") {
+			t.Fatalf("启动错误 %v, 期望拒绝覆盖普通文件", err)
+		}
+		if data, err := os.ReadFile(path); err != nil || string(data) != "keep" {
+			t.Fatalf("普通文件被修改: %q, %v", data, err)
+		}
+	})
+
+	t.Run("替换遗留的套接字", func(t *testing.T) {
+		path := filepath.Join(dir, "control.sock")
+		stale, err := net.Listen("unix", path)
+		if err != nil {
+			t.Skipf("不支持 Unix 套接字: %v", err)
+		}
+		stale.(*net.UnixListener).SetUnlinkOnClose(false)
+		stale.Close()
+
+		if err := startControlSocket(s, path, ""); err != nil {
+			t.Fatalf("启动失败: %v", err)
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := fi.Mode().Perm(); runtime.GOOS != "windows" && perm != 0o600 {
+			t.Fatalf("控制套接字权限 %v, 期望 0600", perm)
+		}
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		mustWrite(t, conn, []byte("maintenance off\n"))
+		expectBytes(t, conn, []byte("ok\n"))
+	})
+}
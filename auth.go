@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"strconv"
+)
+
+// Authenticator 外部认证后端。设置 Server.Authenticator 后用户名/密码由其校验，
+// 取代配置中的 users 与 users_file；返回错误表示后端故障，认证按失败处理
+type Authenticator interface {
+	Authenticate(ctx context.Context, ac AuthContext) (bool, error)
+}
+
+// AuthContext 传给 Authenticator 的认证信息。握手阶段 Destination 为空；
+// 开启 request_time_auth 时每个请求会以请求的目标再校验一次
+type AuthContext struct {
+	Username    string
+	Password    string
+	RemoteAddr  net.Addr // 客户端地址，经 PROXY 协议时为真实客户端地址
+	Command     uint8    // 请求命令，握手阶段为0
+	Destination string   // 请求的目标 "主机:端口"，握手阶段为空
+}
+
+type authContextKey struct{}
+
+// withAuthContext 在 context 中预留握手认证信息的位置，供请求阶段再次认证使用
+func withAuthContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, authContextKey{}, &AuthContext{})
+}
+
+// saveAuthContext 保存握手阶段认证通过的信息，未预留时不保存
+func saveAuthContext(ctx context.Context, ac AuthContext) {
+	if saved, ok := ctx.Value(authContextKey{}).(*AuthContext); ok {
+		*saved = ac
+	}
+}
+
+// authorizeDestination 开启 request_time_auth 时以请求的目标再次调用 Authenticator，
+// 只对握手中通过用户名/密码认证的连接生效，其他连接直接放行
+func (s *Server) authorizeDestination(ctx context.Context, req *Request) bool {
+	saved, ok := ctx.Value(authContextKey{}).(*AuthContext)
+	if !ok || saved.Username == "" || s.Authenticator == nil {
+		return true
+	}
+	ac := *saved
+	ac.Command = req.Command
+	ac.Destination = net.JoinHostPort(req.Host, strconv.Itoa(int(req.Port)))
+	ok, err := s.Authenticator.Authenticate(ctx, ac)
+	if err != nil {
+		log.Printf("[trace %s] 认证后端校验用户 %s 访问 %s 失败: %v", traceIDFrom(ctx), s.logUsername(ac.Username), ac.Destination, err)
+		return false
+	}
+	return ok
+}
+
+// AuthHealthChecker 可由 Authenticator 实现，报告认证后端当前是否可用。
+// 实现应返回缓存的健康检查结果，每次握手都会调用。不可用时服务器在握手中
+// 不选择用户名/密码认证：监听器只接受该方法的客户端立即收到 0xFF，
+// 而不是完成握手后在密码校验阶段失败
+type AuthHealthChecker interface {
+	Healthy() bool
+}
+
+// authBackendHealthy 判断外部认证后端是否可用，未设置或未实现健康检查时视为可用
+func (s *Server) authBackendHealthy() bool {
+	checker, ok := s.Authenticator.(AuthHealthChecker)
+	return !ok || checker.Healthy()
+}
+
+// withoutMethod 返回去掉 method 后的方法列表
+func withoutMethod(methods []byte, method uint8) []byte {
+	out := make([]byte, 0, len(methods))
+	for _, m := range methods {
+		if m != method {
+			out = append(out, m)
+		}
+	}
+	return out
+}
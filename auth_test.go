@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubAuthenticator 按固定结果应答的认证后端，每次校验前等待 delay
+type stubAuthenticator struct {
+	delay time.Duration
+	ok    bool
+	err   error
+}
+
+func (a stubAuthenticator) Authenticate(ctx context.Context, ac AuthContext) (bool, error) {
+	time.Sleep(a.delay)
+	return a.ok, a.err
+}
+
+// healthAuthenticator 健康状态可切换的认证后端，接受任意凭据
+type healthAuthenticator struct {
+	healthy atomic.Bool
+}
+
+func (a *healthAuthenticator) Authenticate(ctx context.Context, ac AuthContext) (bool, error) {
+	return true, nil
+}
+
+func (a *healthAuthenticator) Healthy() bool {
+	return a.healthy.Load()
+}
+
+// histogramMetrics 记录直方图观测值，忽略计数器与仪表
+type histogramMetrics struct {
+	mu     sync.Mutex
+	values map[string][]float64
+}
+
+func (m *histogramMetrics) Counter(name string, labels []Label, delta int64) {}
+
+func (m *histogramMetrics) Gauge(name string, value int64) {}
+
+func (m *histogramMetrics) Histogram(name string, value float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.values == nil {
+		m.values = map[string][]float64{}
+	}
+	m.values[name] = append(m.values[name], value)
+}
+
+func (m *histogramMetrics) observed(name string) []float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]float64(nil), m.values[name]...)
+}
+
+func TestAuthLatency(t *testing.T) {
+	tests := []struct {
+		name string
+		auth stubAuthenticator
+		want bool
+	}{
+		{"快速通过", stubAuthenticator{ok: true}, true},
+		{"慢速通过", stubAuthenticator{delay: 150 * time.Millisecond, ok: true}, true},
+		{"慢速拒绝", stubAuthenticator{delay: 150 * time.Millisecond}, false},
+		{"后端故障", stubAuthenticator{delay: 150 * time.Millisecond, err: errors.New("后端超时")}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			type authEvent struct {
+				username string
+				success  bool
+				elapsed  time.Duration
+			}
+			events := make(chan authEvent, 1)
+			metrics := &histogramMetrics{}
+			auth := tt.auth
+			// 配置了用户的监听器要求密码认证，校验交给认证后端
+			s := startServer(t, testConfig(t, `{"users": {"bob": "other"}}`), func(s *Server) {
+				s.Authenticator = auth
+				s.Metrics = metrics
+				s.OnAuth = func(ctx context.Context, username string, success bool, elapsed time.Duration) {
+					events <- authEvent{username, success, elapsed}
+				}
+			})
+
+			if got := authenticates(t, s, "alice", "secret"); got != tt.want {
+				t.Fatalf("认证结果 %v, 期望 %v", got, tt.want)
+			}
+			var ev authEvent
+			select {
+			case ev = <-events:
+			case <-time.After(5 * time.Second):
+				t.Fatal("OnAuth 未被调用")
+			}
+			if ev.username != "alice" || ev.success != tt.want {
+				t.Fatalf("OnAuth(%q, %v), 期望 (alice, %v)", ev.username, ev.success, tt.want)
+			}
+			if ev.elapsed < tt.auth.delay || ev.elapsed > tt.auth.delay+time.Second {
+				t.Fatalf("OnAuth 耗时 %v, 期望约 %v", ev.elapsed, tt.auth.delay)
+			}
+			// 直方图在 OnAuth 之前记录，单位为毫秒
+			got := metrics.observed("auth_duration_ms")
+			if len(got) != 1 {
+				t.Fatalf("auth_duration_ms 观测值 %v, 期望一个", got)
+			}
+			if want := float64(ev.elapsed) / float64(time.Millisecond); got[0] != want {
+				t.Fatalf("auth_duration_ms 为 %v, 期望与 OnAuth 的 %v 一致", got[0], want)
+			}
+		})
+	}
+}
+
+func TestAuthBackendHealth(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		offered []byte
+		healthy bool
+		want    uint8 // 服务器选择的认证方法
+	}{
+		{"可用", `{"users": {"bob": "other"}}`, []byte{MethodUserPass}, true, MethodUserPass},
+		{"不可用时快速失败", `{"users": {"bob": "other"}}`, []byte{MethodUserPass}, false, MethodNoAcceptable},
+		{"不可用时改用其他方法", `{"users": {"bob": "other"}, "auth_methods": ["user_pass", "no_auth"]}`, []byte{MethodNoAuth, MethodUserPass}, false, MethodNoAuth},
+		{"客户端只提供密码认证", `{"users": {"bob": "other"}, "auth_methods": ["user_pass", "no_auth"]}`, []byte{MethodUserPass}, false, MethodNoAcceptable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := &healthAuthenticator{}
+			auth.healthy.Store(tt.healthy)
+			s := startServer(t, testConfig(t, tt.config), func(s *Server) { s.Authenticator = auth })
+			unavailable := counterValue("auth_backend_unavailable_total")
+
+			conn := dialServer(t, s)
+			mustWrite(t, conn, append([]byte{Version5, byte(len(tt.offered))}, tt.offered...))
+			expectBytes(t, conn, []byte{Version5, tt.want})
+			if tt.want == MethodNoAcceptable {
+				expectClosed(t, conn)
+			}
+			if !tt.healthy {
+				waitCounter(t, "auth_backend_unavailable_total", unavailable+1)
+			}
+		})
+	}
+
+	// 后端恢复后立即重新接受密码认证
+	auth := &healthAuthenticator{}
+	s := startServer(t, testConfig(t, `{"users": {"bob": "other"}}`), func(s *Server) { s.Authenticator = auth })
+	for _, healthy := range []bool{false, true, false} {
+		auth.healthy.Store(healthy)
+		want := []byte{Version5, MethodNoAcceptable}
+		if healthy {
+			want[1] = MethodUserPass
+		}
+		conn := dialServer(t, s)
+		mustWrite(t, conn, []byte{Version5, 1, MethodUserPass})
+		expectBytes(t, conn, want)
+		conn.Close()
+	}
+}
+
+func TestCredentialLengthLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		username string
+		password string
+		log      string // 认证失败时日志应包含的内容，为空表示认证成功
+	}{
+		{"默认允许协议上限", ``, strings.Repeat("u", 255), strings.Repeat("p", 255), ""},
+		{"用户名等于上限", `, "max_username_length": 64`, strings.Repeat("u", 64), "secret", ""},
+		{"用户名超过上限", `, "max_username_length": 64`, strings.Repeat("u", 65), "secret", "用户名长度 65 超过上限 64"},
+		{"密码等于上限", `, "max_password_length": 32`, "alice", strings.Repeat("p", 32), ""},
+		{"密码超过上限", `, "max_password_length": 32`, "alice", strings.Repeat("p", 33), `用户 "alice" 的密码长度 33 超过上限 32`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLog(t)
+			// 认证后端接受任意凭据，失败只能来自长度限制
+			s := startServer(t, testConfig(t, `{"users": {"bob": "other"}`+tt.config+`}`), func(s *Server) {
+				s.Authenticator = stubAuthenticator{ok: true}
+			})
+			if got := authenticates(t, s, tt.username, tt.password); got != (tt.log == "") {
+				t.Fatalf("认证结果 %v, 期望 %v", got, tt.log == "")
+			}
+			if tt.log != "" {
+				waitLog(t, logs, tt.log)
+			}
+		})
+	}
+}
+
+// targetAuthenticator 接受任意凭据，请求阶段拒绝 deny 中的目标，记录每次调用
+type targetAuthenticator struct {
+	deny  map[string]bool
+	err   error // 请求阶段返回的错误
+	mu    sync.Mutex
+	calls []AuthContext
+}
+
+func (a *targetAuthenticator) Authenticate(ctx context.Context, ac AuthContext) (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.calls = append(a.calls, ac)
+	if ac.Destination == "" {
+		return true, nil
+	}
+	return !a.deny[ac.Destination], a.err
+}
+
+func (a *targetAuthenticator) snapshot() []AuthContext {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]AuthContext(nil), a.calls...)
+}
+
+func TestRequestTimeAuth(t *testing.T) {
+	echo := startEcho(t)
+	const denied = "denied.test:80"
+	tests := []struct {
+		name    string
+		enable  bool
+		user    string
+		target  string
+		err     error
+		rep     uint8
+		checked bool // 是否在请求阶段调用了认证后端
+	}{
+		{"允许的目标", true, "alice", echo, nil, RepSuccess, true},
+		{"拒绝的目标", true, "alice", denied, nil, RepConnectionNotAllowed, true},
+		{"后端故障", true, "alice", echo, errors.New("后端超时"), RepConnectionNotAllowed, true},
+		{"未开启时不按目标校验", false, "alice", denied, nil, RepConnectionRefused, false},
+		{"未认证的连接不校验", true, "", denied, nil, RepConnectionRefused, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := &targetAuthenticator{deny: map[string]bool{denied: true}, err: tt.err}
+			config := `{"users": {"bob": "other"}, "auth_methods": ["user_pass", "no_auth"], "request_time_auth": ` + strconv.FormatBool(tt.enable) + `}`
+			s := startServer(t, testConfig(t, config), func(s *Server) {
+				s.Authenticator = auth
+				// 被放行的 denied.test 无法连接，以区分认证拒绝与连接失败
+				s.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+					if address == denied {
+						return nil, errors.New("无法连接")
+					}
+					var d net.Dialer
+					return d.DialContext(ctx, network, address)
+				}
+			})
+
+			conn, rep, _ := connect(t, s, tt.user, "secret", CmdConnect, tt.target)
+			if rep != tt.rep {
+				t.Fatalf("回复码 %#x, 期望 %#x", rep, tt.rep)
+			}
+			if rep == RepSuccess {
+				mustWrite(t, conn, []byte("hello"))
+				expectBytes(t, conn, []byte("hello"))
+			}
+
+			calls := auth.snapshot()
+			var want []AuthContext
+			if tt.user != "" {
+				want = append(want, AuthContext{Username: tt.user, Password: "secret", RemoteAddr: conn.LocalAddr()})
+			}
+			if tt.checked {
+				want = append(want, AuthContext{Username: tt.user, Password: "secret", RemoteAddr: conn.LocalAddr(), Command: CmdConnect, Destination: tt.target})
+			}
+			if len(calls) != len(want) {
+				t.Fatalf("认证后端调用 %+v, 期望 %+v", calls, want)
+			}
+			for i := range want {
+				got := calls[i]
+				if got.Username != want[i].Username || got.Password != want[i].Password || got.RemoteAddr.String() != want[i].RemoteAddr.String() ||
+					got.Command != want[i].Command || got.Destination != want[i].Destination {
+					t.Fatalf("第 %d 次调用 %+v, 期望 %+v", i+1, got, want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// defaultCaptureMaxBytes 未配置时每个抓包文件的大小上限
+const defaultCaptureMaxBytes = 10 << 20
+
+// captureFile 写入抓包数据，超过大小上限后丢弃后续数据。
+// 写入错误不会影响转发，因此 Write 总是报告成功。
+type captureFile struct {
+	f         *os.File
+	remaining int64
+}
+
+func (c *captureFile) Write(p []byte) (int, error) {
+	if c.remaining <= 0 {
+		return len(p), nil
+	}
+	data := p
+	if int64(len(data)) > c.remaining {
+		data = data[:c.remaining]
+	}
+	n, err := c.f.Write(data)
+	c.remaining -= int64(n)
+	if err != nil {
+		c.remaining = 0
+	}
+	return len(p), nil
+}
+
+// connCapture 将单个连接两个方向的原始数据分别写入抓包文件
+type connCapture struct {
+	upload   *captureFile
+	download *captureFile
+}
+
+// newConnCapture 为连接创建抓包文件，未启用抓包或创建失败时返回 nil
+func (s *Server) newConnCapture(ctx context.Context) *connCapture {
+	dir := s.cfg().Capture.Dir
+	if dir == "" {
+		return nil
+	}
+	maxBytes := s.cfg().Capture.MaxBytes
+	if maxBytes == 0 {
+		maxBytes = defaultCaptureMaxBytes
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		log.Printf("创建抓包目录失败: %v", err)
+		return nil
+	}
+	prefix := fmt.Sprintf("%s-conn-%d", time.Now().Format("20060102-150405"), connIDFrom(ctx))
+	c := &connCapture{}
+	for _, d := range []struct {
+		name string
+		file **captureFile
+	}{{"upload", &c.upload}, {"download", &c.download}} {
+		f, err := os.OpenFile(filepath.Join(dir, prefix+"-"+d.name+".bin"), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+		if err != nil {
+			log.Printf("创建抓包文件失败: %v", err)
+			c.Close()
+			return nil
+		}
+		*d.file = &captureFile{f: f, remaining: maxBytes}
+	}
+	return c
+}
+
+// wrap 将从 r 读取的数据同时写入对应方向的抓包文件
+func (c *connCapture) wrap(r io.Reader, upload bool) io.Reader {
+	if c == nil {
+		return r
+	}
+	if upload {
+		return io.TeeReader(r, c.upload)
+	}
+	return io.TeeReader(r, c.download)
+}
+
+// Close 关闭抓包文件
+func (c *connCapture) Close() {
+	if c == nil {
+		return
+	}
+	for _, f := range []*captureFile{c.upload, c.download} {
+		if f != nil {
+			f.f.Close()
+		}
+	}
+}
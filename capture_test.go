@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCaptureFiles(t *testing.T) {
+	echo := startEcho(t)
+	tests := []struct {
+		name     string
+		enable   bool
+		maxBytes int
+		want     string // 每个方向抓包文件的内容
+	}{
+		{"未启用", false, 0, ""},
+		{"完整记录", true, 0, "hello world"},
+		{"大小上限", true, 5, "hello"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "captures")
+			config := `{}`
+			if tt.enable {
+				config = fmt.Sprintf(`{"capture": {"dir": %s, "max_bytes": %d}}`, strconv.Quote(dir), tt.maxBytes)
+			}
+			closed := make(chan struct{}, 1)
+			s := startServer(t, testConfig(t, config), func(s *Server) {
+				s.OnConnectionClose = func(context.Context, *ConnectionInfo) { closed <- struct{}{} }
+			})
+			// 解析配置与启动都不创建目录，首次抓包时才创建
+			if _, err := os.Stat(dir); !os.IsNotExist(err) {
+				t.Fatalf("抓包前目录已存在: %v", err)
+			}
+			conn, rep, _ := connect(t, s, "", "", CmdConnect, echo)
+			if rep != RepSuccess {
+				t.Fatalf("回复码 %#x", rep)
+			}
+			mustWrite(t, conn, []byte("hello world"))
+			expectBytes(t, conn, []byte("hello world"))
+			conn.Close()
+			select {
+			case <-closed:
+			case <-time.After(5 * time.Second):
+				t.Fatal("会话未结束")
+			}
+
+			files, _ := filepath.Glob(filepath.Join(dir, "*"))
+			sort.Strings(files)
+			if !tt.enable {
+				if len(files) != 0 {
+					t.Fatalf("未启用抓包时生成了文件: %v", files)
+				}
+				return
+			}
+			if len(files) != 2 {
+				t.Fatalf("抓包文件为 %v, 期望上下行各一个", files)
+			}
+			for i, suffix := range []string{"-download.bin", "-upload.bin"} {
+				if !strings.HasSuffix(files[i], suffix) {
+					t.Fatalf("抓包文件 %s 不以 %s 结尾", files[i], suffix)
+				}
+				data, err := os.ReadFile(files[i])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(data) != tt.want {
+					t.Fatalf("%s 的内容为 %q, 期望 %q", files[i], data, tt.want)
+				}
+			}
+		})
+	}
+
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseConfig([]byte(`{"address": "127.0.0.1:0", "capture": {"dir": ` + strconv.Quote(file) + `}}`)); err == nil || !strings.Contains(err.Error(), "不是目录") {
+		t.Fatalf("capture.dir 为文件时的错误为 %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"compress/flate"
+	"context"
+	"fmt"
+	"io"
+	"net"
+)
+
+// MethodCompression 隧道压缩使用的私有方法号，客户端在握手中提供该方法表示支持压缩
+const MethodCompression = uint8(0x80)
+
+// 隧道压缩算法
+const (
+	CompressionNone  = uint8(0x00)
+	CompressionFlate = uint8(0x01)
+)
+
+// negotiateCompression 在认证后协商隧道压缩：客户端发送期望的算法（1字节），
+// 服务器回复采用的算法（1字节）。采用 flate 时，之后客户端侧连接上的请求、
+// 回复与转发数据均经 flate 压缩，目标侧连接不受影响。
+func negotiateCompression(ctx context.Context, conn net.Conn, username string) (net.Conn, error) {
+	buf := make([]byte, 1)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, fmt.Errorf("读取压缩算法失败: %w", err)
+	}
+
+	algo := CompressionNone
+	if buf[0] == CompressionFlate {
+		algo = CompressionFlate
+	}
+	if err := writeFull(conn, []byte{algo}); err != nil {
+		return nil, fmt.Errorf("发送压缩算法失败: %w", err)
+	}
+
+	if algo == CompressionNone {
+		return nil, nil
+	}
+	return newFlateConn(conn), nil
+}
+
+// flateConn 对读写数据进行 flate 解压/压缩的连接，每次写入后立即刷新，
+// 保证交互式流量不会滞留在压缩缓冲区中
+type flateConn struct {
+	net.Conn
+	r io.ReadCloser
+	w *flate.Writer
+}
+
+func newFlateConn(conn net.Conn) *flateConn {
+	w, _ := flate.NewWriter(conn, flate.DefaultCompression)
+	return &flateConn{Conn: conn, r: flate.NewReader(conn), w: w}
+}
+
+func (c *flateConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *flateConn) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, c.w.Flush()
+}
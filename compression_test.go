@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCompression(t *testing.T) {
+	echo := startEcho(t)
+	host, port, _ := net.SplitHostPort(echo)
+	p, _ := strconv.Atoi(port)
+	payload := bytes.Repeat([]byte("compressible tunnel data "), 4096)
+
+	tests := []struct {
+		name       string
+		enabled    bool  // 服务器配置 compression
+		requested  uint8 // 客户端期望的算法
+		negotiated bool  // 服务器是否进行压缩协商
+		compressed bool
+	}{
+		{"flate", true, CompressionFlate, true, true},
+		{"客户端不压缩", true, CompressionNone, true, false},
+		{"未知算法", true, 0x7F, true, false},
+		{"服务器未开启", false, CompressionFlate, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startServer(t, testConfig(t, `{"compression": `+strconv.FormatBool(tt.enabled)+`}`))
+			wire := &countingConn{Conn: dialServer(t, s)}
+			var conn net.Conn = wire
+
+			mustWrite(t, conn, []byte{Version5, 2, MethodNoAuth, MethodCompression})
+			expectBytes(t, conn, []byte{Version5, MethodNoAuth})
+			if tt.negotiated {
+				mustWrite(t, conn, []byte{tt.requested})
+				want := CompressionNone
+				if tt.compressed {
+					want = CompressionFlate
+				}
+				expectBytes(t, conn, []byte{want})
+			}
+			if tt.compressed {
+				conn = newFlateConn(conn)
+			}
+
+			mustWrite(t, conn, requestBytes(CmdConnect, host, uint16(p)))
+			if rep, _ := readReply(t, conn); rep != RepSuccess {
+				t.Fatalf("回复码 %#x", rep)
+			}
+			before := wire.read
+			go conn.Write(payload)
+			got := make([]byte, len(payload))
+			if _, err := io.ReadFull(conn, got); err != nil {
+				t.Fatalf("读取失败: %v", err)
+			}
+			if !bytes.Equal(got, payload) {
+				t.Fatal("往返的数据不一致")
+			}
+
+			// 压缩时线路上的字节数应远小于负载
+			onWire := wire.read - before
+			if tt.compressed && onWire*10 > len(payload) {
+				t.Fatalf("压缩后线路上收到 %d 字节, 负载 %d 字节", onWire, len(payload))
+			}
+			if !tt.compressed && onWire != len(payload) {
+				t.Fatalf("未压缩时线路上收到 %d 字节, 期望 %d", onWire, len(payload))
+			}
+		})
+	}
+}
+
+func TestCompressionHalfClose(t *testing.T) {
+	const response = 200000
+	// 目标先发送完整响应并半关闭，再读取客户端的全部数据
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write(make([]byte, response))
+		conn.(*net.TCPConn).CloseWrite()
+		data, _ := io.ReadAll(conn)
+		received <- data
+	}()
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	p, _ := strconv.Atoi(port)
+
+	s := startServer(t, testConfig(t, `{"compression": true}`))
+	raw := dialServer(t, s)
+	mustWrite(t, raw, []byte{Version5, 2, MethodNoAuth, MethodCompression})
+	expectBytes(t, raw, []byte{Version5, MethodNoAuth})
+	mustWrite(t, raw, []byte{CompressionFlate})
+	expectBytes(t, raw, []byte{CompressionFlate})
+	conn := newFlateConn(raw)
+	mustWrite(t, conn, requestBytes(CmdConnect, host, uint16(p)))
+	if rep, _ := readReply(t, conn); rep != RepSuccess {
+		t.Fatalf("回复码 %#x", rep)
+	}
+
+	// 目标的 EOF 经压缩隧道传给客户端，响应完整且不会等到空闲超时
+	raw.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := io.Copy(io.Discard, conn); err != nil || n != response {
+		t.Fatalf("客户端收到 %d 字节 (%v), 期望 %d", n, err, response)
+	}
+
+	// 客户端随后发送的数据与 EOF 同样传给目标
+	mustWrite(t, conn, []byte("late"))
+	if err := closeWrite(conn); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case data := <-received:
+		if string(data) != "late" {
+			t.Fatalf("目标收到 %q, 期望 \"late\"", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("目标未读到 EOF")
+	}
+}
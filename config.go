@@ -1,8 +1,169 @@
 package main
 
 import (
+	"bytes"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UserConfig 表示单个用户的配置
+type UserConfig struct {
+	// 用户密码
+	Password string `json:"password"`
+	// 允许使用的命令列表（connect、bind、udp_associate），为空则不限制
+	Commands []string `json:"commands"`
+	// 默认拒绝模式下该用户额外允许访问的目标（CIDR 或域名）
+	Allow []string `json:"allow"`
+	// 是否只允许通过TLS监听器认证
+	RequireTLS bool `json:"require_tls"`
+	// 所属用户组（groups 中的 key），组的限制与用户自身的限制同时生效
+	Group string `json:"group"`
+	// 该用户同时存在的 CONNECT 会话数上限，0表示不限制
+	MaxConnections int `json:"max_connections"`
+	// 该用户所有 CONNECT 会话的合计带宽（字节/秒，上下行合计），0表示不限制
+	Bandwidth int64 `json:"bandwidth"`
+
+	hash string // 来自 users_file 的 htpasswd 密码哈希，非空时取代 Password
+}
+
+// GroupConfig 用户组，组内所有成员的 CONNECT 会话共享连接数与带宽上限
+type GroupConfig struct {
+	// 组内成员同时存在的 CONNECT 会话数上限，0表示不限制
+	MaxConnections int `json:"max_connections"`
+	// 组内成员所有 CONNECT 会话的合计带宽（字节/秒，上下行合计），0表示不限制
+	Bandwidth int64 `json:"bandwidth"`
+}
+
+// UnmarshalJSON 兼容旧的 "用户名": "密码" 字符串写法
+func (u *UserConfig) UnmarshalJSON(data []byte) error {
+	var password string
+	if err := json.Unmarshal(data, &password); err == nil {
+		*u = UserConfig{Password: password}
+		return nil
+	}
+
+	type plain UserConfig
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode((*plain)(u))
+}
+
+// commandNames 配置中的命令名称与协议命令的对应关系
+var commandNames = map[string]uint8{
+	"connect":       CmdConnect,
+	"bind":          CmdBind,
+	"udp_associate": CmdUDPAssociate,
+}
+
+// commandName 返回协议命令在配置中的名称，未知命令返回其数值
+func commandName(cmd uint8) string {
+	for name, c := range commandNames {
+		if c == cmd {
+			return name
+		}
+	}
+	return strconv.Itoa(int(cmd))
+}
+
+// methodNames 配置中的认证方法名称与协议认证方法的对应关系
+var methodNames = map[string]uint8{
+	"no_auth":   MethodNoAuth,
+	"user_pass": MethodUserPass,
+}
+
+// validateMethods 校验认证方法优先级列表
+func validateMethods(methods []string, hasUsers bool) error {
+	for _, name := range methods {
+		m, ok := methodNames[name]
+		if !ok {
+			return fmt.Errorf("未知的认证方法: %s", name)
+		}
+		if m == MethodUserPass && !hasUsers {
+			return fmt.Errorf("认证方法 %s 需要配置用户", name)
+		}
+	}
+	return nil
+}
+
+// AllowsCommand 判断用户是否允许使用指定命令
+func (u UserConfig) AllowsCommand(cmd uint8) bool {
+	if len(u.Commands) == 0 {
+		return true
+	}
+	for _, name := range u.Commands {
+		if commandNames[name] == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+// TLSConfig 表示TLS配置
+type TLSConfig struct {
+	// 是否启用TLS
+	Enable bool `json:"enable"`
+	// 证书文件路径
+	CertFile string `json:"cert_file"`
+	// 私钥文件路径
+	KeyFile string `json:"key_file"`
+	// ALPN 协议列表，按优先级排列
+	NextProtos []string `json:"next_protos"`
+	// 校验客户端证书的CA证书文件（PEM），配置后要求客户端提供该CA签发的证书
+	ClientCAFile string `json:"client_ca_file"`
+	// 允许的客户端证书 SHA-256 指纹（十六进制，可含冒号），配置后只接受列表中的证书
+	ClientCertFingerprints []string `json:"client_cert_fingerprints"`
+	// 是否禁用会话票据（TLS 1.2 session ticket 与 TLS 1.3 PSK 恢复）
+	SessionTicketsDisabled bool `json:"session_tickets_disabled"`
+	// 会话票据密钥的轮换间隔（秒），票据最长在两个间隔内可用于恢复会话，0表示使用Go默认的轮换策略
+	SessionTicketKeyRotation int `json:"session_ticket_key_rotation"`
+	// 是否为每个连接记录协商的TLS版本、密码套件与客户端证书主题，用于安全审计
+	LogHandshake bool `json:"log_handshake"`
+}
+
+// WebhookConfig 连接事件 webhook 配置
+type WebhookConfig struct {
+	// 接收事件的地址，事件以 JSON 数组 POST 发送，为空则不启用
+	URL string `json:"url"`
+	// 每次最多发送的事件数，默认100
+	BatchSize int `json:"batch_size"`
+	// 未攒满一批时的发送间隔（毫秒），默认1000
+	FlushInterval int `json:"flush_interval"`
+	// 待发送事件队列长度，队列已满时丢弃新事件，默认1000
+	QueueSize int `json:"queue_size"`
+	// 每次请求的超时时间（秒），默认5
+	Timeout int `json:"timeout"`
+}
+
+// 请求被规则拒绝时的处理方式
+const (
+	DenyActionReply = "reply" // 回复 RepConnectionNotAllowed 后关闭
+	DenyActionDrop  = "drop"  // 不回复直接关闭
+)
+
+// CONNECT 会话一个方向结束后另一方向的处理方式
+const (
+	CloseStrategyCloseBoth = "close_both" // 任一方向结束即关闭两端
+	CloseStrategyHalfClose = "half_close" // 正常结束（EOF）时半关闭对端，出错时关闭两端
+	CloseStrategyWaitBoth  = "wait_both"  // 出错时也半关闭对端，等待另一方向结束
+	CloseStrategyLinger    = "linger"     // 同 half_close，但另一方向最多再转发 close_linger 秒
+)
+
+// 出站连接超时时的回复
+const (
+	DialTimeoutReplyHostUnreachable = "host_unreachable" // 回复 RepHostUnreachable
+	DialTimeoutReplyTTLExpired      = "ttl_expired"      // 回复 RepTTLExpired
 )
 
 // Config 表示服务器配置
@@ -10,16 +171,17 @@ type Config struct {
 	// 服务器监听地址
 	Address string `json:"address"`
 	// 认证用户列表
-	Users map[string]string `json:"users"`
+	Users map[string]UserConfig `json:"users"`
+	// htpasswd 格式的用户文件路径，启动及 SIGHUP 时加载并与 users 合并
+	UsersFile string `json:"users_file"`
 	// TLS配置
-	TLS struct {
-		// 是否启用TLS
-		Enable bool `json:"enable"`
-		// 证书文件路径
-		CertFile string `json:"cert_file"`
-		// 私钥文件路径
-		KeyFile string `json:"key_file"`
-	} `json:"tls"`
+	TLS TLSConfig `json:"tls"`
+	// 入站 PROXY 协议配置
+	ProxyProtocol ProxyProtocolConfig `json:"proxy_protocol"`
+	// 认证方法优先级列表（no_auth、user_pass），为空时根据是否配置用户决定
+	AuthMethods []string `json:"auth_methods"`
+	// 监听器列表，配置后取代顶层的 address/tls/proxy_protocol/auth_methods 监听设置
+	Listeners []ListenerConfig `json:"listeners"`
 	// UDP配置
 	UDP struct {
 		// 是否启用UDP
@@ -28,30 +190,647 @@ type Config struct {
 		Address string `json:"address"`
 		// UDP缓冲区大小（字节）
 		BufferSize int `json:"buffer_size"`
-		// UDP会话超时时间（秒）
+		// UDP会话超时时间（秒），默认60
 		Timeout int `json:"timeout"`
+		// 最大UDP会话数，0表示不限制
+		MaxSessions int `json:"max_sessions"`
+		// 会话数达到上限时是否淘汰最久未活动的会话，否则丢弃新会话的数据报
+		EvictOldest bool `json:"evict_oldest"`
+		// 每个客户端IP同时存在的UDP关联（控制连接）数上限，0表示不限制
+		MaxAssociations int `json:"max_associations"`
+		// UDP关联没有数据报经过超过该时间（秒）后关闭控制连接，0表示不限制
+		IdleTimeout int `json:"idle_timeout"`
+		// UDP会话的最长存活时间（秒），到期后即使仍有数据报也关闭会话，0表示不限制
+		MaxLifetime int `json:"max_lifetime"`
+		// 分片数据报的处理方式：drop（默认）或 reassemble
+		FragPolicy string `json:"frag_policy"`
+		// 仅UDP模式：不创建任何TCP监听器，只转发来自 trusted_sources 的数据报
+		Standalone bool `json:"standalone"`
+		// 无需 UDP ASSOCIATE 即可直接转发数据报的来源（CIDR）
+		TrustedSources []string `json:"trusted_sources"`
+		// 是否转发来自任意来源的数据报而不要求 UDP ASSOCIATE（旧版本的行为），默认丢弃没有关联的来源
+		AllowUnassociated bool `json:"allow_unassociated"`
 	} `json:"udp"`
+	// CONNECT 回复中对外通告的 BND.ADDR IP（如 NAT 后的公网IP），为空则使用出站连接的本地地址
+	AdvertisedAddress string `json:"advertised_address"`
+	// 新连接接入速率限制
+	AcceptRate struct {
+		// 全局每秒允许接入的新连接数，0表示不限制
+		Global float64 `json:"global"`
+		// 每个来源IP每秒允许接入的新连接数，0表示不限制
+		PerIP float64 `json:"per_ip"`
+		// 突发容量，0表示与速率相同
+		Burst int `json:"burst"`
+	} `json:"accept_rate"`
+	// TCP 监听套接字的 listen backlog，0表示使用系统默认（Linux 上为 net.core.somaxconn）
+	ListenBacklog int `json:"listen_backlog"`
+	// 同时进行的握手（含认证）数量上限，已进入转发阶段的连接不计入，0表示不限制
+	MaxHandshakes int `json:"max_handshakes"`
+	// 握手名额已满时新连接的最长等待时间（毫秒），超时后关闭连接
+	HandshakeQueueTimeout int `json:"handshake_queue_timeout"`
+	// 从接受连接到完成认证的最长时间（毫秒），覆盖 PROXY 协议头、TLS握手、SOCKS5握手与认证，0表示不限制
+	HandshakeTimeout int `json:"handshake_timeout"`
+	// 所有客户端到同一目标（主机:端口）同时存在的 CONNECT 连接数上限，0表示不限制
+	MaxConnectionsPerDestination int `json:"max_connections_per_destination"`
+	// 出站连接使用的源IP（TCP与UDP），为空则由系统选择
+	OutboundIP string `json:"outbound_ip"`
+	// 多个出口IP及权重，CONNECT 按权重轮询选择源IP，配置后取代 outbound_ip 用于TCP
+	OutboundIPs []OutboundIPConfig `json:"outbound_ips"`
+	// 直接连接前先在本地解析目标域名，对解析出的IP应用访问规则后直接连接该IP，防止DNS重绑定
+	ResolveBeforeDial bool `json:"resolve_before_dial"`
+	// 是否禁止访问私有、回环与链路本地地址，域名目标解析后逐个校验并固定连接通过校验的IP
+	BlockPrivateTargets bool `json:"block_private_targets"`
+	// 是否只允许直接连接公网单播地址，域名目标解析后逐个校验并固定连接通过校验的IP
+	PublicTargetsOnly bool `json:"public_targets_only"`
+	// public_targets_only 拒绝的特殊用途地址段（CIDR），未配置时使用 defaultSpecialUseRanges
+	SpecialUseRanges []string `json:"special_use_ranges"`
+	// 是否在客户端与目标连接上启用 TCP_NODELAY，默认启用；关闭后启用 Nagle 算法，适合大批量传输
+	TCPNoDelay bool `json:"tcp_nodelay"`
+	// 客户端与目标连接的接收缓冲区大小（SO_RCVBUF，字节），0表示使用系统默认值
+	SocketReadBuffer int `json:"socket_read_buffer"`
+	// 客户端与目标连接的发送缓冲区大小（SO_SNDBUF，字节），0表示使用系统默认值
+	SocketWriteBuffer int `json:"socket_write_buffer"`
+	// 一端正常结束发送（EOF）时是否只关闭对端的写方向，让另一方向继续转发剩余数据，默认启用
+	HalfClose bool `json:"half_close"`
+	// 一个方向结束后的处理方式，见 CloseStrategy* 常量，设置后取代 half_close
+	CloseStrategy string `json:"close_strategy"`
+	// linger 策略下另一方向的最长转发时间（秒），默认5
+	CloseLinger int `json:"close_linger"`
+	// 出站连接的 DSCP 标记（0-63），0表示不设置
+	OutboundDSCP int `json:"outbound_dscp"`
+	// 是否在出站套接字上设置 SO_REUSEADDR，缓解固定源IP时 TIME_WAIT 占满源端口
+	OutboundReuseAddr bool `json:"outbound_reuse_addr"`
+	// 出站连接的 SO_LINGER 秒数：0表示关闭时发送 RST 不进入 TIME_WAIT，-1（默认）表示使用系统行为
+	OutboundLinger int `json:"outbound_linger"`
+	// 上游代理列表，key为上游名称
+	Upstreams map[string]UpstreamConfig `json:"upstreams"`
+	// 静态路由规则，按最具体匹配选择出口
+	Routes []RouteConfig `json:"routes"`
+	// TLS 中间人检查（仅用于明确授权的流量检查）
+	MITM MITMConfig `json:"mitm"`
+	// 默认拒绝模式：只允许访问命中 allow 或用户自身 allow 列表的目标
+	DefaultDeny bool `json:"default_deny"`
+	// 默认拒绝模式下所有用户（包括匿名用户）都允许访问的目标（CIDR 或域名）
+	Allow []string `json:"allow"`
+	// 命名的策略包，监听器通过 policy 字段引用
+	Policies map[string]PolicyConfig `json:"policies"`
+	// 用户组，key为组名，顶层与策略包中的用户都可以通过 group 引用
+	Groups map[string]GroupConfig `json:"groups"`
+	// 固定目标（"主机:端口"），配置后所有 CONNECT 请求都连接该目标，忽略客户端请求的目标
+	FixedDestination string `json:"fixed_destination"`
+	// 是否识别HTTP/TLS扫描探测并快速应答（HTTP回复400，TLS直接关闭），探测仅在 debug 级别记录日志
+	RejectProbes bool `json:"reject_probes"`
+	// 读取连接首字节（协议版本）的超时时间（毫秒），默认5000，显式设为0表示不限制
+	FirstByteTimeout int `json:"first_byte_timeout"`
+	// 认证完成后等待客户端发送请求的超时时间（毫秒），0表示不限制
+	RequestTimeout int `json:"request_timeout"`
+	// 请求被路由规则或请求钩子拒绝时的处理方式：reply（默认）或 drop
+	DenyAction string `json:"deny_action"`
+	// CONNECT 出站连接超时时间（秒），0表示使用系统默认超时
+	DialTimeout int `json:"dial_timeout"`
+	// 出站连接超时时的回复：host_unreachable（默认）或 ttl_expired
+	DialTimeoutReply string `json:"dial_timeout_reply"`
+	// 发送方法选择回复前的随机延迟范围（毫秒），用于干扰基于时序的指纹识别，默认关闭
+	GreetingJitter struct {
+		Min int `json:"min"`
+		Max int `json:"max"`
+	} `json:"greeting_jitter"`
+	// 握手中允许客户端提供的最大认证方法数，超过时视为协议错误并关闭连接，默认16
+	MaxMethods int `json:"max_methods"`
+	// 用户名/密码认证中允许的用户名与密码最大长度（字节），超过时认证失败，默认255即协议上限
+	MaxUsernameLength int `json:"max_username_length"`
+	MaxPasswordLength int `json:"max_password_length"`
+	// 是否在请求阶段以请求的目标再次调用外部认证后端（Server.Authenticator），未设置后端时无效
+	RequestTimeAuth bool `json:"request_time_auth"`
+	// 日志级别：info（默认）或 debug，debug 级别会输出握手与请求的原始字节
+	LogLevel string `json:"log_level"`
+	// 成功连接的日志采样率：每 N 个成功的连接记录一次日志，0或1表示全部记录；错误与认证失败始终记录
+	LogSampleRate int `json:"log_sample_rate"`
+	// 日志中用户名的显示方式：plain（默认）、mask（仅保留首字符）或 hash（首字符加哈希）
+	LogUsernames string `json:"log_usernames"`
+	// 出站连接耗时告警阈值（毫秒），0表示不告警
+	SlowDialThreshold int `json:"slow_dial_threshold"`
+	// 出站 CONNECT 使用的网络：tcp（默认）、tcp4 或 tcp6
+	Network string `json:"network"`
+	// 解析域名时的地址族优先顺序：system（默认，保持解析器返回的顺序）、ipv4 或 ipv6
+	DNSPreference string `json:"dns_preference"`
+	// CONNECT 会话最长持续时间（秒），到期后无论是否活跃都关闭连接，0表示不限制
+	MaxSessionDuration int `json:"max_session_duration"`
+	// 每个 CONNECT 连接的流量配额（字节），达到后关闭连接，0表示不限制
+	MaxBytesPerConnection int64 `json:"max_bytes_per_connection"`
+	// 流量配额统计的方向：both（默认）、upload 或 download
+	QuotaDirection string `json:"quota_direction"`
+	// 调试抓包配置，将每个 CONNECT 连接两个方向的原始数据写入文件
+	Capture struct {
+		// 抓包文件目录，为空则不启用
+		Dir string `json:"dir"`
+		// 每个抓包文件的大小上限（字节），0表示使用默认值 10MiB
+		MaxBytes int64 `json:"max_bytes"`
+	} `json:"capture"`
+	// 是否允许自定义客户端通过私有方法 0x80 协商隧道压缩（flate），标准客户端不受影响
+	Compression bool `json:"compression"`
+	// 管理控制套接字（Unix 套接字）路径，为空则不启用
+	ControlSocket string `json:"control_socket"`
+	// 健康探测配置，周期性地通过服务器自身的出站逻辑连接探测目标
+	HealthProbe struct {
+		// 探测目标，格式为 "主机:端口"，为空则不启用
+		Target string `json:"target"`
+		// 探测间隔（秒），0表示使用默认值60
+		Interval int `json:"interval"`
+		// 每次探测的超时时间（秒），0表示使用默认值10
+		Timeout int `json:"timeout"`
+	} `json:"health_probe"`
+	// 连接事件 webhook 配置
+	Webhook WebhookConfig `json:"webhook"`
+	// 指标配置
+	Metrics struct {
+		// 指标HTTP监听地址，为空则不启用
+		Address string `json:"address"`
+		// 分组指标使用的标签（command、user、egress_ip、target_host），未配置时只使用 command
+		Labels []string `json:"labels"`
+	} `json:"metrics"`
 }
 
-// LoadConfig 从指定路径加载配置文件
+// 配置来源：标准输入与 HTTP(S) 地址只在启动时读取一次
+const (
+	configSourceStdin = "-"
+	maxConfigSize     = 10 << 20 // 从标准输入或URL读取的配置大小上限
+)
+
+// onceConfigs 保存只读取一次的配置来源（路径 -> 内容），重新加载时复用
+var onceConfigs sync.Map
+
+// LoadConfig 从指定路径加载配置文件。path 为 "-" 时从标准输入读取，
+// 为 http:// 或 https:// 地址时通过 HTTP GET 获取；这两种来源只在第一次
+// 加载时读取，之后的重新加载复用启动时的内容
 func LoadConfig(path string) (*Config, error) {
-	file, err := os.ReadFile(path)
+	if path != configSourceStdin && !isConfigURL(path) {
+		file, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return parseConfig(file)
+	}
+
+	if data, ok := onceConfigs.Load(path); ok {
+		log.Printf("配置来源 %s 只在启动时读取, 重新加载使用启动时的配置", redactConfigURL(path))
+		return parseConfig(data.([]byte))
+	}
+	var data []byte
+	var err error
+	if path == configSourceStdin {
+		data, err = io.ReadAll(io.LimitReader(os.Stdin, maxConfigSize+1))
+	} else {
+		data, err = fetchConfig(path)
+	}
 	if err != nil {
 		return nil, err
 	}
+	if len(data) > maxConfigSize {
+		return nil, fmt.Errorf("配置内容超过 %d 字节", maxConfigSize)
+	}
+	onceConfigs.Store(path, data)
+	return parseConfig(data)
+}
 
-	var config Config
-	if err := json.Unmarshal(file, &config); err != nil {
-		return nil, err
+// isConfigURL 判断配置路径是否为 HTTP(S) 地址
+func isConfigURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// fetchConfig 通过 HTTP GET 获取配置内容，只接受 200 响应
+func fetchConfig(rawURL string) ([]byte, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(rawURL)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			urlErr.URL = redactConfigURL(urlErr.URL)
+		}
+		return nil, fmt.Errorf("获取配置失败: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("获取配置失败: %s 返回 %s", redactConfigURL(rawURL), resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxConfigSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("读取配置响应失败: %w", err)
+	}
+	return data, nil
+}
+
+// redactConfigURL 去掉配置地址中的用户信息与查询参数，以免令牌出现在日志中
+func redactConfigURL(path string) string {
+	u, err := url.Parse(path)
+	if err != nil || u.Scheme == "" {
+		return path
+	}
+	u.User, u.RawQuery, u.Fragment = nil, "", ""
+	return u.String()
+}
+
+// parseConfig 解析配置内容，设置默认值并校验
+func parseConfig(data []byte) (*Config, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	// 默认值为 true 的布尔选项，以及可以显式设为0关闭的超时，需在解码前设置默认值
+	config := Config{TCPNoDelay: true, HalfClose: true, OutboundLinger: -1, HandshakeQueueTimeout: 100, HandshakeTimeout: 10000, FirstByteTimeout: 5000}
+	if err := dec.Decode(&config); err != nil {
+		return nil, describeJSONError(data, err)
 	}
 
 	// 设置默认值
+	if config.Address == "" && len(config.Listeners) > 0 {
+		config.Address = config.Listeners[0].Address
+	}
 	if config.Address == "" {
 		config.Address = ":1080"
 	}
 	if config.Users == nil {
-		config.Users = make(map[string]string)
+		config.Users = make(map[string]UserConfig)
+	}
+	if config.DenyAction == "" {
+		config.DenyAction = DenyActionReply
+	}
+	if config.DenyAction != DenyActionReply && config.DenyAction != DenyActionDrop {
+		return nil, fmt.Errorf("无效的 deny_action: %s", config.DenyAction)
+	}
+	if config.DialTimeout < 0 {
+		return nil, fmt.Errorf("dial_timeout 不能为负数")
+	}
+	if config.DialTimeoutReply == "" {
+		config.DialTimeoutReply = DialTimeoutReplyHostUnreachable
+	}
+	if config.DialTimeoutReply != DialTimeoutReplyHostUnreachable && config.DialTimeoutReply != DialTimeoutReplyTTLExpired {
+		return nil, fmt.Errorf("无效的 dial_timeout_reply: %s", config.DialTimeoutReply)
+	}
+	switch config.Network {
+	case "":
+		config.Network = "tcp"
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("无效的 network: %s", config.Network)
+	}
+	switch config.DNSPreference {
+	case "":
+		config.DNSPreference = DNSPreferSystem
+	case DNSPreferSystem, DNSPreferIPv4, DNSPreferIPv6:
+	default:
+		return nil, fmt.Errorf("无效的 dns_preference: %s", config.DNSPreference)
+	}
+	switch config.QuotaDirection {
+	case "":
+		config.QuotaDirection = QuotaDirectionBoth
+	case QuotaDirectionBoth, QuotaDirectionUpload, QuotaDirectionDownload:
+	default:
+		return nil, fmt.Errorf("无效的 quota_direction: %s", config.QuotaDirection)
+	}
+	switch config.CloseStrategy {
+	case "":
+		config.CloseStrategy = CloseStrategyHalfClose
+		if !config.HalfClose {
+			config.CloseStrategy = CloseStrategyCloseBoth
+		}
+	case CloseStrategyCloseBoth, CloseStrategyHalfClose, CloseStrategyWaitBoth, CloseStrategyLinger:
+	default:
+		return nil, fmt.Errorf("无效的 close_strategy: %s", config.CloseStrategy)
+	}
+	if config.CloseLinger < 0 {
+		return nil, fmt.Errorf("close_linger 不能为负数")
+	}
+	if config.CloseLinger == 0 {
+		config.CloseLinger = 5
+	}
+	if config.OutboundLinger < -1 {
+		return nil, fmt.Errorf("outbound_linger 只能为 -1 或非负数")
+	}
+	if config.OutboundDSCP < 0 || config.OutboundDSCP > 63 {
+		return nil, fmt.Errorf("outbound_dscp 必须在 0 到 63 之间")
+	}
+	if config.MaxMethods == 0 {
+		config.MaxMethods = 16
+	}
+	if config.MaxMethods < 1 || config.MaxMethods > 255 {
+		return nil, fmt.Errorf("max_methods 必须在 1 到 255 之间")
+	}
+	if config.MaxUsernameLength == 0 {
+		config.MaxUsernameLength = 255
+	}
+	if config.MaxUsernameLength < 1 || config.MaxUsernameLength > 255 {
+		return nil, fmt.Errorf("max_username_length 必须在 1 到 255 之间")
+	}
+	if config.MaxPasswordLength == 0 {
+		config.MaxPasswordLength = 255
+	}
+	if config.MaxPasswordLength < 1 || config.MaxPasswordLength > 255 {
+		return nil, fmt.Errorf("max_password_length 必须在 1 到 255 之间")
+	}
+	if config.Capture.MaxBytes < 0 {
+		return nil, fmt.Errorf("capture.max_bytes 不能为负数")
+	}
+	// 校验没有副作用，抓包目录在首次抓包时创建，这里只检查已存在的路径是否为目录
+	if config.Capture.Dir != "" {
+		if fi, err := os.Stat(config.Capture.Dir); err == nil && !fi.IsDir() {
+			return nil, fmt.Errorf("capture.dir %s 不是目录", config.Capture.Dir)
+		}
+	}
+	if config.HealthProbe.Target != "" {
+		if _, _, err := net.SplitHostPort(config.HealthProbe.Target); err != nil {
+			return nil, fmt.Errorf("无效的 health_probe.target: %w", err)
+		}
+	}
+	if config.HealthProbe.Interval < 0 || config.HealthProbe.Timeout < 0 {
+		return nil, fmt.Errorf("health_probe.interval 与 health_probe.timeout 不能为负数")
+	}
+	if w := config.Webhook; w.URL != "" {
+		if !isConfigURL(w.URL) {
+			return nil, fmt.Errorf("webhook.url 必须是 http:// 或 https:// 地址")
+		}
+		if w.BatchSize < 0 || w.FlushInterval < 0 || w.QueueSize < 0 || w.Timeout < 0 {
+			return nil, fmt.Errorf("webhook 的 batch_size、flush_interval、queue_size 与 timeout 不能为负数")
+		}
+	}
+	if config.Metrics.Labels == nil {
+		config.Metrics.Labels = defaultMetricLabels
+	}
+	for _, name := range config.Metrics.Labels {
+		if !validMetricLabel(name) {
+			return nil, fmt.Errorf("无效的 metrics.labels 标签: %s", name)
+		}
+	}
+	if config.LogLevel == "" {
+		config.LogLevel = LogLevelInfo
+	}
+	if config.LogLevel != LogLevelInfo && config.LogLevel != LogLevelDebug {
+		return nil, fmt.Errorf("无效的 log_level: %s", config.LogLevel)
+	}
+	switch config.LogUsernames {
+	case "":
+		config.LogUsernames = LogUsernamesPlain
+	case LogUsernamesPlain, LogUsernamesMask, LogUsernamesHash:
+	default:
+		return nil, fmt.Errorf("无效的 log_usernames: %s", config.LogUsernames)
+	}
+	if config.LogSampleRate < 0 {
+		return nil, fmt.Errorf("log_sample_rate 不能为负数")
+	}
+	for i, lc := range config.Listeners {
+		if lc.Address == "" {
+			return nil, fmt.Errorf("第 %d 个监听器缺少 address", i+1)
+		}
+		hasUsers := config.hasUsers()
+		if lc.Policy != "" {
+			pc, ok := config.Policies[lc.Policy]
+			if !ok {
+				return nil, fmt.Errorf("监听器 %s 引用的策略 %s 不存在", lc.Address, lc.Policy)
+			}
+			hasUsers = pc.hasUsers()
+		}
+		if lc.Auth && !hasUsers {
+			return nil, fmt.Errorf("监听器 %s 要求认证但未配置用户", lc.Address)
+		}
+		if err := validateMethods(lc.Methods, hasUsers); err != nil {
+			return nil, fmt.Errorf("监听器 %s: %w", lc.Address, err)
+		}
+		switch lc.Network {
+		case "", "tcp", "tcp4", "tcp6":
+		default:
+			if lc.Transparent {
+				return nil, fmt.Errorf("监听器 %s: 透明代理模式只支持 tcp 传输", lc.Address)
+			}
+		}
+		if lc.Transparent {
+			if !transparentSupported {
+				return nil, fmt.Errorf("监听器 %s: 透明代理模式仅支持 Linux", lc.Address)
+			}
+			if lc.TLS.Enable || lc.Auth || len(lc.Methods) > 0 {
+				return nil, fmt.Errorf("监听器 %s: 透明代理模式不支持 TLS 与认证", lc.Address)
+			}
+		}
+	}
+	if err := validateMethods(config.AuthMethods, config.hasUsers()); err != nil {
+		return nil, err
+	}
+	for _, lc := range config.listenerConfigs() {
+		if err := lc.ProxyProtocol.validate(lc.Transparent); err != nil {
+			return nil, fmt.Errorf("监听器 %s: %w", lc.Address, err)
+		}
+		if lc.TLS.Enable {
+			if err := lc.TLS.applyClientAuth(&tls.Config{}); err != nil {
+				return nil, fmt.Errorf("监听器 %s: %w", lc.Address, err)
+			}
+			if lc.TLS.SessionTicketKeyRotation < 0 {
+				return nil, fmt.Errorf("监听器 %s: session_ticket_key_rotation 不能为负数", lc.Address)
+			}
+		}
+	}
+	if config.UsersFile != "" {
+		if _, err := loadHtpasswd(config.UsersFile); err != nil {
+			return nil, fmt.Errorf("加载 users_file 失败: %w", err)
+		}
+	}
+	for name, user := range config.Users {
+		for _, cmd := range user.Commands {
+			if _, ok := commandNames[cmd]; !ok {
+				return nil, fmt.Errorf("用户 %s 配置了未知命令: %s", name, cmd)
+			}
+		}
+	}
+	if _, err := parseCIDRs(config.UDP.TrustedSources); err != nil {
+		return nil, fmt.Errorf("无效的 udp.trusted_sources: %w", err)
+	}
+	if config.UDP.Standalone {
+		switch {
+		case !config.UDP.Enable:
+			return nil, fmt.Errorf("udp.standalone 需要同时启用 udp.enable")
+		case len(config.UDP.TrustedSources) == 0:
+			return nil, fmt.Errorf("udp.standalone 没有控制连接建立关联, 必须配置 udp.trusted_sources")
+		case len(config.Listeners) > 0:
+			return nil, fmt.Errorf("udp.standalone 不能与 listeners 同时使用")
+		}
+	}
+	if config.UDP.Enable {
+		if err := config.validateUDPAddress(); err != nil {
+			return nil, err
+		}
+	}
+	if config.UDP.FragPolicy == "" {
+		config.UDP.FragPolicy = UDPFragDrop
+	}
+	if config.UDP.FragPolicy != UDPFragDrop && config.UDP.FragPolicy != UDPFragReassemble {
+		return nil, fmt.Errorf("无效的 udp.frag_policy: %s", config.UDP.FragPolicy)
+	}
+	if config.UDP.MaxLifetime < 0 {
+		return nil, fmt.Errorf("udp.max_lifetime 不能为负数")
+	}
+	if config.UDP.Timeout < 0 {
+		return nil, fmt.Errorf("udp.timeout 不能为负数")
+	}
+	if config.UDP.Timeout == 0 {
+		config.UDP.Timeout = 60
+	}
+	if config.AdvertisedAddress != "" && net.ParseIP(config.AdvertisedAddress) == nil {
+		return nil, fmt.Errorf("无效的 advertised_address: %s", config.AdvertisedAddress)
+	}
+	if config.AcceptRate.Global < 0 || config.AcceptRate.PerIP < 0 || config.AcceptRate.Burst < 0 {
+		return nil, fmt.Errorf("accept_rate 不能为负数")
+	}
+	if config.ListenBacklog < 0 {
+		return nil, fmt.Errorf("listen_backlog 不能为负数")
+	}
+	if config.SocketReadBuffer < 0 || config.SocketWriteBuffer < 0 {
+		return nil, fmt.Errorf("socket_read_buffer 与 socket_write_buffer 不能为负数")
+	}
+	if j := config.GreetingJitter; j.Min < 0 || j.Max < j.Min || j.Max > maxGreetingJitter {
+		return nil, fmt.Errorf("greeting_jitter 必须满足 0 <= min <= max <= %d", maxGreetingJitter)
+	}
+	if config.FixedDestination != "" {
+		if _, _, err := splitHostPort(config.FixedDestination); err != nil {
+			return nil, fmt.Errorf("无效的 fixed_destination: %w", err)
+		}
+	}
+	if config.MaxHandshakes < 0 || config.HandshakeQueueTimeout < 0 || config.HandshakeTimeout < 0 {
+		return nil, fmt.Errorf("max_handshakes、handshake_queue_timeout 与 handshake_timeout 不能为负数")
+	}
+	if config.SpecialUseRanges == nil {
+		config.SpecialUseRanges = defaultSpecialUseRanges
+	}
+	if _, err := parseCIDRs(config.SpecialUseRanges); err != nil {
+		return nil, fmt.Errorf("无效的 special_use_ranges: %w", err)
+	}
+	if config.FirstByteTimeout < 0 {
+		return nil, fmt.Errorf("first_byte_timeout 不能为负数")
+	}
+	if config.RequestTimeout < 0 {
+		return nil, fmt.Errorf("request_timeout 不能为负数")
+	}
+	if config.MaxConnectionsPerDestination < 0 {
+		return nil, fmt.Errorf("max_connections_per_destination 不能为负数")
+	}
+	if config.OutboundIP != "" && net.ParseIP(config.OutboundIP) == nil {
+		return nil, fmt.Errorf("无效的 outbound_ip: %s", config.OutboundIP)
+	}
+	if _, err := newEgressPicker(config.OutboundIPs); err != nil {
+		return nil, err
+	}
+	for name, g := range config.Groups {
+		if g.MaxConnections < 0 || g.Bandwidth < 0 {
+			return nil, fmt.Errorf("用户组 %s 的 max_connections 与 bandwidth 不能为负数", name)
+		}
+	}
+	if err := config.topPolicy().validate(config.Groups); err != nil {
+		return nil, err
+	}
+	for name, pc := range config.Policies {
+		if err := pc.validate(config.Groups); err != nil {
+			return nil, fmt.Errorf("策略 %s: %w", name, err)
+		}
+	}
+	if config.MITM.Enable {
+		if len(config.MITM.Ports) == 0 {
+			config.MITM.Ports = []int{443}
+		}
+		if _, err := newMITM(config.MITM); err != nil {
+			return nil, err
+		}
+		for _, p := range config.MITM.Ports {
+			if p <= 0 || p > 65535 {
+				return nil, fmt.Errorf("mitm.ports 包含无效端口: %d", p)
+			}
+		}
 	}
 
 	return &config, nil
+}
+
+// udpAddress 返回UDP监听地址及其来源的配置字段，未设置 udp.address 时使用TCP地址
+func (c *Config) udpAddress() (addr, field string) {
+	if c.UDP.Address != "" {
+		return c.UDP.Address, "udp.address"
+	}
+	return c.Address, "address"
+}
+
+// validateUDPAddress 校验UDP监听地址格式，错误信息包含出错的配置字段
+func (c *Config) validateUDPAddress() error {
+	addr, field := c.udpAddress()
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("%s: invalid UDP listen address %q (want \"host:port\" or \":port\"): %v", field, addr, err)
+	}
+	if _, err := net.LookupPort("udp", port); err != nil {
+		return fmt.Errorf("%s: invalid port in UDP listen address %q: %v", field, addr, err)
+	}
+	return nil
+}
+
+// hasUsers 判断是否配置了用户（内联 users 或 users_file）
+func (c *Config) hasUsers() bool {
+	return c.topPolicy().hasUsers()
+}
+
+// topPolicy 返回顶层的用户与访问规则配置，未引用策略包的监听器使用
+func (c *Config) topPolicy() PolicyConfig {
+	return PolicyConfig{
+		Users:       c.Users,
+		UsersFile:   c.UsersFile,
+		Upstreams:   c.Upstreams,
+		Routes:      c.Routes,
+		DefaultDeny: c.DefaultDeny,
+		Allow:       c.Allow,
+	}
+}
+
+// splitHostPort 将 "主机:端口" 拆分为主机与数字端口
+func splitHostPort(addr string) (string, uint16, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || host == "" {
+		return "", 0, fmt.Errorf("%s 不是有效的 \"主机:端口\"", addr)
+	}
+	return host, uint16(port), nil
+}
+
+// listenerConfigs 返回需要启动的监听器，未配置 listeners 时使用顶层设置，仅UDP模式下为空
+func (c *Config) listenerConfigs() []ListenerConfig {
+	if c.UDP.Standalone {
+		return nil
+	}
+	if len(c.Listeners) > 0 {
+		return c.Listeners
+	}
+	return []ListenerConfig{{
+		Address:       c.Address,
+		Auth:          c.hasUsers(),
+		Methods:       c.AuthMethods,
+		TLS:           c.TLS,
+		ProxyProtocol: c.ProxyProtocol,
+	}}
+}
+
+// describeJSONError 将 JSON 解析错误转换为带字段路径或行号的说明
+func describeJSONError(data []byte, err error) error {
+	var typeErr *json.UnmarshalTypeError
+	var syntaxErr *json.SyntaxError
+
+	switch {
+	case errors.As(err, &typeErr):
+		field := typeErr.Field
+		if field == "" {
+			field = "(根对象)"
+		}
+		return fmt.Errorf("配置字段 %s 类型错误: 期望 %s, 实际为 JSON %s", field, typeErr.Type, typeErr.Value)
+	case errors.As(err, &syntaxErr):
+		offset := min(int(syntaxErr.Offset), len(data))
+		line := 1 + bytes.Count(data[:offset], []byte("\n"))
+		return fmt.Errorf("配置文件第 %d 行语法错误: %w", line, err)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		return fmt.Errorf("配置文件包含未知字段 %s", strings.TrimPrefix(err.Error(), "json: unknown field "))
+	}
+	return err
 }
\ No newline at end of file
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+)
+
+// bufferedConn 读取时优先返回 bufio.Reader 中已缓冲的数据，
+// 用于预读协议字节或读取上游响应后不丢失多读的数据
+type bufferedConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr // PROXY 协议头中的真实客户端地址，为 nil 时使用底层连接的地址
+}
+
+func (c *bufferedConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// writeFull 循环写入直到 b 全部发送或出错，避免部分写入破坏协议帧
+func writeFull(w io.Writer, b []byte) error {
+	for len(b) > 0 {
+		n, err := w.Write(b)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// closeWrite 关闭连接的写方向：TCP 连接发送 FIN，TLS 连接发送 close_notify，
+// 压缩连接先写出压缩流的结束块，再关闭底层连接的写方向。
+// 不支持半关闭的连接返回 errors.ErrUnsupported
+func closeWrite(conn net.Conn) error {
+	for {
+		switch c := conn.(type) {
+		case *bufferedConn:
+			conn = c.Conn
+		case *flateConn:
+			// 结束块使对端的解压读取得到 EOF，而不是底层连接关闭导致的 ErrUnexpectedEOF
+			if err := c.w.Close(); err != nil {
+				return err
+			}
+			conn = c.Conn
+		case *tls.Conn:
+			return c.CloseWrite()
+		case *net.TCPConn:
+			return c.CloseWrite()
+		default:
+			return errors.ErrUnsupported
+		}
+	}
+}
+
+// tcpConnOf 返回包装连接的底层TCP连接，不是TCP连接时返回 nil
+func tcpConnOf(conn net.Conn) *net.TCPConn {
+	for {
+		switch c := conn.(type) {
+		case *bufferedConn:
+			conn = c.Conn
+		case *flateConn:
+			conn = c.Conn
+		case *tls.Conn:
+			conn = c.NetConn()
+		case *net.TCPConn:
+			return c
+		default:
+			return nil
+		}
+	}
+}
+
+// setNoDelay 设置底层TCP连接的 TCP_NODELAY，非TCP连接忽略
+func setNoDelay(conn net.Conn, noDelay bool) {
+	if tc := tcpConnOf(conn); tc != nil {
+		tc.SetNoDelay(noDelay)
+	}
+}
+
+// setBuffers 设置底层TCP连接的接收与发送缓冲区大小，0表示保持系统默认值，非TCP连接忽略
+func setBuffers(conn net.Conn, read, write int) error {
+	tc := tcpConnOf(conn)
+	if tc == nil {
+		return nil
+	}
+	if read > 0 {
+		if err := tc.SetReadBuffer(read); err != nil {
+			return err
+		}
+	}
+	if write > 0 {
+		if err := tc.SetWriteBuffer(write); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unwrapConn 在 bufferedConn（可能多层嵌套）没有待读取的缓冲数据时返回底层连接
+func unwrapConn(conn net.Conn) net.Conn {
+	for {
+		bc, ok := conn.(*bufferedConn)
+		if !ok || bc.r.Buffered() > 0 {
+			return conn
+		}
+		conn = bc.Conn
+	}
+}
+
+// isTLSConn 判断客户端连接是否为TLS连接（可能被 bufferedConn 包装）
+func isTLSConn(conn net.Conn) bool {
+	for {
+		switch c := conn.(type) {
+		case *tls.Conn:
+			return true
+		case *bufferedConn:
+			conn = c.Conn
+		default:
+			return false
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// shortWriter 每次最多写入 max 字节
+type shortWriter struct {
+	w   io.Writer
+	max int
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	return w.w.Write(p[:min(len(p), w.max)])
+}
+
+// shortWriteConn 每次 Write 最多写入1字节的连接
+type shortWriteConn struct {
+	net.Conn
+}
+
+func (c shortWriteConn) Write(p []byte) (int, error) {
+	return (&shortWriter{w: c.Conn, max: 1}).Write(p)
+}
+
+func TestWriteFull(t *testing.T) {
+	data := []byte("0123456789")
+	tests := []struct {
+		name string
+		max  int
+		err  error
+	}{
+		{"一次写完", 100, nil},
+		{"每次1字节", 1, nil},
+		{"每次3字节", 3, nil},
+		{"没有进展", 0, io.ErrShortWrite},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := writeFull(&shortWriter{w: &buf, max: tt.max}, data)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("writeFull = %v, 期望 %v", err, tt.err)
+			}
+			if tt.err == nil && buf.String() != string(data) {
+				t.Fatalf("写入 %q, 期望 %q", buf.String(), data)
+			}
+		})
+	}
+}
+
+func TestProtocolShortWrites(t *testing.T) {
+	s := NewServer(testConfig(t, `{"users": {"alice": "secret"}}`))
+	l := s.listeners[0]
+	ctx := context.Background()
+
+	tests := []struct {
+		name   string
+		phase  func(conn net.Conn) error
+		input  []byte
+		output []byte
+	}{
+		{
+			"方法选择与认证",
+			func(conn net.Conn) error { _, _, err := s.handleHandshake(ctx, conn, l); return err },
+			append([]byte{Version5, 1, MethodUserPass}, userPassAuth("alice", "secret")...),
+			[]byte{Version5, MethodUserPass, AuthUserPassVersion, AuthUserPassSuccess},
+		},
+		{
+			"IPv6回复",
+			func(conn net.Conn) error {
+				return s.sendReply(conn, RepSuccess, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 0x1234})
+			},
+			nil,
+			append(append([]byte{Version5, RepSuccess, 0, TypeIPv6}, net.ParseIP("2001:db8::1")...), 0x12, 0x34),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := tcpPair(t)
+			mustWrite(t, client, tt.input)
+			if err := tt.phase(shortWriteConn{server}); err != nil {
+				t.Fatal(err)
+			}
+			server.Close()
+			if out, _ := io.ReadAll(client); string(out) != string(tt.output) {
+				t.Fatalf("客户端收到 % x, 期望 % x", out, tt.output)
+			}
+		})
+	}
+}
@@ -0,0 +1,28 @@
+//go:build !windows
+
+package main
+
+import (
+	"strings"
+	"syscall"
+)
+
+// dscpControl 返回在出站套接字上设置 DSCP 标记的 net.Dialer.Control 函数，
+// IPv4 使用 IP_TOS，IPv6 使用 IPV6_TCLASS
+func dscpControl(dscp int) func(network, address string, c syscall.RawConn) error {
+	tos := dscp << 2
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			if strings.HasSuffix(network, "6") {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos)
+				return
+			}
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
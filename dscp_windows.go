@@ -0,0 +1,18 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"syscall"
+)
+
+var dscpWarnOnce sync.Once
+
+// dscpControl Windows 不允许普通程序直接设置 IP_TOS，需通过 QoS 策略配置，
+// 这里仅记录一次警告
+func dscpControl(dscp int) func(network, address string, c syscall.RawConn) error {
+	dscpWarnOnce.Do(func() {
+		log.Printf("警告: Windows 不支持 outbound_dscp, 请使用系统 QoS 策略")
+	})
+	return nil
+}
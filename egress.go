@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// OutboundIPConfig 表示一个出口IP及其权重
+type OutboundIPConfig struct {
+	// 出口IP
+	IP string `json:"ip"`
+	// 权重，0表示默认权重1
+	Weight int `json:"weight"`
+}
+
+// egressPicker 按权重平滑轮询选择出口IP
+type egressPicker struct {
+	mu      sync.Mutex
+	ips     []net.IP
+	weights []int
+	current []int
+	total   int
+}
+
+// newEgressPicker 根据配置创建出口IP选择器
+func newEgressPicker(configs []OutboundIPConfig) (*egressPicker, error) {
+	p := &egressPicker{}
+	for _, c := range configs {
+		ip := net.ParseIP(c.IP)
+		if ip == nil {
+			return nil, fmt.Errorf("无效的出口IP: %s", c.IP)
+		}
+		if c.Weight < 0 {
+			return nil, fmt.Errorf("出口IP %s 的权重不能为负数", c.IP)
+		}
+
+		weight := c.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		p.ips = append(p.ips, ip)
+		p.weights = append(p.weights, weight)
+		p.total += weight
+	}
+	p.current = make([]int, len(p.ips))
+	return p, nil
+}
+
+// next 返回下一个出口IP，每个IP被选中的比例与其权重成正比且分布均匀
+func (p *egressPicker) next() net.IP {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	best := 0
+	for i, w := range p.weights {
+		p.current[i] += w
+		if p.current[i] > p.current[best] {
+			best = i
+		}
+	}
+	p.current[best] -= p.total
+	return p.ips[best]
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestEgressPickerWeights(t *testing.T) {
+	tests := []struct {
+		name    string
+		configs []OutboundIPConfig
+		want    map[string]int // 每轮（权重之和次选择）中各IP被选中的次数
+	}{
+		{"单个IP", []OutboundIPConfig{{IP: "192.0.2.1"}}, map[string]int{"192.0.2.1": 1}},
+		{"默认权重", []OutboundIPConfig{{IP: "192.0.2.1"}, {IP: "192.0.2.2"}}, map[string]int{"192.0.2.1": 1, "192.0.2.2": 1}},
+		{"加权", []OutboundIPConfig{{IP: "192.0.2.1", Weight: 5}, {IP: "192.0.2.2", Weight: 1}, {IP: "2001:db8::1", Weight: 2}}, map[string]int{"192.0.2.1": 5, "192.0.2.2": 1, "2001:db8::1": 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := newEgressPicker(tt.configs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// 平滑加权轮询在每轮中严格按权重分配，且同一IP不会连续占满一轮
+			for round := 0; round < 100; round++ {
+				got := map[string]int{}
+				run, longest := 0, 0
+				var last string
+				for i := 0; i < p.total; i++ {
+					ip := p.next().String()
+					got[ip]++
+					if ip == last {
+						run++
+					} else {
+						run = 1
+					}
+					last, longest = ip, max(longest, run)
+				}
+				for ip, n := range tt.want {
+					if got[ip] != n {
+						t.Fatalf("第 %d 轮中 %s 被选中 %d 次, 期望 %d", round, ip, got[ip], n)
+					}
+				}
+				if len(tt.want) > 1 && longest == p.total {
+					t.Fatalf("第 %d 轮全部选择了同一个IP", round)
+				}
+			}
+		})
+	}
+
+	for _, configs := range [][]OutboundIPConfig{
+		{{IP: "not-an-ip"}},
+		{{IP: "192.0.2.1", Weight: -1}},
+	} {
+		if _, err := newEgressPicker(configs); err == nil {
+			t.Errorf("配置 %+v 应校验失败", configs)
+		}
+	}
+}
+
+func TestEgressDistribution(t *testing.T) {
+	if ln, err := net.Listen("tcp", "127.0.0.2:0"); err != nil {
+		t.Skipf("无法绑定 127.0.0.2: %v", err)
+	} else {
+		ln.Close()
+	}
+
+	// 目标记录每个连接的来源IP
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	sources := make(chan string, 100)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			sources <- conn.RemoteAddr().(*net.TCPAddr).IP.String()
+			conn.Close()
+		}
+	}()
+
+	s := startServer(t, testConfig(t, `{"outbound_ips": [{"ip": "127.0.0.2", "weight": 3}, {"ip": "127.0.0.3"}]}`))
+	got := map[string]int{}
+	for i := 0; i < 40; i++ {
+		conn, rep, bnd := connect(t, s, "", "", CmdConnect, ln.Addr().String())
+		if rep != RepSuccess {
+			t.Fatalf("回复码 %#x", rep)
+		}
+		conn.Close()
+		src := <-sources
+		if !bnd.IP.Equal(net.ParseIP(src)) {
+			t.Fatalf("BND.ADDR 为 %s, 目标看到的来源为 %s", bnd.IP, src)
+		}
+		got[src]++
+	}
+	if got["127.0.0.2"] != 30 || got["127.0.0.3"] != 10 {
+		t.Fatalf("出口分布为 %v, 期望 127.0.0.2:30 127.0.0.3:10", got)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// 可通过 errors.Is 判断原因的错误，具体错误会以 %w 包装它们并附带详细信息
+var (
+	// ErrUnsupportedVersion 客户端使用了不支持的协议版本
+	ErrUnsupportedVersion = errors.New("不支持的SOCKS版本")
+	// ErrProtocolViolation 客户端发送了不符合协议或超出限制的数据
+	ErrProtocolViolation = errors.New("协议错误")
+	// ErrNoAcceptableMethod 客户端提供的认证方法都不被接受
+	ErrNoAcceptableMethod = errors.New("没有可用的认证方法")
+	// ErrAuthFailed 用户名/密码认证失败
+	ErrAuthFailed = errors.New("认证失败")
+	// ErrCommandNotSupported 命令不受支持或当前用户无权使用
+	ErrCommandNotSupported = errors.New("不支持的命令")
+	// ErrAddressTypeNotSupported 请求的地址类型不受支持
+	ErrAddressTypeNotSupported = errors.New("不支持的地址类型")
+	// ErrHostUnreachable 目标地址无法连接
+	ErrHostUnreachable = errors.New("目标地址不可达")
+	// ErrConnectionNotAllowed 目标被规则禁止访问
+	ErrConnectionNotAllowed = errors.New("连接被规则禁止")
+	// ErrResolveFailed 目标域名解析失败，是 ErrHostUnreachable 的一种
+	ErrResolveFailed = fmt.Errorf("%w: 域名解析失败", ErrHostUnreachable)
+	// ErrDialFailed 连接目标服务器（含上游代理握手）失败
+	ErrDialFailed = errors.New("连接目标服务器失败")
+	// ErrQuotaExceeded 连接数或流量超过配置的上限
+	ErrQuotaExceeded = errors.New("超过配额")
+	// ErrRequestTimeout 客户端完成认证后未在 request_timeout 内发送请求
+	ErrRequestTimeout = errors.New("请求阶段超时")
+	// ErrHandshakeTimeout 客户端未在 handshake_timeout 内完成握手与认证
+	ErrHandshakeTimeout = errors.New("握手阶段超时")
+)
+
+// 请求失败的原因分类，用于日志的 reason 字段与 request_failures_total 指标。
+// 协议本身无法携带原因，客户端只能看到对应的回复码
+const (
+	reasonResolveFailed    = "resolve_failed"    // 域名解析失败，回复 RepHostUnreachable
+	reasonDialFailed       = "dial_failed"       // 连接目标失败，按错误回复 RepConnectionRefused 等
+	reasonACLDenied        = "acl_denied"        // 被规则拒绝，回复 RepConnectionNotAllowed
+	reasonQuotaExceeded    = "quota_exceeded"    // 超过连接数或流量上限，回复 RepServerFailure
+	reasonAuthRequired     = "auth_required"     // 认证失败或没有可用的认证方法
+	reasonRequestTimeout   = "request_timeout"   // 认证后未在 request_timeout 内发送请求，直接关闭连接
+	reasonHandshakeTimeout = "handshake_timeout" // 未在 handshake_timeout 内完成握手与认证，直接关闭连接
+	reasonProtocolError    = "protocol_error"    // 不支持的版本或协议错误
+	reasonNotSupported     = "not_supported"     // 不支持的命令或地址类型
+	reasonOther            = "other"
+)
+
+// failureReason 返回错误对应的失败原因分类
+func failureReason(err error) string {
+	switch {
+	case errors.Is(err, ErrHandshakeTimeout):
+		return reasonHandshakeTimeout
+	case errors.Is(err, ErrResolveFailed):
+		return reasonResolveFailed
+	case errors.Is(err, ErrConnectionNotAllowed):
+		return reasonACLDenied
+	case errors.Is(err, ErrQuotaExceeded):
+		return reasonQuotaExceeded
+	case errors.Is(err, ErrDialFailed):
+		return reasonDialFailed
+	case errors.Is(err, ErrAuthFailed), errors.Is(err, ErrNoAcceptableMethod):
+		return reasonAuthRequired
+	case errors.Is(err, ErrRequestTimeout):
+		return reasonRequestTimeout
+	case errors.Is(err, ErrUnsupportedVersion), errors.Is(err, ErrProtocolViolation), errors.Is(err, ErrProxyHeader):
+		return reasonProtocolError
+	case errors.Is(err, ErrCommandNotSupported), errors.Is(err, ErrAddressTypeNotSupported):
+		return reasonNotSupported
+	}
+	return reasonOther
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestReplyCodeForWrappedErrors(t *testing.T) {
+	tests := []struct {
+		err    error
+		rep    uint8
+		reason string
+	}{
+		{fmt.Errorf("路由规则禁止访问: %w", ErrConnectionNotAllowed), RepConnectionNotAllowed, reasonACLDenied},
+		{fmt.Errorf("%w: %w", ErrDialFailed, ErrConnectionNotAllowed), RepConnectionNotAllowed, reasonACLDenied},
+		{fmt.Errorf("拨号: %w", ErrAddressTypeNotSupported), RepAddressTypeNotSupported, reasonNotSupported},
+		{fmt.Errorf("%w: 链路本地地址", ErrHostUnreachable), RepHostUnreachable, reasonOther},
+		{fmt.Errorf("%w: %w", ErrDialFailed, fmt.Errorf("%w: 解析失败", ErrResolveFailed)), RepHostUnreachable, reasonResolveFailed},
+		{fmt.Errorf("%w: 连接数已达上限", ErrQuotaExceeded), RepServerFailure, reasonQuotaExceeded},
+		{fmt.Errorf("%w: %w", ErrDialFailed, &upstreamReplyError{Code: RepNetworkUnreachable}), RepNetworkUnreachable, reasonDialFailed},
+		{fmt.Errorf("%w: %w", ErrDialFailed, context.DeadlineExceeded), RepTTLExpired, reasonDialFailed},
+		{fmt.Errorf("%w: %w", ErrDialFailed, errors.New("connection refused")), RepConnectionRefused, reasonDialFailed},
+		{fmt.Errorf("%w: 10s 内未完成握手: %w", ErrHandshakeTimeout, os.ErrDeadlineExceeded), RepTTLExpired, reasonHandshakeTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.err.Error(), func(t *testing.T) {
+			if got := replyCodeFor(tt.err, RepTTLExpired); got != tt.rep {
+				t.Errorf("replyCodeFor = %#x, 期望 %#x", got, tt.rep)
+			}
+			if got := failureReason(tt.err); got != tt.reason {
+				t.Errorf("failureReason = %s, 期望 %s", got, tt.reason)
+			}
+		})
+	}
+}
+
+// tcpPair 返回一对相连的回环TCP连接
+func tcpPair(t testing.TB) (client, server net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err = net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []net.Conn{client, server} {
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestProtocolErrorsIs(t *testing.T) {
+	s := NewServer(testConfig(t, `{"users": {"alice": {"password": "secret", "commands": ["connect"]}}}`))
+	l := s.listeners[0]
+	ctx := context.Background()
+
+	// 不支持的版本在预读首字节时被拒绝，不进入握手
+	preRead := func(conn net.Conn) error {
+		_, err := s.preRead(ctx, &bufferedConn{Conn: conn, r: bufio.NewReader(conn)}, time.Time{})
+		return err
+	}
+	handshake := func(conn net.Conn) error {
+		_, _, err := s.handleHandshake(ctx, conn, l)
+		return err
+	}
+	request := func(username string) func(conn net.Conn) error {
+		return func(conn net.Conn) error { return s.handleRequest(ctx, conn, username) }
+	}
+
+	failure := func(rep uint8) []byte { return []byte{Version5, rep, 0, TypeIPv4, 0, 0, 0, 0, 0, 0} }
+	tests := []struct {
+		name   string
+		phase  func(conn net.Conn) error
+		input  []byte
+		target error
+		output []byte // 服务器写出的全部数据
+	}{
+		{"握手版本", preRead, []byte{0x06, 1, MethodNoAuth}, ErrUnsupportedVersion, nil},
+		{"方法数超限", handshake, append([]byte{Version5, 17}, make([]byte, 17)...), ErrProtocolViolation, nil},
+		{"没有可用方法", handshake, []byte{Version5, 1, MethodNoAuth}, ErrNoAcceptableMethod, []byte{Version5, MethodNoAcceptable}},
+		{"密码错误", handshake, append([]byte{Version5, 1, MethodUserPass}, userPassAuth("alice", "wrong")...), ErrAuthFailed, []byte{Version5, MethodUserPass, AuthUserPassVersion, AuthUserPassFailure}},
+		{"请求版本", request(""), []byte{Version4, CmdConnect, 0, TypeIPv4, 1, 2, 3, 4, 0, 80}, ErrUnsupportedVersion, nil},
+		{"未知命令", request(""), requestBytes(0x09, "192.0.2.1", 80), ErrCommandNotSupported, failure(RepCommandNotSupported)},
+		{"无权使用命令", request("alice"), requestBytes(CmdUDPAssociate, "192.0.2.1", 80), ErrCommandNotSupported, failure(RepCommandNotSupported)},
+		{"未知地址类型", request(""), []byte{Version5, CmdConnect, 0, 0x05}, ErrAddressTypeNotSupported, failure(RepAddressTypeNotSupported)},
+		{"空域名", request(""), []byte{Version5, CmdConnect, 0, TypeDomain, 0}, ErrAddressTypeNotSupported, failure(RepAddressTypeNotSupported)},
+		{"未指定的IPv6地址", request(""), requestBytes(CmdConnect, "::", 80), ErrHostUnreachable, failure(RepHostUnreachable)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := tcpPair(t)
+			mustWrite(t, client, tt.input)
+			err := tt.phase(server)
+			server.Close()
+			if !errors.Is(err, tt.target) {
+				t.Fatalf("错误 %v 不是 %v", err, tt.target)
+			}
+			if out, _ := io.ReadAll(client); string(out) != string(tt.output) {
+				t.Fatalf("服务器写出 % x, 期望 % x", out, tt.output)
+			}
+		})
+	}
+}
+
+func TestDialTimeoutReply(t *testing.T) {
+	// timeout 拨号一直等到超时，否则立即被拒绝
+	dial := func(timeout bool) func(ctx context.Context, network, address string) (net.Conn, error) {
+		return func(ctx context.Context, network, address string) (net.Conn, error) {
+			if !timeout {
+				return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("connection refused")}
+			}
+			<-ctx.Done()
+			return nil, &net.OpError{Op: "dial", Net: network, Err: ctx.Err()}
+		}
+	}
+	tests := []struct {
+		name    string
+		config  string
+		timeout bool
+		rep     uint8
+	}{
+		{"默认", `{"dial_timeout": 1}`, true, RepHostUnreachable},
+		{"host_unreachable", `{"dial_timeout": 1, "dial_timeout_reply": "host_unreachable"}`, true, RepHostUnreachable},
+		{"ttl_expired", `{"dial_timeout": 1, "dial_timeout_reply": "ttl_expired"}`, true, RepTTLExpired},
+		// 超时以外的失败不受该选项影响
+		{"ttl_expired拒绝连接", `{"dial_timeout": 1, "dial_timeout_reply": "ttl_expired"}`, false, RepConnectionRefused},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			timeout := tt.timeout
+			s := startServer(t, testConfig(t, tt.config), func(s *Server) { s.Dial = dial(timeout) })
+			start := time.Now()
+			if _, rep, _ := connect(t, s, "", "", CmdConnect, "192.0.2.1:80"); rep != tt.rep {
+				t.Fatalf("回复码 %#x, 期望 %#x", rep, tt.rep)
+			}
+			if elapsed := time.Since(start); tt.timeout && elapsed < time.Second {
+				t.Fatalf("拨号在 %v 后失败, 早于 dial_timeout", elapsed)
+			}
+		})
+	}
+
+	if _, err := parseConfig([]byte(`{"address": "127.0.0.1:0", "dial_timeout_reply": "timeout"}`)); err == nil {
+		t.Fatal("无效的 dial_timeout_reply 应被拒绝")
+	}
+}
+
+func TestFailureReasons(t *testing.T) {
+	echo := startEcho(t)
+	dial := func(err error) func(s *Server) {
+		return func(s *Server) {
+			s.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+				return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+			}
+		}
+	}
+	tests := []struct {
+		name   string
+		config string
+		opt    func(s *Server)
+		user   string
+		target string
+		hold   bool  // 先建立一个到 target 的会话并保持
+		rep    uint8 // authFailed 表示认证失败
+		reason string
+	}{
+		{"解析失败", `{}`, dial(&net.DNSError{Err: "no such host", Name: "nx.test", IsNotFound: true}), "", "nx.test:80", false, RepHostUnreachable, reasonResolveFailed},
+		{"连接失败", `{}`, dial(errors.New("connection refused")), "", "192.0.2.1:80", false, RepConnectionRefused, reasonDialFailed},
+		{"规则拒绝", `{"routes": [{"match": "blocked.test", "via": "block"}]}`, nil, "", "blocked.test:80", false, RepConnectionNotAllowed, reasonACLDenied},
+		{"超过配额", `{"max_connections_per_destination": 1}`, nil, "", echo, true, RepServerFailure, reasonQuotaExceeded},
+		{"认证失败", `{"users": {"alice": "other"}}`, nil, "alice", echo, false, authFailed, reasonAuthRequired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLog(t)
+			var opts []func(s *Server)
+			if tt.opt != nil {
+				opts = append(opts, tt.opt)
+			}
+			s := startServer(t, testConfig(t, tt.config), opts...)
+			if tt.hold {
+				conn, rep := tryConnect(t, s, tt.user, tt.target)
+				if rep != RepSuccess {
+					t.Fatalf("第一个会话回复码 %#x", rep)
+				}
+				defer conn.Close()
+			}
+			failures := failureCount(tt.reason)
+
+			if _, rep := tryConnect(t, s, tt.user, tt.target); rep != tt.rep {
+				t.Fatalf("回复码 %#x, 期望 %#x", rep, tt.rep)
+			}
+			waitLog(t, logs, "(reason="+tt.reason+")")
+			if n := failureCount(tt.reason) - failures; n != 1 {
+				t.Fatalf("reason=%s 的失败数增加 %d, 期望1", tt.reason, n)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// 健康探测的默认间隔与超时
+const (
+	defaultHealthProbeInterval = 60 * time.Second
+	defaultHealthProbeTimeout  = 10 * time.Second
+)
+
+// runHealthProbe 按 health_probe 配置周期性地通过服务器自身的出站逻辑
+// （路由、上游、目标校验）连接探测目标，结果记录到指标，状态变化时记录日志
+func (s *Server) runHealthProbe(ctx context.Context) {
+	interval := time.Duration(s.cfg().HealthProbe.Interval) * time.Second
+	if interval <= 0 {
+		interval = defaultHealthProbeInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	healthy := true
+	for {
+		ok := s.probeOnce(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if ok != healthy {
+			if ok {
+				log.Printf("健康探测: 连接 %s 已恢复", s.cfg().HealthProbe.Target)
+			}
+			healthy = ok
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probeOnce 执行一次探测并更新指标，返回是否成功。失败时总是记录日志
+func (s *Server) probeOnce(ctx context.Context) bool {
+	timeout := time.Duration(s.cfg().HealthProbe.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultHealthProbeTimeout
+	}
+	dialCtx, cancel := context.WithTimeout(withTraceID(ctx), timeout)
+	defer cancel()
+
+	target := s.cfg().HealthProbe.Target
+	start := time.Now()
+	conn, err := s.dialTarget(dialCtx, s.cfg().Network, target)
+	elapsed := time.Since(start)
+	if err != nil {
+		// 服务器停止导致的失败不计入
+		if ctx.Err() != nil {
+			return false
+		}
+		metricHealthProbeFailures.Add(s.metrics(), 1)
+		metricHealthProbeUp.Set(s.metrics(), 0)
+		log.Printf("[trace %s] 健康探测失败: 连接 %s: %v", traceIDFrom(dialCtx), target, err)
+		return false
+	}
+	conn.Close()
+
+	metricHealthProbeSuccesses.Add(s.metrics(), 1)
+	metricHealthProbeUp.Set(s.metrics(), 1)
+	s.debugf(dialCtx, "健康探测成功: 连接 %s 耗时 %v", target, elapsed)
+	return true
+}
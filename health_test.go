@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+// waitMetric 等待指标实现收到 call
+func waitMetric(t *testing.T, m *recordingMetrics, call string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !slices.Contains(m.snapshot(), call) {
+		if time.Now().After(deadline) {
+			t.Fatalf("未收到指标调用 %q, 已收到: %v", call, m.snapshot())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHealthProbe(t *testing.T) {
+	echo := startEcho(t)
+	dead := freeAddr(t)
+	tests := []struct {
+		name   string
+		config string // 附加的配置字段
+		target string
+		ok     bool
+		log    string
+	}{
+		{"目标可用", "", echo, true, ""},
+		{"目标不可用", "", dead, false, "健康探测失败: 连接 " + dead},
+		// 探测经过服务器自身的路由规则
+		{"路由禁止", `, "routes": [{"match": "probe.test", "via": "block"}]`, "probe.test:80", false, "健康探测失败: 连接 probe.test:80"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLog(t)
+			rec := &recordingMetrics{}
+			startServer(t, testConfig(t, `{"health_probe": {"target": "`+tt.target+`"}`+tt.config+`}`), func(s *Server) { s.Metrics = rec })
+
+			if tt.ok {
+				waitMetric(t, rec, "counter health_probe_success_total 1")
+				waitMetric(t, rec, "gauge health_probe_up 1")
+			} else {
+				waitMetric(t, rec, "counter health_probe_failure_total 1")
+				waitMetric(t, rec, "gauge health_probe_up 0")
+				waitLog(t, logs, tt.log)
+			}
+		})
+	}
+}
+
+func TestHealthProbeRecovery(t *testing.T) {
+	logs := captureLog(t)
+	target := freeAddr(t)
+	rec := &recordingMetrics{}
+	startServer(t, testConfig(t, `{"health_probe": {"target": "`+target+`", "interval": 1}}`), func(s *Server) { s.Metrics = rec })
+
+	waitMetric(t, rec, "gauge health_probe_up 0")
+	// 目标恢复后下一次探测成功并记录日志
+	ln, err := net.Listen("tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	waitMetric(t, rec, "gauge health_probe_up 1")
+	waitLog(t, logs, "健康探测: 连接 "+target+" 已恢复")
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// loadHtpasswd 读取 htpasswd 格式的用户文件，返回 用户名 -> 密码哈希。
+// 支持 bcrypt（$2y$）、apr1（$apr1$）与 SHA1（{SHA}）三种哈希格式。
+func loadHtpasswd(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hashes := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		name, hash, ok := strings.Cut(text, ":")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%s 第 %d 行格式无效", path, line)
+		}
+		if !supportedHtpasswdHash(hash) {
+			return nil, fmt.Errorf("%s 第 %d 行: 用户 %s 使用了不支持的哈希格式", path, line, name)
+		}
+		hashes[name] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+// supportedHtpasswdHash 判断是否为支持的 htpasswd 哈希格式
+func supportedHtpasswdHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2") || strings.HasPrefix(hash, "$apr1$") || strings.HasPrefix(hash, "{SHA}")
+}
+
+// verifyHtpasswd 按哈希格式校验密码
+func verifyHtpasswd(hash, password string) bool {
+	var computed string
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt, _, _ := strings.Cut(strings.TrimPrefix(hash, "$apr1$"), "$")
+		computed = apr1(password, salt)
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		computed = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	default:
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1
+}
+
+// apr1 计算 Apache 的 MD5-crypt 变体哈希
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+
+	alt := md5.Sum([]byte(password + salt + password))
+	ctx := []byte(password + magic + salt)
+	for i := len(password); i > 0; i -= 16 {
+		ctx = append(ctx, alt[:min(i, 16)]...)
+	}
+	for i := len(password); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			ctx = append(ctx, 0)
+		} else {
+			ctx = append(ctx, password[0])
+		}
+	}
+	final := md5.Sum(ctx)
+
+	for i := 0; i < 1000; i++ {
+		var round []byte
+		if i&1 != 0 {
+			round = append(round, password...)
+		} else {
+			round = append(round, final[:]...)
+		}
+		if i%3 != 0 {
+			round = append(round, salt...)
+		}
+		if i%7 != 0 {
+			round = append(round, password...)
+		}
+		if i&1 != 0 {
+			round = append(round, final[:]...)
+		} else {
+			round = append(round, password...)
+		}
+		final = md5.Sum(round)
+	}
+
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	var out strings.Builder
+	encode := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out.WriteByte(itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	f := final
+	encode(uint32(f[0])<<16|uint32(f[6])<<8|uint32(f[12]), 4)
+	encode(uint32(f[1])<<16|uint32(f[7])<<8|uint32(f[13]), 4)
+	encode(uint32(f[2])<<16|uint32(f[8])<<8|uint32(f[14]), 4)
+	encode(uint32(f[3])<<16|uint32(f[9])<<8|uint32(f[15]), 4)
+	encode(uint32(f[4])<<16|uint32(f[10])<<8|uint32(f[5]), 4)
+	encode(uint32(f[11]), 2)
+
+	return magic + salt + "$" + out.String()
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// shaHash 返回密码的 htpasswd {SHA} 哈希
+func shaHash(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// bcryptHash 返回密码的 htpasswd bcrypt 哈希（$2y$ 前缀，与 htpasswd -B 一致）
+func bcryptHash(t *testing.T, password string) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "$2y$" + strings.TrimPrefix(string(hash), "$2a$")
+}
+
+// authenticates 以用户名/密码完成握手，返回认证是否成功
+func authenticates(t *testing.T, s *Server, username, password string) bool {
+	t.Helper()
+	conn := dialServer(t, s)
+	mustWrite(t, conn, []byte{Version5, 1, MethodUserPass})
+	expectBytes(t, conn, []byte{Version5, MethodUserPass})
+	mustWrite(t, conn, userPassAuth(username, password))
+	status := make([]byte, 2)
+	if _, err := conn.Read(status); err != nil {
+		return false
+	}
+	return status[1] == AuthUserPassSuccess
+}
+
+func TestVerifyHtpasswd(t *testing.T) {
+	tests := []struct {
+		name     string
+		hash     string
+		password string
+		want     bool
+	}{
+		{"bcrypt", bcryptHash(t, "secret"), "secret", true},
+		{"bcrypt密码错误", bcryptHash(t, "secret"), "wrong", false},
+		// openssl passwd -apr1 -salt saltsalt secret
+		{"apr1", "$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0", "secret", true},
+		{"apr1密码错误", "$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0", "wrong", false},
+		{"SHA", shaHash("secret"), "secret", true},
+		{"SHA密码错误", shaHash("secret"), "wrong", false},
+		{"不支持的格式", "plaintext", "plaintext", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := verifyHtpasswd(tt.hash, tt.password); got != tt.want {
+				t.Fatalf("verifyHtpasswd = %v, 期望 %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUsersFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	writeFile := func(lines ...string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(
+		"# 测试用户",
+		"bob:"+bcryptHash(t, "bob-pw"),
+		"carol:"+shaHash("carol-pw"),
+		"alice:"+shaHash("file-pw"),
+	)
+	config := `{"users_file": "` + path + `", "users": {"alice": "inline-pw"}}`
+	s := startServer(t, testConfig(t, config))
+
+	tests := []struct {
+		user, password string
+		want           bool
+	}{
+		{"bob", "bob-pw", true},
+		{"bob", "wrong", false},
+		{"carol", "carol-pw", true},
+		// 同名用户以内联 users 为准
+		{"alice", "inline-pw", true},
+		{"alice", "file-pw", false},
+		{"dave", "dave-pw", false},
+	}
+	for _, tt := range tests {
+		if got := authenticates(t, s, tt.user, tt.password); got != tt.want {
+			t.Errorf("用户 %s 使用密码 %s 认证成功为 %v, 期望 %v", tt.user, tt.password, got, tt.want)
+		}
+	}
+
+	// 重新加载时重新读取用户文件
+	writeFile("bob:"+bcryptHash(t, "bob-pw"), "dave:"+shaHash("dave-pw"))
+	if err := s.Reload(testConfig(t, config)); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		user, password string
+		want           bool
+	}{
+		{"bob", "bob-pw", true},
+		{"carol", "carol-pw", false},
+		{"dave", "dave-pw", true},
+	} {
+		if got := authenticates(t, s, tt.user, tt.password); got != tt.want {
+			t.Errorf("重新加载后用户 %s 认证成功为 %v, 期望 %v", tt.user, got, tt.want)
+		}
+	}
+
+	for _, lines := range []string{"bob", "bob:plaintext"} {
+		writeFile(lines)
+		if _, err := parseConfig([]byte(config)); err == nil {
+			t.Errorf("用户文件 %q 应校验失败", lines)
+		}
+	}
+}
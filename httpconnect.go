@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// httpConnect 在已建立的连接上发送 HTTP CONNECT 请求并读取响应。
+// 返回的 bufio.Reader 可能缓冲了隧道建立后上游已发送的数据。
+func httpConnect(ctx context.Context, conn net.Conn, name string, u UpstreamConfig, target string) (*bufio.Reader, error) {
+	req, err := http.NewRequest(http.MethodConnect, "http://"+target, nil)
+	if err != nil {
+		return nil, fmt.Errorf("构建 CONNECT 请求失败: %w", err)
+	}
+	req.Host = target
+	for key, value := range u.Headers {
+		req.Header.Set(key, value)
+	}
+	if u.Username != "" {
+		token := base64.StdEncoding.EncodeToString([]byte(u.Username + ":" + u.Password))
+		req.Header.Set("Proxy-Authorization", "Basic "+token)
+	}
+	// 后台预建的隧道不属于任何连接，没有追踪ID
+	if id := traceIDFrom(ctx); u.TraceHeader != "" && id != "" {
+		req.Header.Set(u.TraceHeader, id)
+	}
+
+	if err := req.Write(conn); err != nil {
+		return nil, fmt.Errorf("发送上游 CONNECT 请求失败: %w", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, fmt.Errorf("读取上游 CONNECT 响应失败: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &upstreamReplyError{
+			Upstream: name,
+			Code:     replyCodeForHTTPStatus(resp.StatusCode),
+			Status:   resp.Status,
+		}
+	}
+	return br, nil
+}
+
+// validateHeader 校验 CONNECT 请求中附加的请求头。名称必须是 RFC 7230 的 token，
+// 值不能包含控制字符；Host 与 Proxy-Authorization 由请求目标和上游认证配置生成，不能设置
+func validateHeader(key, value string) error {
+	if key == "" {
+		return fmt.Errorf("请求头名称不能为空")
+	}
+	for i := 0; i < len(key); i++ {
+		if !isTokenChar(key[i]) {
+			return fmt.Errorf("无效的请求头名称: %q", key)
+		}
+	}
+	switch textproto.CanonicalMIMEHeaderKey(key) {
+	case "Host", "Proxy-Authorization":
+		return fmt.Errorf("请求头 %s 不能通过 headers 设置", key)
+	}
+	for i := 0; i < len(value); i++ {
+		if c := value[i]; (c < 0x20 && c != '\t') || c == 0x7F {
+			return fmt.Errorf("请求头 %s 的值包含控制字符", key)
+		}
+	}
+	return nil
+}
+
+// isTokenChar 判断字节是否为 RFC 7230 token 允许的字符
+func isTokenChar(c byte) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+// replyCodeForHTTPStatus 将上游 HTTP 代理的响应状态码映射为 SOCKS5 回复码
+func replyCodeForHTTPStatus(status int) uint8 {
+	switch status {
+	case http.StatusForbidden, http.StatusProxyAuthRequired:
+		return RepConnectionNotAllowed
+	case http.StatusNotFound, http.StatusBadGateway:
+		return RepHostUnreachable
+	case http.StatusServiceUnavailable:
+		return RepNetworkUnreachable
+	case http.StatusGatewayTimeout:
+		return RepTTLExpired
+	default:
+		return RepServerFailure
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startHTTPProxy 启动一个桩 HTTP CONNECT 代理：每个收到的请求发送到 requests，
+// 以 status 响应；status 为 200 时把隧道连接到 echo，并在响应后立即发送 early
+func startHTTPProxy(t *testing.T, status int, echo, early string) (string, <-chan *http.Request) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	requests := make(chan *http.Request, 16)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				req, err := http.ReadRequest(br)
+				if err != nil {
+					return
+				}
+				requests <- req
+				// 响应头与隧道中的首批数据在同一次写入中发送
+				resp := fmt.Sprintf("HTTP/1.1 %d %s\r\n\r\n", status, http.StatusText(status))
+				if status != http.StatusOK {
+					io.WriteString(conn, resp)
+					return
+				}
+				io.WriteString(conn, resp+early)
+				dest, err := net.Dial("tcp", echo)
+				if err != nil {
+					return
+				}
+				defer dest.Close()
+				go func() {
+					io.Copy(dest, br)
+					dest.(*net.TCPConn).CloseWrite()
+				}()
+				io.Copy(conn, dest)
+			}()
+		}
+	}()
+	return ln.Addr().String(), requests
+}
+
+func TestHTTPConnectUpstream(t *testing.T) {
+	echo := startEcho(t)
+	tests := []struct {
+		name     string
+		status   int
+		username string
+		rep      uint8
+	}{
+		{"建立隧道", http.StatusOK, "", RepSuccess},
+		{"上游认证", http.StatusOK, "bob", RepSuccess},
+		{"禁止访问", http.StatusForbidden, "", RepConnectionNotAllowed},
+		{"需要认证", http.StatusProxyAuthRequired, "", RepConnectionNotAllowed},
+		{"目标不存在", http.StatusNotFound, "", RepHostUnreachable},
+		{"网关错误", http.StatusBadGateway, "", RepHostUnreachable},
+		{"服务不可用", http.StatusServiceUnavailable, "", RepNetworkUnreachable},
+		{"网关超时", http.StatusGatewayTimeout, "", RepTTLExpired},
+		{"其他错误", http.StatusInternalServerError, "", RepServerFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy, requests := startHTTPProxy(t, tt.status, echo, "early")
+			s := startServer(t, testConfig(t, `{
+				"upstreams": {"up": {"type": "http-connect", "address": "`+proxy+`", "username": "`+tt.username+`", "password": "pw"}},
+				"routes": [{"match": "echo.test", "via": "up"}]
+			}`))
+
+			conn, rep, _ := connect(t, s, "", "", CmdConnect, "echo.test:7")
+			if rep != tt.rep {
+				t.Fatalf("回复码 %#x, 期望 %#x", rep, tt.rep)
+			}
+
+			req := <-requests
+			if req.Method != http.MethodConnect || req.Host != "echo.test:7" {
+				t.Fatalf("上游收到 %s %s, 期望 CONNECT echo.test:7", req.Method, req.Host)
+			}
+			auth := req.Header.Get("Proxy-Authorization")
+			if want := "Basic " + base64.StdEncoding.EncodeToString([]byte("bob:pw")); tt.username != "" && auth != want {
+				t.Fatalf("Proxy-Authorization 为 %q, 期望 %q", auth, want)
+			} else if tt.username == "" && auth != "" {
+				t.Fatalf("未配置上游认证时发送了 Proxy-Authorization: %q", auth)
+			}
+
+			if rep != RepSuccess {
+				expectClosed(t, conn)
+				return
+			}
+			// 上游在响应后立即发送的数据不能丢失
+			expectBytes(t, conn, []byte("early"))
+			mustWrite(t, conn, []byte("hello"))
+			expectBytes(t, conn, []byte("hello"))
+		})
+	}
+}
+
+func TestHTTPConnectHeaders(t *testing.T) {
+	echo := startEcho(t)
+	tests := []struct {
+		name    string
+		headers string
+		pool    int
+		want    http.Header
+	}{
+		{"User-Agent", `{"User-Agent": "my-proxy/1.0"}`, 0, http.Header{"User-Agent": {"my-proxy/1.0"}}},
+		{"多个请求头", `{"user-agent": "my-proxy/1.0", "X-Client-Id": "edge-1"}`, 0, http.Header{"User-Agent": {"my-proxy/1.0"}, "X-Client-Id": {"edge-1"}}},
+		{"预建隧道", `{"X-Client-Id": "edge-1"}`, 1, http.Header{"X-Client-Id": {"edge-1"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy, requests := startHTTPProxy(t, http.StatusOK, echo, "")
+			s := startServer(t, testConfig(t, `{
+				"upstreams": {"up": {"type": "http-connect", "address": "`+proxy+`", "pool_size": `+strconv.Itoa(tt.pool)+`, "headers": `+tt.headers+`}},
+				"routes": [{"match": "echo.test", "via": "up"}]
+			}`))
+
+			conn, rep, _ := connect(t, s, "", "", CmdConnect, "echo.test:7")
+			if rep != RepSuccess {
+				t.Fatalf("回复码 %#x", rep)
+			}
+			mustWrite(t, conn, []byte("hello"))
+			expectBytes(t, conn, []byte("hello"))
+
+			// 开启预建时第二个请求来自后台预建的隧道
+			for i := 0; i <= tt.pool; i++ {
+				var req *http.Request
+				select {
+				case req = <-requests:
+				case <-time.After(5 * time.Second):
+					t.Fatalf("上游未收到第 %d 个 CONNECT 请求", i+1)
+				}
+				for key, values := range tt.want {
+					if got := req.Header.Values(key); strings.Join(got, ",") != strings.Join(values, ",") {
+						t.Fatalf("第 %d 个请求的 %s 为 %q, 期望 %q", i+1, key, got, values)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestValidateHeader(t *testing.T) {
+	tests := []struct {
+		key, value string
+		valid      bool
+	}{
+		{"User-Agent", "my-proxy/1.0", true},
+		{"X-Trace", "a\tb", true},
+		{"", "v", false},
+		{"Bad Header", "v", false},
+		{"X:Header", "v", false},
+		{"X-Header", "a\r\nInjected: 1", false},
+		{"X-Header", "a\x7f", false},
+		{"host", "example.com", false},
+		{"Proxy-Authorization", "Basic eDp5", false},
+	}
+	for _, tt := range tests {
+		if err := validateHeader(tt.key, tt.value); (err == nil) != tt.valid {
+			t.Errorf("validateHeader(%q, %q) = %v, 期望有效为 %v", tt.key, tt.value, err, tt.valid)
+		}
+	}
+
+	// 只有 http-connect 上游支持附加请求头
+	if err := validateUpstream("up", UpstreamConfig{Type: UpstreamSOCKS5, Address: "127.0.0.1:1080", Headers: map[string]string{"User-Agent": "x"}}); err == nil {
+		t.Fatal("socks5 上游配置 headers 时应报错")
+	}
+}
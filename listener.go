@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// ListenerConfig 表示一个监听器的配置
+type ListenerConfig struct {
+	// 监听地址，格式为 "IP:端口"
+	Address string `json:"address"`
+	// 是否要求用户名/密码认证
+	Auth bool `json:"auth"`
+	// 认证方法优先级列表（no_auth、user_pass），配置后取代 auth
+	Methods []string `json:"methods"`
+	// TLS配置
+	TLS TLSConfig `json:"tls"`
+	// 透明代理模式（仅 Linux）：不解析SOCKS请求，转发到 iptables REDIRECT 前的原始目标
+	Transparent bool `json:"transparent"`
+	// 入站 PROXY 协议配置
+	ProxyProtocol ProxyProtocolConfig `json:"proxy_protocol"`
+	// 该监听器使用的策略包名称（policies 中的 key），为空则使用顶层的用户与访问规则
+	Policy string `json:"policy"`
+	// 控制通道的传输协议，默认为 tcp。tcp 以外的传输（如实验性的 quic、sctp）
+	// 需要嵌入方通过 Server.ListenTransport 提供
+	Network string `json:"network"`
+}
+
+// listener 运行中的监听器及其认证、TLS策略
+type listener struct {
+	addr         string
+	network      string  // 传输协议，tcp 以外的由 Server.ListenTransport 提供
+	policy       string  // 引用的策略包名称，为空时使用顶层策略
+	methods      []uint8 // 按优先级排列的认证方法
+	tlsConfig    *tls.Config
+	logHandshake bool          // 记录每个连接协商的TLS参数
+	certs        *certStore    // TLS证书存储
+	ticketKeys   *ticketKeys   // 按配置间隔轮换的会话票据密钥，未配置时为 nil
+	raw          net.Listener  // 绑定的TCP监听器，重新加载时可被新的监听器复用
+	ln           net.Listener  // 接受连接的监听器（TLS模式下包装 raw）
+	retired      atomic.Bool   // 已被重新加载替换，serve 应退出且不关闭 raw
+	done         chan struct{} // serve 协程退出时关闭
+	transparent  bool          // 透明代理模式
+	// PROXY 协议：为 nil 时不接受协议头
+	proxyTrusted []*net.IPNet
+	proxyRequire bool
+}
+
+// newListener 根据配置创建监听器，TLS证书加载失败时回退为非TLS模式
+func newListener(lc ListenerConfig) *listener {
+	l := &listener{addr: lc.Address, network: lc.Network, done: make(chan struct{}), transparent: lc.Transparent, policy: lc.Policy}
+	if l.network == "" {
+		l.network = "tcp"
+	}
+	if lc.ProxyProtocol.Enable {
+		// CIDR 已在加载配置时校验
+		l.proxyTrusted, _ = parseTrustedProxies(lc.ProxyProtocol.Trusted)
+		l.proxyRequire = lc.ProxyProtocol.Require
+	}
+
+	switch {
+	case len(lc.Methods) > 0:
+		for _, name := range lc.Methods {
+			l.methods = append(l.methods, methodNames[name])
+		}
+	case lc.Auth:
+		l.methods = []uint8{MethodUserPass}
+	default:
+		l.methods = []uint8{MethodNoAuth}
+	}
+
+	if lc.TLS.Enable {
+		certs, err := newCertStore(lc.TLS.CertFile, lc.TLS.KeyFile)
+		if err == nil {
+			l.certs = certs
+			l.logHandshake = lc.TLS.LogHandshake
+			l.tlsConfig = &tls.Config{
+				GetCertificate:         certs.GetCertificate,
+				MinVersion:             tls.VersionTLS12,
+				NextProtos:             lc.TLS.NextProtos,
+				SessionTicketsDisabled: lc.TLS.SessionTicketsDisabled,
+			}
+			if d := time.Duration(lc.TLS.SessionTicketKeyRotation) * time.Second; d > 0 && !lc.TLS.SessionTicketsDisabled {
+				l.ticketKeys = &ticketKeys{interval: d}
+				l.ticketKeys.maybeRotate(l.tlsConfig)
+			}
+			// 客户端证书配置已在加载配置时校验，此时失败说明文件已变化，
+			// 拒绝所有客户端证书而不是放行
+			if err := lc.TLS.applyClientAuth(l.tlsConfig); err != nil {
+				log.Printf("监听器 %s 客户端证书配置加载失败: %v, 将拒绝所有连接", lc.Address, err)
+				l.tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+				l.tlsConfig.ClientCAs = x509.NewCertPool()
+			}
+		} else {
+			log.Printf("监听器 %s TLS证书加载失败: %v, 将使用非TLS模式", lc.Address, err)
+		}
+	}
+
+	return l
+}
+
+// listen 用 listenFn 绑定监听地址，raw 非空时复用已绑定的监听器
+func (l *listener) listen(raw net.Listener, listenFn func(network, address string) (net.Listener, error)) error {
+	if raw == nil {
+		var err error
+		if raw, err = listenFn(l.network, l.addr); err != nil {
+			return fmt.Errorf("启动服务器失败: %w", err)
+		}
+	}
+	l.raw, l.ln = raw, raw
+
+	if l.network != "tcp" {
+		log.Printf("监听器 %s 使用实验性传输 %s", raw.Addr(), l.network)
+	}
+
+	if l.tlsConfig != nil {
+		log.Printf("SOCKS5 服务器正在监听 %s (TLS模式, 认证方法: % x)", raw.Addr(), l.methods)
+		// PROXY 协议头在 TLS 握手之前发送，由 handleConnection 解析后再建立TLS
+		if l.proxyTrusted == nil {
+			l.ln = tls.NewListener(raw, l.tlsConfig)
+		}
+		return nil
+	}
+
+	if l.transparent {
+		log.Printf("SOCKS5 服务器正在监听 %s (透明代理模式)", raw.Addr())
+		return nil
+	}
+	log.Printf("SOCKS5 服务器正在监听 %s (认证方法: % x)", raw.Addr(), l.methods)
+	return nil
+}
+
+// key 返回监听器的传输与地址，重新加载时只有两者都相同才复用已绑定的监听器
+func (l *listener) key() string {
+	return l.network + " " + l.addr
+}
+
+// retire 让 serve 协程停止接受连接并等待其退出，keepOpen 为 true 时
+// 不关闭已绑定的TCP监听器，以便新的监听器继续使用。已接受的连接是独立的
+// 套接字，由各自的 handleConnection 协程持有，retire 不记录也不关闭它们，
+// 握手中的连接继续使用旧监听器的TLS与认证设置完成
+func (l *listener) retire(keepOpen bool) {
+	if !keepOpen {
+		l.ln.Close()
+		<-l.done
+		return
+	}
+
+	l.retired.Store(true)
+	tl, ok := l.raw.(*net.TCPListener)
+	if !ok {
+		l.ln.Close()
+		<-l.done
+		return
+	}
+	tl.SetDeadline(time.Now())
+	<-l.done
+	tl.SetDeadline(time.Time{})
+}
+
+// selectMethod returns the highest-priority listener method that the
+// client also offered, or MethodNoAcceptable
+func (l *listener) selectMethod(offered []byte) uint8 {
+	for _, m := range l.methods {
+		if bytes.IndexByte(offered, m) >= 0 {
+			return m
+		}
+	}
+	return MethodNoAcceptable
+}
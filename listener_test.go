@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMultipleListeners(t *testing.T) {
+	echo := startEcho(t)
+	open, authed := freeAddr(t), freeAddr(t)
+	s := startServer(t, testConfig(t, `{
+		"users": {"alice": "secret"},
+		"listeners": [
+			{"address": "`+open+`"},
+			{"address": "`+authed+`", "auth": true}
+		]
+	}`))
+
+	tests := []struct {
+		name    string
+		addr    string
+		offered []byte // 客户端提供的认证方法
+		method  uint8  // 服务器选择的方法
+	}{
+		{"无认证监听器", open, []byte{MethodNoAuth}, MethodNoAuth},
+		{"无认证监听器不接受密码认证", open, []byte{MethodUserPass}, MethodNoAcceptable},
+		{"认证监听器要求密码", authed, []byte{MethodNoAuth}, MethodNoAcceptable},
+		{"认证监听器", authed, []byte{MethodNoAuth, MethodUserPass}, MethodUserPass},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := dialAddr(t, tt.addr)
+			mustWrite(t, conn, append([]byte{Version5, byte(len(tt.offered))}, tt.offered...))
+			expectBytes(t, conn, []byte{Version5, tt.method})
+		})
+	}
+
+	// 各监听器按自己的认证方式完成请求
+	if rep := connectAddr(t, open, "", "", echo); rep != RepSuccess {
+		t.Fatalf("无认证监听器回复码 %#x", rep)
+	}
+	if rep := connectAddr(t, authed, "alice", "secret", echo); rep != RepSuccess {
+		t.Fatalf("认证监听器回复码 %#x", rep)
+	}
+
+	// 停止服务器关闭所有监听器
+	s.Stop()
+	expectRefused(t, open)
+	expectRefused(t, authed)
+}
+
+func TestAuthMethodOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		offered []byte
+		method  uint8
+	}{
+		{"默认仅无认证", `{}`, []byte{MethodUserPass, MethodNoAuth}, MethodNoAuth},
+		{"配置用户时默认要求密码", `{"users": {"alice": "secret"}}`, []byte{MethodNoAuth}, MethodNoAcceptable},
+		{"优先密码认证", `{"users": {"alice": "secret"}, "auth_methods": ["user_pass", "no_auth"]}`, []byte{MethodNoAuth, MethodUserPass}, MethodUserPass},
+		{"未提供密码认证时回退", `{"users": {"alice": "secret"}, "auth_methods": ["user_pass", "no_auth"]}`, []byte{MethodNoAuth}, MethodNoAuth},
+		{"优先无认证", `{"users": {"alice": "secret"}, "auth_methods": ["no_auth", "user_pass"]}`, []byte{MethodUserPass, MethodNoAuth}, MethodNoAuth},
+		{"仅密码认证", `{"users": {"alice": "secret"}, "auth_methods": ["user_pass"]}`, []byte{MethodNoAuth}, MethodNoAcceptable},
+		{"客户端未提供方法", `{}`, []byte{}, MethodNoAcceptable},
+		{"监听器覆盖全局顺序", `{"users": {"alice": "secret"}, "auth_methods": ["user_pass"], "listeners": [{"address": "127.0.0.1:0", "methods": ["no_auth", "user_pass"]}]}`, []byte{MethodUserPass, MethodNoAuth}, MethodNoAuth},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startServer(t, testConfig(t, tt.config))
+			conn := dialServer(t, s)
+			mustWrite(t, conn, append([]byte{Version5, byte(len(tt.offered))}, tt.offered...))
+			expectBytes(t, conn, []byte{Version5, tt.method})
+		})
+	}
+
+	for _, js := range []string{
+		`{"auth_methods": ["gssapi"]}`,
+		`{"auth_methods": ["user_pass"]}`,
+	} {
+		if _, err := parseConfig([]byte(js)); err == nil {
+			t.Errorf("配置 %s 应校验失败", js)
+		}
+	}
+}
+
+func TestMaxMethods(t *testing.T) {
+	// methods 返回 n 个方法，最后一个为无认证
+	methods := func(n int) []byte {
+		m := make([]byte, n)
+		for i := range m[:n-1] {
+			m[i] = byte(0x03 + i%0x7D)
+		}
+		m[n-1] = MethodNoAuth
+		return m
+	}
+	tests := []struct {
+		name     string
+		config   string
+		nmethods int
+		accepted bool
+	}{
+		{"默认上限以内", `{}`, 16, true},
+		{"超过默认上限", `{}`, 200, false},
+		{"调高上限", `{"max_methods": 255}`, 200, true},
+		{"调低上限", `{"max_methods": 2}`, 3, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLog(t)
+			s := startServer(t, testConfig(t, tt.config))
+			conn := dialServer(t, s)
+			mustWrite(t, conn, append([]byte{Version5, byte(tt.nmethods)}, methods(tt.nmethods)...))
+			if tt.accepted {
+				expectBytes(t, conn, []byte{Version5, MethodNoAuth})
+				return
+			}
+			// 视为协议违规，不回复直接关闭
+			expectClosed(t, conn)
+			waitLog(t, logs, fmt.Sprintf("提供了 %d 个认证方法", tt.nmethods))
+		})
+	}
+
+	for _, n := range []string{"-1", "256"} {
+		if _, err := parseConfig([]byte(`{"max_methods": ` + n + `}`)); err == nil {
+			t.Errorf("max_methods %s 应校验失败", n)
+		}
+	}
+}
+
+// streamListener 内存中的流式传输，模拟 QUIC 等多路复用传输：每次 dial 产生一个流，
+// Accept 返回流的服务器端
+type streamListener struct {
+	streams chan net.Conn
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func newStreamListener() *streamListener {
+	return &streamListener{streams: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *streamListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.streams:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *streamListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *streamListener) Addr() net.Addr {
+	return streamAddr("stream")
+}
+
+// dial 打开一个新的流，测试结束时关闭
+func (l *streamListener) dial(t *testing.T) net.Conn {
+	t.Helper()
+	client, server := net.Pipe()
+	select {
+	case l.streams <- server:
+	case <-time.After(5 * time.Second):
+		t.Fatal("监听器未接受新的流")
+	}
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+type streamAddr string
+
+func (a streamAddr) Network() string { return "stream" }
+func (a streamAddr) String() string  { return string(a) }
+
+func TestListenTransport(t *testing.T) {
+	echo := startEcho(t)
+	stream := newStreamListener()
+	var mu sync.Mutex
+	var bound []string
+	tcp := freeAddr(t)
+	startServer(t, testConfig(t, `{
+		"users": {"alice": "secret"},
+		"listeners": [
+			{"address": "`+tcp+`"},
+			{"address": "stream-1", "network": "stream", "auth": true}
+		]
+	}`), func(s *Server) {
+		s.ListenTransport = func(network, address string) (net.Listener, error) {
+			mu.Lock()
+			bound = append(bound, network+" "+address)
+			mu.Unlock()
+			if network == "stream" {
+				return stream, nil
+			}
+			return net.Listen(network, address)
+		}
+	})
+	mu.Lock()
+	if fmt.Sprint(bound) != fmt.Sprint([]string{"tcp " + tcp, "stream stream-1"}) {
+		t.Fatalf("ListenTransport 调用 %v", bound)
+	}
+	mu.Unlock()
+
+	// 每个流按独立的 SOCKS 连接处理，使用该监听器的认证设置
+	for i := 0; i < 2; i++ {
+		conn := stream.dial(t)
+		greet(t, conn, "alice", "secret")
+		host, port, _ := net.SplitHostPort(echo)
+		p, _ := strconv.Atoi(port)
+		mustWrite(t, conn, requestBytes(CmdConnect, host, uint16(p)))
+		if rep, _ := readReply(t, conn); rep != RepSuccess {
+			t.Fatalf("第 %d 个流回复码 %#x", i+1, rep)
+		}
+		mustWrite(t, conn, []byte("ping"))
+		expectBytes(t, conn, []byte("ping"))
+	}
+	// TCP 监听器不受影响
+	if rep := connectAddr(t, tcp, "", "", echo); rep != RepSuccess {
+		t.Fatalf("TCP 监听器回复码 %#x", rep)
+	}
+}
+
+func TestListenTransportRequired(t *testing.T) {
+	// 未提供 ListenTransport 时 tcp 以外的传输在绑定时失败
+	s := NewServer(testConfig(t, `{"listeners": [{"address": "stream-1", "network": "stream"}]}`))
+	err := s.Listen()
+	if err == nil {
+		s.Stop()
+		t.Fatal("期望绑定失败")
+	}
+	if !strings.Contains(err.Error(), "Server.ListenTransport") {
+		t.Fatalf("错误 %q 未提示使用 Server.ListenTransport", err)
+	}
+
+	if _, err := parseConfig([]byte(`{"listeners": [{"address": "127.0.0.1:0", "network": "stream", "transparent": true}]}`)); err == nil {
+		t.Fatal("非 tcp 传输的透明代理监听器应被拒绝")
+	}
+}
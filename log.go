@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"sync/atomic"
+)
+
+// 日志级别
+const (
+	LogLevelDebug = "debug"
+	LogLevelInfo  = "info"
+)
+
+// nextConnID 用于为每个连接分配递增的ID
+var nextConnID atomic.Uint64
+
+type connIDKey struct{}
+
+// withConnID 为连接分配新的ID并保存到 context 中
+func withConnID(ctx context.Context) context.Context {
+	return context.WithValue(ctx, connIDKey{}, nextConnID.Add(1))
+}
+
+// connIDFrom 返回 context 中的连接ID，不存在时为0
+func connIDFrom(ctx context.Context) uint64 {
+	id, _ := ctx.Value(connIDKey{}).(uint64)
+	return id
+}
+
+type sampledKey struct{}
+
+// nextSample 用于成功连接日志的 1/N 采样计数
+var nextSample atomic.Uint64
+
+// withLogSample 按 log_sample_rate 决定该连接的成功日志是否输出，并保存到 context 中
+func (s *Server) withLogSample(ctx context.Context) context.Context {
+	n := uint64(s.cfg().LogSampleRate)
+	sampled := n <= 1 || nextSample.Add(1)%n == 1
+	return context.WithValue(ctx, sampledKey{}, sampled)
+}
+
+// logSampled 记录成功连接的日志，未被采样的连接仅在 debug 级别下输出。
+// 错误与认证失败不应使用该函数，以免被采样丢弃
+func (s *Server) logSampled(ctx context.Context, format string, args ...any) {
+	if sampled, ok := ctx.Value(sampledKey{}).(bool); ok && !sampled && s.cfg().LogLevel != LogLevelDebug {
+		return
+	}
+	log.Printf(format, args...)
+}
+
+type traceIDKey struct{}
+
+// withTraceID 为连接生成随机的追踪ID并保存到 context 中，用于跨服务关联日志
+func withTraceID(ctx context.Context) context.Context {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return context.WithValue(ctx, traceIDKey{}, hex.EncodeToString(b))
+}
+
+// traceIDFrom 返回 context 中的追踪ID，不存在时为空
+func traceIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(traceIDKey{}).(string)
+	return id
+}
+
+// 日志中用户名的显示方式
+const (
+	LogUsernamesPlain = "plain"
+	LogUsernamesMask  = "mask"
+	LogUsernamesHash  = "hash"
+)
+
+// logUsername 按 log_usernames 返回用于日志的用户名：mask 保留首字符，
+// hash 保留首字符并附加 SHA-256 前8位十六进制以便关联同一用户的日志。
+// 仅用于日志与错误信息，访问控制等仍使用原始用户名
+func (s *Server) logUsername(name string) string {
+	if name == "" {
+		return name
+	}
+	first := string([]rune(name)[:1])
+	switch s.cfg().LogUsernames {
+	case LogUsernamesMask:
+		return first + "***"
+	case LogUsernamesHash:
+		sum := sha256.Sum256([]byte(name))
+		return first + "~" + hex.EncodeToString(sum[:4])
+	}
+	return name
+}
+
+// logFailure 记录连接处理失败的日志，附带 reason 字段并按原因计入 request_failures_total
+func (s *Server) logFailure(ctx context.Context, msg string, err error) {
+	reason := failureReason(err)
+	metricRequestFailures.Add(s.metrics(), []Label{{Name: "reason", Value: reason}}, 1)
+	log.Printf("[trace %s] %s (reason=%s): %v", traceIDFrom(ctx), msg, reason, err)
+}
+
+// debugf 仅在 debug 日志级别下输出带连接ID与追踪ID的日志
+func (s *Server) debugf(ctx context.Context, format string, args ...any) {
+	if s.cfg().LogLevel != LogLevelDebug {
+		return
+	}
+	log.Printf("[debug] [conn %d] [trace %s] "+format, append([]any{connIDFrom(ctx), traceIDFrom(ctx)}, args...)...)
+}
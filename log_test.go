@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// logBuffer 并发安全的日志缓冲区
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLog 将标准日志重定向到缓冲区，测试结束时恢复
+func captureLog(t *testing.T) *logBuffer {
+	t.Helper()
+	b := &logBuffer{}
+	log.SetOutput(b)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return b
+}
+
+// waitLog 等待日志中出现 substr，连接关闭后服务器可能稍晚才写出日志
+func waitLog(t *testing.T, logs *logBuffer, substr string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(logs.String(), substr) {
+		if time.Now().After(deadline) {
+			t.Fatalf("日志中没有 %q:\n%s", substr, logs)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDebugByteDumps(t *testing.T) {
+	echo := startEcho(t)
+	tests := []struct {
+		level string
+		dump  bool
+	}{
+		{LogLevelDebug, true},
+		{LogLevelInfo, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.level, func(t *testing.T) {
+			logs := captureLog(t)
+			s := startServer(t, testConfig(t, `{"users": {"alice": "hunter2"}, "log_level": "`+tt.level+`"}`))
+			if _, rep, _ := connect(t, s, "alice", "hunter2", CmdConnect, echo); rep != RepSuccess {
+				t.Fatalf("回复码 %#x", rep)
+			}
+
+			host, port, _ := net.SplitHostPort(echo)
+			p, _ := strconv.Atoi(port)
+			wants := []string{
+				fmt.Sprintf("握手字节: % x % x", []byte{Version5, 1}, []byte{MethodUserPass}),
+				fmt.Sprintf("请求字节: % x", requestBytes(CmdConnect, host, uint16(p))),
+			}
+			out := logs.String()
+			for _, want := range wants {
+				if strings.Contains(out, want) != tt.dump {
+					t.Errorf("日志中包含 %q 为 %v, 期望 %v", want, !tt.dump, tt.dump)
+				}
+			}
+			// 认证密码在任何级别都不出现在日志中
+			if pw := fmt.Sprintf("% x", []byte("hunter2")); strings.Contains(out, pw) || strings.Contains(out, "hunter2") {
+				t.Errorf("日志包含密码:\n%s", out)
+			}
+			// 调试日志带有连接ID
+			if tt.dump && !strings.Contains(out, "[debug] [conn ") {
+				t.Errorf("调试日志缺少连接ID:\n%s", out)
+			}
+		})
+	}
+}
+
+func TestTraceID(t *testing.T) {
+	echo := startEcho(t)
+	tests := []struct {
+		name   string
+		header bool // 经 http-connect 上游并以请求头传递追踪ID
+		slow   bool // 连接目标超过 slow_dial_threshold，警告日志同样带追踪ID
+	}{
+		{"直接连接", false, false},
+		{"HTTP上游", true, false},
+		{"连接目标缓慢", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := `{}`
+			var requests <-chan *http.Request
+			if tt.header {
+				var proxy string
+				proxy, requests = startHTTPProxy(t, http.StatusOK, echo, "")
+				config = `{
+					"upstreams": {"up": {"type": "http-connect", "address": "` + proxy + `", "trace_header": "X-Trace-Id"}},
+					"routes": [{"match": "127.0.0.0/8", "via": "up"}]
+				}`
+			}
+			if tt.slow {
+				config = `{"slow_dial_threshold": 1}`
+			}
+			logs := captureLog(t)
+			closed := make(chan string, 2)
+			s := startServer(t, testConfig(t, config), func(s *Server) {
+				s.OnConnectionClose = func(ctx context.Context, info *ConnectionInfo) { closed <- info.TraceID }
+				if tt.slow {
+					s.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+						time.Sleep(20 * time.Millisecond)
+						return (&net.Dialer{}).DialContext(ctx, network, address)
+					}
+				}
+			})
+
+			var ids []string
+			for i := 0; i < 2; i++ {
+				conn, rep, _ := connect(t, s, "", "", CmdConnect, echo)
+				if rep != RepSuccess {
+					t.Fatalf("回复码 %#x", rep)
+				}
+				conn.Close()
+				var id string
+				select {
+				case id = <-closed:
+				case <-time.After(5 * time.Second):
+					t.Fatal("会话未结束")
+				}
+				if len(id) != 16 {
+					t.Fatalf("追踪ID %q 不是16位十六进制", id)
+				}
+				// 会话日志与关闭钩子使用同一个追踪ID
+				waitLog(t, logs, "[trace "+id+"] 连接 ")
+				if tt.slow {
+					waitLog(t, logs, "[trace "+id+"] 警告: 连接目标 ")
+				}
+				if tt.header {
+					if got := (<-requests).Header.Get("X-Trace-Id"); got != id {
+						t.Fatalf("上游收到的追踪ID为 %q, 期望 %q", got, id)
+					}
+				}
+				ids = append(ids, id)
+			}
+			if ids[0] == ids[1] {
+				t.Fatalf("两个连接使用了相同的追踪ID %s", ids[0])
+			}
+		})
+	}
+}
+
+func TestLogSampling(t *testing.T) {
+	const sessions = 10
+	echo := startEcho(t)
+	tests := []struct {
+		name   string
+		config string
+		want   int // 输出日志的成功会话数，认证失败总是全部记录
+	}{
+		{"不采样", `"log_sample_rate": 0`, sessions},
+		{"采样率1", `"log_sample_rate": 1`, sessions},
+		// 连续的10个计数中恰好有2个命中 1/5 采样
+		{"采样率5", `"log_sample_rate": 5`, sessions / 5},
+		{"debug级别不采样", `"log_sample_rate": 5, "log_level": "debug"`, sessions},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLog(t)
+			closed := make(chan struct{}, sessions)
+			s := startServer(t, testConfig(t, `{"users": {"alice": "secret"}, `+tt.config+`}`), func(s *Server) {
+				s.OnConnectionClose = func(context.Context, *ConnectionInfo) { closed <- struct{}{} }
+			})
+			for i := 0; i < sessions; i++ {
+				conn, rep, _ := connect(t, s, "alice", "secret", CmdConnect, echo)
+				if rep != RepSuccess {
+					t.Fatalf("回复码 %#x", rep)
+				}
+				conn.Close()
+				select {
+				case <-closed:
+				case <-time.After(5 * time.Second):
+					t.Fatal("会话未结束")
+				}
+				if authenticates(t, s, "alice", "wrong") {
+					t.Fatal("错误密码认证成功")
+				}
+			}
+
+			failure := "invalid credentials for user"
+			deadline := time.Now().Add(5 * time.Second)
+			for strings.Count(logs.String(), failure) < sessions && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			if got := strings.Count(logs.String(), failure); got != sessions {
+				t.Fatalf("记录了 %d 次认证失败, 期望 %d", got, sessions)
+			}
+			if got := strings.Count(logs.String(), "] 连接 "+echo+" "); got != tt.want {
+				t.Fatalf("记录了 %d 个成功会话, 期望 %d:\n%s", got, tt.want, logs)
+			}
+		})
+	}
+}
+
+func TestLogUsernameRedaction(t *testing.T) {
+	echo := startEcho(t)
+	sum := sha256.Sum256([]byte("alice"))
+	tests := []struct {
+		mode string
+		want string // 日志中用户名的形式
+	}{
+		{LogUsernamesPlain, "alice"},
+		{LogUsernamesMask, "a***"},
+		{LogUsernamesHash, "a~" + hex.EncodeToString(sum[:4])},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			logs := captureLog(t)
+			s := startServer(t, testConfig(t, `{
+				"log_usernames": "`+tt.mode+`",
+				"users": {"alice": {"password": "secret", "allow": ["allowed.test"]}},
+				"default_deny": true
+			}`), func(s *Server) {
+				s.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "tcp", echo)
+				}
+			})
+
+			// 允许列表按真实用户名匹配
+			if _, rep := tryConnect(t, s, "alice", "allowed.test:80"); rep != RepSuccess {
+				t.Fatalf("允许的目标回复码 %#x", rep)
+			}
+			if _, rep := tryConnect(t, s, "alice", "denied.test:80"); rep != RepConnectionNotAllowed {
+				t.Fatalf("不允许的目标回复码 %#x", rep)
+			}
+			if authenticates(t, s, "alice", "wrong") {
+				t.Fatal("错误密码认证成功")
+			}
+
+			waitLog(t, logs, fmt.Sprintf("用户 %q 的允许列表不包含 denied.test", tt.want))
+			waitLog(t, logs, fmt.Sprintf("invalid credentials for user %q", tt.want))
+			if tt.mode != LogUsernamesPlain && strings.Contains(logs.String(), "alice") {
+				t.Fatalf("日志中出现了明文用户名:\n%s", logs)
+			}
+		})
+	}
+}
@@ -4,17 +4,17 @@ import (
 	"flag"
 	"log"
 	"os"
-
-	"github.com/justn-gpt/socks5-server"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
-	configPath := flag.String("c", "config.json", "配置文件路径")
+	configPath := flag.String("c", "config.json", "配置文件路径，\"-\" 表示从标准输入读取，也可以是 http(s):// 地址")
 	flag.Parse()
 
-	log.Printf("尝试加载配置文件: %s", *configPath)
+	log.Printf("尝试加载配置文件: %s", redactConfigURL(*configPath))
 
-	cfg, err := socks5.LoadConfig(*configPath)
+	cfg, err := LoadConfig(*configPath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			log.Printf("配置文件不存在，使用环境变量配置功能暂未实现")
@@ -26,13 +26,46 @@ func main() {
 	}
 
 	// 如果需要校验配置，请自己实现
-	// socks5.CheckServerCfgDefault(cfg)
+	// CheckServerCfgDefault(cfg)
+
+	// 配置中含有用户名、密码与上游凭据，只记录摘要
+	log.Printf("加载配置: %d 个监听器, %d 个用户, %d 个策略包", len(cfg.listenerConfigs()), len(cfg.Users), len(cfg.Policies))
 
-	log.Printf("加载配置: %+v", cfg)
+	server := NewServer(cfg)
+	go handleSignals(server, *configPath)
 
-	server := socks5.NewServer(cfg)
+	if cfg.ControlSocket != "" {
+		if err := startControlSocket(server, cfg.ControlSocket, *configPath); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
 
-	if err := server.Run(); err != nil {
+	if err := server.Start(); err != nil {
 		log.Fatalf("服务器启动失败: %v", err)
 	}
 }
+
+// handleSignals 收到 SIGHUP 时重新加载配置中的访问策略、设置和TLS证书，
+// 收到 SIGINT/SIGTERM 时停止服务器
+func handleSignals(server *Server, configPath string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+
+	for sig := range signals {
+		if sig != syscall.SIGHUP {
+			log.Printf("收到 %v, 停止服务器", sig)
+			server.Stop()
+			return
+		}
+
+		log.Printf("收到 SIGHUP, 重新加载配置")
+		if cfg, err := LoadConfig(configPath); err != nil {
+			log.Printf("重新加载配置文件失败: %v", err)
+		} else if err := server.Reload(cfg); err != nil {
+			log.Printf("重新加载配置失败: %v", err)
+		}
+		if err := server.ReloadCertificates(); err != nil {
+			log.Printf("重新加载TLS证书失败: %v", err)
+		}
+	}
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 服务器运行指标，经由各 Server 的 Metrics 实现记录，默认通过 expvar 以 JSON 形式暴露在 /debug/vars，
+// 并以 Prometheus 文本格式暴露在 /metrics
+var (
+	// 出站连接建立耗时（毫秒）
+	metricDialDuration = newHistogram("dial_duration_ms", []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000})
+	// 用户名/密码凭据校验耗时（毫秒）
+	metricAuthDuration = newHistogram("auth_duration_ms", []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000})
+	// 超过慢连接阈值的出站连接数
+	metricSlowDials = newCounter("slow_dials_total")
+	// 因超过接入速率限制而关闭的连接数
+	metricAcceptRejected = newCounter("accept_rate_limited_total")
+	// 因 PROXY 协议头无效或来源不可信而拒绝的连接数
+	metricProxyHeaderRejected = newCounter("proxy_header_rejected_total")
+	// 首字节不是支持的 SOCKS 版本而立即关闭的连接数
+	metricProtocolMismatch = newCounter("protocol_mismatch_total")
+	// 因握手名额已满而关闭的连接数
+	metricHandshakesRejected = newCounter("handshakes_rejected_total")
+	// 因到同一目标的连接数达到上限而被拒绝的 CONNECT 请求数
+	metricDestinationRejected = newCounter("destination_connections_rejected_total")
+	// 因外部认证后端不可用而未选择用户名/密码认证的握手数
+	metricAuthBackendUnavailable = newCounter("auth_backend_unavailable_total")
+	// 健康探测成功与失败次数，以及最近一次探测是否成功（1/0）
+	metricHealthProbeSuccesses = newCounter("health_probe_success_total")
+	metricHealthProbeFailures  = newCounter("health_probe_failure_total")
+	metricHealthProbeUp        = newGauge("health_probe_up")
+	// 被规则拒绝的请求数
+	metricDenied = newCounter("requests_denied_total")
+	// 按原因分类的失败连接数，标签为 reason，例如 {reason="dial_failed"}
+	metricRequestFailures = newCounterMap("request_failures_total")
+	// 因UDP会话数达到上限而丢弃的数据报数
+	metricUDPSessionsDropped = newCounter("udp_sessions_dropped_total")
+	// 按 frag_policy 丢弃的UDP分片数据报数
+	metricUDPFragmentsDropped = newCounter("udp_fragments_dropped_total")
+	// 因UDP会话数达到上限而被淘汰的会话数
+	metricUDPSessionsEvicted = newCounter("udp_sessions_evicted_total")
+	// 来自没有UDP关联（控制连接）的客户端而被丢弃的数据报数
+	metricUDPUnassociatedDropped = newCounter("udp_unassociated_dropped_total")
+	// 因同时进行的域名解析过多而丢弃的目标为域名的UDP数据报数
+	metricUDPLookupsDropped = newCounter("udp_lookups_dropped_total")
+	// 目标IP被 routes 的 block 规则、block_private_targets 或 public_targets_only 拒绝而丢弃的UDP数据报数
+	metricUDPDatagramsDenied = newCounter("udp_datagrams_denied_total")
+	// 使用预建的 HTTP CONNECT 上游隧道的连接数
+	metricTunnelPoolHits = newCounter("upstream_tunnel_pool_hits_total")
+	// 因长时间没有UDP数据报而被关闭的UDP关联数
+	metricUDPAssociationsReaped = newCounter("udp_associations_reaped_total")
+	// UDP转发的上行（客户端到目标）与下行（目标到客户端）负载字节数，不含SOCKS5 UDP头
+	metricUDPUploadBytes   = newCounter("udp_upload_bytes_total")
+	metricUDPDownloadBytes = newCounter("udp_download_bytes_total")
+	// 因超过最长会话时长而被关闭的 CONNECT 会话数
+	metricSessionsExpired = newCounter("sessions_expired_total")
+	// 因超过流量配额而被关闭的 CONNECT 会话数
+	metricQuotaExceeded = newCounter("sessions_quota_exceeded_total")
+
+	// 成功发送、发送失败以及因队列已满而丢弃的 webhook 连接事件数
+	metricWebhookSent    = newCounter("webhook_events_sent_total")
+	metricWebhookFailed  = newCounter("webhook_events_failed_total")
+	metricWebhookDropped = newCounter("webhook_events_dropped_total")
+
+	// 以下指标按 metrics.labels 配置的标签分组，例如 {command="connect",user="alice"}
+	// 通过访问控制的请求数
+	metricRequests = newCounterMap("requests_total")
+	// CONNECT 会话结束时累计的上行与下行字节数
+	metricSessionUpload   = newCounterMap("session_upload_bytes_total")
+	metricSessionDownload = newCounterMap("session_download_bytes_total")
+)
+
+// 分组指标可用的标签
+const (
+	MetricLabelCommand    = "command"     // 请求命令
+	MetricLabelUser       = "user"        // 用户名（按 log_usernames 脱敏）
+	MetricLabelEgressIP   = "egress_ip"   // 出口IP，仅用于会话字节数
+	MetricLabelTargetHost = "target_host" // 目标主机，基数很高
+)
+
+// defaultMetricLabels 未配置 metrics.labels 时使用的标签，不包含高基数的标签
+var defaultMetricLabels = []string{MetricLabelCommand}
+
+// validMetricLabel 判断标签名是否受支持
+func validMetricLabel(name string) bool {
+	switch name {
+	case MetricLabelCommand, MetricLabelUser, MetricLabelEgressIP, MetricLabelTargetHost:
+		return true
+	}
+	return false
+}
+
+// metricLabels 按配置的标签顺序生成分组指标的标签。egress 为出站连接的本地地址，
+// 为 nil 时（请求阶段还没有出站连接）不输出 egress_ip 标签
+func (s *Server) metricLabels(req *Request, egress net.Addr) []Label {
+	var labels []Label
+	for _, name := range s.cfg().Metrics.Labels {
+		var value string
+		switch name {
+		case MetricLabelCommand:
+			value = commandName(req.Command)
+		case MetricLabelUser:
+			value = s.logUsername(req.Username)
+		case MetricLabelEgressIP:
+			if egress == nil {
+				continue
+			}
+			value = egress.String()
+			if host, _, err := net.SplitHostPort(value); err == nil {
+				value = host
+			}
+		case MetricLabelTargetHost:
+			value = req.Host
+		}
+		labels = append(labels, Label{Name: name, Value: value})
+	}
+	return labels
+}
+
+// formatLabels 将标签格式化为 {name="value",...}，quote 负责转义标签值
+func formatLabels(labels []Label, quote func(string) string) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, l := range labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(l.Name)
+		b.WriteByte('=')
+		b.WriteString(quote(l.Value))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// histogram 简单的分桶直方图，实现 expvar.Var
+type histogram struct {
+	mu     sync.Mutex
+	bounds []float64 // 各桶上界（升序）
+	counts []int64   // 各桶计数，最后一个为溢出桶
+	sum    float64
+	count  int64
+}
+
+// newHistogram 创建直方图并以指定名称发布到 expvar
+func newHistogram(name string, bounds []float64) *histogramMetric {
+	expvar.Publish(name, newHistogramBuckets(bounds))
+	metricKinds[name] = "histogram"
+	histogramBounds[name] = bounds
+	return &histogramMetric{name: name}
+}
+
+// newHistogramBuckets 创建指定分桶上界的空直方图
+func newHistogramBuckets(bounds []float64) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]int64, len(bounds)+1),
+	}
+}
+
+// observe 记录一个观测值
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	i := 0
+	for i < len(h.bounds) && v > h.bounds[i] {
+		i++
+	}
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+// snapshot 返回各桶计数、总和与观测次数的副本
+func (h *histogram) snapshot() (counts []int64, sum float64, count int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]int64(nil), h.counts...), h.sum, h.count
+}
+
+// String 以 JSON 形式输出直方图
+func (h *histogram) String() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	data, _ := json.Marshal(struct {
+		Bounds []float64 `json:"bounds"`
+		Counts []int64   `json:"counts"`
+		Sum    float64   `json:"sum"`
+		Count  int64     `json:"count"`
+	}{h.bounds, h.counts, h.sum, h.count})
+	return string(data)
+}
+
+// Metrics 接收服务器记录的所有指标。未设置 Server.Metrics 时，指标同时写入 expvar
+// （以 JSON 形式暴露在 /debug/vars）与每个 Server 自己的 PrometheusMetrics（暴露在 /metrics）；
+// 嵌入方可以设置 Server.Metrics 转发到 StatsD、OpenTelemetry 等系统。实现必须可以并发调用
+type Metrics interface {
+	// Counter 增加计数器。labels 为分组指标按 metrics.labels 顺序排列的标签，未分组的指标为空
+	Counter(name string, labels []Label, delta int64)
+	// Gauge 设置仪表的当前值
+	Gauge(name string, value int64)
+	// Histogram 记录直方图的一个观测值
+	Histogram(name string, value float64)
+}
+
+// Label 分组指标的一个标签
+type Label struct {
+	Name  string
+	Value string
+}
+
+// ExpvarMetrics 写入以指标名发布的 expvar 变量，分组指标的键的格式为 {command="connect"}。
+// expvar 变量是进程级的，同一进程中的多个 Server 写入同一组变量
+type ExpvarMetrics struct{}
+
+func (ExpvarMetrics) Counter(name string, labels []Label, delta int64) {
+	switch v := expvar.Get(name).(type) {
+	case *expvar.Int:
+		v.Add(delta)
+	case *expvar.Map:
+		v.Add(formatLabels(labels, strconv.Quote), delta)
+	}
+}
+
+func (ExpvarMetrics) Gauge(name string, value int64) {
+	if v, ok := expvar.Get(name).(*expvar.Int); ok {
+		v.Set(value)
+	}
+}
+
+func (ExpvarMetrics) Histogram(name string, value float64) {
+	if h, ok := expvar.Get(name).(*histogram); ok {
+		h.observe(value)
+	}
+}
+
+// NopMetrics 丢弃所有指标
+type NopMetrics struct{}
+
+func (NopMetrics) Counter(name string, labels []Label, delta int64) {}
+func (NopMetrics) Gauge(name string, value int64)                   {}
+func (NopMetrics) Histogram(name string, value float64)             {}
+
+// multiMetrics 将指标依次写入多个实现
+type multiMetrics []Metrics
+
+func (m multiMetrics) Counter(name string, labels []Label, delta int64) {
+	for _, sink := range m {
+		sink.Counter(name, labels, delta)
+	}
+}
+
+func (m multiMetrics) Gauge(name string, value int64) {
+	for _, sink := range m {
+		sink.Gauge(name, value)
+	}
+}
+
+func (m multiMetrics) Histogram(name string, value float64) {
+	for _, sink := range m {
+		sink.Histogram(name, value)
+	}
+}
+
+// 已声明的指标的类型、按标签分组的指标与直方图的分桶上界，在包初始化时由 newCounter 等填充，之后只读
+var (
+	metricKinds     = map[string]string{}
+	labelledMetrics = map[string]bool{}
+	histogramBounds = map[string][]float64{}
+)
+
+// PrometheusMetrics 以 Prometheus 文本格式输出指标，同时实现 http.Handler。
+// 指标名加 socks5_ 前缀；已声明但尚无数据的未分组指标输出为 0，直方图的分桶与 /debug/vars 相同
+type PrometheusMetrics struct {
+	mu         sync.Mutex
+	counters   map[string]map[string]int64 // 指标名 -> 标签 -> 值
+	gauges     map[string]int64
+	histograms map[string]*histogram
+}
+
+// NewPrometheusMetrics 创建空的 Prometheus 指标
+func NewPrometheusMetrics() *PrometheusMetrics {
+	return &PrometheusMetrics{
+		counters:   make(map[string]map[string]int64),
+		gauges:     make(map[string]int64),
+		histograms: make(map[string]*histogram),
+	}
+}
+
+func (m *PrometheusMetrics) Counter(name string, labels []Label, delta int64) {
+	key := ""
+	if len(labels) > 0 {
+		key = formatLabels(labels, prometheusQuote)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	values := m.counters[name]
+	if values == nil {
+		values = make(map[string]int64)
+		m.counters[name] = values
+	}
+	values[key] += delta
+}
+
+func (m *PrometheusMetrics) Gauge(name string, value int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gauges[name] = value
+}
+
+func (m *PrometheusMetrics) Histogram(name string, value float64) {
+	m.mu.Lock()
+	h := m.histograms[name]
+	if h == nil {
+		h = newHistogramBuckets(histogramBounds[name])
+		m.histograms[name] = h
+	}
+	m.mu.Unlock()
+	h.observe(value)
+}
+
+// ServeHTTP 按指标名排序输出全部指标
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	m.mu.Lock()
+	kinds := make(map[string]string, len(metricKinds))
+	for name, kind := range metricKinds {
+		kinds[name] = kind
+	}
+	counters := make(map[string]map[string]int64, len(m.counters))
+	for name, values := range m.counters {
+		kinds[name] = "counter"
+		counters[name] = make(map[string]int64, len(values))
+		for key, v := range values {
+			counters[name][key] = v
+		}
+	}
+	gauges := make(map[string]int64, len(m.gauges))
+	for name, v := range m.gauges {
+		kinds[name] = "gauge"
+		gauges[name] = v
+	}
+	histograms := make(map[string]*histogram, len(m.histograms))
+	for name, h := range m.histograms {
+		kinds[name] = "histogram"
+		histograms[name] = h
+	}
+	m.mu.Unlock()
+
+	names := make([]string, 0, len(kinds))
+	for name := range kinds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		full := "socks5_" + name
+		fmt.Fprintf(&b, "# TYPE %s %s\n", full, kinds[name])
+		switch kinds[name] {
+		case "counter":
+			values := counters[name]
+			if len(values) == 0 {
+				if !labelledMetrics[name] {
+					fmt.Fprintf(&b, "%s 0\n", full)
+				}
+			}
+			keys := make([]string, 0, len(values))
+			for key := range values {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				fmt.Fprintf(&b, "%s%s %d\n", full, key, values[key])
+			}
+		case "gauge":
+			fmt.Fprintf(&b, "%s %d\n", full, gauges[name])
+		case "histogram":
+			bounds := histogramBounds[name]
+			counts, sum, count := make([]int64, len(bounds)+1), 0.0, int64(0)
+			if h := histograms[name]; h != nil {
+				bounds = h.bounds
+				counts, sum, count = h.snapshot()
+			}
+			var cumulative int64
+			for i, bound := range bounds {
+				cumulative += counts[i]
+				fmt.Fprintf(&b, "%s_bucket{le=\"%s\"} %d\n", full, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+			}
+			fmt.Fprintf(&b, "%s_bucket{le=\"+Inf\"} %d\n", full, count)
+			fmt.Fprintf(&b, "%s_sum %s\n", full, strconv.FormatFloat(sum, 'g', -1, 64))
+			fmt.Fprintf(&b, "%s_count %d\n", full, count)
+		}
+	}
+	io.WriteString(w, b.String())
+}
+
+// prometheusQuote 按 Prometheus 文本格式为标签值加引号，只转义反斜杠、双引号与换行
+func prometheusQuote(s string) string {
+	return `"` + prometheusEscaper.Replace(s) + `"`
+}
+
+var prometheusEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metrics 返回记录指标的实现：设置了 Server.Metrics 时使用它，
+// 否则同时写入 expvar 与本服务器的 Prometheus 指标
+func (s *Server) metrics() Metrics {
+	if s.Metrics != nil {
+		return s.Metrics
+	}
+	return s.defaultMetrics
+}
+
+// counter 计数器，以名称发布到 expvar，更新经由调用方传入的指标实现
+type counter struct{ name string }
+
+func newCounter(name string) *counter {
+	expvar.NewInt(name)
+	metricKinds[name] = "counter"
+	return &counter{name: name}
+}
+
+func (c *counter) Add(m Metrics, delta int64) {
+	m.Counter(c.name, nil, delta)
+}
+
+// counterMap 按标签分组的计数器
+type counterMap struct{ name string }
+
+func newCounterMap(name string) *counterMap {
+	expvar.NewMap(name)
+	metricKinds[name] = "counter"
+	labelledMetrics[name] = true
+	return &counterMap{name: name}
+}
+
+func (c *counterMap) Add(m Metrics, labels []Label, delta int64) {
+	m.Counter(c.name, labels, delta)
+}
+
+// gauge 记录当前值的仪表
+type gauge struct{ name string }
+
+func newGauge(name string) *gauge {
+	expvar.NewInt(name)
+	metricKinds[name] = "gauge"
+	return &gauge{name: name}
+}
+
+func (g *gauge) Set(m Metrics, value int64) {
+	m.Gauge(g.name, value)
+}
+
+// histogramMetric 直方图指标，分桶数据由各指标实现保存
+type histogramMetric struct{ name string }
+
+func (h *histogramMetric) Observe(m Metrics, v float64) {
+	m.Histogram(h.name, v)
+}
+
+// startMetricsServer 启动指标HTTP服务：/debug/vars 输出 expvar，/metrics 输出本服务器的
+// Prometheus 指标。Server.Metrics 实现了 http.Handler 时 /metrics 改由它输出
+func (s *Server) startMetricsServer(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	var prometheus http.Handler = s.prometheus
+	if h, ok := s.Metrics.(http.Handler); ok {
+		prometheus = h
+	}
+	mux.Handle("/metrics", prometheus)
+
+	// 同步绑定，地址被占用等错误由 Start 返回
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: mux}
+	s.mu.Lock()
+	s.metricsServer = srv
+	s.mu.Unlock()
+
+	log.Printf("指标服务正在监听 %s", ln.Addr())
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("指标服务退出: %v", err)
+		}
+	}()
+	return nil
+}
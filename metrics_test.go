@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingMetrics 按顺序记录所有指标调用，直方图只记录名称
+type recordingMetrics struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (m *recordingMetrics) record(call string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls = append(m.calls, call)
+}
+
+func (m *recordingMetrics) snapshot() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.calls...)
+}
+
+func (m *recordingMetrics) Counter(name string, labels []Label, delta int64) {
+	if len(labels) > 0 {
+		name += formatLabels(labels, strconv.Quote)
+	}
+	m.record(fmt.Sprintf("counter %s %d", name, delta))
+}
+
+func (m *recordingMetrics) Gauge(name string, value int64) {
+	m.record(fmt.Sprintf("gauge %s %d", name, value))
+}
+
+func (m *recordingMetrics) Histogram(name string, value float64) {
+	m.record("histogram " + name)
+}
+
+func TestMetricsForConnect(t *testing.T) {
+	echo := startEcho(t)
+	tests := []struct {
+		name   string
+		config string
+		user   string
+		want   []string
+	}{
+		{
+			name:   "默认标签",
+			config: `{}`,
+			want: []string{
+				`counter requests_total{command="connect"} 1`,
+				`histogram dial_duration_ms`,
+				`counter session_upload_bytes_total{command="connect"} 5`,
+				`counter session_download_bytes_total{command="connect"} 5`,
+			},
+		},
+		{
+			name:   "用户与出口IP标签",
+			config: `{"users": {"alice": "secret"}, "metrics": {"labels": ["command", "user", "egress_ip"]}}`,
+			user:   "alice",
+			want: []string{
+				`histogram auth_duration_ms`,
+				`counter requests_total{command="connect",user="alice"} 1`,
+				`histogram dial_duration_ms`,
+				`counter session_upload_bytes_total{command="connect",user="alice",egress_ip="127.0.0.1"} 5`,
+				`counter session_download_bytes_total{command="connect",user="alice",egress_ip="127.0.0.1"} 5`,
+			},
+		},
+		{
+			name:   "显式开启目标主机标签",
+			config: `{"metrics": {"labels": ["target_host", "command"]}}`,
+			want: []string{
+				`counter requests_total{target_host="127.0.0.1",command="connect"} 1`,
+				`histogram dial_duration_ms`,
+				`counter session_upload_bytes_total{target_host="127.0.0.1",command="connect"} 5`,
+				`counter session_download_bytes_total{target_host="127.0.0.1",command="connect"} 5`,
+			},
+		},
+		{
+			name:   "不分组",
+			config: `{"metrics": {"labels": []}}`,
+			want: []string{
+				`counter requests_total 1`,
+				`histogram dial_duration_ms`,
+				`counter session_upload_bytes_total 5`,
+				`counter session_download_bytes_total 5`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, other := &recordingMetrics{}, &recordingMetrics{}
+			// 会话结束时的调用在 OnConnectionClose 之前记录
+			closed := make(chan []string, 1)
+			s := startServer(t, testConfig(t, tt.config), func(s *Server) {
+				s.Metrics = rec
+				s.OnConnectionClose = func(ctx context.Context, info *ConnectionInfo) { closed <- rec.snapshot() }
+			})
+			// 同一进程中的另一个服务器使用自己的指标实现，不应收到任何调用
+			startServer(t, testConfig(t, tt.config), func(s *Server) { s.Metrics = other })
+
+			conn, rep, _ := connect(t, s, tt.user, "secret", CmdConnect, echo)
+			if rep != RepSuccess {
+				t.Fatalf("回复码 %#x, 期望成功", rep)
+			}
+			mustWrite(t, conn, []byte("hello"))
+			expectBytes(t, conn, []byte("hello"))
+			conn.Close()
+
+			var got []string
+			select {
+			case got = <-closed:
+			case <-time.After(5 * time.Second):
+				t.Fatal("会话未结束")
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Fatalf("指标调用:\n%s\n期望:\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+			if calls := other.snapshot(); len(calls) > 0 {
+				t.Fatalf("另一个服务器的指标实现收到了调用: %v", calls)
+			}
+		})
+	}
+}
+
+func TestPrometheusMetricsOutput(t *testing.T) {
+	m := NewPrometheusMetrics()
+	m.Counter("requests_total", []Label{{Name: "command", Value: "connect"}, {Name: "user", Value: "a\"b\\c\n"}}, 2)
+	m.Counter("requests_total", []Label{{Name: "command", Value: "connect"}, {Name: "user", Value: "a\"b\\c\n"}}, 1)
+	m.Counter("slow_dials_total", nil, 4)
+	m.Gauge("health_probe_up", 1)
+	m.Histogram("dial_duration_ms", 7)
+	m.Histogram("dial_duration_ms", 30000)
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("Content-Type 为 %q", ct)
+	}
+	lines := map[string]bool{}
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		lines[line] = true
+	}
+
+	tests := []struct {
+		line string
+		want bool
+	}{
+		{`# TYPE socks5_requests_total counter`, true},
+		{`socks5_requests_total{command="connect",user="a\"b\\c\n"} 3`, true},
+		{`socks5_slow_dials_total 4`, true},
+		// 已声明但尚无数据的未分组指标输出为 0，分组指标只输出类型
+		{`socks5_requests_denied_total 0`, true},
+		{`# TYPE socks5_session_upload_bytes_total counter`, true},
+		{`socks5_session_upload_bytes_total 0`, false},
+		{`# TYPE socks5_health_probe_up gauge`, true},
+		{`socks5_health_probe_up 1`, true},
+		// 直方图的桶是累积的
+		{`# TYPE socks5_dial_duration_ms histogram`, true},
+		{`socks5_dial_duration_ms_bucket{le="5"} 0`, true},
+		{`socks5_dial_duration_ms_bucket{le="10"} 1`, true},
+		{`socks5_dial_duration_ms_bucket{le="10000"} 1`, true},
+		{`socks5_dial_duration_ms_bucket{le="+Inf"} 2`, true},
+		{`socks5_dial_duration_ms_sum 30007`, true},
+		{`socks5_dial_duration_ms_count 2`, true},
+		{`socks5_auth_duration_ms_bucket{le="+Inf"} 0`, true},
+		{`socks5_auth_duration_ms_count 0`, true},
+	}
+	for _, tt := range tests {
+		if lines[tt.line] != tt.want {
+			t.Errorf("输出中包含 %q 为 %v, 期望 %v", tt.line, lines[tt.line], tt.want)
+		}
+	}
+	if t.Failed() {
+		t.Logf("输出:\n%s", rec.Body.String())
+	}
+}
+
+// fetchMetrics 读取指标服务的 /metrics，服务尚未监听时重试
+func fetchMetrics(t *testing.T, addr string) string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := http.Get("http://" + addr + "/metrics")
+		if err == nil {
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			return string(body)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("读取 %s 的指标失败: %v", addr, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPrometheusMetricsPerServer(t *testing.T) {
+	echo := startEcho(t)
+	addrA, addrB := freeAddr(t), freeAddr(t)
+	a := startServer(t, testConfig(t, `{"metrics": {"address": "`+addrA+`"}}`))
+	startServer(t, testConfig(t, `{"metrics": {"address": "`+addrB+`"}}`))
+
+	conn, rep, _ := connect(t, a, "", "", CmdConnect, echo)
+	if rep != RepSuccess {
+		t.Fatalf("回复码 %#x, 期望成功", rep)
+	}
+	conn.Close()
+
+	want := `socks5_requests_total{command="connect"} 1`
+	if body := fetchMetrics(t, addrA); !strings.Contains(body, want) {
+		t.Fatalf("服务器 A 的 /metrics 缺少 %q:\n%s", want, body)
+	}
+	if body := fetchMetrics(t, addrB); strings.Contains(body, "socks5_requests_total{") {
+		t.Fatalf("服务器 B 的 /metrics 包含了服务器 A 的请求:\n%s", body)
+	}
+}
+
+func TestMetricsServerLifecycle(t *testing.T) {
+	tests := []struct {
+		name string
+		busy bool // 指标地址已被占用
+	}{
+		{"地址被占用", true},
+		{"停止后重新绑定", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := freeAddr(t)
+			cfg := testConfig(t, `{"metrics": {"address": "`+addr+`"}}`)
+			if tt.busy {
+				ln, err := net.Listen("tcp", addr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer ln.Close()
+				s := NewServer(cfg)
+				if err := s.Start(); err == nil || !strings.Contains(err.Error(), "启动指标服务失败") {
+					t.Fatalf("Start 返回 %v, 期望指标服务绑定失败", err)
+				}
+				return
+			}
+
+			// 同一进程内先后启动、停止两个服务器，第二个应能绑定同一指标地址
+			for i := 0; i < 2; i++ {
+				s := NewServer(cfg)
+				if err := s.Listen(); err != nil {
+					t.Fatal(err)
+				}
+				done := make(chan error, 1)
+				go func() { done <- s.Start() }()
+				fetchMetrics(t, addr)
+				s.Stop()
+				select {
+				case err := <-done:
+					if err != nil {
+						t.Fatalf("第 %d 次 Start 返回 %v", i+1, err)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("Stop 后 Start 未返回")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MITMConfig TLS 中间人检查配置，仅用于明确授权的企业流量检查
+type MITMConfig struct {
+	// 是否启用
+	Enable bool `json:"enable"`
+	// 签发动态证书的CA证书文件，客户端需信任该CA
+	CACertFile string `json:"ca_cert_file"`
+	// CA私钥文件
+	CAKeyFile string `json:"ca_key_file"`
+	// 允许解密的 SNI 主机名（域名，匹配该域名及其子域名），不能为空
+	Hosts []string `json:"hosts"`
+	// 检查的目标端口，默认只检查443
+	Ports []int `json:"ports"`
+}
+
+const (
+	// mitmCertValidity 动态签发证书的有效期
+	mitmCertValidity = 7 * 24 * time.Hour
+	// mitmCertCacheSize 证书缓存上限，超过时清空重建
+	mitmCertCacheSize = 1024
+	// mitmPeekTimeout 等待客户端发送首个字节的时间，超时视为服务器先发言的协议，原样转发
+	mitmPeekTimeout = 3 * time.Second
+)
+
+// errMITMSkip 连接的 SNI 不在允许列表中，不进行解密
+var errMITMSkip = errors.New("SNI不在中间人检查允许列表中")
+
+// mitm 按 SNI 动态签发证书并解密命中允许列表的 TLS 连接
+type mitm struct {
+	caCert *x509.Certificate
+	caDER  []byte
+	caKey  any
+	key    *ecdsa.PrivateKey // 所有动态证书共用的私钥
+	hosts  hostList
+	ports  map[int]bool
+	roots  *x509.CertPool // 校验源站证书的根证书，nil 表示使用系统根证书
+
+	mu    sync.Mutex
+	certs map[string]*tls.Certificate // SNI -> 动态证书
+}
+
+// newMITM 加载CA并创建中间人检查器
+func newMITM(c MITMConfig) (*mitm, error) {
+	ca, err := tls.LoadX509KeyPair(c.CACertFile, c.CAKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("加载中间人检查CA失败: %w", err)
+	}
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("解析中间人检查CA失败: %w", err)
+	}
+	if !caCert.IsCA {
+		return nil, fmt.Errorf("证书 %s 不是CA证书", c.CACertFile)
+	}
+	if len(c.Hosts) == 0 {
+		return nil, fmt.Errorf("中间人检查必须配置 hosts 允许列表")
+	}
+	for _, h := range c.Hosts {
+		if net.ParseIP(h) != nil || strings.Contains(h, "/") {
+			return nil, fmt.Errorf("中间人检查的 hosts 只能是域名: %s", h)
+		}
+	}
+	hosts, err := newHostList(c.Hosts)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("生成证书私钥失败: %w", err)
+	}
+
+	m := &mitm{
+		caCert: caCert,
+		caDER:  ca.Certificate[0],
+		caKey:  ca.PrivateKey,
+		key:    key,
+		hosts:  hosts,
+		ports:  map[int]bool{},
+		certs:  make(map[string]*tls.Certificate),
+	}
+	ports := c.Ports
+	if len(ports) == 0 {
+		ports = []int{443}
+	}
+	for _, p := range ports {
+		m.ports[p] = true
+	}
+	return m, nil
+}
+
+// matchesPort 判断目标端口是否需要检查
+func (m *mitm) matchesPort(target string) bool {
+	_, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return false
+	}
+	port, _ := strconv.Atoi(portStr)
+	return m.ports[port]
+}
+
+// intercept 尝试解密客户端连接：SNI 命中允许列表时以动态证书与客户端完成握手，
+// 并以客户端提供的 SNI 和 ALPN 与源站重新建立经过校验的 TLS 连接，返回两端的明文连接。
+// 不是TLS、没有 SNI 或未命中允许列表时回放已读取的字节，返回可原样转发的连接
+func (m *mitm) intercept(ctx context.Context, conn, dest net.Conn) (net.Conn, net.Conn, string, error) {
+	// 客户端先发送 TLS 握手记录时才尝试解密，服务器先发言的协议不等待
+	bc := &bufferedConn{Conn: conn, r: bufio.NewReader(conn)}
+	conn.SetReadDeadline(time.Now().Add(mitmPeekTimeout))
+	first, err := bc.r.Peek(1)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil, nil, "", err
+	}
+	if err != nil || first[0] != 0x16 {
+		return bc, dest, "", nil
+	}
+
+	rc := &recordingConn{Conn: bc}
+	var origin *tls.Conn
+	var sni string
+	server := tls.Server(rc, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni = hello.ServerName
+			if sni == "" || !m.hosts.contains(sni) {
+				return nil, errMITMSkip
+			}
+			rc.commit()
+
+			origin = tls.Client(dest, &tls.Config{
+				ServerName: sni,
+				RootCAs:    m.roots,
+				NextProtos: hello.SupportedProtos,
+				MinVersion: tls.VersionTLS12,
+			})
+			if err := origin.HandshakeContext(ctx); err != nil {
+				return nil, fmt.Errorf("与源站 %s 的TLS握手失败: %w", sni, err)
+			}
+			cert, err := m.certFor(sni)
+			if err != nil {
+				return nil, err
+			}
+			cfg := &tls.Config{
+				Certificates: []tls.Certificate{*cert},
+				MinVersion:   tls.VersionTLS12,
+			}
+			if proto := origin.ConnectionState().NegotiatedProtocol; proto != "" {
+				cfg.NextProtos = []string{proto}
+			}
+			return cfg, nil
+		},
+	})
+
+	err = server.HandshakeContext(ctx)
+	if !rc.committed {
+		// 未决定解密前发给客户端的数据（如告警）均已丢弃，回放已读取的字节后原样转发。
+		// 预先把已读取的字节装入缓冲区，使 unwrapConn 不会跳过回放直接使用底层连接
+		replay := bufio.NewReaderSize(io.MultiReader(bytes.NewReader(rc.recorded), bc), max(len(rc.recorded), 4096))
+		if _, err := replay.Peek(len(rc.recorded)); err != nil {
+			return nil, nil, sni, err
+		}
+		return &bufferedConn{Conn: conn, r: replay}, dest, sni, nil
+	}
+	if err != nil {
+		return nil, nil, sni, err
+	}
+	return server, origin, sni, nil
+}
+
+// certFor 返回为 host 签发的证书，缓存中没有或即将过期时重新签发
+func (m *mitm) certFor(host string) (*tls.Certificate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if cert, ok := m.certs[host]; ok && now.Before(cert.Leaf.NotAfter.Add(-time.Hour)) {
+		return cert, nil
+	}
+	if len(m.certs) >= mitmCertCacheSize {
+		clear(m.certs)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(mitmCertValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if tmpl.NotAfter.After(m.caCert.NotAfter) {
+		tmpl.NotAfter = m.caCert.NotAfter
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, m.caCert, &m.key.PublicKey, m.caKey)
+	if err != nil {
+		return nil, fmt.Errorf("为 %s 签发证书失败: %w", host, err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	cert := &tls.Certificate{
+		Certificate: [][]byte{der, m.caDER},
+		PrivateKey:  m.key,
+		Leaf:        leaf,
+	}
+	m.certs[host] = cert
+	return cert, nil
+}
+
+// recordingConn 在决定是否解密前记录读取的字节并丢弃写入，
+// 使未命中允许列表的连接可以回放 ClientHello 后原样转发
+type recordingConn struct {
+	net.Conn
+	recorded  []byte
+	committed bool
+}
+
+func (c *recordingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if !c.committed {
+		c.recorded = append(c.recorded, p[:n]...)
+	}
+	return n, err
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	if !c.committed {
+		return len(p), nil
+	}
+	return c.Conn.Write(p)
+}
+
+// commit 确定解密连接，此后不再记录读取且写入发往客户端
+func (c *recordingConn) commit() {
+	c.committed = true
+	c.recorded = nil
+}
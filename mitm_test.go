@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestMITM(t *testing.T) {
+	echo := startEcho(t)
+	mitmCA := newTestCert(t, "MITM CA", nil)
+	originCA := newTestCert(t, "Origin CA", nil)
+
+	// 源站是只为 origin.test 持有证书的 HTTPS 服务
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "来自源站 "+r.Host)
+	}))
+	origin.TLS = &tls.Config{Certificates: []tls.Certificate{newTestCert(t, "origin.test", originCA).tlsCertificate()}}
+	origin.StartTLS()
+	defer origin.Close()
+	originAddr := origin.Listener.Addr().String()
+
+	const inspected, other = 8443, 9443
+	caFile, keyFile := mitmCA.files(t)
+	logs := captureLog(t)
+	s := startServer(t, testConfig(t, `{"mitm": {
+		"enable": true,
+		"ca_cert_file": "`+caFile+`",
+		"ca_key_file": "`+keyFile+`",
+		"hosts": ["origin.test"],
+		"ports": [`+strconv.Itoa(inspected)+`]
+	}}`), func(s *Server) {
+		roots := x509.NewCertPool()
+		roots.AddCert(originCA.cert)
+		s.mitm.roots = roots
+		// plain.test 指向回显服务，其余目标都指向源站
+		s.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+			target := originAddr
+			if host, _, _ := net.SplitHostPort(address); host == "plain.test" {
+				target = echo
+			}
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", target)
+		}
+	})
+
+	tests := []struct {
+		name   string
+		target string
+		sni    string // 为空表示发送明文
+		issuer string // 客户端看到的证书签发者
+	}{
+		{"解密允许的主机", "origin.test:" + strconv.Itoa(inspected), "origin.test", "MITM CA"},
+		{"未允许的主机原样转发", "other.test:" + strconv.Itoa(inspected), "other.test", "Origin CA"},
+		{"未检查的端口原样转发", "origin.test:" + strconv.Itoa(other), "origin.test", "Origin CA"},
+		{"非TLS流量原样转发", "plain.test:" + strconv.Itoa(inspected), "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, rep, _ := connect(t, s, "", "", CmdConnect, tt.target)
+			if rep != RepSuccess {
+				t.Fatalf("回复码 %#x", rep)
+			}
+			if tt.sni == "" {
+				mustWrite(t, conn, []byte("ping"))
+				expectBytes(t, conn, []byte("ping"))
+				return
+			}
+
+			// 客户端只信任中间人CA，原样转发的连接不校验证书，只检查签发者
+			pool := x509.NewCertPool()
+			pool.AddCert(mitmCA.cert)
+			tc := tls.Client(conn, &tls.Config{ServerName: tt.sni, RootCAs: pool, InsecureSkipVerify: tt.issuer != "MITM CA"})
+			if err := tc.Handshake(); err != nil {
+				t.Fatalf("TLS握手失败: %v", err)
+			}
+			cert := tc.ConnectionState().PeerCertificates[0]
+			if cert.Issuer.CommonName != tt.issuer {
+				t.Fatalf("证书签发者为 %q, 期望 %q", cert.Issuer.CommonName, tt.issuer)
+			}
+			if tt.issuer == "MITM CA" && (cert.Subject.CommonName != tt.sni || len(cert.DNSNames) != 1 || cert.DNSNames[0] != tt.sni) {
+				t.Fatalf("动态证书主体为 %q %v, 期望 %s", cert.Subject.CommonName, cert.DNSNames, tt.sni)
+			}
+
+			io.WriteString(tc, "GET / HTTP/1.1\r\nHost: "+tt.sni+"\r\nConnection: close\r\n\r\n")
+			resp, err := http.ReadResponse(bufio.NewReader(tc), nil)
+			if err != nil {
+				t.Fatalf("读取响应失败: %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			if want := "来自源站 " + tt.sni; string(body) != want {
+				t.Fatalf("响应为 %q, 期望 %q", body, want)
+			}
+			if tt.issuer == "MITM CA" {
+				waitLog(t, logs, "TLS中间人检查: 解密到 "+tt.target)
+			}
+		})
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+)
+
+// PolicyConfig 命名的策略包，包含用户、上游、路由与访问规则。
+// 监听器通过 policy 字段引用，取代顶层的对应配置
+type PolicyConfig struct {
+	// 认证用户列表
+	Users map[string]UserConfig `json:"users"`
+	// htpasswd 格式的用户文件路径
+	UsersFile string `json:"users_file"`
+	// 上游代理列表，key为上游名称
+	Upstreams map[string]UpstreamConfig `json:"upstreams"`
+	// 静态路由规则
+	Routes []RouteConfig `json:"routes"`
+	// 默认拒绝模式
+	DefaultDeny bool `json:"default_deny"`
+	// 默认拒绝模式下所有用户都允许访问的目标
+	Allow []string `json:"allow"`
+}
+
+// hasUsers 判断策略包是否配置了用户（内联 users 或 users_file）
+func (c PolicyConfig) hasUsers() bool {
+	return len(c.Users) > 0 || c.UsersFile != ""
+}
+
+// validate 校验策略包中的上游、路由、允许列表以及用户引用的用户组
+func (c PolicyConfig) validate(groups map[string]GroupConfig) error {
+	for name, upstream := range c.Upstreams {
+		if err := validateUpstream(name, upstream); err != nil {
+			return err
+		}
+	}
+	if _, err := newRouter(c.Routes, c.Upstreams); err != nil {
+		return err
+	}
+	if _, err := newHostList(c.Allow); err != nil {
+		return err
+	}
+	for name, user := range c.Users {
+		if _, err := newHostList(user.Allow); err != nil {
+			return fmt.Errorf("用户 %s 的%w", name, err)
+		}
+		if _, ok := groups[user.Group]; user.Group != "" && !ok {
+			return fmt.Errorf("用户 %s 引用的用户组 %s 不存在", name, user.Group)
+		}
+		if user.MaxConnections < 0 || user.Bandwidth < 0 {
+			return fmt.Errorf("用户 %s 的 max_connections 与 bandwidth 不能为负数", name)
+		}
+	}
+	return nil
+}
+
+// policy 可通过 SIGHUP 热加载的访问策略快照。
+// 每次重新加载都会创建新的快照并原子替换，已建立的连接不受影响。
+type policy struct {
+	users       map[string]UserConfig     // username -> user config
+	upstreams   map[string]UpstreamConfig // 上游代理
+	router      *router                   // 静态路由表
+	defaultDeny bool                      // 默认拒绝模式
+	allow       hostList                  // 所有用户允许访问的目标
+	userAllow   map[string]hostList       // 各用户额外允许访问的目标
+	groups      map[string]GroupConfig    // 用户组，所有策略包共用顶层配置
+	named       map[string]*policy        // 命名的策略包，仅顶层快照使用
+}
+
+// denyAllPolicy 监听器引用的策略包不存在时使用的策略：没有用户且拒绝所有目标
+var denyAllPolicy = &policy{router: &router{}, defaultDeny: true}
+
+// newPolicy 根据配置创建顶层策略快照及其命名的策略包
+func newPolicy(config *Config) (*policy, error) {
+	p, err := newPolicyBundle(config.topPolicy())
+	if err != nil {
+		return nil, err
+	}
+	p.groups = config.Groups
+	p.named = make(map[string]*policy, len(config.Policies))
+	for name, pc := range config.Policies {
+		if p.named[name], err = newPolicyBundle(pc); err != nil {
+			return nil, fmt.Errorf("策略 %s: %w", name, err)
+		}
+		p.named[name].groups = config.Groups
+	}
+	return p, nil
+}
+
+// newPolicyBundle 根据一组用户与访问规则配置创建策略
+func newPolicyBundle(config PolicyConfig) (*policy, error) {
+	rt, err := newRouter(config.Routes, config.Upstreams)
+	if err != nil {
+		return nil, err
+	}
+
+	// 合并 users_file 中的用户，同名时以内联 users 为准
+	users := config.Users
+	if config.UsersFile != "" {
+		hashes, err := loadHtpasswd(config.UsersFile)
+		if err != nil {
+			return nil, fmt.Errorf("加载 users_file 失败: %w", err)
+		}
+		users = make(map[string]UserConfig, len(hashes)+len(config.Users))
+		for name, hash := range hashes {
+			users[name] = UserConfig{hash: hash}
+		}
+		for name, user := range config.Users {
+			users[name] = user
+		}
+	}
+
+	allow, err := newHostList(config.Allow)
+	if err != nil {
+		return nil, err
+	}
+	userAllow := make(map[string]hostList)
+	for name, user := range users {
+		if len(user.Allow) == 0 {
+			continue
+		}
+		if userAllow[name], err = newHostList(user.Allow); err != nil {
+			return nil, fmt.Errorf("用户 %s 的%w", name, err)
+		}
+	}
+
+	return &policy{
+		users:       users,
+		upstreams:   config.Upstreams,
+		router:      rt,
+		defaultDeny: config.DefaultDeny,
+		allow:       allow,
+		userAllow:   userAllow,
+	}, nil
+}
+
+type policyNameKey struct{}
+
+// withPolicyName 将连接所在监听器引用的策略包名称保存到 context 中
+func withPolicyName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, policyNameKey{}, name)
+}
+
+// policyFor 返回连接适用的策略：监听器引用了策略包时为该策略包，否则为顶层策略。
+// 引用的策略包在重新加载后不存在时拒绝所有请求
+func (s *Server) policyFor(ctx context.Context) *policy {
+	p := s.settings.Load().policy
+	name, _ := ctx.Value(policyNameKey{}).(string)
+	if name == "" {
+		return p
+	}
+	if named, ok := p.named[name]; ok {
+		return named
+	}
+	return denyAllPolicy
+}
+
+// allows 判断默认拒绝模式下用户是否可以访问目标主机，未启用该模式时总是允许
+func (p *policy) allows(username, host string) bool {
+	if !p.defaultDeny {
+		return true
+	}
+	return p.allow.contains(host) || p.userAllow[username].contains(host)
+}
+
+// shareLimits 返回用户自身及其所属用户组的连接数与带宽上限，都未限制时返回 nil。
+// logName 为用于错误信息的用户名
+func (p *policy) shareLimits(username, logName string) []shareLimit {
+	user, ok := p.users[username]
+	if !ok {
+		return nil
+	}
+	var limits []shareLimit
+	if user.MaxConnections > 0 || user.Bandwidth > 0 {
+		limits = append(limits, shareLimit{
+			name:           "用户 " + logName,
+			key:            "user:" + username,
+			maxConnections: user.MaxConnections,
+			bandwidth:      user.Bandwidth,
+		})
+	}
+	if g, ok := p.groups[user.Group]; ok && (g.MaxConnections > 0 || g.Bandwidth > 0) {
+		limits = append(limits, shareLimit{
+			name:           "用户组 " + user.Group,
+			key:            "group:" + user.Group,
+			maxConnections: g.MaxConnections,
+			bandwidth:      g.Bandwidth,
+		})
+	}
+	return limits
+}
+
+// settings 可热加载的配置快照：配置、访问策略以及由配置派生的字段。
+// 重新加载时整体替换，连接读取到的配置与策略总是来自同一份配置文件
+type settings struct {
+	config       *Config
+	policy       *policy
+	advertisedIP net.IP        // CONNECT 回复中通告的IP
+	outboundIP   net.IP        // 出站连接的源IP
+	specialUse   []*net.IPNet  // public_targets_only 拒绝的特殊用途地址段
+	egress       *egressPicker // 多出口IP选择器
+}
+
+// newSettings 根据配置构建访问策略与派生字段，配置无效时返回错误
+func newSettings(config *Config) (*settings, error) {
+	p, err := newPolicy(config)
+	if err != nil {
+		return nil, err
+	}
+	st := &settings{config: config, policy: p}
+	if err := st.derive(); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// derive 根据配置设置派生字段，出口IP配置无效时返回错误，其他字段仍会设置
+func (st *settings) derive() error {
+	config := st.config
+	if config.AdvertisedAddress != "" {
+		st.advertisedIP = net.ParseIP(config.AdvertisedAddress)
+	}
+	if config.OutboundIP != "" {
+		st.outboundIP = net.ParseIP(config.OutboundIP)
+	}
+	st.specialUse, _ = parseCIDRs(config.SpecialUseRanges)
+	if len(config.OutboundIPs) > 0 {
+		egress, err := newEgressPicker(config.OutboundIPs)
+		if err != nil {
+			return err
+		}
+		st.egress = egress
+	}
+	return nil
+}
+
+// cfg 返回当前生效的配置
+func (s *Server) cfg() *Config {
+	return s.settings.Load().config
+}
+
+// Reload 使用新的配置替换访问策略以及超时、访问限制、日志等按连接读取的设置，
+// 新连接立即使用新的设置。接入速率限制就地调整速率与容量，已有的令牌不会重新装满。
+// 监听地址、TLS 等需要重新绑定监听器的设置由 ReloadConfig 处理；启动时创建状态的设置
+// （UDP、握手名额、每目标连接数、webhook、TLS中间人检查、指标服务）需要重启才能生效。
+func (s *Server) Reload(config *Config) error {
+	st, err := newSettings(config)
+	if err != nil {
+		return err
+	}
+
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	s.settings.Store(st)
+	s.resizeAcceptLimiter(config)
+	s.logReload(st)
+	return nil
+}
+
+// ReloadConfig 按新的配置重新加载设置并重新绑定监听器。先构建并校验访问策略，
+// 与配置一起替换后再绑定监听器，新监听器接受的第一个连接即可使用新的策略；
+// 绑定失败时恢复原来的设置，旧的监听器继续服务。
+func (s *Server) ReloadConfig(config *Config) error {
+	st, err := newSettings(config)
+	if err != nil {
+		return err
+	}
+
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	old := s.settings.Swap(st)
+	if err := s.ReloadListeners(config); err != nil {
+		s.settings.Store(old)
+		return fmt.Errorf("重新绑定监听器失败, 已恢复原来的配置: %w", err)
+	}
+	s.resizeAcceptLimiter(config)
+	s.logReload(st)
+	return nil
+}
+
+// resizeAcceptLimiter 按新的配置调整接入速率限制
+func (s *Server) resizeAcceptLimiter(config *Config) {
+	s.acceptLimiter.resize(config.AcceptRate.Global, config.AcceptRate.PerIP, config.AcceptRate.Burst)
+}
+
+// logReload 记录重新加载的结果，监听器引用的策略包不存在时提示
+func (s *Server) logReload(st *settings) {
+	p := st.policy
+	log.Printf("配置已重新加载: %d 个用户, %d 条路由规则, %d 个策略包", len(p.users), len(p.router.routes), len(p.named))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, l := range s.listeners {
+		if _, ok := p.named[l.policy]; l.policy != "" && !ok {
+			log.Printf("警告: 监听器 %s 引用的策略 %s 不存在, 该监听器将拒绝所有请求", l.addr, l.policy)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// authFailed 为 tryConnect 在认证失败时返回的值
+const authFailed = 0xFF
+
+// tryConnect 以 username（密码为 secret）认证后请求 CONNECT target，返回回复码，认证失败时返回 authFailed
+func tryConnect(t *testing.T, s *Server, username, target string) (net.Conn, uint8) {
+	t.Helper()
+	return tryConnectAddr(t, s.Addr().String(), username, target)
+}
+
+// tryConnectAddr 同 tryConnect，连接 addr 上的监听器
+func tryConnectAddr(t *testing.T, addr, username, target string) (net.Conn, uint8) {
+	t.Helper()
+	conn := dialAddr(t, addr)
+	if username != "" {
+		mustWrite(t, conn, []byte{Version5, 1, MethodUserPass})
+		expectBytes(t, conn, []byte{Version5, MethodUserPass})
+		mustWrite(t, conn, userPassAuth(username, "secret"))
+		status := make([]byte, 2)
+		if _, err := conn.Read(status); err != nil || status[1] != AuthUserPassSuccess {
+			return conn, authFailed
+		}
+	} else {
+		greet(t, conn, "", "")
+	}
+	host, port, _ := net.SplitHostPort(target)
+	p, _ := strconv.Atoi(port)
+	mustWrite(t, conn, requestBytes(CmdConnect, host, uint16(p)))
+	rep, _ := readReply(t, conn)
+	return conn, rep
+}
+
+func TestReloadPolicy(t *testing.T) {
+	echo := startEcho(t)
+	tests := []struct {
+		name    string
+		before  string
+		after   string
+		user    string // 重新加载前建立会话以及之后再次连接的用户
+		wantErr bool
+		rep     uint8 // 重新加载后新连接的回复码
+	}{
+		{
+			name:   "收紧路由规则",
+			before: `{}`,
+			after:  `{"routes": [{"match": "127.0.0.0/8", "via": "block"}]}`,
+			rep:    RepConnectionNotAllowed,
+		},
+		{
+			name:   "启用默认拒绝",
+			before: `{"users": {"alice": "secret"}}`,
+			after:  `{"users": {"alice": "secret"}, "default_deny": true, "allow": ["example.com"]}`,
+			user:   "alice",
+			rep:    RepConnectionNotAllowed,
+		},
+		{
+			name:   "删除用户",
+			before: `{"users": {"alice": "secret", "bob": "secret"}}`,
+			after:  `{"users": {"bob": "secret"}}`,
+			user:   "alice",
+			rep:    authFailed,
+		},
+		{
+			// 已有会话仍计入用户的连接数，调低上限后新连接立即被拒绝
+			name:   "调低连接数上限",
+			before: `{"users": {"alice": {"password": "secret", "max_connections": 2}}}`,
+			after:  `{"users": {"alice": {"password": "secret", "max_connections": 1}}}`,
+			user:   "alice",
+			rep:    RepServerFailure,
+		},
+		{
+			name:    "无效配置保留原策略",
+			before:  `{}`,
+			after:   `{"routes": [{"match": "127.0.0.0/8", "via": "missing"}]}`,
+			wantErr: true,
+			rep:     RepSuccess,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startServer(t, testConfig(t, tt.before))
+			existing, rep := tryConnect(t, s, tt.user, echo)
+			if rep != RepSuccess {
+				t.Fatalf("重新加载前回复码 %#x", rep)
+			}
+
+			cfg, err := parseConfig([]byte(tt.after))
+			if err == nil {
+				err = s.Reload(cfg)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("重新加载出错 %v, 期望出错 %v", err, tt.wantErr)
+			}
+
+			if _, rep := tryConnect(t, s, tt.user, echo); rep != tt.rep {
+				t.Fatalf("重新加载后回复码 %#x, 期望 %#x", rep, tt.rep)
+			}
+			// 已建立的会话不受影响
+			mustWrite(t, existing, []byte("ping"))
+			expectBytes(t, existing, []byte("ping"))
+		})
+	}
+}
+
+func TestDefaultDenyAllowLists(t *testing.T) {
+	echo := startEcho(t)
+	s := startServer(t, testConfig(t, `{
+		"users": {
+			"alice": {"password": "secret", "allow": ["alice.test", "198.51.100.0/24"]},
+			"bob": {"password": "secret", "allow": ["bob.test"]}
+		},
+		"default_deny": true,
+		"allow": ["shared.test"],
+		"routes": [{"match": "blocked.alice.test", "via": "block"}]
+	}`), func(s *Server) {
+		// 所有允许的目标都转发到回显服务
+		s.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", echo)
+		}
+	})
+
+	tests := []struct {
+		user   string
+		target string
+		rep    uint8
+	}{
+		{"alice", "alice.test:80", RepSuccess},
+		{"alice", "www.alice.test:443", RepSuccess},
+		{"alice", "198.51.100.9:80", RepSuccess},
+		{"alice", "shared.test:80", RepSuccess},
+		{"alice", "bob.test:80", RepConnectionNotAllowed},
+		{"alice", "198.51.101.9:80", RepConnectionNotAllowed},
+		{"alice", "example.com:80", RepConnectionNotAllowed},
+		// 全局路由规则的拒绝优先于用户的允许列表
+		{"alice", "blocked.alice.test:80", RepConnectionNotAllowed},
+		{"bob", "bob.test:80", RepSuccess},
+		{"bob", "shared.test:80", RepSuccess},
+		{"bob", "alice.test:80", RepConnectionNotAllowed},
+		{"bob", "198.51.100.9:80", RepConnectionNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.user+"/"+tt.target, func(t *testing.T) {
+			conn, rep := tryConnect(t, s, tt.user, tt.target)
+			if rep != tt.rep {
+				t.Fatalf("回复码 %#x, 期望 %#x", rep, tt.rep)
+			}
+			if rep != RepSuccess {
+				expectClosed(t, conn)
+				return
+			}
+			mustWrite(t, conn, []byte("ping"))
+			expectBytes(t, conn, []byte("ping"))
+		})
+	}
+
+	// 默认拒绝模式下不允许 UDP 转发
+	conn := dialServer(t, s)
+	greet(t, conn, "alice", "secret")
+	mustWrite(t, conn, requestBytes(CmdUDPAssociate, "0.0.0.0", 0))
+	if rep, _ := readReply(t, conn); rep != RepConnectionNotAllowed {
+		t.Fatalf("UDP ASSOCIATE 回复码 %#x, 期望 %#x", rep, RepConnectionNotAllowed)
+	}
+}
+
+func TestListenerPolicies(t *testing.T) {
+	echo := startEcho(t)
+	proxy, requests := startHTTPProxy(t, http.StatusOK, echo, "")
+	open, strict, blocked, chained := freeAddr(t), freeAddr(t), freeAddr(t), freeAddr(t)
+	startServer(t, testConfig(t, `{
+		"users": {"alice": "secret"},
+		"policies": {
+			"strict": {"default_deny": true, "allow": ["192.0.2.0/24"]},
+			"blocked": {"users": {"bob": "secret"}, "routes": [{"match": "127.0.0.0/8", "via": "block"}]},
+			"chained": {
+				"upstreams": {"up": {"type": "http-connect", "address": "`+proxy+`"}},
+				"routes": [{"match": "127.0.0.0/8", "via": "up"}]
+			}
+		},
+		"listeners": [
+			{"address": "`+open+`", "auth": true},
+			{"address": "`+strict+`", "policy": "strict"},
+			{"address": "`+blocked+`", "auth": true, "policy": "blocked"},
+			{"address": "`+chained+`", "policy": "chained"}
+		]
+	}`))
+
+	// 同一目标按客户端连接的监听器使用不同的策略
+	tests := []struct {
+		name     string
+		addr     string
+		user     string
+		rep      uint8
+		upstream bool // 是否经上游代理连接
+	}{
+		{"顶层策略", open, "alice", RepSuccess, false},
+		{"默认拒绝的策略包", strict, "", RepConnectionNotAllowed, false},
+		{"策略包中的用户与路由", blocked, "bob", RepConnectionNotAllowed, false},
+		{"顶层用户不属于策略包", blocked, "alice", authFailed, false},
+		{"策略包中的用户不属于顶层", open, "bob", authFailed, false},
+		{"策略包中的上游", chained, "", RepSuccess, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, rep := tryConnectAddr(t, tt.addr, tt.user, echo)
+			if rep != tt.rep {
+				t.Fatalf("回复码 %#x, 期望 %#x", rep, tt.rep)
+			}
+			if rep != RepSuccess {
+				return
+			}
+			mustWrite(t, conn, []byte("ping"))
+			expectBytes(t, conn, []byte("ping"))
+			select {
+			case req := <-requests:
+				if !tt.upstream {
+					t.Fatalf("顶层策略的连接经过了上游: %s", req.Host)
+				}
+				if req.Host != echo {
+					t.Fatalf("上游收到 CONNECT %s, 期望 %s", req.Host, echo)
+				}
+			default:
+				if tt.upstream {
+					t.Fatal("策略包的路由未使用上游")
+				}
+			}
+		})
+	}
+
+	if _, err := parseConfig([]byte(`{"listeners": [{"address": "127.0.0.1:0", "policy": "missing"}]}`)); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Fatalf("引用不存在的策略包时错误为 %v", err)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// defaultPoolIdleTimeout 空闲隧道默认保留时间
+const defaultPoolIdleTimeout = 30 * time.Second
+
+// poolDialTimeout 后台预建隧道的超时时间
+const poolDialTimeout = 10 * time.Second
+
+// tunnelPool 缓存预先建立、尚未使用的 HTTP CONNECT 隧道，按上游与目标分组。
+// CONNECT 隧道一旦承载过会话就与目标的连接状态绑定，不能再次使用，
+// 因此池中只保存在后台为同一目标预先建立的隧道，每条隧道只交付一次
+type tunnelPool struct {
+	mu      sync.Mutex
+	idle    map[string][]*pooledTunnel
+	pending map[string]int // 正在后台建立的隧道数
+	closed  bool           // 服务器已停止，之后建立完成的隧道直接关闭
+}
+
+type pooledTunnel struct {
+	conn  net.Conn
+	timer *time.Timer // 空闲超时后关闭隧道
+}
+
+func newTunnelPool() *tunnelPool {
+	return &tunnelPool{
+		idle:    make(map[string][]*pooledTunnel),
+		pending: make(map[string]int),
+	}
+}
+
+// get 取出一条仍然可用的空闲隧道，没有时返回 nil
+func (p *tunnelPool) get(key string) net.Conn {
+	for {
+		p.mu.Lock()
+		tunnels := p.idle[key]
+		if len(tunnels) == 0 {
+			p.mu.Unlock()
+			return nil
+		}
+		t := tunnels[len(tunnels)-1]
+		p.idle[key] = tunnels[:len(tunnels)-1]
+		if len(p.idle[key]) == 0 {
+			delete(p.idle, key)
+		}
+		p.mu.Unlock()
+
+		if !t.timer.Stop() {
+			// 空闲超时已触发，隧道已被关闭
+			continue
+		}
+		if conn, ok := tunnelAlive(t.conn); ok {
+			return conn
+		}
+		t.conn.Close()
+	}
+}
+
+// refill 在后台为 key 预建隧道，直到空闲与建立中的隧道数达到 size
+func (p *tunnelPool) refill(key string, size int, idleTimeout time.Duration, dial func(ctx context.Context) (net.Conn, error)) {
+	p.mu.Lock()
+	n := size - len(p.idle[key]) - p.pending[key]
+	if n <= 0 || p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.pending[key] += n
+	p.mu.Unlock()
+
+	for i := 0; i < n; i++ {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), poolDialTimeout)
+			conn, err := dial(ctx)
+			cancel()
+
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			if p.pending[key]--; p.pending[key] == 0 {
+				delete(p.pending, key)
+			}
+			if err != nil {
+				log.Printf("预建上游隧道 %s 失败: %v", key, err)
+				return
+			}
+			if p.closed {
+				conn.Close()
+				return
+			}
+			t := &pooledTunnel{conn: conn}
+			t.timer = time.AfterFunc(idleTimeout, func() { p.evict(key, t) })
+			p.idle[key] = append(p.idle[key], t)
+		}()
+	}
+}
+
+// evict 关闭空闲超时的隧道并将其移出池
+func (p *tunnelPool) evict(key string, t *pooledTunnel) {
+	p.mu.Lock()
+	tunnels := p.idle[key]
+	for i, c := range tunnels {
+		if c == t {
+			p.idle[key] = append(tunnels[:i], tunnels[i+1:]...)
+			break
+		}
+	}
+	if len(p.idle[key]) == 0 {
+		delete(p.idle, key)
+	}
+	p.mu.Unlock()
+	t.conn.Close()
+}
+
+// closeAll 关闭所有空闲隧道，此后仍在建立的隧道完成后直接关闭，不再放入池中
+func (p *tunnelPool) closeAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for key, tunnels := range p.idle {
+		for _, t := range tunnels {
+			t.timer.Stop()
+			t.conn.Close()
+		}
+		delete(p.idle, key)
+	}
+}
+
+// tunnelAlive 检查空闲隧道是否仍被对端保持：短暂读取超时说明连接正常且没有数据；
+// 读到数据（例如目标先发送的欢迎信息）同样视为可用，数据保留在返回的缓冲连接中；
+// 读到 EOF 或其他错误说明目标或上游已关闭隧道
+func tunnelAlive(conn net.Conn) (net.Conn, bool) {
+	bc, ok := conn.(*bufferedConn)
+	if !ok {
+		bc = &bufferedConn{Conn: conn, r: bufio.NewReader(conn)}
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	_, err := bc.r.Peek(1)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil, false
+	}
+	return unwrapConn(bc), true
+}
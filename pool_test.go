@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// idleTunnels 返回池中 key 的空闲隧道数
+func (p *tunnelPool) idleTunnels(key string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.idle[key])
+}
+
+func TestTunnelPool(t *testing.T) {
+	echo := startEcho(t)
+	type step struct {
+		target string
+		wait   time.Duration // 请求前等待的时间
+		hit    bool          // 是否使用预建的隧道
+	}
+	tests := []struct {
+		name        string
+		size        int
+		idleTimeout int
+		steps       []step
+	}{
+		{"同一目标复用", 1, 0, []step{{"echo.test:7", 0, false}, {"echo.test:7", 0, true}, {"echo.test:7", 0, true}}},
+		{"不同目标不复用", 1, 0, []step{{"echo.test:7", 0, false}, {"echo.test:8", 0, false}, {"echo.test:7", 0, true}}},
+		{"空闲超时后关闭", 1, 1, []step{{"echo.test:7", 0, false}, {"echo.test:7", 1500 * time.Millisecond, false}}},
+		{"未启用", 0, 0, []step{{"echo.test:7", 0, false}, {"echo.test:7", 0, false}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy, _ := startHTTPProxy(t, http.StatusOK, echo, "")
+			s := startServer(t, testConfig(t, `{
+				"upstreams": {"up": {"type": "http-connect", "address": "`+proxy+`", "pool_size": `+strconv.Itoa(tt.size)+`, "pool_idle_timeout": `+strconv.Itoa(tt.idleTimeout)+`}},
+				"routes": [{"match": "echo.test", "via": "up"}]
+			}`))
+
+			for i, st := range tt.steps {
+				time.Sleep(st.wait)
+				hits := counterValue("upstream_tunnel_pool_hits_total")
+				conn, rep, _ := connect(t, s, "", "", CmdConnect, st.target)
+				if rep != RepSuccess {
+					t.Fatalf("第 %d 个请求回复码 %#x", i+1, rep)
+				}
+				mustWrite(t, conn, []byte("hello"))
+				expectBytes(t, conn, []byte("hello"))
+				conn.Close()
+				if got := counterValue("upstream_tunnel_pool_hits_total") > hits; got != st.hit {
+					t.Fatalf("第 %d 个请求使用预建隧道为 %v, 期望 %v", i+1, got, st.hit)
+				}
+
+				// 等待后台为该目标补足空闲隧道
+				key := poolKey("up", s.cfg().Upstreams["up"], st.target)
+				deadline := time.Now().Add(5 * time.Second)
+				for s.tunnels.idleTunnels(key) < tt.size {
+					if time.Now().After(deadline) {
+						t.Fatalf("第 %d 个请求后未预建隧道", i+1)
+					}
+					time.Sleep(time.Millisecond)
+				}
+			}
+		})
+	}
+}
+
+func TestTunnelPoolClosedDuringRefill(t *testing.T) {
+	p := newTunnelPool()
+	release := make(chan struct{})
+	remote := make(chan net.Conn, 1)
+	p.refill("key", 1, time.Minute, func(ctx context.Context) (net.Conn, error) {
+		<-release
+		local, peer := net.Pipe()
+		remote <- peer
+		return local, nil
+	})
+
+	// 停止时仍在建立的隧道完成后直接关闭，不放入池中
+	p.closeAll()
+	close(release)
+	peer := <-remote
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := peer.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("停止后建立的隧道未被关闭: %v", err)
+	}
+	if n := p.idleTunnels("key"); n != 0 {
+		t.Fatalf("停止后池中有 %d 条空闲隧道", n)
+	}
+
+	// 停止后不再预建
+	p.refill("key", 1, time.Minute, func(ctx context.Context) (net.Conn, error) {
+		t.Error("停止后仍在预建隧道")
+		return nil, errors.New("closed")
+	})
+}
+
+func TestTunnelPoolReload(t *testing.T) {
+	echo := startEcho(t)
+	tests := []struct {
+		name     string
+		username string // 重新加载后的上游凭据与 User-Agent
+		password string
+		agent    string
+		hit      bool // 重新加载后的请求是否使用之前预建的隧道
+	}{
+		{"凭据不变", "alice", "secret", "probe/1", true},
+		{"修改密码", "alice", "changed", "probe/1", false},
+		{"修改用户名", "bob", "secret", "probe/1", false},
+		{"修改请求头", "alice", "secret", "probe/2", false},
+	}
+	config := func(proxy, username, password, agent string) string {
+		return `{
+			"upstreams": {"up": {"type": "http-connect", "address": "` + proxy + `", "username": "` + username + `", "password": "` + password + `", "headers": {"User-Agent": "` + agent + `"}, "pool_size": 1}},
+			"routes": [{"match": "echo.test", "via": "up"}]
+		}`
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy, _ := startHTTPProxy(t, http.StatusOK, echo, "")
+			s := startServer(t, testConfig(t, config(proxy, "alice", "secret", "probe/1")))
+			conn, rep, _ := connect(t, s, "", "", CmdConnect, "echo.test:7")
+			if rep != RepSuccess {
+				t.Fatalf("回复码 %#x", rep)
+			}
+			conn.Close()
+			key := poolKey("up", s.cfg().Upstreams["up"], "echo.test:7")
+			deadline := time.Now().Add(5 * time.Second)
+			for s.tunnels.idleTunnels(key) < 1 {
+				if time.Now().After(deadline) {
+					t.Fatal("未预建隧道")
+				}
+				time.Sleep(time.Millisecond)
+			}
+
+			if err := s.Reload(testConfig(t, config(proxy, tt.username, tt.password, tt.agent))); err != nil {
+				t.Fatal(err)
+			}
+			hits := counterValue("upstream_tunnel_pool_hits_total")
+			conn, rep, _ = connect(t, s, "", "", CmdConnect, "echo.test:7")
+			if rep != RepSuccess {
+				t.Fatalf("重新加载后回复码 %#x", rep)
+			}
+			mustWrite(t, conn, []byte("hello"))
+			expectBytes(t, conn, []byte("hello"))
+			if got := counterValue("upstream_tunnel_pool_hits_total") > hits; got != tt.hit {
+				t.Fatalf("重新加载后使用预建隧道为 %v, 期望 %v", got, tt.hit)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// errProbe 连接是常见的非SOCKS探测（HTTP、TLS 扫描器）
+var errProbe = errors.New("非SOCKS探测")
+
+// httpBadRequest 对HTTP探测的应答
+const httpBadRequest = "HTTP/1.1 400 Bad Request\r\nConnection: close\r\nContent-Length: 0\r\n\r\n"
+
+// rejectProbe 根据连接的前两个字节识别HTTP请求和TLS ClientHello，
+// 对HTTP请求回复400，对TLS直接关闭。未识别时返回nil。
+func rejectProbe(conn net.Conn, header []byte) error {
+	switch {
+	case header[0] == 0x16 && header[1] == 0x03:
+		return fmt.Errorf("%w: TLS ClientHello", errProbe)
+	case isUpperASCII(header[0]) && isUpperASCII(header[1]):
+		writeFull(conn, []byte(httpBadRequest))
+		return fmt.Errorf("%w: HTTP请求", errProbe)
+	}
+	return nil
+}
+
+// isUpperASCII 判断字节是否为大写字母（HTTP方法的组成字符）
+func isUpperASCII(b byte) bool {
+	return b >= 'A' && b <= 'Z'
+}
+
+// maxGreetingJitter 方法选择回复随机延迟的上限（毫秒），远小于常见客户端的握手超时
+const maxGreetingJitter = 1000
+
+// greetingJitter 按 greeting_jitter 配置在发送方法选择回复前随机等待，
+// 使扫描器无法依据回复时延识别服务器。未配置时立即返回
+func (s *Server) greetingJitter(ctx context.Context) {
+	j := s.cfg().GreetingJitter
+	if j.Max <= 0 {
+		return
+	}
+	d := time.Duration(j.Min+rand.Intn(j.Max-j.Min+1)) * time.Millisecond
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRejectProbes(t *testing.T) {
+	echo := startEcho(t)
+	httpGet := []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	clientHello := []byte{0x16, 0x03, 0x01, 0x00, 0x05, 0x01, 0x00, 0x00, 0x01, 0x00}
+	tests := []struct {
+		name   string
+		reject bool
+		probe  []byte
+		reply  string // 服务器关闭前写出的全部数据
+		logged bool   // 是否以普通级别记录失败
+	}{
+		{"HTTP请求", true, httpGet, httpBadRequest, false},
+		{"TLS ClientHello", true, clientHello, "", false},
+		{"无法识别的数据", true, []byte{0x01, 0x02, 0x03}, "", true},
+		{"未开启时HTTP请求", false, httpGet, "", true},
+		{"未开启时TLS ClientHello", false, clientHello, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLog(t)
+			s := startServer(t, testConfig(t, `{"reject_probes": `+strconv.FormatBool(tt.reject)+`}`))
+			conn := dialServer(t, s)
+			mustWrite(t, conn, tt.probe)
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			out, err := io.ReadAll(conn)
+			if err != nil {
+				t.Fatalf("读取失败: %v", err)
+			}
+			if string(out) != tt.reply {
+				t.Fatalf("服务器回复 %q, 期望 %q", out, tt.reply)
+			}
+			if got := strings.Contains(logs.String(), "拒绝来自"); got != tt.logged {
+				t.Fatalf("日志中记录拒绝为 %v, 期望 %v:\n%s", got, tt.logged, logs)
+			}
+
+			// 探测识别不影响正常的SOCKS5客户端
+			if _, rep, _ := connect(t, s, "", "", CmdConnect, echo); rep != RepSuccess {
+				t.Fatalf("回复码 %#x", rep)
+			}
+		})
+	}
+}
+
+func TestGreetingJitter(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		min, max time.Duration
+	}{
+		{"未开启", `{}`, 0, 20 * time.Millisecond},
+		{"随机范围", `{"greeting_jitter": {"min": 30, "max": 60}}`, 30 * time.Millisecond, 60 * time.Millisecond},
+		{"固定延迟", `{"greeting_jitter": {"min": 40, "max": 40}}`, 40 * time.Millisecond, 40 * time.Millisecond},
+	}
+	// 计时包含本机往返，上限留出调度误差
+	const slack = 30 * time.Millisecond
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startServer(t, testConfig(t, tt.config))
+			for i := 0; i < 10; i++ {
+				conn := dialServer(t, s)
+				start := time.Now()
+				mustWrite(t, conn, []byte{Version5, 1, MethodNoAuth})
+				expectBytes(t, conn, []byte{Version5, MethodNoAuth})
+				elapsed := time.Since(start)
+				conn.Close()
+				if elapsed < tt.min || elapsed > tt.max+slack {
+					t.Fatalf("第 %d 次握手回复耗时 %v, 期望在 %v 到 %v 之间", i+1, elapsed, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
+
+func TestFirstByteMismatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		first  byte
+		reject bool
+	}{
+		{"SOCKS5", Version5, false},
+		{"SOCKS4", Version4, false},
+		{"零字节", 0x00, true},
+		{"ASCII", 'X', true},
+		{"TLS记录", 0x16, true},
+		{"0xFF", 0xFF, true},
+	}
+	s := startServer(t, testConfig(t, `{}`))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mismatches := counterValue("protocol_mismatch_total")
+			conn := dialServer(t, s)
+			// 只发送首字节：不支持的版本立即被关闭，不等待后续数据
+			mustWrite(t, conn, []byte{tt.first})
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			n, err := conn.Read(make([]byte, 1))
+			if !tt.reject {
+				if ne, ok := err.(interface{ Timeout() bool }); !ok || !ne.Timeout() {
+					t.Fatalf("支持的版本被关闭: 读到 %d 字节 (%v)", n, err)
+				}
+				if got := counterValue("protocol_mismatch_total"); got != mismatches {
+					t.Fatalf("protocol_mismatch_total 增加到 %d", got)
+				}
+				return
+			}
+			if err != io.EOF {
+				t.Fatalf("不支持的版本 %#x 未被立即关闭: 读到 %d 字节 (%v)", tt.first, n, err)
+			}
+			waitCounter(t, "protocol_mismatch_total", mismatches+1)
+		})
+	}
+}
+
+func TestFirstByteTimeoutDefault(t *testing.T) {
+	if got := testConfig(t, `{}`).FirstByteTimeout; got != 5000 {
+		t.Fatalf("默认 first_byte_timeout 为 %d, 期望 5000", got)
+	}
+	if got := testConfig(t, `{"first_byte_timeout": 0}`).FirstByteTimeout; got != 0 {
+		t.Fatalf("显式设为0后 first_byte_timeout 为 %d", got)
+	}
+}
+
+func TestFirstByteTimeout(t *testing.T) {
+	echo := startEcho(t)
+	tests := []struct {
+		name    string
+		timeout int           // first_byte_timeout（毫秒）
+		delay   time.Duration // 发送首字节前的等待
+		closed  bool
+	}{
+		{"超时未收到首字节", 200, 500 * time.Millisecond, true},
+		{"超时前收到首字节", 500, 100 * time.Millisecond, false},
+		{"未限制", 0, 500 * time.Millisecond, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startServer(t, testConfig(t, `{"first_byte_timeout": `+strconv.Itoa(tt.timeout)+`}`))
+			conn := dialServer(t, s)
+			time.Sleep(tt.delay)
+			conn.Write([]byte{Version5})
+			if tt.closed {
+				expectClosed(t, conn)
+				return
+			}
+			// 收到首字节后不再受该超时限制，其余握手可以慢慢到达
+			time.Sleep(time.Duration(tt.timeout)*time.Millisecond + 100*time.Millisecond)
+			mustWrite(t, conn, []byte{1, MethodNoAuth})
+			expectBytes(t, conn, []byte{Version5, MethodNoAuth})
+			host, port, _ := net.SplitHostPort(echo)
+			p, _ := strconv.Atoi(port)
+			mustWrite(t, conn, requestBytes(CmdConnect, host, uint16(p)))
+			if rep, _ := readReply(t, conn); rep != RepSuccess {
+				t.Fatalf("回复码 %#x", rep)
+			}
+		})
+	}
+}
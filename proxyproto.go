@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ProxyProtocolConfig 入站 PROXY 协议（v1/v2）配置，用于位于负载均衡之后时获取真实客户端地址
+type ProxyProtocolConfig struct {
+	// 是否接受 PROXY 协议头
+	Enable bool `json:"enable"`
+	// 允许发送 PROXY 协议头的可信代理 CIDR 列表，启用时不能为空
+	Trusted []string `json:"trusted"`
+	// 来自可信代理的连接是否必须携带 PROXY 协议头，否则拒绝
+	Require bool `json:"require"`
+}
+
+// PROXY 协议签名
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// ppTypeUsername 携带认证用户名的自定义 TLV 类型（PP2_TYPE_MIN_CUSTOM）
+const ppTypeUsername = 0xE0
+
+// proxyV1MaxLen v1 协议头（含 CRLF）的最大长度
+const proxyV1MaxLen = 107
+
+// ErrProxyHeader PROXY 协议头被拒绝或格式错误
+var ErrProxyHeader = errors.New("PROXY协议头无效")
+
+// proxyHeader 解析后的 PROXY 协议头
+type proxyHeader struct {
+	src      net.Addr // 真实客户端地址，LOCAL/UNKNOWN 时为 nil
+	tlv      []byte   // v2 协议头中地址之后的 TLV 数据
+	username string   // 前级代理在 TLV 中携带的认证用户名
+}
+
+// validate 校验 PROXY 协议配置
+func (c ProxyProtocolConfig) validate(transparent bool) error {
+	if !c.Enable {
+		return nil
+	}
+	if len(c.Trusted) == 0 {
+		return errors.New("启用 proxy_protocol 时必须配置 trusted")
+	}
+	if transparent {
+		return errors.New("透明代理模式不支持 proxy_protocol")
+	}
+	_, err := parseTrustedProxies(c.Trusted)
+	return err
+}
+
+// parseTrustedProxies 解析可信代理 CIDR 列表
+func parseTrustedProxies(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("无效的可信代理 CIDR %s: %v", c, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// acceptProxyHeader 按监听器的可信代理列表处理连接开头的 PROXY 协议头：
+// 可信来源携带的协议头被解析，返回的连接以真实客户端地址作为 RemoteAddr；
+// 不可信来源携带协议头时拒绝，防止伪造来源地址；没有协议头的可信来源按 require 处理
+func (l *listener) acceptProxyHeader(conn net.Conn) (net.Conn, *proxyHeader, error) {
+	bc := &bufferedConn{Conn: conn, r: bufio.NewReader(conn)}
+	version, err := peekProxyVersion(bc.r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	trusted := false
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		for _, n := range l.proxyTrusted {
+			if n.Contains(addr.IP) {
+				trusted = true
+				break
+			}
+		}
+	}
+
+	switch {
+	case version != 0 && !trusted:
+		return nil, nil, fmt.Errorf("%w: 来自不可信来源 %s", ErrProxyHeader, conn.RemoteAddr())
+	case version == 0 && trusted && l.proxyRequire:
+		return nil, nil, fmt.Errorf("%w: 可信代理 %s 的连接缺少协议头", ErrProxyHeader, conn.RemoteAddr())
+	case version == 0:
+		return bc, nil, nil
+	}
+
+	var h *proxyHeader
+	if version == 1 {
+		h, err = readProxyV1(bc.r)
+	} else {
+		h, err = readProxyV2(bc.r)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrProxyHeader, err)
+	}
+	bc.remote = h.src
+	return bc, h, nil
+}
+
+// peekProxyVersion 预读连接开头判断是否为 PROXY 协议头，返回版本号，不是时返回0。
+// 先只预读1个字节：SOCKS 与 TLS 客户端发送的首字节不会与协议头签名的首字节相同，
+// 避免在客户端只发送了很短的握手时阻塞
+func peekProxyVersion(r *bufio.Reader) (int, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return 0, err
+	}
+	var sig []byte
+	switch first[0] {
+	case proxyV1Prefix[0]:
+		sig = proxyV1Prefix
+	case proxyV2Signature[0]:
+		sig = proxyV2Signature
+	default:
+		return 0, nil
+	}
+	b, err := r.Peek(len(sig))
+	if err != nil || !bytes.Equal(b, sig) {
+		return 0, nil
+	}
+	if first[0] == proxyV1Prefix[0] {
+		return 1, nil
+	}
+	return 2, nil
+}
+
+// readProxyV1 解析文本格式的 v1 协议头，例如 "PROXY TCP4 1.2.3.4 5.6.7.8 1234 1080\r\n"
+func readProxyV1(r *bufio.Reader) (*proxyHeader, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("v1 协议头超过 %d 字节", proxyV1MaxLen)
+	}
+
+	fields := strings.Fields(strings.TrimSuffix(string(line), "\r\n"))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return &proxyHeader{}, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("v1 协议头格式错误: %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("v1 协议头源地址无效: %q", line)
+	}
+	return &proxyHeader{src: &net.TCPAddr{IP: ip, Port: int(port)}}, nil
+}
+
+// readProxyV2 解析二进制格式的 v2 协议头
+func readProxyV2(r *bufio.Reader) (*proxyHeader, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	verCmd, family := header[12], header[13]
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("v2 协议头版本无效: %#x", verCmd)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	// LOCAL 命令（代理自身的健康检查等）使用连接本身的地址
+	if verCmd&0x0F == 0x00 {
+		return &proxyHeader{}, nil
+	}
+	if verCmd&0x0F != 0x01 {
+		return nil, fmt.Errorf("v2 协议头命令无效: %#x", verCmd)
+	}
+
+	var addrLen, ipLen int
+	switch family {
+	case 0x11, 0x12: // TCP/UDP over IPv4
+		addrLen, ipLen = 12, net.IPv4len
+	case 0x21, 0x22: // TCP/UDP over IPv6
+		addrLen, ipLen = 36, net.IPv6len
+	default:
+		// 不支持的地址族（如 UNIX 套接字）使用连接本身的地址
+		return &proxyHeader{}, nil
+	}
+	if len(body) < addrLen {
+		return nil, fmt.Errorf("v2 协议头地址长度不足: %d", len(body))
+	}
+	ip := net.IP(append([]byte(nil), body[:ipLen]...))
+	port := binary.BigEndian.Uint16(body[2*ipLen : 2*ipLen+2])
+	h := &proxyHeader{
+		src: &net.TCPAddr{IP: ip, Port: int(port)},
+		tlv: body[addrLen:],
+	}
+	h.username = string(findTLV(h.tlv, ppTypeUsername))
+	return h, nil
+}
+
+// findTLV 返回 TLV 数据中第一个指定类型的值，不存在或格式错误时返回 nil
+func findTLV(tlv []byte, typ byte) []byte {
+	for len(tlv) >= 3 {
+		n := int(binary.BigEndian.Uint16(tlv[1:3]))
+		if len(tlv) < 3+n {
+			return nil
+		}
+		if tlv[0] == typ {
+			return tlv[3 : 3+n]
+		}
+		tlv = tlv[3+n:]
+	}
+	return nil
+}
+
+type clientInfoKey struct{}
+
+// clientInfo 发起出站连接的客户端信息，用于向上游发送 PROXY 协议头
+type clientInfo struct {
+	src      net.Addr // 客户端地址
+	dst      net.Addr // 客户端连接的本地地址
+	username string   // 认证用户名，未认证时为空
+}
+
+// withClientInfo 将客户端信息保存到 context 中
+func withClientInfo(ctx context.Context, info clientInfo) context.Context {
+	return context.WithValue(ctx, clientInfoKey{}, info)
+}
+
+// clientInfoFrom 返回 context 中的客户端信息，不存在时（如健康探测）为零值
+func clientInfoFrom(ctx context.Context) clientInfo {
+	info, _ := ctx.Value(clientInfoKey{}).(clientInfo)
+	return info
+}
+
+// proxyV2Header 构建发送给上游的 PROXY 协议 v2 头。没有客户端地址时使用 LOCAL 命令；
+// 认证用户名以 ppTypeUsername 类型的 TLV 附加在地址之后
+func proxyV2Header(info clientInfo) []byte {
+	verCmd, family := byte(0x21), byte(0x00)
+	var body []byte
+	src, _ := info.src.(*net.TCPAddr)
+	dst, _ := info.dst.(*net.TCPAddr)
+	switch {
+	case src == nil || dst == nil:
+		verCmd = 0x20
+	case src.IP.To4() != nil && dst.IP.To4() != nil:
+		family = 0x11
+		body = append(append(body, src.IP.To4()...), dst.IP.To4()...)
+	default:
+		family = 0x21
+		body = append(append(body, src.IP.To16()...), dst.IP.To16()...)
+	}
+	if family != 0x00 {
+		body = binary.BigEndian.AppendUint16(body, uint16(src.Port))
+		body = binary.BigEndian.AppendUint16(body, uint16(dst.Port))
+	}
+	if name := info.username; name != "" {
+		body = append(body, ppTypeUsername)
+		body = binary.BigEndian.AppendUint16(body, uint16(len(name)))
+		body = append(body, name...)
+	}
+
+	header := append([]byte(nil), proxyV2Signature...)
+	header = append(header, verCmd, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(body)))
+	return append(header, body...)
+}
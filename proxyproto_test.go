@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// dialFrom 从本地地址 local 连接 addr，测试结束时关闭
+func dialFrom(t *testing.T, addr string, local net.IP) net.Conn {
+	t.Helper()
+	d := net.Dialer{LocalAddr: &net.TCPAddr{IP: local}, Timeout: 5 * time.Second}
+	conn, err := d.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("从 %s 连接失败: %v", local, err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestProxyProtocolTrust(t *testing.T) {
+	echo := startEcho(t)
+	trusted, untrusted := net.IPv4(127, 0, 0, 1), net.IPv4(127, 0, 0, 2)
+	if ln, err := net.Listen("tcp", "127.0.0.2:0"); err != nil {
+		t.Skipf("无法使用 127.0.0.2 作为不可信来源: %v", err)
+	} else {
+		ln.Close()
+	}
+
+	v1 := []byte("PROXY TCP4 203.0.113.7 192.0.2.1 5000 1080\r\n")
+	v2 := proxyV2Header(clientInfo{
+		src: &net.TCPAddr{IP: net.IPv4(203, 0, 113, 8), Port: 6000},
+		dst: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1080},
+	})
+	tests := []struct {
+		name    string
+		require bool
+		from    net.IP
+		header  []byte
+		client  string // 服务器看到的客户端地址，只有IP时不比较端口；为空表示连接被拒绝
+	}{
+		{"可信来源v1", false, trusted, v1, "203.0.113.7:5000"},
+		{"可信来源v2", false, trusted, v2, "203.0.113.8:6000"},
+		{"不可信来源v1", false, untrusted, v1, ""},
+		{"不可信来源v2", false, untrusted, v2, ""},
+		{"不可信来源无协议头", true, untrusted, nil, "127.0.0.2"},
+		{"可信来源无协议头", false, trusted, nil, "127.0.0.1"},
+		{"可信来源必须携带协议头", true, trusted, nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seen := make(chan net.Addr, 1)
+			s := startServer(t, testConfig(t, `{"proxy_protocol": {"enable": true, "trusted": ["127.0.0.1/32"], "require": `+strconv.FormatBool(tt.require)+`}}`), func(s *Server) {
+				s.OnRequest = func(ctx context.Context, req *Request) (*Request, error) {
+					seen <- req.RemoteAddr
+					return req, nil
+				}
+			})
+			rejected := counterValue("proxy_header_rejected_total")
+
+			conn := dialFrom(t, s.Addr().String(), tt.from)
+			host, port, _ := net.SplitHostPort(echo)
+			p, _ := strconv.Atoi(port)
+			mustWrite(t, conn, append(append(append([]byte(nil), tt.header...), Version5, 1, MethodNoAuth), requestBytes(CmdConnect, host, uint16(p))...))
+			if tt.client == "" {
+				expectClosed(t, conn)
+				waitCounter(t, "proxy_header_rejected_total", rejected+1)
+				return
+			}
+
+			expectBytes(t, conn, []byte{Version5, MethodNoAuth})
+			if rep, _ := readReply(t, conn); rep != RepSuccess {
+				t.Fatalf("回复码 %#x", rep)
+			}
+			addr := (<-seen).String()
+			if want := tt.client; addr != want {
+				if host, _, _ := net.SplitHostPort(addr); host != want {
+					t.Fatalf("服务器看到的客户端地址 %s, 期望 %s", addr, want)
+				}
+			}
+		})
+	}
+}
+
+func TestProxyV2Header(t *testing.T) {
+	tests := []struct {
+		name string
+		info clientInfo
+		src  string // 解析出的客户端地址，为空表示 LOCAL
+	}{
+		{"IPv4", clientInfo{src: &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 5000}, dst: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1080}}, "203.0.113.7:5000"},
+		{"IPv4携带用户名", clientInfo{src: &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 5000}, dst: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1080}, username: "alice"}, "203.0.113.7:5000"},
+		{"IPv6携带用户名", clientInfo{src: &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 5000}, dst: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1080}, username: "用户"}, "[2001:db8::7]:5000"},
+		{"混合地址族", clientInfo{src: &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 5000}, dst: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1080}, username: "bob"}, "203.0.113.7:5000"},
+		{"没有客户端", clientInfo{}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := proxyV2Header(tt.info)
+			if !bytes.HasPrefix(header, proxyV2Signature) {
+				t.Fatalf("协议头 % x 缺少 v2 签名", header)
+			}
+			h, err := readProxyV2(bufio.NewReader(bytes.NewReader(header)))
+			if err != nil {
+				t.Fatalf("解析失败: %v", err)
+			}
+			var src string
+			if h.src != nil {
+				src = h.src.String()
+			}
+			if src != tt.src {
+				t.Fatalf("客户端地址 %q, 期望 %q", src, tt.src)
+			}
+			if h.username != tt.info.username {
+				t.Fatalf("用户名 TLV 为 %q, 期望 %q", h.username, tt.info.username)
+			}
+			if got := findTLV(h.tlv, ppTypeUsername); (got != nil) != (tt.info.username != "") {
+				t.Fatalf("TLV % x 中用户名存在为 %v", h.tlv, got != nil)
+			}
+		})
+	}
+}
+
+func TestUpstreamProxyProtocolUsername(t *testing.T) {
+	echo := startEcho(t)
+	tests := []struct {
+		name   string
+		config string
+		user   string
+	}{
+		{"认证用户", `"users": {"alice": "secret"},`, "alice"},
+		{"匿名用户", ``, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLog(t)
+			// 上游是信任本机 PROXY 协议头的另一个实例，在 debug 日志中记录前级用户
+			seen := make(chan net.Addr, 1)
+			up := startServer(t, testConfig(t, `{"log_level": "debug", "proxy_protocol": {"enable": true, "trusted": ["127.0.0.1/32"], "require": true}}`), func(s *Server) {
+				s.OnRequest = func(ctx context.Context, req *Request) (*Request, error) {
+					seen <- req.RemoteAddr
+					return req, nil
+				}
+			})
+			s := startServer(t, testConfig(t, `{`+tt.config+`
+				"upstreams": {"up": {"type": "socks5", "address": "`+up.Addr().String()+`", "proxy_protocol": true}},
+				"routes": [{"match": "127.0.0.0/8", "via": "up"}]
+			}`))
+
+			conn, rep, _ := connect(t, s, tt.user, "secret", CmdConnect, echo)
+			if rep != RepSuccess {
+				t.Fatalf("回复码 %#x", rep)
+			}
+			mustWrite(t, conn, []byte("hello"))
+			expectBytes(t, conn, []byte("hello"))
+			if got := (<-seen).String(); got != conn.LocalAddr().String() {
+				t.Fatalf("上游看到的客户端地址 %s, 期望 %s", got, conn.LocalAddr())
+			}
+			waitLog(t, logs, "客户端 "+conn.LocalAddr().String()+", 前级用户 "+strconv.Quote(tt.user))
+		})
+	}
+
+	if err := validateUpstream("up", UpstreamConfig{Type: UpstreamHTTPConnect, Address: "127.0.0.1:3128", PoolSize: 1, ProxyProtocol: true}); err == nil {
+		t.Fatal("pool_size 与 proxy_protocol 同时配置时应报错")
+	}
+}
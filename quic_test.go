@@ -0,0 +1,167 @@
+//go:build quic
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// 以真实的 QUIC 传输运行 SOCKS5：go test -tags quic -run TestQUICTransport
+
+// quicListener 将 QUIC 连接上的每个双向流作为一个 net.Conn 交给服务器
+type quicListener struct {
+	ln      *quic.Listener
+	streams chan net.Conn
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func listenQUIC(addr string, tlsConfig *tls.Config) (*quicListener, error) {
+	ln, err := quic.ListenAddr(addr, tlsConfig, nil)
+	if err != nil {
+		return nil, err
+	}
+	l := &quicListener{ln: ln, streams: make(chan net.Conn), closed: make(chan struct{})}
+	go l.acceptConns()
+	return l, nil
+}
+
+// acceptConns 接受 QUIC 连接，并为每个连接接受其上的流
+func (l *quicListener) acceptConns() {
+	for {
+		conn, err := l.ln.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		go func() {
+			for {
+				stream, err := conn.AcceptStream(context.Background())
+				if err != nil {
+					return
+				}
+				select {
+				case l.streams <- &quicStream{Stream: stream, conn: conn}:
+				case <-l.closed:
+					stream.CancelRead(0)
+					stream.Close()
+					return
+				}
+			}
+		}()
+	}
+}
+
+func (l *quicListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.streams:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *quicListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return l.ln.Close()
+}
+
+func (l *quicListener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// quicStream 为 QUIC 流补上 net.Conn 需要的地址，关闭时同时放弃读方向
+type quicStream struct {
+	quic.Stream
+	conn quic.Connection
+}
+
+func (s *quicStream) LocalAddr() net.Addr  { return s.conn.LocalAddr() }
+func (s *quicStream) RemoteAddr() net.Addr { return s.conn.RemoteAddr() }
+
+func (s *quicStream) Close() error {
+	s.Stream.CancelRead(0)
+	return s.Stream.Close()
+}
+
+func TestQUICTransport(t *testing.T) {
+	echo := startEcho(t)
+	ca := newTestCert(t, "quic-ca", nil)
+	leaf := newTestCert(t, "127.0.0.1", ca)
+	serverTLS := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{leaf.der}, PrivateKey: leaf.key}},
+		NextProtos:   []string{"socks5"},
+	}
+	var bound string
+	startServer(t, testConfig(t, `{
+		"users": {"alice": "secret"},
+		"listeners": [{"address": "127.0.0.1:0", "network": "quic", "auth": true}]
+	}`), func(s *Server) {
+		s.ListenTransport = func(network, address string) (net.Listener, error) {
+			if network != "quic" {
+				return net.Listen(network, address)
+			}
+			ln, err := listenQUIC(address, serverTLS)
+			if err == nil {
+				bound = ln.Addr().String()
+			}
+			return ln, err
+		}
+	})
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	qc, err := quic.DialAddr(ctx, bound, &tls.Config{RootCAs: roots, ServerName: "127.0.0.1", NextProtos: []string{"socks5"}}, nil)
+	if err != nil {
+		t.Fatalf("建立 QUIC 连接失败: %v", err)
+	}
+	defer qc.CloseWithError(0, "")
+
+	host, port, _ := net.SplitHostPort(echo)
+	p, _ := strconv.Atoi(port)
+	tests := []struct {
+		name     string
+		password string
+		rep      uint8
+	}{
+		{"认证成功", "secret", RepSuccess},
+		{"同一连接上的第二个流", "secret", RepSuccess},
+		{"密码错误", "wrong", authFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream, err := qc.OpenStreamSync(ctx)
+			if err != nil {
+				t.Fatalf("打开 QUIC 流失败: %v", err)
+			}
+			conn := &quicStream{Stream: stream, conn: qc}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			if tt.rep == authFailed {
+				mustWrite(t, conn, []byte{Version5, 1, MethodUserPass})
+				expectBytes(t, conn, []byte{Version5, MethodUserPass})
+				mustWrite(t, conn, userPassAuth("alice", tt.password))
+				expectBytes(t, conn, []byte{AuthUserPassVersion, AuthUserPassFailure})
+				return
+			}
+			greet(t, conn, "alice", tt.password)
+			mustWrite(t, conn, requestBytes(CmdConnect, host, uint16(p)))
+			if rep, _ := readReply(t, conn); rep != tt.rep {
+				t.Fatalf("回复码 %#x, 期望 %#x", rep, tt.rep)
+			}
+			mustWrite(t, conn, []byte("ping"))
+			expectBytes(t, conn, []byte("ping"))
+		})
+	}
+}
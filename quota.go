@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// 流量配额统计的方向
+const (
+	QuotaDirectionBoth     = "both"     // 上下行合计
+	QuotaDirectionUpload   = "upload"   // 仅客户端到目标
+	QuotaDirectionDownload = "download" // 仅目标到客户端
+)
+
+// errQuotaExceeded 连接的流量达到配额
+var errQuotaExceeded = fmt.Errorf("%w: 连接流量已用完", ErrQuotaExceeded)
+
+// byteQuota 单个连接的流量配额，统计的各个方向共享同一额度
+type byteQuota struct {
+	direction string
+	remaining atomic.Int64
+	exceeded  atomic.Bool
+}
+
+// newByteQuota 创建流量配额，limit 为0时返回 nil 表示不限制
+func newByteQuota(limit int64, direction string) *byteQuota {
+	if limit <= 0 {
+		return nil
+	}
+	q := &byteQuota{direction: direction}
+	q.remaining.Store(limit)
+	return q
+}
+
+// wrap 为指定方向的读取端加上配额限制，该方向不计入配额时原样返回
+func (q *byteQuota) wrap(r io.Reader, upload bool) io.Reader {
+	if q == nil {
+		return r
+	}
+	if (upload && q.direction == QuotaDirectionDownload) || (!upload && q.direction == QuotaDirectionUpload) {
+		return r
+	}
+	return &quotaReader{r: r, q: q}
+}
+
+// isExceeded 判断配额是否已经用尽
+func (q *byteQuota) isExceeded() bool {
+	return q != nil && q.exceeded.Load()
+}
+
+// quotaReader 每次读取后从配额中扣除读到的字节数。读取前不预留额度，
+// 以免一个方向阻塞等待数据时占用另一方向的额度
+type quotaReader struct {
+	r io.Reader
+	q *byteQuota
+}
+
+func (r *quotaReader) Read(p []byte) (int, error) {
+	remaining := r.q.remaining.Load()
+	if remaining <= 0 {
+		// 额度恰好用完时只有对端还有数据要发送才算超过配额
+		var probe [1]byte
+		if n, err := r.r.Read(probe[:]); n == 0 {
+			return 0, err
+		}
+		r.q.exceeded.Store(true)
+		return 0, errQuotaExceeded
+	}
+
+	n, err := r.r.Read(p[:min(int64(len(p)), remaining)])
+	// 读取期间另一方向可能已用掉部分额度，超出剩余额度的数据被丢弃
+	for {
+		remaining = r.q.remaining.Load()
+		take := min(int64(n), max(remaining, 0))
+		if r.q.remaining.CompareAndSwap(remaining, remaining-take) {
+			if take < int64(n) {
+				r.q.exceeded.Store(true)
+				return int(take), errQuotaExceeded
+			}
+			return n, err
+		}
+	}
+}
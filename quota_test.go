@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestByteQuota(t *testing.T) {
+	const limit = 4096
+	tests := []struct {
+		direction        string
+		upload, download int // 客户端发送的字节数与目标回复的字节数
+		wantUp, wantDown int // 目标与客户端实际收到的字节数
+		exceeded         bool
+	}{
+		{QuotaDirectionDownload, 0, 10000, 0, limit, true},
+		{QuotaDirectionUpload, 10000, 0, limit, 0, true},
+		{QuotaDirectionBoth, 3000, 10000, 3000, limit - 3000, true},
+		{QuotaDirectionUpload, 3000, 10000, 3000, 10000, false},
+		{QuotaDirectionBoth, 1000, 3096, 1000, 3096, false},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%d+%d", tt.direction, tt.upload, tt.download), func(t *testing.T) {
+			// 目标读取客户端的数据后回复 download 字节，记录收到的字节数
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			received := make(chan int64, 1)
+			upload, download := tt.upload, tt.download
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				n, _ := io.CopyN(io.Discard, conn, int64(upload))
+				received <- n
+				conn.Write(make([]byte, download))
+			}()
+
+			logs := captureLog(t)
+			closed := make(chan struct{}, 1)
+			s := startServer(t, testConfig(t, fmt.Sprintf(`{"max_bytes_per_connection": %d, "quota_direction": %q}`, limit, tt.direction)), func(s *Server) {
+				s.OnConnectionClose = func(context.Context, *ConnectionInfo) { closed <- struct{}{} }
+			})
+			exceeded := counterValue("sessions_quota_exceeded_total")
+			conn, rep, _ := connect(t, s, "", "", CmdConnect, ln.Addr().String())
+			if rep != RepSuccess {
+				t.Fatalf("回复码 %#x", rep)
+			}
+			conn.Write(make([]byte, tt.upload))
+			if up := <-received; up != int64(tt.wantUp) {
+				t.Fatalf("目标收到 %d 字节, 期望 %d", up, tt.wantUp)
+			}
+			down, _ := io.Copy(io.Discard, conn)
+			if down != int64(tt.wantDown) {
+				t.Fatalf("客户端收到 %d 字节, 期望 %d", down, tt.wantDown)
+			}
+			conn.Close()
+
+			select {
+			case <-closed:
+			case <-time.After(5 * time.Second):
+				t.Fatal("会话未结束")
+			}
+			want := int64(0)
+			if tt.exceeded {
+				want = 1
+			}
+			if got := counterValue("sessions_quota_exceeded_total") - exceeded; got != want {
+				t.Fatalf("sessions_quota_exceeded_total 增加了 %d, 期望 %d", got, want)
+			}
+			if got := strings.Contains(logs.String(), "超过流量配额 4096 字节已关闭"); got != tt.exceeded {
+				t.Fatalf("日志中记录超过配额为 %v, 期望 %v:\n%s", got, tt.exceeded, logs)
+			}
+		})
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenBucket 令牌桶，rate 为每秒补充的令牌数，burst 为桶容量
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket 创建一个装满令牌的令牌桶
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	b := float64(burst)
+	if b <= 0 {
+		b = rate
+	}
+	if b < 1 {
+		b = 1
+	}
+	return &tokenBucket{rate: rate, burst: b, tokens: b, last: now}
+}
+
+// allow 尝试取出一个令牌，调用方需保证并发安全
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// reserve 取出 n 个令牌，令牌不足时允许透支，返回还清透支需要等待的时间。
+// 调用方需保证并发安全
+func (b *tokenBucket) reserve(n float64, now time.Time) time.Duration {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// resize 更新速率与容量，保留已有的令牌（不超过新的容量）。调用方需保证并发安全
+func (b *tokenBucket) resize(rate float64, burst int, now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	b.last = now
+	b.rate = rate
+	b.burst = newTokenBucket(rate, burst, now).burst
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// full 判断令牌桶在 now 时是否已经补满
+func (b *tokenBucket) full(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+// acceptLimiter 限制新连接的接入速率（全局与每个来源IP）
+type acceptLimiter struct {
+	mu        sync.Mutex
+	global    *tokenBucket
+	perIPRate float64
+	burst     int
+	perIP     map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// newAcceptLimiter 创建接入速率限制器，速率为0表示不限制对应维度
+func newAcceptLimiter(globalRate, perIPRate float64, burst int) *acceptLimiter {
+	now := time.Now()
+	l := &acceptLimiter{
+		perIPRate: perIPRate,
+		burst:     burst,
+		perIP:     make(map[string]*tokenBucket),
+		lastSweep: now,
+	}
+	if globalRate > 0 {
+		l.global = newTokenBucket(globalRate, burst, now)
+	}
+	return l
+}
+
+// resize 按重新加载的配置更新速率与突发容量。已有的令牌桶保留剩余令牌，
+// 不会因重新加载而重新装满；速率改为0的维度不再限制
+func (l *acceptLimiter) resize(globalRate, perIPRate float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	switch {
+	case globalRate <= 0:
+		l.global = nil
+	case l.global == nil:
+		l.global = newTokenBucket(globalRate, burst, now)
+	default:
+		l.global.resize(globalRate, burst, now)
+	}
+
+	l.perIPRate, l.burst = perIPRate, burst
+	if perIPRate <= 0 {
+		clear(l.perIP)
+		return
+	}
+	for _, b := range l.perIP {
+		b.resize(perIPRate, burst, now)
+	}
+}
+
+// allow 判断来自 addr 的新连接是否可以接入
+func (l *acceptLimiter) allow(addr net.Addr) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.global == nil && l.perIPRate <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	if l.perIPRate > 0 {
+		ip := addr.String()
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+		}
+
+		// 定期清理已补满的令牌桶，避免来源IP过多时占用内存
+		if now.Sub(l.lastSweep) > time.Minute {
+			for key, b := range l.perIP {
+				if b.full(now) {
+					delete(l.perIP, key)
+				}
+			}
+			l.lastSweep = now
+		}
+
+		b, ok := l.perIP[ip]
+		if !ok {
+			b = newTokenBucket(l.perIPRate, l.burst, now)
+			l.perIP[ip] = b
+		}
+		if !b.allow(now) {
+			return false
+		}
+	}
+
+	return l.global == nil || l.global.allow(now)
+}
+
+// acquireHandshake 占用一个握手名额，名额已满时最多等待 handshake_queue_timeout，
+// 仍未获得时返回 false。返回的函数释放名额，可重复调用
+func (s *Server) acquireHandshake() (func(), bool) {
+	if s.handshakes == nil {
+		return func() {}, true
+	}
+
+	select {
+	case s.handshakes <- struct{}{}:
+	default:
+		timer := time.NewTimer(time.Duration(s.cfg().HandshakeQueueTimeout) * time.Millisecond)
+		defer timer.Stop()
+		select {
+		case s.handshakes <- struct{}{}:
+		case <-timer.C:
+			return nil, false
+		}
+	}
+	return sync.OnceFunc(func() { <-s.handshakes }), true
+}
+
+// destLimiter 限制到同一目标同时存在的连接数
+type destLimiter struct {
+	mu     sync.Mutex
+	max    int
+	active map[string]int // 规范化的目标 -> 进行中的连接数
+}
+
+// newDestLimiter 创建目标连接数限制器，max 为0时返回 nil 表示不限制
+func newDestLimiter(max int) *destLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &destLimiter{max: max, active: make(map[string]int)}
+}
+
+// acquire 为到 host:port 的连接占用一个名额，已达上限时返回 false。
+// 返回的函数释放名额，可重复调用
+func (d *destLimiter) acquire(host string, port uint16) (func(), bool) {
+	if d == nil {
+		return func() {}, true
+	}
+	key := normalizeDestination(host, port)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.active[key] >= d.max {
+		return nil, false
+	}
+	d.active[key]++
+	return sync.OnceFunc(func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if d.active[key]--; d.active[key] <= 0 {
+			delete(d.active, key)
+		}
+	}), true
+}
+
+// normalizeDestination 返回目标的规范形式：域名转为小写并去掉末尾的点，
+// IPv4 映射的 IPv6 地址按 IPv4 处理，使同一目标的不同写法共用一个名额
+func normalizeDestination(host string, port uint16) string {
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	} else {
+		host = strings.TrimSuffix(strings.ToLower(host), ".")
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port)))
+}
+
+// shareLimit 一个用户或用户组的连接数与带宽上限，0表示不限制
+type shareLimit struct {
+	name           string // 用于日志与错误信息，如 "用户组 team-a"
+	key            string // 共享状态的键，用户与用户组分开命名
+	maxConnections int
+	bandwidth      int64 // 字节/秒
+}
+
+// share 一个用户或用户组的共享状态，由其所有进行中的 CONNECT 会话共用
+type share struct {
+	conns  int
+	bucket *tokenBucket // 未限制带宽时为 nil
+}
+
+// shareLimiter 按用户与用户组限制同时存在的会话数与合计带宽。
+// 没有进行中的会话时释放对应状态，重新加载配置后新会话使用新的限制
+type shareLimiter struct {
+	mu     sync.Mutex
+	shares map[string]*share
+}
+
+// newShareLimiter 创建用户与用户组限制器
+func newShareLimiter() *shareLimiter {
+	return &shareLimiter{shares: make(map[string]*share)}
+}
+
+// acquire 为一个会话在 limits 的每一项中占用名额，任一项已达上限时不占用并返回错误
+func (l *shareLimiter) acquire(limits []shareLimit) (*shareLease, error) {
+	lease := &shareLease{limiter: l}
+	if len(limits) == 0 {
+		return lease, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, limit := range limits {
+		if sh := l.shares[limit.key]; limit.maxConnections > 0 && sh != nil && sh.conns >= limit.maxConnections {
+			return nil, fmt.Errorf("%w: %s 的连接数已达上限 %d", ErrQuotaExceeded, limit.name, limit.maxConnections)
+		}
+	}
+	now := time.Now()
+	for _, limit := range limits {
+		sh := l.shares[limit.key]
+		if sh == nil {
+			sh = &share{}
+			l.shares[limit.key] = sh
+		}
+		sh.conns++
+		switch rate := float64(limit.bandwidth); {
+		case rate <= 0:
+			sh.bucket = nil
+		case sh.bucket == nil:
+			sh.bucket = newTokenBucket(rate, 0, now)
+		default:
+			// 配置重新加载后按原速率补足至今的令牌，再更新速率与容量，剩余令牌不超过新的容量
+			sh.bucket.resize(rate, 0, now)
+		}
+		lease.keys = append(lease.keys, limit.key)
+	}
+	return lease, nil
+}
+
+// shareLease 一个会话占用的用户与用户组名额
+type shareLease struct {
+	limiter *shareLimiter
+	keys    []string
+	once    sync.Once
+}
+
+// release 释放会话占用的名额，可重复调用
+func (s *shareLease) release() {
+	s.once.Do(func() {
+		s.limiter.mu.Lock()
+		defer s.limiter.mu.Unlock()
+		for _, key := range s.keys {
+			if sh := s.limiter.shares[key]; sh != nil {
+				if sh.conns--; sh.conns <= 0 {
+					delete(s.limiter.shares, key)
+				}
+			}
+		}
+	})
+}
+
+// throttle 从会话所属的每个令牌桶取出 n 字节的额度，返回需要等待的最长时间
+func (s *shareLease) throttle(n int) time.Duration {
+	s.limiter.mu.Lock()
+	defer s.limiter.mu.Unlock()
+	now := time.Now()
+	var wait time.Duration
+	for _, key := range s.keys {
+		if sh := s.limiter.shares[key]; sh != nil && sh.bucket != nil {
+			wait = max(wait, sh.bucket.reserve(float64(n), now))
+		}
+	}
+	return wait
+}
+
+// chunk 返回单次读取的上限：不超过会话所属令牌桶中最小的突发容量，
+// 使每次读取后需要等待的时间保持在突发容量对应的时长内
+func (s *shareLease) chunk(n int) int {
+	s.limiter.mu.Lock()
+	defer s.limiter.mu.Unlock()
+	for _, key := range s.keys {
+		if sh := s.limiter.shares[key]; sh != nil && sh.bucket != nil {
+			n = min(n, max(int(sh.bucket.burst), 1))
+		}
+	}
+	return n
+}
+
+// wrap 为读取端加上带宽限制，done 关闭时结束等待。会话不受带宽限制时原样返回，
+// 以便使用零拷贝转发；因此重新加载配置为其增加带宽限制后，已建立的会话仍不限速，
+// 只有新会话受限。已限速的会话在每次读取时使用当前的速率，取消限制后不再等待
+func (s *shareLease) wrap(r io.Reader, done <-chan struct{}) io.Reader {
+	s.limiter.mu.Lock()
+	defer s.limiter.mu.Unlock()
+	for _, key := range s.keys {
+		if sh := s.limiter.shares[key]; sh != nil && sh.bucket != nil {
+			return &throttledReader{r: r, lease: s, done: done}
+		}
+	}
+	return r
+}
+
+// throttledReader 每次读取后按读取的字节数扣除额度，额度透支时等待补足。
+// 会话结束（done 关闭）时立即结束等待
+type throttledReader struct {
+	r     io.Reader
+	lease *shareLease
+	done  <-chan struct{}
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	p = p[:r.lease.chunk(len(p))]
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if wait := r.lease.throttle(n); wait > 0 {
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-r.done:
+			}
+		}
+	}
+	return n, err
+}
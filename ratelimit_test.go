@@ -0,0 +1,495 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"expvar"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowAuthenticator 在 ctx 取消前不返回的认证后端
+type slowAuthenticator struct{}
+
+func (slowAuthenticator) Authenticate(ctx context.Context, ac AuthContext) (bool, error) {
+	<-ctx.Done()
+	return false, ctx.Err()
+}
+
+// failureCount 返回 request_failures_total 中某个原因的计数
+func failureCount(reason string) int64 {
+	v, ok := expvar.Get("request_failures_total").(*expvar.Map).Get(`{reason="` + reason + `"}`).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+	return v.Value()
+}
+
+// waitHandshakes 等待进行中的握手数达到 n
+func waitHandshakes(t *testing.T, s *Server, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s.handshakes) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("进行中的握手数为 %d, 期望 %d", len(s.handshakes), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHandshakeTimeoutReleasesSlot(t *testing.T) {
+	echo := startEcho(t)
+	tests := []struct {
+		name   string
+		config string
+		stall  func(t *testing.T, conn net.Conn) // 发送部分握手后停止
+		setup  func(s *Server)
+	}{
+		{"不发送数据", ``, func(t *testing.T, conn net.Conn) {}, nil},
+		{"PROXY协议头不完整", `, "proxy_protocol": {"enable": true, "trusted": ["127.0.0.0/8"]}`, func(t *testing.T, conn net.Conn) {
+			mustWrite(t, conn, []byte("PROXY TCP4 192.0.2.1"))
+		}, nil},
+		{"方法列表不完整", ``, func(t *testing.T, conn net.Conn) {
+			mustWrite(t, conn, []byte{Version5, 2, MethodNoAuth})
+		}, nil},
+		{"协商后不认证", `, "users": {"alice": {"password": "secret"}}`, func(t *testing.T, conn net.Conn) {
+			mustWrite(t, conn, []byte{Version5, 1, MethodUserPass})
+			expectBytes(t, conn, []byte{Version5, MethodUserPass})
+		}, nil},
+		{"SOCKS4请求不完整", ``, func(t *testing.T, conn net.Conn) {
+			mustWrite(t, conn, []byte{Version4, CmdConnect, 0, 80})
+		}, nil},
+		{"认证后端缓慢", `, "users": {"alice": {"password": "secret"}}`, func(t *testing.T, conn net.Conn) {
+			mustWrite(t, conn, []byte{Version5, 1, MethodUserPass})
+			expectBytes(t, conn, []byte{Version5, MethodUserPass})
+			mustWrite(t, conn, userPassAuth("alice", "secret"))
+		}, func(s *Server) { s.Authenticator = slowAuthenticator{} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, `{"max_handshakes": 1, "handshake_queue_timeout": 50, "handshake_timeout": 300`+tt.config+`}`)
+			var setup []func(*Server)
+			if tt.setup != nil {
+				setup = append(setup, tt.setup)
+			}
+			s := startServer(t, cfg, setup...)
+
+			// 停滞的客户端占用唯一的握手名额，名额已满时新连接被关闭
+			before := failureCount(reasonHandshakeTimeout)
+			stalled := dialServer(t, s)
+			tt.stall(t, stalled)
+			waitHandshakes(t, s, 1)
+			expectClosed(t, dialServer(t, s))
+
+			// 握手截止时间到达后停滞的连接被关闭并释放名额
+			start := time.Now()
+			expectClosed(t, stalled)
+			if elapsed := time.Since(start); elapsed > 3*time.Second {
+				t.Fatalf("停滞的连接 %v 后才关闭", elapsed)
+			}
+			waitHandshakes(t, s, 0)
+			for failureCount(reasonHandshakeTimeout) == before && time.Since(start) < 5*time.Second {
+				time.Sleep(time.Millisecond)
+			}
+			if n := failureCount(reasonHandshakeTimeout) - before; n != 1 {
+				t.Fatalf("reason=handshake_timeout 的失败数增加 %d, 期望1", n)
+			}
+		})
+	}
+
+	// 进入请求阶段前清除截止时间，认证后超过 handshake_timeout 才发送请求不受影响
+	t.Run("请求阶段不受限制", func(t *testing.T) {
+		s := startServer(t, testConfig(t, `{"max_handshakes": 1, "handshake_timeout": 100}`))
+		conn := dialServer(t, s)
+		greet(t, conn, "", "")
+		time.Sleep(300 * time.Millisecond)
+		host, port, _ := net.SplitHostPort(echo)
+		p, _ := strconv.Atoi(port)
+		mustWrite(t, conn, requestBytes(CmdConnect, host, uint16(p)))
+		if rep, _ := readReply(t, conn); rep != RepSuccess {
+			t.Fatalf("回复码 %#x, 期望成功", rep)
+		}
+		mustWrite(t, conn, []byte("ping"))
+		expectBytes(t, conn, []byte("ping"))
+	})
+}
+
+func TestHandshakeTimeoutConfig(t *testing.T) {
+	tests := []struct {
+		config string
+		want   int
+		valid  bool
+	}{
+		{`{}`, 10000, true},
+		{`{"handshake_timeout": 0}`, 0, true},
+		{`{"handshake_timeout": 2500}`, 2500, true},
+		{`{"handshake_timeout": -1}`, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.config, func(t *testing.T) {
+			cfg, err := parseConfig([]byte(tt.config))
+			if (err == nil) != tt.valid {
+				t.Fatalf("parseConfig 错误 %v, 期望有效 %v", err, tt.valid)
+			}
+			if err == nil && cfg.HandshakeTimeout != tt.want {
+				t.Fatalf("handshake_timeout 为 %d, 期望 %d", cfg.HandshakeTimeout, tt.want)
+			}
+		})
+	}
+}
+
+// greetFrom 从 local 地址连接 addr 并发送问候，返回服务器是否回复了认证方法
+func greetFrom(t *testing.T, addr string, local net.IP) bool {
+	t.Helper()
+	d := net.Dialer{LocalAddr: &net.TCPAddr{IP: local}, Timeout: 5 * time.Second}
+	conn, err := d.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("从 %s 连接失败: %v", local, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte{Version5, 1, MethodNoAuth}); err != nil {
+		return false
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			t.Fatalf("从 %s 的连接既未被关闭也未收到回复", local)
+		}
+		return false
+	}
+	return buf[0] == Version5 && buf[1] == MethodNoAuth
+}
+
+func TestAcceptRate(t *testing.T) {
+	first, second := net.IPv4(127, 0, 0, 1), net.IPv4(127, 0, 0, 2)
+	if ln, err := net.Listen("tcp", "127.0.0.2:0"); err != nil {
+		second = nil
+	} else {
+		ln.Close()
+	}
+
+	// 速率足够低，测试期间不会补充令牌
+	tests := []struct {
+		name    string
+		config  string
+		sources []net.IP
+		served  []bool
+	}{
+		{"不限制", `{}`, []net.IP{first, first, first, first}, []bool{true, true, true, true}},
+		{"全局限制", `{"accept_rate": {"global": 0.001, "burst": 2}}`, []net.IP{first, first, first, first}, []bool{true, true, false, false}},
+		{"全局限制不区分来源", `{"accept_rate": {"global": 0.001, "burst": 2}}`, []net.IP{first, second, second, first}, []bool{true, true, false, false}},
+		{"每个来源IP分别限制", `{"accept_rate": {"per_ip": 0.001, "burst": 2}}`, []net.IP{first, first, first, second, second, second}, []bool{true, true, false, true, true, false}},
+		{"两者同时限制", `{"accept_rate": {"global": 0.001, "per_ip": 0.001, "burst": 2}}`, []net.IP{first, first, second, second}, []bool{true, true, false, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, ip := range tt.sources {
+				if ip == nil {
+					t.Skip("无法绑定 127.0.0.2")
+				}
+			}
+			s := startServer(t, testConfig(t, tt.config))
+			rejected := counterValue("accept_rate_limited_total")
+			var want int64
+			for i, ip := range tt.sources {
+				if got := greetFrom(t, s.Addr().String(), ip); got != tt.served[i] {
+					t.Fatalf("第 %d 个连接（来自 %s）被服务为 %v, 期望 %v", i+1, ip, got, tt.served[i])
+				}
+				if !tt.served[i] {
+					want++
+				}
+			}
+			if got := counterValue("accept_rate_limited_total") - rejected; got != want {
+				t.Fatalf("accept_rate_limited_total 增加了 %d, 期望 %d", got, want)
+			}
+		})
+	}
+}
+
+func TestMaxConnectionsPerDestination(t *testing.T) {
+	echo := startEcho(t)
+	tests := []struct {
+		name    string
+		max     int
+		targets []string // 依次建立并保持的会话
+		reps    []uint8
+	}{
+		{"超过上限被拒绝", 2, []string{"a.test:80", "a.test:80", "a.test:80"}, []uint8{RepSuccess, RepSuccess, RepServerFailure}},
+		{"其他目标不受影响", 1, []string{"a.test:80", "b.test:80", "a.test:443", "a.test:80"}, []uint8{RepSuccess, RepSuccess, RepSuccess, RepServerFailure}},
+		{"同一目标的不同写法", 1, []string{"a.test:80", "A.Test.:80"}, []uint8{RepSuccess, RepServerFailure}},
+		{"IPv4映射地址", 1, []string{"192.0.2.1:80", "[::ffff:192.0.2.1]:80"}, []uint8{RepSuccess, RepServerFailure}},
+		{"未限制", 0, []string{"a.test:80", "a.test:80", "a.test:80"}, []uint8{RepSuccess, RepSuccess, RepSuccess}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startServer(t, testConfig(t, `{"max_connections_per_destination": `+strconv.Itoa(tt.max)+`}`), func(s *Server) {
+				s.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "tcp", echo)
+				}
+			})
+			rejected := counterValue("destination_connections_rejected_total")
+			var want int64
+			var first net.Conn
+			for i, target := range tt.targets {
+				conn, rep, _ := connect(t, s, "", "", CmdConnect, target)
+				if rep != tt.reps[i] {
+					t.Fatalf("第 %d 个到 %s 的请求回复码 %#x, 期望 %#x", i+1, target, rep, tt.reps[i])
+				}
+				if rep != RepSuccess {
+					want++
+					expectClosed(t, conn)
+					continue
+				}
+				mustWrite(t, conn, []byte("hello"))
+				expectBytes(t, conn, []byte("hello"))
+				if first == nil {
+					first = conn
+				}
+			}
+			if got := counterValue("destination_connections_rejected_total") - rejected; got != want {
+				t.Fatalf("destination_connections_rejected_total 增加 %d, 期望 %d", got, want)
+			}
+			if want == 0 {
+				return
+			}
+
+			// 会话结束后释放名额
+			first.Close()
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				conn, rep, _ := connect(t, s, "", "", CmdConnect, tt.targets[0])
+				if rep == RepSuccess {
+					conn.Close()
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("会话结束后到 %s 的请求回复码 %#x", tt.targets[0], rep)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestGroupConnectionLimits(t *testing.T) {
+	echo := startEcho(t)
+	tests := []struct {
+		name   string
+		config string
+		users  []string // 依次建立并保持会话的用户
+		reps   []uint8
+	}{
+		{"组内成员合计", `"users": {"alice": {"password": "secret", "group": "team"}, "bob": {"password": "secret", "group": "team"}}, "groups": {"team": {"max_connections": 2}}`,
+			[]string{"alice", "bob", "alice", "bob"}, []uint8{RepSuccess, RepSuccess, RepServerFailure, RepServerFailure}},
+		{"不同组各自计数", `"users": {"alice": {"password": "secret", "group": "a"}, "bob": {"password": "secret", "group": "b"}}, "groups": {"a": {"max_connections": 1}, "b": {"max_connections": 1}}`,
+			[]string{"alice", "bob", "alice"}, []uint8{RepSuccess, RepSuccess, RepServerFailure}},
+		{"用户上限先于组上限", `"users": {"alice": {"password": "secret", "group": "team", "max_connections": 1}, "bob": {"password": "secret", "group": "team"}}, "groups": {"team": {"max_connections": 3}}`,
+			[]string{"alice", "alice", "bob", "bob", "bob"}, []uint8{RepSuccess, RepServerFailure, RepSuccess, RepSuccess, RepServerFailure}},
+		// 用户与同名的用户组分开计数
+		{"与用户同名的组", `"users": {"team": {"password": "secret", "max_connections": 1}, "alice": {"password": "secret", "group": "team"}}, "groups": {"team": {"max_connections": 1}}`,
+			[]string{"team", "alice", "team"}, []uint8{RepSuccess, RepSuccess, RepServerFailure}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startServer(t, testConfig(t, `{`+tt.config+`}`))
+			failures := failureCount(reasonQuotaExceeded)
+			var want int64
+			for i, user := range tt.users {
+				conn, rep := tryConnect(t, s, user, echo)
+				if rep != tt.reps[i] {
+					t.Fatalf("第 %d 个请求（%s）回复码 %#x, 期望 %#x", i+1, user, rep, tt.reps[i])
+				}
+				if rep != RepSuccess {
+					want++
+					continue
+				}
+				mustWrite(t, conn, []byte("hello"))
+				expectBytes(t, conn, []byte("hello"))
+			}
+			deadline := time.Now().Add(5 * time.Second)
+			for failureCount(reasonQuotaExceeded)-failures != want {
+				if time.Now().After(deadline) {
+					t.Fatalf("reason=quota_exceeded 的失败数增加 %d, 期望 %d", failureCount(reasonQuotaExceeded)-failures, want)
+				}
+				time.Sleep(time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestGroupBandwidth(t *testing.T) {
+	echo := startEcho(t)
+	// 每个用户经回显服务往返 size 字节，上下行合计 2*size 计入限速；突发容量为1秒的带宽
+	const size = 40000
+	tests := []struct {
+		name   string
+		config string
+		slow   bool // 两个用户合计超过突发容量，需要等待补充令牌
+	}{
+		{"同组成员共享带宽", `"users": {"alice": {"password": "secret", "group": "team"}, "bob": {"password": "secret", "group": "team"}}, "groups": {"team": {"bandwidth": 100000}}`, true},
+		{"不同组各自限速", `"users": {"alice": {"password": "secret", "group": "a"}, "bob": {"password": "secret", "group": "b"}}, "groups": {"a": {"bandwidth": 100000}, "b": {"bandwidth": 100000}}`, false},
+		{"用户限速与组限速同时生效", `"users": {"alice": {"password": "secret", "group": "team", "bandwidth": 50000}, "bob": {"password": "secret", "group": "team"}}, "groups": {"team": {"bandwidth": 1000000}}`, true},
+		{"未限速", `"users": {"alice": {"password": "secret", "group": "team"}, "bob": {"password": "secret", "group": "team"}}, "groups": {"team": {}}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startServer(t, testConfig(t, `{`+tt.config+`}`))
+			payload := bytes.Repeat([]byte("x"), size)
+
+			start := time.Now()
+			var wg sync.WaitGroup
+			for _, user := range []string{"alice", "bob"} {
+				conn, rep := tryConnect(t, s, user, echo)
+				if rep != RepSuccess {
+					t.Fatalf("%s 的请求回复码 %#x", user, rep)
+				}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					go conn.Write(payload)
+					if _, err := io.ReadFull(conn, make([]byte, size)); err != nil {
+						t.Errorf("读取回显失败: %v", err)
+					}
+				}()
+			}
+			wg.Wait()
+			// 限速时至少需要 (4*size - 100000) / 100000 = 0.6s
+			if elapsed := time.Since(start); (elapsed >= 300*time.Millisecond) != tt.slow {
+				t.Fatalf("传输用时 %v, 期望限速为 %v", elapsed, tt.slow)
+			}
+		})
+	}
+}
+
+func TestThrottledSessionReleasesSlots(t *testing.T) {
+	echo := startEcho(t)
+	// 带宽很低，两个方向共用额度，会话结束时转发协程都在等待补充令牌
+	s := startServer(t, testConfig(t, `{"max_session_duration": 1, "users": {"alice": {"password": "secret", "bandwidth": 1000, "max_connections": 1}}}`))
+
+	conn, rep := tryConnect(t, s, "alice", echo)
+	if rep != RepSuccess {
+		t.Fatalf("请求回复码 %#x", rep)
+	}
+	go conn.Write(bytes.Repeat([]byte("x"), 64*1024))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(io.Discard, conn); err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			t.Fatal("会话到期后连接仍然打开")
+		}
+	}
+	conn.Close()
+
+	// 会话关闭后不必等到限速的等待结束，名额立即释放
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for {
+		conn, rep := tryConnect(t, s, "alice", echo)
+		conn.Close()
+		if rep == RepSuccess {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("会话关闭后新请求的回复码 %#x", rep)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestThrottledReaderChunk(t *testing.T) {
+	lease, err := newShareLimiter().acquire([]shareLimit{{name: "用户 alice", key: "user:alice", bandwidth: 100}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	r := lease.wrap(bytes.NewReader(make([]byte, 1000)), done)
+
+	// 单次读取不超过突发容量
+	if n, err := r.Read(make([]byte, 1000)); n != 100 || err != nil {
+		t.Fatalf("第一次读取 %d 字节 (%v), 期望 100 字节", n, err)
+	}
+
+	// 额度耗尽后的等待在 done 关闭时结束
+	time.AfterFunc(50*time.Millisecond, func() { close(done) })
+	start := time.Now()
+	if _, err := r.Read(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("done 关闭后仍等待了 %v", elapsed)
+	}
+}
+
+func TestAcceptRateReload(t *testing.T) {
+	local := net.IPv4(127, 0, 0, 1)
+	s := startServer(t, testConfig(t, `{"accept_rate": {"global": 0.001, "burst": 2}}`))
+	served := func(want bool) {
+		t.Helper()
+		if got := greetFrom(t, s.Addr().String(), local); got != want {
+			t.Fatalf("新连接被服务为 %v, 期望 %v", got, want)
+		}
+	}
+	reload := func(config string) {
+		t.Helper()
+		if err := s.Reload(testConfig(t, config)); err != nil {
+			t.Fatalf("重新加载失败: %v", err)
+		}
+	}
+	served(true)
+	served(true)
+	served(false)
+
+	// 调大突发容量不会重新装满令牌桶
+	reload(`{"accept_rate": {"global": 0.001, "burst": 5}}`)
+	served(false)
+
+	// 取消限制后立即生效
+	reload(`{}`)
+	served(true)
+	served(true)
+	served(true)
+
+	// 重新启用时按新的容量限制
+	reload(`{"accept_rate": {"per_ip": 0.001, "burst": 1}}`)
+	served(true)
+	served(false)
+}
+
+func TestShareBandwidthReload(t *testing.T) {
+	l := newShareLimiter()
+	limit := shareLimit{name: "用户组 team", key: "group:team", bandwidth: 100}
+	old, err := l.acquire([]shareLimit{limit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.release()
+	old.throttle(100) // 用完突发容量
+
+	// 重新加载提高带宽：重新加载之前的时间按原速率补充令牌，不按新速率追溯
+	time.Sleep(100 * time.Millisecond)
+	limit.bandwidth = 100000
+	lease, err := l.acquire([]shareLimit{limit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lease.release()
+	if wait := lease.throttle(1000); wait == 0 {
+		t.Fatal("重新加载前的空闲时间按新速率补充了令牌")
+	}
+
+	// 重新加载降低带宽：剩余额度不超过新的容量
+	time.Sleep(100 * time.Millisecond)
+	limit.bandwidth = 100
+	again, err := l.acquire([]shareLimit{limit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.release()
+	if wait := again.throttle(200); wait < 500*time.Millisecond {
+		t.Fatalf("超出新容量后等待 %v, 期望按新速率约1秒", wait)
+	}
+}
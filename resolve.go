@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+)
+
+// Resolver 解析域名，*net.Resolver 满足该接口
+type Resolver interface {
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+}
+
+// 域名解析的地址族优先顺序
+const (
+	DNSPreferSystem = "system"
+	DNSPreferIPv4   = "ipv4"
+	DNSPreferIPv6   = "ipv6"
+)
+
+// lookupIP 使用 Server.Resolver（未设置时为系统解析器）解析域名，
+// 并按 dns_preference 将优先的地址族排在前面
+func (s *Server) lookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	var ips []net.IP
+	var err error
+	if s.Resolver != nil {
+		ips, err = s.Resolver.LookupIP(ctx, network, host)
+	} else {
+		ips, err = net.DefaultResolver.LookupIP(ctx, network, host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sortByPreference(ips, s.cfg().DNSPreference)
+	return ips, nil
+}
+
+// sortByPreference 将优先地址族的IP稳定地排到前面，同一地址族内保持解析器返回的顺序
+func sortByPreference(ips []net.IP, preference string) {
+	if preference != DNSPreferIPv4 && preference != DNSPreferIPv6 {
+		return
+	}
+	wantV4 := preference == DNSPreferIPv4
+	sort.SliceStable(ips, func(i, j int) bool {
+		return (ips[i].To4() != nil) == wantV4 && (ips[j].To4() != nil) != wantV4
+	})
+}
+
+// resolveTarget 在本地解析目标中的域名，返回 "IP:端口"
+func (s *Server) resolveTarget(ctx context.Context, target string) (string, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil || net.ParseIP(host) != nil {
+		return target, err
+	}
+	ips, err := s.lookupIP(ctx, "ip", host)
+	if err != nil || len(ips) == 0 {
+		return "", fmt.Errorf("%w: 解析 %s 失败: %v", ErrResolveFailed, host, err)
+	}
+	return net.JoinHostPort(ips[0].String(), port), nil
+}
+
+// prefersFamily 判断是否配置了地址族优先顺序，此时直接连接的域名由本地按该顺序解析，
+// 而不是交给拨号器（拨号器总是优先使用解析器返回的第一个地址族）
+func (s *Server) prefersFamily() bool {
+	return s.cfg().DNSPreference == DNSPreferIPv4 || s.cfg().DNSPreference == DNSPreferIPv6
+}
+
+// isPrivateIP 判断IP是否属于私有、回环、链路本地或未指定地址
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
+
+// defaultSpecialUseRanges public_targets_only 默认拒绝的特殊用途地址段，
+// 取自 IANA IPv4/IPv6 Special-Purpose Address Registry 中不可全局路由的地址段，
+// 以及组播、保留与广播地址
+var defaultSpecialUseRanges = []string{
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.0.0.0/24", "192.0.2.0/24", "192.88.99.0/24", "192.168.0.0/16",
+	"198.18.0.0/15", "198.51.100.0/24", "203.0.113.0/24", "224.0.0.0/4", "240.0.0.0/4",
+	"::/128", "::1/128", "64:ff9b:1::/48", "100::/64", "2001::/23", "2001:db8::/32",
+	"2002::/16", "fc00::/7", "fe80::/10", "ff00::/8",
+}
+
+// parseCIDRs 解析 CIDR 列表
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// isPublicIP 判断IP是否为公网单播地址：全局单播且不属于任何特殊用途地址段
+func isPublicIP(ip net.IP, specialUse []*net.IPNet) bool {
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	for _, n := range specialUse {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkTargetIP 对目标IP应用路由 block 规则、私有地址与公网地址限制
+func (s *Server) checkTargetIP(p *policy, ip net.IP) error {
+	if p.router.lookup(ip.String()) == RouteBlock {
+		return fmt.Errorf("%w: 路由规则禁止访问 %s", ErrConnectionNotAllowed, ip)
+	}
+	st := s.settings.Load()
+	if st.config.BlockPrivateTargets && isPrivateIP(ip) {
+		return fmt.Errorf("%w: 禁止访问私有地址 %s", ErrConnectionNotAllowed, ip)
+	}
+	if st.config.PublicTargetsOnly && !isPublicIP(ip, st.specialUse) {
+		return fmt.Errorf("%w: 禁止访问非公网地址 %s", ErrConnectionNotAllowed, ip)
+	}
+	return nil
+}
+
+// pinTarget 解析目标域名一次，对解析结果逐个应用访问规则，返回第一个允许访问的
+// "IP:端口"。之后直接连接该IP，避免连接时再次解析得到与校验时不同的地址（DNS 重绑定）。
+func (s *Server) pinTarget(ctx context.Context, p *policy, network, host, port string) (string, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		if err := s.checkTargetIP(p, ip); err != nil {
+			return "", err
+		}
+		return net.JoinHostPort(host, port), nil
+	}
+
+	ipNetwork := "ip"
+	switch network {
+	case "tcp4":
+		ipNetwork = "ip4"
+	case "tcp6":
+		ipNetwork = "ip6"
+	}
+	ips, err := s.lookupIP(ctx, ipNetwork, host)
+	if err == nil && len(ips) == 0 {
+		err = fmt.Errorf("没有可用的地址")
+	}
+	if err != nil {
+		return "", fmt.Errorf("%w: 解析 %s 失败: %v", ErrResolveFailed, host, err)
+	}
+
+	var denied error
+	for _, ip := range ips {
+		if err := s.checkTargetIP(p, ip); err != nil {
+			denied = err
+			continue
+		}
+		return net.JoinHostPort(ip.String(), port), nil
+	}
+	return "", fmt.Errorf("%s 的解析结果均被拒绝: %w", host, denied)
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// sequenceResolver 依次返回 answers 中的解析结果，用完后重复最后一个，模拟 DNS 重绑定
+type sequenceResolver struct {
+	mu      sync.Mutex
+	answers [][]net.IP
+	calls   int
+}
+
+func (r *sequenceResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	answer := r.answers[min(r.calls, len(r.answers)-1)]
+	r.calls++
+	return append([]net.IP(nil), answer...), nil
+}
+
+// recordingDial 返回记录拨号地址并实际连接 target 的 Server.Dial
+func recordingDial(target string, dialed *[]string, mu *sync.Mutex) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		mu.Lock()
+		*dialed = append(*dialed, address)
+		mu.Unlock()
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", target)
+	}
+}
+
+func TestBlockPrivateTargetsPinsDomains(t *testing.T) {
+	echo := startEcho(t)
+	public := net.IPv4(93, 184, 216, 34)
+	tests := []struct {
+		name    string
+		answers [][]net.IP
+		rep     uint8
+		dialed  string // 期望的拨号地址，为空表示不应拨号
+	}{
+		{"公网地址", [][]net.IP{{public}}, RepSuccess, "93.184.216.34:80"},
+		{"跳过私有地址", [][]net.IP{{net.IPv4(10, 0, 0, 1), public}}, RepSuccess, "93.184.216.34:80"},
+		{"只有私有地址", [][]net.IP{{net.IPv4(127, 0, 0, 1)}}, RepConnectionNotAllowed, ""},
+		// 第二次解析返回私有地址，固定连接后不会再次解析
+		{"DNS重绑定", [][]net.IP{{public}, {net.IPv4(127, 0, 0, 1)}}, RepSuccess, "93.184.216.34:80"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver := &sequenceResolver{answers: tt.answers}
+			var mu sync.Mutex
+			var dialed []string
+			s := startServer(t, testConfig(t, `{"block_private_targets": true}`), func(s *Server) {
+				s.Resolver = resolver
+				s.Dial = recordingDial(echo, &dialed, &mu)
+			})
+			_, rep, _ := connect(t, s, "", "", CmdConnect, "rebind.test:80")
+			if rep != tt.rep {
+				t.Fatalf("回复码 %#x, 期望 %#x", rep, tt.rep)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case tt.dialed == "" && len(dialed) > 0:
+				t.Fatalf("不应拨号, 实际拨号 %v", dialed)
+			case tt.dialed != "" && (len(dialed) != 1 || dialed[0] != tt.dialed):
+				t.Fatalf("拨号 %v, 期望 [%s]", dialed, tt.dialed)
+			}
+			if resolver.calls != 1 {
+				t.Fatalf("解析 %d 次, 期望1次", resolver.calls)
+			}
+		})
+	}
+
+	// 未设置 Resolver 时域名目标同样先解析再校验，而不是交给拨号器解析
+	t.Run("系统解析器", func(t *testing.T) {
+		var mu sync.Mutex
+		var dialed []string
+		s := startServer(t, testConfig(t, `{"block_private_targets": true}`), func(s *Server) {
+			s.Dial = recordingDial(echo, &dialed, &mu)
+		})
+		_, port, _ := net.SplitHostPort(echo)
+		_, rep, _ := connect(t, s, "", "", CmdConnect, net.JoinHostPort("localhost", port))
+		if rep == RepSuccess {
+			t.Fatalf("CONNECT localhost 成功, 期望被拒绝")
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if len(dialed) > 0 {
+			t.Fatalf("不应拨号, 实际拨号 %v", dialed)
+		}
+	})
+}
+
+func TestCheckTargetIPPublicOnly(t *testing.T) {
+	tests := []struct {
+		ip      string
+		ranges  string // special_use_ranges，为空时使用内置列表
+		allowed bool
+	}{
+		{"93.184.216.34", "", true},
+		{"2606:4700::1111", "", true},
+		{"224.0.0.251", "", false},     // 组播
+		{"ff02::fb", "", false},        // IPv6 组播
+		{"255.255.255.255", "", false}, // 广播
+		{"169.254.1.1", "", false},     // 链路本地
+		{"fe80::1", "", false},         // IPv6 链路本地
+		{"10.0.0.1", "", false},        // 私有
+		{"192.168.1.1", "", false},     // 私有
+		{"fd00::1", "", false},         // IPv6 唯一本地
+		{"127.0.0.1", "", false},       // 回环
+		{"100.64.0.1", "", false},      // 运营商级NAT
+		{"192.0.2.1", "", false},       // 文档地址
+		{"198.18.0.1", "", false},      // 基准测试
+		{"240.0.0.1", "", false},       // 保留
+		{"100.64.0.1", `[]`, true},     // 不配置特殊用途地址段时只按地址类型拒绝
+		{"224.0.0.251", `[]`, false},   // 组播不是全局单播
+		{"10.0.0.1", `[]`, false},      // 私有地址总是拒绝
+		{"93.184.216.34", `["93.184.216.0/24"]`, false},
+	}
+	for _, tt := range tests {
+		name := tt.ip
+		if tt.ranges != "" {
+			name += " " + tt.ranges
+		}
+		t.Run(name, func(t *testing.T) {
+			cfg := `{"public_targets_only": true}`
+			if tt.ranges != "" {
+				cfg = `{"public_targets_only": true, "special_use_ranges": ` + tt.ranges + `}`
+			}
+			s := NewServer(testConfig(t, cfg))
+			err := s.checkTargetIP(s.settings.Load().policy, net.ParseIP(tt.ip))
+			if allowed := err == nil; allowed != tt.allowed {
+				t.Fatalf("checkTargetIP(%s) = %v, 期望允许 %v", tt.ip, err, tt.allowed)
+			}
+			if err != nil && !errors.Is(err, ErrConnectionNotAllowed) {
+				t.Fatalf("错误 %v 不是 ErrConnectionNotAllowed", err)
+			}
+		})
+	}
+}
+
+func TestPublicTargetsOnlyPinsDomains(t *testing.T) {
+	echo := startEcho(t)
+	tests := []struct {
+		name   string
+		answer []net.IP
+		rep    uint8
+		dialed string
+	}{
+		{"公网地址", []net.IP{net.ParseIP("93.184.216.34")}, RepSuccess, "93.184.216.34:80"},
+		{"跳过非公网地址", []net.IP{net.ParseIP("224.0.0.251"), net.ParseIP("169.254.1.1"), net.ParseIP("10.0.0.1"), net.ParseIP("93.184.216.34")}, RepSuccess, "93.184.216.34:80"},
+		{"组播", []net.IP{net.ParseIP("224.0.0.251")}, RepConnectionNotAllowed, ""},
+		{"链路本地", []net.IP{net.ParseIP("169.254.1.1"), net.ParseIP("fe80::1")}, RepConnectionNotAllowed, ""},
+		{"私有地址", []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("fd00::1")}, RepConnectionNotAllowed, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var dialed []string
+			s := startServer(t, testConfig(t, `{"public_targets_only": true}`), func(s *Server) {
+				s.Resolver = &sequenceResolver{answers: [][]net.IP{tt.answer}}
+				s.Dial = recordingDial(echo, &dialed, &mu)
+			})
+			_, rep, _ := connect(t, s, "", "", CmdConnect, "public.test:80")
+			if rep != tt.rep {
+				t.Fatalf("回复码 %#x, 期望 %#x", rep, tt.rep)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if got := strings.Join(dialed, ","); got != tt.dialed {
+				t.Fatalf("拨号 [%s], 期望 [%s]", got, tt.dialed)
+			}
+		})
+	}
+}
+
+// familyResolver 像系统解析器一样只返回 network 限定地址族的结果，并记录请求的 network
+type familyResolver struct {
+	mu       sync.Mutex
+	ips      []net.IP
+	networks []string
+}
+
+func (r *familyResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.networks = append(r.networks, network)
+	var ips []net.IP
+	for _, ip := range r.ips {
+		if network == "ip" || (network == "ip4") == (ip.To4() != nil) {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, nil
+}
+
+func TestNetworkFamily(t *testing.T) {
+	echo := startEcho(t)
+	tests := []struct {
+		network string
+		target  string
+		rep     uint8
+		lookup  string // 解析域名时请求的 network
+		dialed  string // 拨号的 network 与地址，为空表示不拨号
+	}{
+		{"tcp4", "[2001:db8::1]:80", RepAddressTypeNotSupported, "", ""},
+		{"tcp4", "192.0.2.1:80", RepSuccess, "", "tcp4 192.0.2.1:80"},
+		{"tcp4", "dual.test:80", RepSuccess, "ip4", "tcp4 192.0.2.1:80"},
+		{"tcp6", "192.0.2.1:80", RepAddressTypeNotSupported, "", ""},
+		{"tcp6", "dual.test:80", RepSuccess, "ip6", "tcp6 [2001:db8::1]:80"},
+		{"tcp", "[2001:db8::1]:80", RepSuccess, "", "tcp [2001:db8::1]:80"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.network+" "+tt.target, func(t *testing.T) {
+			resolver := &familyResolver{ips: []net.IP{net.ParseIP("2001:db8::1"), net.IPv4(192, 0, 2, 1)}}
+			var mu sync.Mutex
+			var dialed []string
+			s := startServer(t, testConfig(t, `{"network": "`+tt.network+`"}`), func(s *Server) {
+				s.Resolver = resolver
+				s.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+					mu.Lock()
+					dialed = append(dialed, network+" "+address)
+					mu.Unlock()
+					var d net.Dialer
+					return d.DialContext(ctx, "tcp", echo)
+				}
+			})
+
+			if _, rep, _ := connect(t, s, "", "", CmdConnect, tt.target); rep != tt.rep {
+				t.Fatalf("回复码 %#x, 期望 %#x", rep, tt.rep)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if got := strings.Join(dialed, ","); got != tt.dialed {
+				t.Fatalf("拨号 %q, 期望 %q", got, tt.dialed)
+			}
+			resolver.mu.Lock()
+			defer resolver.mu.Unlock()
+			if got := strings.Join(resolver.networks, ","); got != tt.lookup {
+				t.Fatalf("解析请求的 network 为 %q, 期望 %q", got, tt.lookup)
+			}
+		})
+	}
+}
+
+func TestDNSPreference(t *testing.T) {
+	echo := startEcho(t)
+	v6First := []net.IP{net.ParseIP("2001:db8::1"), net.IPv4(192, 0, 2, 1), net.ParseIP("2001:db8::2"), net.IPv4(192, 0, 2, 2)}
+	v4First := []net.IP{net.IPv4(192, 0, 2, 1), net.ParseIP("2001:db8::1")}
+	tests := []struct {
+		preference string
+		answers    []net.IP
+		dialed     string
+		order      string // 排序后的解析结果，同一地址族内保持解析器返回的顺序
+	}{
+		{"", v6First, "[2001:db8::1]:80", "2001:db8::1,192.0.2.1,2001:db8::2,192.0.2.2"},
+		{DNSPreferSystem, v4First, "192.0.2.1:80", "192.0.2.1,2001:db8::1"},
+		{DNSPreferIPv4, v6First, "192.0.2.1:80", "192.0.2.1,192.0.2.2,2001:db8::1,2001:db8::2"},
+		{DNSPreferIPv4, v4First, "192.0.2.1:80", "192.0.2.1,2001:db8::1"},
+		{DNSPreferIPv6, v6First, "[2001:db8::1]:80", "2001:db8::1,2001:db8::2,192.0.2.1,192.0.2.2"},
+		{DNSPreferIPv6, v4First, "[2001:db8::1]:80", "2001:db8::1,192.0.2.1"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%q 首个结果 %s", tt.preference, tt.answers[0]), func(t *testing.T) {
+			ips := append([]net.IP(nil), tt.answers...)
+			preference := tt.preference
+			if preference == "" {
+				preference = DNSPreferSystem
+			}
+			sortByPreference(ips, preference)
+			var got []string
+			for _, ip := range ips {
+				got = append(got, ip.String())
+			}
+			if strings.Join(got, ",") != tt.order {
+				t.Fatalf("排序结果 %v, 期望 %s", got, tt.order)
+			}
+
+			var mu sync.Mutex
+			var dialed []string
+			s := startServer(t, testConfig(t, `{"dns_preference": "`+tt.preference+`"}`), func(s *Server) {
+				s.Resolver = &familyResolver{ips: tt.answers}
+				s.Dial = recordingDial(echo, &dialed, &mu)
+			})
+			if _, rep, _ := connect(t, s, "", "", CmdConnect, "dual.test:80"); rep != RepSuccess {
+				t.Fatalf("回复码 %#x", rep)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if len(dialed) != 1 || dialed[0] != tt.dialed {
+				t.Fatalf("拨号 %v, 期望 %s", dialed, tt.dialed)
+			}
+		})
+	}
+
+	if _, err := parseConfig([]byte(`{"address": "127.0.0.1:0", "dns_preference": "ipv5"}`)); err == nil {
+		t.Fatal("无效的 dns_preference 应被拒绝")
+	}
+}
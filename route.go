@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// 路由动作，除此之外的取值表示上游代理名称
+const (
+	RouteDirect = "direct"
+	RouteBlock  = "block"
+)
+
+// RouteConfig 表示一条静态路由规则
+type RouteConfig struct {
+	// 匹配目标：CIDR（如 10.0.0.0/8）或域名（匹配该域名及其子域名）
+	Match string `json:"match"`
+	// 出口：direct、block 或上游代理名称
+	Via string `json:"via"`
+}
+
+// route 解析后的路由规则
+type route struct {
+	network *net.IPNet
+	domain  string
+	via     string
+}
+
+// router 根据目标选择出口，最具体的规则优先
+type router struct {
+	routes []route
+}
+
+// newRouter 根据配置创建路由表
+func newRouter(configs []RouteConfig, upstreams map[string]UpstreamConfig) (*router, error) {
+	r := &router{}
+	for _, rc := range configs {
+		if rc.Via != RouteDirect && rc.Via != RouteBlock {
+			if _, ok := upstreams[rc.Via]; !ok {
+				return nil, fmt.Errorf("路由 %s 引用了未知的上游代理: %s", rc.Match, rc.Via)
+			}
+		}
+
+		rt, err := parseMatch(rc.Match)
+		if err != nil {
+			return nil, fmt.Errorf("路由%w", err)
+		}
+		rt.via = rc.Via
+		r.routes = append(r.routes, rt)
+	}
+	return r, nil
+}
+
+// hostList 目标匹配列表（CIDR 或域名），用于默认拒绝模式下的允许列表
+type hostList []route
+
+// newHostList 解析匹配规则列表
+func newHostList(matches []string) (hostList, error) {
+	var l hostList
+	for _, m := range matches {
+		rt, err := parseMatch(m)
+		if err != nil {
+			return nil, fmt.Errorf("允许列表%w", err)
+		}
+		l = append(l, rt)
+	}
+	return l, nil
+}
+
+// contains 判断目标主机是否命中列表中的任一规则
+func (l hostList) contains(host string) bool {
+	ip := net.ParseIP(host)
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, rt := range l {
+		if rt.score(ip, host) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// parseMatch 解析匹配规则：CIDR 或域名
+func parseMatch(match string) (route, error) {
+	var rt route
+	if strings.Contains(match, "/") {
+		_, network, err := net.ParseCIDR(match)
+		if err != nil {
+			return rt, fmt.Errorf("CIDR %s 无效: %v", match, err)
+		}
+		rt.network = network
+		return rt, nil
+	}
+	rt.domain = strings.ToLower(strings.Trim(match, "."))
+	if rt.domain == "" {
+		return rt, fmt.Errorf("匹配规则不能为空")
+	}
+	return rt, nil
+}
+
+// score 返回规则与目标的匹配程度（CIDR 前缀长度或域名长度），不匹配时为 -1。
+// host 需已转为小写并去掉末尾的点
+func (rt route) score(ip net.IP, host string) int {
+	switch {
+	case rt.network != nil:
+		if ip == nil || !rt.network.Contains(ip) {
+			return -1
+		}
+		ones, _ := rt.network.Mask.Size()
+		return ones
+	case ip == nil:
+		if host != rt.domain && !strings.HasSuffix(host, "."+rt.domain) {
+			return -1
+		}
+		return len(rt.domain)
+	}
+	return -1
+}
+
+// lookup 返回目标主机对应的出口，未命中任何规则时为 direct
+func (r *router) lookup(host string) string {
+	via := RouteDirect
+	best := -1
+
+	ip := net.ParseIP(host)
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, rt := range r.routes {
+		if score := rt.score(ip, host); score > best {
+			best = score
+			via = rt.via
+		}
+	}
+	return via
+}
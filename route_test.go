@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestRouterLookup(t *testing.T) {
+	r, err := newRouter([]RouteConfig{
+		{Match: "10.0.0.0/8", Via: "up"},
+		{Match: "10.1.0.0/16", Via: RouteDirect},
+		{Match: "example.com", Via: RouteBlock},
+		{Match: "api.example.com", Via: "up"},
+		{Match: "2001:db8::/32", Via: RouteBlock},
+	}, map[string]UpstreamConfig{"up": {Type: UpstreamSOCKS5, Address: "127.0.0.1:1080"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"10.2.3.4", "up"},
+		{"10.1.2.3", RouteDirect},  // 前缀更长的规则优先
+		{"192.0.2.1", RouteDirect}, // 未命中任何规则
+		{"example.com", RouteBlock},
+		{"www.Example.COM.", RouteBlock}, // 子域名，不区分大小写，忽略末尾的点
+		{"api.example.com", "up"},        // 域名更长的规则优先
+		{"notexample.com", RouteDirect},
+		{"2001:db8::1", RouteBlock},
+	}
+	for _, tt := range tests {
+		if got := r.lookup(tt.host); got != tt.want {
+			t.Errorf("lookup(%q) = %s, 期望 %s", tt.host, got, tt.want)
+		}
+	}
+
+	if _, err := newRouter([]RouteConfig{{Match: "example.com", Via: "missing"}}, nil); err == nil {
+		t.Error("引用未知上游的路由应被拒绝")
+	}
+}
+
+func TestStaticRoutes(t *testing.T) {
+	echo := startEcho(t)
+	echoHost, echoPort, _ := net.SplitHostPort(echo)
+	port, _ := strconv.Atoi(echoPort)
+
+	// 上游代理记录收到的目标，并全部改写为回显服务
+	var mu sync.Mutex
+	var seen []string
+	up := startServer(t, testConfig(t, ""), func(s *Server) {
+		s.OnRequest = func(ctx context.Context, req *Request) (*Request, error) {
+			mu.Lock()
+			seen = append(seen, req.Host)
+			mu.Unlock()
+			rewritten := *req
+			rewritten.Host, rewritten.Port = echoHost, uint16(port)
+			return &rewritten, nil
+		}
+	})
+	s := startServer(t, testConfig(t, `{
+		"upstreams": {"up": {"type": "socks5", "address": "`+up.Addr().String()+`"}},
+		"routes": [
+			{"match": "via-upstream.test", "via": "up"},
+			{"match": "blocked.test", "via": "block"},
+			{"match": "127.0.0.0/8", "via": "direct"}
+		]
+	}`))
+
+	tests := []struct {
+		name     string
+		target   string
+		rep      uint8
+		upstream bool // 是否经过上游
+	}{
+		{"直接连接", echo, RepSuccess, false},
+		{"经上游", "via-upstream.test:80", RepSuccess, true},
+		{"拒绝", "blocked.test:80", RepConnectionNotAllowed, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			seen = nil
+			mu.Unlock()
+
+			conn, rep, _ := connect(t, s, "", "", CmdConnect, tt.target)
+			if rep != tt.rep {
+				t.Fatalf("回复码 %#x, 期望 %#x", rep, tt.rep)
+			}
+			if rep == RepSuccess {
+				mustWrite(t, conn, []byte("ping"))
+				expectBytes(t, conn, []byte("ping"))
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			host, _, _ := net.SplitHostPort(tt.target)
+			if got := len(seen) == 1 && seen[0] == host; got != tt.upstream {
+				t.Fatalf("上游收到的目标 %v, 期望经过上游 %v", seen, tt.upstream)
+			}
+		})
+	}
+}
+
+func TestDenyAction(t *testing.T) {
+	echo := startEcho(t)
+	rules := []struct {
+		name   string
+		config string
+		target string
+	}{
+		{"路由拒绝", `"routes": [{"match": "blocked.test", "via": "block"}]`, "blocked.test:80"},
+		{"默认拒绝", `"default_deny": true, "allow": ["allowed.test"]`, echo},
+		{"私有地址", `"block_private_targets": true`, echo},
+	}
+	for _, action := range []string{DenyActionReply, DenyActionDrop} {
+		for _, rule := range rules {
+			t.Run(action+"/"+rule.name, func(t *testing.T) {
+				s := startServer(t, testConfig(t, `{"deny_action": "`+action+`", `+rule.config+`}`))
+				denied := counterValue("requests_denied_total")
+
+				conn := dialServer(t, s)
+				greet(t, conn, "", "")
+				host, portStr, _ := net.SplitHostPort(rule.target)
+				port, _ := strconv.Atoi(portStr)
+				mustWrite(t, conn, requestBytes(CmdConnect, host, uint16(port)))
+				if action == DenyActionReply {
+					if rep, _ := readReply(t, conn); rep != RepConnectionNotAllowed {
+						t.Fatalf("回复码 %#x, 期望 %#x", rep, RepConnectionNotAllowed)
+					}
+				}
+				// 静默丢弃时不写出任何回复字节
+				expectClosed(t, conn)
+				if got := counterValue("requests_denied_total") - denied; got != 1 {
+					t.Fatalf("requests_denied_total 增加了 %d, 期望 1", got)
+				}
+			})
+		}
+	}
+}
+
+func TestFixedDestination(t *testing.T) {
+	echo := startEcho(t)
+	tests := []struct {
+		name   string
+		config string // 追加在 fixed_destination 之后的配置
+		cmd    uint8
+		target string
+		rep    uint8
+	}{
+		{"域名目标", ``, CmdConnect, "example.com:80", RepSuccess},
+		{"IPv4目标", ``, CmdConnect, "192.0.2.1:443", RepSuccess},
+		{"IPv6目标", ``, CmdConnect, "[2001:db8::1]:22", RepSuccess},
+		{"路由规则按固定目标检查", `, "routes": [{"match": "fixed.test", "via": "block"}]`, CmdConnect, "example.com:80", RepConnectionNotAllowed},
+		{"请求的目标被阻止也不影响", `, "routes": [{"match": "example.com", "via": "block"}]`, CmdConnect, "example.com:80", RepSuccess},
+		{"拒绝UDP转发", `, "udp": {"enable": true, "timeout": 60, "buffer_size": 65535}`, CmdUDPAssociate, "0.0.0.0:0", RepConnectionNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var dialed []string
+			s := startServer(t, testConfig(t, `{"fixed_destination": "fixed.test:7"`+tt.config+`}`), func(s *Server) {
+				s.Dial = recordingDial(echo, &dialed, &mu)
+			})
+
+			conn, rep, _ := connect(t, s, "", "", tt.cmd, tt.target)
+			if rep != tt.rep {
+				t.Fatalf("回复码 %#x, 期望 %#x", rep, tt.rep)
+			}
+			if rep != RepSuccess {
+				return
+			}
+			mustWrite(t, conn, []byte("hello"))
+			expectBytes(t, conn, []byte("hello"))
+			mu.Lock()
+			defer mu.Unlock()
+			if len(dialed) != 1 || dialed[0] != "fixed.test:7" {
+				t.Fatalf("拨号 %v, 期望 [fixed.test:7]", dialed)
+			}
+		})
+	}
+
+	// SOCKS4 请求同样连接固定目标
+	var mu sync.Mutex
+	var dialed []string
+	s := startServer(t, testConfig(t, `{"fixed_destination": "fixed.test:7"}`), func(s *Server) { s.Dial = recordingDial(echo, &dialed, &mu) })
+	conn := dialServer(t, s)
+	mustWrite(t, conn, socks4Request(CmdConnect, "192.0.2.1", 80, ""))
+	reply := make([]byte, 8)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != Socks4Granted {
+		t.Fatalf("SOCKS4 回复 % x (%v)", reply, err)
+	}
+	mustWrite(t, conn, []byte("hello"))
+	expectBytes(t, conn, []byte("hello"))
+	mu.Lock()
+	defer mu.Unlock()
+	if len(dialed) != 1 || dialed[0] != "fixed.test:7" {
+		t.Fatalf("SOCKS4 拨号 %v, 期望 [fixed.test:7]", dialed)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import "syscall"
+
+// controlFunc 在出站套接字连接前设置选项，即 net.Dialer.Control
+type controlFunc func(network, address string, c syscall.RawConn) error
+
+// chainControl 依次执行多个套接字控制函数，忽略为 nil 的函数，全部为 nil 时返回 nil
+func chainControl(fns ...controlFunc) controlFunc {
+	var active []controlFunc
+	for _, fn := range fns {
+		if fn != nil {
+			active = append(active, fn)
+		}
+	}
+	if len(active) == 0 {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		for _, fn := range active {
+			if err := fn(network, address, c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// setsockoptControl 返回在套接字上设置整数选项的控制函数
+func setsockoptControl(level, name, value int) controlFunc {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = setsockoptInt(fd, level, name, value)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
+
+// reuseAddrControl 返回设置 SO_REUSEADDR 的控制函数
+func reuseAddrControl() controlFunc {
+	return setsockoptControl(syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+}
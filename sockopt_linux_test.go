@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// socketByPeer 在本进程打开的文件描述符中查找对端地址为 peer 的套接字，
+// 用于检查服务器在会话的客户端侧与目标侧套接字上设置的选项
+func socketByPeer(t *testing.T, peer string) int {
+	t.Helper()
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skipf("无法读取 /proc/self/fd: %v", err)
+	}
+	for _, e := range entries {
+		fd, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		sa, err := syscall.Getpeername(fd)
+		if err != nil {
+			continue
+		}
+		if sockaddrString(sa) == peer {
+			return fd
+		}
+	}
+	t.Fatalf("没有对端为 %s 的套接字", peer)
+	return -1
+}
+
+func sockaddrString(sa syscall.Sockaddr) string {
+	switch a := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return net.JoinHostPort(net.IP(a.Addr[:]).String(), strconv.Itoa(a.Port))
+	case *syscall.SockaddrInet6:
+		return net.JoinHostPort(net.IP(a.Addr[:]).String(), strconv.Itoa(a.Port))
+	}
+	return ""
+}
+
+// sessionSockets 经服务器建立到新回显服务的会话，返回服务器侧的客户端套接字与目标套接字。
+// 部分选项在发送成功回复后才设置，因此先完成一次数据往返，确保转发已经开始
+func sessionSockets(t *testing.T, s *Server) (client, dest int) {
+	t.Helper()
+	conn, client, dest := sessionSocketsTo(t, s, startEcho(t))
+	mustWrite(t, conn, []byte("ping"))
+	expectBytes(t, conn, []byte("ping"))
+	return client, dest
+}
+
+// sessionSocketsTo 经服务器建立到 target 的会话，target 上需有服务在监听
+func sessionSocketsTo(t *testing.T, s *Server, target string) (conn net.Conn, client, dest int) {
+	t.Helper()
+	conn, rep, _ := connect(t, s, "", "", CmdConnect, target)
+	if rep != RepSuccess {
+		t.Fatalf("回复码 %#x", rep)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, socketByPeer(t, conn.LocalAddr().String()), socketByPeer(t, target)
+}
+
+func getsockopt(t *testing.T, fd, level, name int) int {
+	t.Helper()
+	v, err := syscall.GetsockoptInt(fd, level, name)
+	if err != nil {
+		t.Fatalf("getsockopt(%d, %d) 失败: %v", level, name, err)
+	}
+	return v
+}
+
+func TestOutboundDSCP(t *testing.T) {
+	for _, dscp := range []int{0, 10, 46} {
+		t.Run(fmt.Sprint(dscp), func(t *testing.T) {
+			s := startServer(t, testConfig(t, fmt.Sprintf(`{"outbound_dscp": %d}`, dscp)))
+			client, dest := sessionSockets(t, s)
+			// TOS 字节的高6位为 DSCP
+			if got := getsockopt(t, dest, syscall.IPPROTO_IP, syscall.IP_TOS); got != dscp<<2 {
+				t.Fatalf("目标连接的 IP_TOS 为 %#x, 期望 %#x", got, dscp<<2)
+			}
+			if got := getsockopt(t, client, syscall.IPPROTO_IP, syscall.IP_TOS); got != 0 {
+				t.Fatalf("客户端连接的 IP_TOS 为 %#x, 期望不设置", got)
+			}
+		})
+	}
+
+	// IPv6 目标使用 IPV6_TCLASS
+	ln, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("本机不支持 IPv6 回环地址: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	s := startServer(t, testConfig(t, `{"outbound_dscp": 46}`))
+	_, _, dest := sessionSocketsTo(t, s, ln.Addr().String())
+	if got := getsockopt(t, dest, syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS); got != 46<<2 {
+		t.Fatalf("IPv6 目标连接的 IPV6_TCLASS 为 %#x, 期望 %#x", got, 46<<2)
+	}
+}
+
+func TestTCPNoDelay(t *testing.T) {
+	tests := []struct {
+		config string
+		want   int
+	}{
+		{`{}`, 1},
+		{`{"tcp_nodelay": true}`, 1},
+		{`{"tcp_nodelay": false}`, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.config, func(t *testing.T) {
+			s := startServer(t, testConfig(t, tt.config))
+			client, dest := sessionSockets(t, s)
+			for name, fd := range map[string]int{"客户端": client, "目标": dest} {
+				if got := getsockopt(t, fd, syscall.IPPROTO_TCP, syscall.TCP_NODELAY); (got != 0) != (tt.want != 0) {
+					t.Errorf("%s连接的 TCP_NODELAY 为 %d, 期望 %d", name, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+// getLinger 读取套接字的 SO_LINGER，syscall 包没有对应的读取函数
+func getLinger(t *testing.T, fd int) syscall.Linger {
+	t.Helper()
+	l, err := unix.GetsockoptLinger(fd, unix.SOL_SOCKET, unix.SO_LINGER)
+	if err != nil {
+		t.Fatalf("getsockopt(SO_LINGER) 失败: %v", err)
+	}
+	return syscall.Linger{Onoff: l.Onoff, Linger: l.Linger}
+}
+
+func TestOutboundReuseAddrAndLinger(t *testing.T) {
+	tests := []struct {
+		config    string
+		reuseAddr int
+		linger    syscall.Linger
+	}{
+		{`{}`, 0, syscall.Linger{}},
+		{`{"outbound_reuse_addr": true}`, 1, syscall.Linger{}},
+		{`{"outbound_linger": 0}`, 0, syscall.Linger{Onoff: 1, Linger: 0}},
+		{`{"outbound_reuse_addr": true, "outbound_linger": 5}`, 1, syscall.Linger{Onoff: 1, Linger: 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.config, func(t *testing.T) {
+			s := startServer(t, testConfig(t, tt.config))
+			client, dest := sessionSockets(t, s)
+			if got := getsockopt(t, dest, syscall.SOL_SOCKET, syscall.SO_REUSEADDR); (got != 0) != (tt.reuseAddr != 0) {
+				t.Errorf("目标连接的 SO_REUSEADDR 为 %d, 期望 %d", got, tt.reuseAddr)
+			}
+			if got := getLinger(t, dest); got != tt.linger {
+				t.Errorf("目标连接的 SO_LINGER 为 %+v, 期望 %+v", got, tt.linger)
+			}
+			// 只作用于出站连接
+			if got := getLinger(t, client); got != (syscall.Linger{}) {
+				t.Errorf("客户端连接的 SO_LINGER 为 %+v, 期望不设置", got)
+			}
+		})
+	}
+}
+
+func TestSocketBuffers(t *testing.T) {
+	// Linux 会把设置的缓冲区大小加倍，为内核簿记预留空间；0 表示不设置，只检查没有被改成配置以外的值
+	tests := []struct {
+		config      string
+		read, write int
+	}{
+		{`{"socket_read_buffer": 100000, "socket_write_buffer": 70000}`, 100000, 70000},
+		{`{"socket_read_buffer": 100000}`, 100000, 0},
+		{`{"socket_write_buffer": 70000}`, 0, 70000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.config, func(t *testing.T) {
+			s := startServer(t, testConfig(t, tt.config))
+			client, dest := sessionSockets(t, s)
+			for name, fd := range map[string]int{"客户端": client, "目标": dest} {
+				for _, opt := range []struct {
+					name       string
+					opt, value int
+				}{{"SO_RCVBUF", syscall.SO_RCVBUF, tt.read}, {"SO_SNDBUF", syscall.SO_SNDBUF, tt.write}} {
+					got := getsockopt(t, fd, syscall.SOL_SOCKET, opt.opt)
+					if opt.value > 0 && got != 2*opt.value {
+						t.Errorf("%s连接的 %s 为 %d, 期望 %d", name, opt.name, got, 2*opt.value)
+					}
+					if opt.value == 0 && (got == 200000 || got == 140000) {
+						t.Errorf("%s连接的 %s 为 %d, 期望使用系统默认值", name, opt.name, got)
+					}
+				}
+			}
+		})
+	}
+}
+
+// listenBacklog 读取监听套接字生效的 backlog。对处于 LISTEN 状态的套接字，
+// Linux 在 TCP_INFO 的 tcpi_sacked 中返回 accept 队列长度上限
+func listenBacklog(t *testing.T, s *Server) int {
+	t.Helper()
+	sc, err := s.listeners[0].raw.(*net.TCPListener).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info *unix.TCPInfo
+	sc.Control(func(fd uintptr) {
+		info, err = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	})
+	if err != nil {
+		t.Fatalf("getsockopt(TCP_INFO) 失败: %v", err)
+	}
+	return int(info.Sacked)
+}
+
+func TestListenBacklog(t *testing.T) {
+	data, err := os.ReadFile("/proc/sys/net/core/somaxconn")
+	if err != nil {
+		t.Skipf("无法读取 somaxconn: %v", err)
+	}
+	somaxconn, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	if somaxconn < 64 {
+		t.Skipf("somaxconn 为 %d，过小", somaxconn)
+	}
+	// 生效值为配置与 somaxconn 中较小的一个；0 使用 Go 的默认值即 somaxconn
+	tests := []struct {
+		backlog int
+		want    int
+	}{
+		{0, somaxconn},
+		{16, 16},
+		{somaxconn / 2, somaxconn / 2},
+		{somaxconn * 2, somaxconn},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.backlog), func(t *testing.T) {
+			s := startServer(t, testConfig(t, `{"listen_backlog": `+strconv.Itoa(tt.backlog)+`}`))
+			if got := listenBacklog(t, s); got != tt.want {
+				t.Fatalf("backlog 为 %d, 期望 %d", got, tt.want)
+			}
+			// 设置后监听器仍正常接受连接
+			if !greetFrom(t, s.Addr().String(), net.IPv4(127, 0, 0, 1)) {
+				t.Fatal("服务器未完成握手")
+			}
+		})
+	}
+}
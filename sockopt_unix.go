@@ -0,0 +1,45 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// listenUnixPrivate 在 path 上创建只有当前用户可以连接（0600）的 Unix 套接字。
+// 套接字文件由 bind 按 umask 创建，因此在监听期间临时设置 umask，
+// 使套接字从创建起就不会以更宽的权限出现。umask 是进程级的，调用期间创建的其他文件同样受影响
+func listenUnixPrivate(path string) (net.Listener, error) {
+	old := syscall.Umask(0o177)
+	defer syscall.Umask(old)
+	return net.Listen("unix", path)
+}
+
+func setsockoptInt(fd uintptr, level, name, value int) error {
+	return syscall.SetsockoptInt(int(fd), level, name, value)
+}
+
+// setListenBacklog 修改已监听套接字的 backlog。net.ListenConfig.Control 在 bind
+// 之前执行，backlog 由标准库随后的 listen 调用固定为 somaxconn，因此在监听后
+// 对同一套接字再次调用 listen：Linux 与 BSD 会据此更新队列长度，
+// 实际生效值仍受 net.core.somaxconn（BSD 为 kern.ipc.somaxconn）限制
+func setListenBacklog(ln net.Listener, backlog int) error {
+	tl, ok := ln.(*net.TCPListener)
+	if !ok {
+		return fmt.Errorf("不是TCP监听器: %T", ln)
+	}
+	rc, err := tl.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		sockErr = syscall.Listen(int(fd), backlog)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
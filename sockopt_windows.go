@@ -0,0 +1,21 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// listenUnixPrivate Windows 上没有 umask，Unix 套接字的访问权限由所在目录的 ACL 决定
+func listenUnixPrivate(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
+
+func setsockoptInt(fd uintptr, level, name, value int) error {
+	return syscall.SetsockoptInt(syscall.Handle(fd), level, name, value)
+}
+
+// setListenBacklog Windows 上对已监听的套接字再次调用 listen 不会改变 backlog，不支持该选项
+func setListenBacklog(ln net.Listener, backlog int) error {
+	return errors.New("Windows 不支持修改 listen backlog")
+}
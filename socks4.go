@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// SOCKS4 protocol constants
+const (
+	Version4       = uint8(4)
+	Socks4Granted  = uint8(90)
+	Socks4Rejected = uint8(91)
+)
+
+// socks4MaxField 用户ID与SOCKS4a域名的最大长度
+const socks4MaxField = 255
+
+// readSOCKS4Request 读取 SOCKS4/SOCKS4a 请求，返回请求与用户ID。
+// 调用方在握手截止时间内读取，停滞的客户端不会一直占用连接
+func readSOCKS4Request(conn net.Conn) (*Request, string, error) {
+	// 读取 VN、CD、DSTPORT、DSTIP
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, "", fmt.Errorf("读取SOCKS4请求失败: %w", err)
+	}
+	port := binary.BigEndian.Uint16(header[2:4])
+	ip := net.IP(header[4:8])
+
+	userID, err := readNullTerminated(conn)
+	if err != nil {
+		return nil, "", fmt.Errorf("读取SOCKS4用户ID失败: %w", err)
+	}
+
+	// SOCKS4a：目标IP为 0.0.0.x (x非0) 时，用户ID之后跟随域名
+	host := ip.String()
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		if host, err = readNullTerminated(conn); err != nil {
+			return nil, "", fmt.Errorf("读取SOCKS4a域名失败: %w", err)
+		}
+	}
+	return &Request{Command: header[1], Host: host, Port: port, RemoteAddr: conn.RemoteAddr()}, userID, nil
+}
+
+// handleSOCKS4 处理 readSOCKS4Request 读取的请求，仅支持 CONNECT 命令。
+// SOCKS4 没有密码认证，只有监听器允许匿名访问时才会接受。
+func (s *Server) handleSOCKS4(ctx context.Context, conn net.Conn, l *listener, req *Request, userID string) error {
+	reply := func(rep uint8, addr *net.TCPAddr) error {
+		return sendSOCKS4Reply(conn, rep, addr)
+	}
+	s.debugf(ctx, "SOCKS4请求: 命令 %d, 目标 %s:%d, 用户ID %q", req.Command, req.Host, req.Port, s.logUsername(userID))
+
+	if l.selectMethod([]byte{MethodNoAuth}) != MethodNoAuth {
+		reply(RepConnectionNotAllowed, nil)
+		return fmt.Errorf("%w: 监听器要求认证, 拒绝SOCKS4请求", ErrAuthFailed)
+	}
+	if req.Command != CmdConnect {
+		reply(RepCommandNotSupported, nil)
+		return fmt.Errorf("%w: SOCKS4命令 %d", ErrCommandNotSupported, req.Command)
+	}
+
+	req, err := s.authorizeRequest(ctx, req, reply)
+	if err != nil {
+		return err
+	}
+
+	return s.handleConnect(ctx, conn, req, reply)
+}
+
+// readNullTerminated 读取以 0x00 结尾的字符串
+func readNullTerminated(r io.Reader) (string, error) {
+	var buf []byte
+	b := make([]byte, 1)
+	for len(buf) <= socks4MaxField {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return string(buf), nil
+		}
+		buf = append(buf, b[0])
+	}
+	return "", fmt.Errorf("字段超过 %d 字节", socks4MaxField)
+}
+
+// sendSOCKS4Reply 发送SOCKS4响应，SOCKS5回复码映射为授予或拒绝
+func sendSOCKS4Reply(conn net.Conn, rep uint8, addr *net.TCPAddr) error {
+	response := make([]byte, 8)
+	response[1] = Socks4Rejected
+	if rep == RepSuccess {
+		response[1] = Socks4Granted
+	}
+	if addr != nil {
+		binary.BigEndian.PutUint16(response[2:4], uint16(addr.Port))
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			copy(response[4:8], ip4)
+		}
+	}
+	return writeFull(conn, response)
+}
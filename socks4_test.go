@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+)
+
+// socks4Request 构造 SOCKS4 请求；host 不是IPv4地址时按 SOCKS4a 发送域名
+func socks4Request(cmd uint8, host string, port uint16, userID string) []byte {
+	req := []byte{Version4, cmd, 0, 0}
+	binary.BigEndian.PutUint16(req[2:], port)
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		ip = net.IPv4(0, 0, 0, 1).To4()
+	}
+	req = append(req, ip...)
+	req = append(append(req, userID...), 0)
+	if net.ParseIP(host) == nil {
+		req = append(append(req, host...), 0)
+	}
+	return req
+}
+
+func TestSOCKS4AndSOCKS5SamePort(t *testing.T) {
+	echo := startEcho(t)
+	echoHost, echoPort, _ := net.SplitHostPort(echo)
+	p, _ := strconv.Atoi(echoPort)
+	port := uint16(p)
+	open := startServer(t, testConfig(t, ``))
+	authed := startServer(t, testConfig(t, `{"users": {"alice": "secret"}}`))
+
+	tests := []struct {
+		name    string
+		s       *Server
+		request []byte
+		granted bool
+	}{
+		{"SOCKS4", open, socks4Request(CmdConnect, echoHost, port, "bob"), true},
+		{"SOCKS4a", open, socks4Request(CmdConnect, "localhost", port, ""), true},
+		{"SOCKS4 BIND", open, socks4Request(CmdBind, echoHost, port, ""), false},
+		{"要求认证的监听器", authed, socks4Request(CmdConnect, echoHost, port, "alice"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := dialServer(t, tt.s)
+			mustWrite(t, conn, tt.request)
+			reply := make([]byte, 8)
+			if _, err := io.ReadFull(conn, reply); err != nil {
+				t.Fatalf("读取SOCKS4回复失败: %v", err)
+			}
+			if reply[0] != 0 || (reply[1] == Socks4Granted) != tt.granted {
+				t.Fatalf("SOCKS4 回复 % x, 期望授予为 %v", reply, tt.granted)
+			}
+			if !tt.granted {
+				expectClosed(t, conn)
+				return
+			}
+			mustWrite(t, conn, []byte("hello"))
+			expectBytes(t, conn, []byte("hello"))
+		})
+	}
+
+	// 同一端口上的 SOCKS5 客户端不受影响
+	for s, user := range map[*Server]string{open: "", authed: "alice"} {
+		conn, rep, _ := connect(t, s, user, "secret", CmdConnect, echo)
+		if rep != RepSuccess {
+			t.Fatalf("SOCKS5 回复码 %#x", rep)
+		}
+		mustWrite(t, conn, []byte("hello"))
+		expectBytes(t, conn, []byte("hello"))
+	}
+}
@@ -2,6 +2,9 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/binary"
 	"errors"
@@ -9,6 +12,12 @@ import (
 	"io"
 	"log"
 	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // SOCKS5 protocol constants
@@ -21,6 +30,7 @@ const (
 	MethodNoAuth = uint8(0x00)
 	MethodGSSAPI = uint8(0x01)
 	MethodUserPass = uint8(0x02)
+	MethodPrivateMin = uint8(0x80) // 0x80-0xFE 为私有方法
 	MethodNoAcceptable = uint8(0xFF)
 )
 
@@ -64,228 +74,812 @@ type Credentials struct {
 	Password string
 }
 
+// Request describes a parsed client request passed to Server.OnRequest
+type Request struct {
+	Command    uint8
+	Host       string // 目标主机（IP或域名）
+	Port       uint16
+	Username   string // 认证用户名，未认证时为空
+	RemoteAddr net.Addr
+}
+
+// ConnectionInfo describes a finished CONNECT session passed to
+// Server.OnConnectionClose
+type ConnectionInfo struct {
+	TraceID  string   // 连接的追踪ID，与日志中的 [trace ...] 一致
+	Target   string   // 目标地址 "主机:端口"
+	Egress   net.Addr // 出站连接的本地地址
+	Upload   int64    // 客户端到目标的字节数
+	Download int64    // 目标到客户端的字节数
+}
+
 // Server represents a SOCKS5 server
 type Server struct {
-	addr        string
-	credentials map[string]string // username -> password
-	authEnabled bool
-	tlsConfig   *tls.Config
-	useTLS      bool
+	// Dial 用于建立出站连接，为空时使用 net.Dialer
+	Dial func(ctx context.Context, network, address string) (net.Conn, error)
+	// ListenTransport 为监听器绑定控制通道，可选。network 为监听器配置中的
+	// network（默认 tcp），为空时只支持 tcp/tcp4/tcp6 并使用 net.Listen。
+	// 嵌入方可借此提供 QUIC、SCTP 等实验性传输：Accept 返回的每个 net.Conn
+	// （例如一个 QUIC 流）按一个 SOCKS 连接处理
+	ListenTransport func(network, address string) (net.Listener, error)
+	// OnRequest 在请求解析后调用，可选。返回错误表示拒绝请求
+	// （回复 RepConnectionNotAllowed），返回新的 Request 可改写目标
+	OnRequest func(ctx context.Context, req *Request) (*Request, error)
+	// Negotiators 按私有方法号（0x80-0xFE）注册的能力协商处理函数，可选。
+	// 客户端在握手中提供已注册的私有方法时，认证成功后、请求阶段之前调用
+	// 对应的处理函数与客户端交换能力信息；标准客户端不会提供私有方法，不受影响。
+	// 返回非空的连接时，后续请求阶段与数据转发改用该连接（例如压缩包装）。
+	// 返回的连接应包装传入的 conn 而非其底层连接，以免丢失已缓冲的流水线数据
+	Negotiators map[uint8]func(ctx context.Context, conn net.Conn, username string) (net.Conn, error)
+	// OnAuth 在用户名/密码凭据校验完成后调用，可选。elapsed 为校验耗时，
+	// 可用于发现响应缓慢的认证后端
+	OnAuth func(ctx context.Context, username string, success bool, elapsed time.Duration)
+	// OnConnectionClose 在 CONNECT 会话结束后调用，可选
+	OnConnectionClose func(ctx context.Context, info *ConnectionInfo)
+	// Resolver 用于解析目标域名（TCP 与 UDP），为空时使用系统解析器
+	Resolver Resolver
+	// Authenticator 外部认证后端，可选，设置后取代配置中的用户校验用户名/密码
+	Authenticator Authenticator
+	// Metrics 接收本服务器记录的所有指标，为空时同时写入 expvar 与本服务器的
+	// Prometheus 指标（见 metrics.address）。需在 Start 之前设置
+	Metrics Metrics
+
+	settings    atomic.Pointer[settings] // 可热加载的配置与访问策略
+	reloadMu    sync.Mutex       // 串行化 Reload 与 ReloadConfig
+	stopOnce    sync.Once        // 保证 Stop 只执行一次
+	listeners   []*listener      // 监听器
+	wg          sync.WaitGroup   // 监听器服务协程
+	mu          sync.Mutex       // 保护已绑定的 net.Listener
 	udpHandler  *UDPHandler      // UDP处理器
-	config      *Config          // 服务器配置
+	acceptLimiter *acceptLimiter // 新连接接入速率限制
+	handshakes  chan struct{}    // 进行中的握手名额，不限制时为 nil
+	destinations *destLimiter    // 每个目标的连接数限制，不限制时为 nil
+	shares      *shareLimiter    // 用户与用户组的连接数与带宽限制
+	maintenance atomic.Bool      // 维护模式，开启时拒绝新连接
+	tunnels     *tunnelPool      // 预建的 HTTP CONNECT 上游隧道
+	mitm        *mitm            // TLS 中间人检查，未启用时为 nil
+	stopProbe   context.CancelFunc // 停止健康探测，未启用时为 nil
+	events      *eventEmitter    // 连接事件 webhook，未启用时为 nil
+	stopEvents  context.CancelFunc // 停止发送连接事件，未启用时为 nil
+	prometheus  *PrometheusMetrics // 本服务器的 Prometheus 指标，输出在 /metrics
+	defaultMetrics Metrics         // 未设置 Metrics 时使用的指标实现
+	metricsServer *http.Server     // 指标HTTP服务，未配置 metrics.address 时为 nil
 }
 
 // NewServer creates a new SOCKS5 server
 func NewServer(config *Config) *Server {
-	var tlsConfig *tls.Config
-	useTLS := false
-	
-	if config.TLS.Enable {
-		cert, err := tls.LoadX509KeyPair(config.TLS.CertFile, config.TLS.KeyFile)
-		if err == nil {
-			tlsConfig = &tls.Config{
-				Certificates: []tls.Certificate{cert},
-				MinVersion:  tls.VersionTLS12,
-			}
-			useTLS = true
-		} else {
-			log.Printf("TLS证书加载失败: %v, 将使用非TLS模式", err)
+	server := &Server{
+		tunnels:     newTunnelPool(),
+		acceptLimiter: newAcceptLimiter(config.AcceptRate.Global, config.AcceptRate.PerIP, config.AcceptRate.Burst),
+		destinations: newDestLimiter(config.MaxConnectionsPerDestination),
+		shares:      newShareLimiter(),
+		events:      newEventEmitter(config.Webhook),
+		prometheus:  NewPrometheusMetrics(),
+	}
+	server.defaultMetrics = multiMetrics{ExpvarMetrics{}, server.prometheus}
+	if config.MaxHandshakes > 0 {
+		server.handshakes = make(chan struct{}, config.MaxHandshakes)
+	}
+
+	for _, lc := range config.listenerConfigs() {
+		server.listeners = append(server.listeners, newListener(lc))
+	}
+
+	st, err := newSettings(config)
+	if err != nil {
+		log.Printf("访问策略配置无效: %v, 将仅使用内联用户并直接连接所有目标", err)
+		st = &settings{config: config, policy: &policy{users: config.Users, router: &router{}}}
+		if err := st.derive(); err != nil {
+			log.Printf("出口IP配置无效: %v, 将由系统选择源地址", err)
 		}
 	}
-	
-	server := &Server{
-		addr:        config.Address,
-		credentials: config.Users,
-		authEnabled: len(config.Users) > 0,
-		tlsConfig:   tlsConfig,
-		useTLS:      useTLS,
-		config:      config,
+	server.settings.Store(st)
+
+	if config.MITM.Enable {
+		m, err := newMITM(config.MITM)
+		if err != nil {
+			log.Printf("TLS中间人检查配置无效: %v, 将不解密任何连接", err)
+		} else {
+			server.mitm = m
+			log.Printf("警告: 已启用TLS中间人检查, 端口 %v 上 SNI 匹配 %v 的连接将被解密", config.MITM.Ports, config.MITM.Hosts)
+		}
 	}
 
 	if config.UDP.Enable {
 		server.udpHandler = NewUDPHandler(config)
+		server.udpHandler.lookupIP = server.lookupIP
+		server.udpHandler.checkTarget = func(ip net.IP) error { return server.checkTargetIP(server.settings.Load().policy, ip) }
 	}
 	
 	return server
 }
 
-// Start starts the SOCKS5 server
+// Start starts the SOCKS5 server and blocks until all listeners are stopped
 func (s *Server) Start() error {
-	var listener net.Listener
-	var err error
+	if s.events != nil {
+		s.events.metrics = s.metrics()
+	}
 
 	// 启动UDP服务（如果启用）
 	if s.udpHandler != nil {
+		s.udpHandler.metrics = s.metrics()
 		if err := s.udpHandler.Start(); err != nil {
-			return fmt.Errorf("启动UDP服务失败: %v", err)
+			return fmt.Errorf("启动UDP服务失败: %w", err)
 		}
 	}
 
-	// 启动TCP服务
-	if s.useTLS {
-		listener, err = tls.Listen("tcp", s.addr, s.tlsConfig)
-		if err != nil {
-			return fmt.Errorf("启动TLS服务器失败: %v", err)
+	// 启动指标服务（如果配置）
+	if s.cfg().Metrics.Address != "" {
+		if err := s.startMetricsServer(s.cfg().Metrics.Address); err != nil {
+			s.Stop()
+			return fmt.Errorf("启动指标服务失败: %w", err)
 		}
-		log.Printf("SOCKS5 服务器正在监听 %s (TLS模式, 认证模式: %v)", s.addr, s.authEnabled)
-	} else {
-		listener, err = net.Listen("tcp", s.addr)
-		if err != nil {
-			return fmt.Errorf("启动服务器失败: %v", err)
+	}
+
+	// 启动TCP服务（调用方可能已通过 Listen 绑定）
+	if err := s.Listen(); err != nil {
+		s.Stop()
+		return err
+	}
+	s.mu.Lock()
+	for _, l := range s.listeners {
+		s.wg.Add(1)
+		go s.serve(l)
+	}
+	// 仅UDP模式下没有监听器，等待UDP处理器停止后再返回
+	if s.cfg().UDP.Standalone {
+		log.Printf("仅UDP模式: 未创建TCP监听器, 只转发来自 %v 的数据报", s.cfg().UDP.TrustedSources)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.udpHandler.wg.Wait()
+		}()
+	}
+	if s.cfg().HealthProbe.Target != "" {
+		var ctx context.Context
+		ctx, s.stopProbe = context.WithCancel(context.Background())
+		go s.runHealthProbe(ctx)
+	}
+	if s.events != nil {
+		var ctx context.Context
+		ctx, s.stopEvents = context.WithCancel(context.Background())
+		go s.events.run(ctx)
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return nil
+}
+
+// Listen binds every TCP listener without accepting connections yet. Start
+// calls it automatically; calling it first lets embedders read Addr (for
+// example after binding to port 0) before Start blocks
+func (s *Server) Listen() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, l := range s.listeners {
+		if l.raw != nil {
+			continue
+		}
+		if err := l.listen(nil, s.listenFunc); err != nil {
+			// 任一监听器绑定失败时关闭本次已绑定的监听器
+			for _, bound := range s.listeners[:i] {
+				bound.raw.Close()
+				bound.raw, bound.ln = nil, nil
+			}
+			return err
 		}
-		log.Printf("SOCKS5 服务器正在监听 %s (认证模式: %v)", s.addr, s.authEnabled)
 	}
-	defer listener.Close()
+	return nil
+}
+
+// listenFunc 绑定一个监听器，未设置 ListenTransport 时只支持 TCP
+func (s *Server) listenFunc(network, address string) (net.Listener, error) {
+	if s.ListenTransport != nil {
+		return s.ListenTransport(network, address)
+	}
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("传输 %s 需要通过 Server.ListenTransport 提供", network)
+	}
+	ln, err := net.Listen(network, address)
+	if err != nil || s.cfg().ListenBacklog <= 0 {
+		return ln, err
+	}
+	if err := setListenBacklog(ln, s.cfg().ListenBacklog); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("设置 listen_backlog 失败: %w", err)
+	}
+	return ln, nil
+}
+
+// Addr returns the bound address of the first listener, or nil before the
+// listeners are bound
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.listeners) == 0 || s.listeners[0].raw == nil {
+		return nil
+	}
+	return s.listeners[0].raw.Addr()
+}
+
+// serve accepts connections on a listener until it is closed
+func (s *Server) serve(l *listener) {
+	defer s.wg.Done()
+	defer close(l.done)
 
 	for {
-		conn, err := listener.Accept()
+		conn, err := l.ln.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) || l.retired.Load() {
+				return
+			}
 			log.Printf("接受连接失败: %v", err)
 			continue
 		}
 
-		go s.handleConnection(conn)
+		// 超过接入速率限制的连接直接关闭
+		if !s.acceptLimiter.allow(conn.RemoteAddr()) {
+			metricAcceptRejected.Add(s.metrics(), 1)
+			conn.Close()
+			continue
+		}
+
+		go s.handleConnection(conn, l)
+	}
+}
+
+// SetMaintenance turns maintenance mode on or off. While on, new
+// connections are closed right after accept and established sessions
+// continue undisturbed.
+func (s *Server) SetMaintenance(on bool) {
+	s.maintenance.Store(on)
+	log.Printf("维护模式: %v", on)
+}
+
+// ReloadListeners binds the listeners described by config and swaps them in
+// for the running ones. Listeners whose address is unchanged keep their bound
+// socket, so pending connections are not refused. If any listener fails to
+// bind, the new listeners are closed and the old ones keep serving.
+// Established connections and UDP sessions are not affected.
+func (s *Server) ReloadListeners(config *Config) error {
+	var fresh []*listener
+	for _, lc := range config.listenerConfigs() {
+		fresh = append(fresh, newListener(lc))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old := make(map[string]*listener, len(s.listeners))
+	for _, l := range s.listeners {
+		old[l.key()] = l
+	}
+
+	// 绑定新的监听器，传输与地址都未变的复用旧的监听器
+	kept := make(map[string]bool)
+	for i, l := range fresh {
+		var raw net.Listener
+		if o, ok := old[l.key()]; ok {
+			raw = o.raw
+			kept[l.key()] = true
+		}
+		if err := l.listen(raw, s.listenFunc); err != nil {
+			for _, bound := range fresh[:i] {
+				if !kept[bound.key()] {
+					bound.raw.Close()
+				}
+			}
+			return err
+		}
+	}
+
+	// 防止旧协程全部退出、新协程尚未启动时 Start 提前返回
+	s.wg.Add(1)
+	defer s.wg.Done()
+
+	for _, l := range s.listeners {
+		l.retire(kept[l.key()])
+	}
+	s.listeners = fresh
+	for _, l := range s.listeners {
+		s.wg.Add(1)
+		go s.serve(l)
+	}
+
+	log.Printf("监听器已重新加载: %d 个监听器", len(fresh))
+	return nil
+}
+
+// ExportUDPSessions returns the state of every active UDP session so an
+// operator can hand them to a replacement process.
+func (s *Server) ExportUDPSessions() ([]UDPSessionState, error) {
+	if s.udpHandler == nil {
+		return nil, fmt.Errorf("UDP支持未启用")
+	}
+	return s.udpHandler.ExportSessions(), nil
+}
+
+// ImportUDPSessions recreates UDP sessions exported by another process and
+// returns how many were created. See UDPHandler.ImportSessions.
+func (s *Server) ImportUDPSessions(states []UDPSessionState) (int, error) {
+	if s.udpHandler == nil {
+		return 0, fmt.Errorf("UDP支持未启用")
+	}
+	return s.udpHandler.ImportSessions(states)
+}
+
+// ReloadCertificates reloads the TLS certificates from disk. New handshakes
+// use the new certificates while established connections are left intact.
+func (s *Server) ReloadCertificates() error {
+	// 与 ReloadListeners 互斥，避免 SIGHUP 与管理命令同时替换监听器列表
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, l := range s.listeners {
+		if l.certs == nil {
+			continue
+		}
+		if err := l.certs.Reload(); err != nil {
+			return err
+		}
+		log.Printf("监听器 %s TLS证书已重新加载", l.addr)
 	}
+	return nil
 }
 
-// Stop stops the SOCKS5 server
+// Stop stops all listeners and the UDP relay. Established connections
+// are left to finish on their own. Calls after the first do nothing.
 func (s *Server) Stop() {
+	s.stopOnce.Do(s.stop)
+}
+
+// stop 执行 Stop 的实际关闭步骤，只执行一次
+func (s *Server) stop() {
+	s.mu.Lock()
+	for _, l := range s.listeners {
+		if l.ln != nil {
+			l.ln.Close()
+		}
+	}
+	if s.stopProbe != nil {
+		s.stopProbe()
+	}
+	stopEvents := s.stopEvents
+	metricsServer := s.metricsServer
+	s.mu.Unlock()
+
+	// 关闭指标服务，释放其监听地址
+	if metricsServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		metricsServer.Shutdown(ctx)
+		cancel()
+	}
+
+	// 发送队列中剩余的连接事件
+	if stopEvents != nil {
+		stopEvents()
+		<-s.events.done
+	}
+
 	// 停止UDP服务
 	if s.udpHandler != nil {
 		s.udpHandler.Stop()
 	}
+	s.tunnels.closeAll()
 }
 
-// handleConnection processes a client connection
-func (s *Server) handleConnection(conn net.Conn) {
+// handleConnection processes a client connection accepted on l
+func (s *Server) handleConnection(conn net.Conn, l *listener) {
 	defer conn.Close()
+	ctx, cancel := context.WithCancel(s.withLogSample(withTraceID(withConnID(context.Background()))))
+	defer cancel()
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("[trace %s] 处理连接 %s 时发生panic: %v", traceIDFrom(ctx), conn.RemoteAddr(), r)
+		}
+	}()
 
-	if err := s.handleHandshake(conn); err != nil {
-		log.Printf("握手失败: %v", err)
+	// 维护模式下立即关闭新连接，已建立的连接不受影响
+	if s.maintenance.Load() {
+		log.Printf("[trace %s] 维护模式, 拒绝来自 %s 的新连接", traceIDFrom(ctx), conn.RemoteAddr())
 		return
 	}
 
-	if err := s.handleRequest(conn); err != nil {
-		log.Printf("请求处理失败: %v", err)
+	if l.policy != "" {
+		ctx = withPolicyName(ctx, l.policy)
+	}
+	s.debugf(ctx, "新连接 %s", conn.RemoteAddr())
+
+	// 握手与认证期间占用一个握手名额，进入请求阶段前释放
+	release, ok := s.acquireHandshake()
+	if !ok {
+		metricHandshakesRejected.Add(s.metrics(), 1)
+		log.Printf("[trace %s] 进行中的握手数达到上限 %d, 拒绝来自 %s 的连接", traceIDFrom(ctx), cap(s.handshakes), conn.RemoteAddr())
 		return
 	}
+	defer release()
+
+	// 从接受连接到完成认证必须在 handshake_timeout 内完成，停滞的客户端不会一直占用握手名额。
+	// 截止时间设置在原始连接上，同时作用于 PROXY 协议头、TLS握手与之后包装的连接
+	raw := conn
+	timeout := time.Duration(s.cfg().HandshakeTimeout) * time.Millisecond
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+		raw.SetDeadline(deadline)
+	}
+	// endHandshake 释放握手名额并清除握手截止时间，进入请求阶段前调用
+	endHandshake := func() {
+		release()
+		if timeout > 0 {
+			raw.SetDeadline(time.Time{})
+		}
+	}
+	// handshakeErr 将到达握手截止时间后的失败（读写超时、认证后端因 ctx 到期失败等）包装为 ErrHandshakeTimeout
+	handshakeErr := func(err error) error {
+		if timeout > 0 && !time.Now().Before(deadline) {
+			return fmt.Errorf("%w: %s 内未完成握手: %w", ErrHandshakeTimeout, timeout, err)
+		}
+		return err
+	}
+
+	// 解析负载均衡发送的 PROXY 协议头，之后 conn.RemoteAddr() 为真实客户端地址
+	if l.proxyTrusted != nil {
+		proxied, h, err := l.acceptProxyHeader(conn)
+		if err != nil {
+			if err = handshakeErr(err); !errors.Is(err, ErrHandshakeTimeout) {
+				metricProxyHeaderRejected.Add(s.metrics(), 1)
+			}
+			s.logFailure(ctx, fmt.Sprintf("拒绝来自 %s 的连接", conn.RemoteAddr()), err)
+			return
+		}
+		if h != nil && h.src != nil {
+			s.debugf(ctx, "PROXY协议头: 代理 %s, 客户端 %s, 前级用户 %q", conn.RemoteAddr(), h.src, s.logUsername(h.username))
+		}
+		conn = proxied
+		if l.tlsConfig != nil {
+			conn = tls.Server(conn, l.tlsConfig)
+		}
+	}
+
+	if l.transparent {
+		endHandshake()
+		if err := s.handleTransparent(ctx, conn); err != nil {
+			log.Printf("[trace %s] 透明代理连接处理失败: %v", traceIDFrom(ctx), err)
+		}
+		return
+	}
+
+	// TLS连接先完成握手，以便记录协商的ALPN协议
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if l.ticketKeys != nil {
+			l.ticketKeys.maybeRotate(l.tlsConfig)
+		}
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			if err := handshakeErr(err); errors.Is(err, ErrHandshakeTimeout) {
+				s.logFailure(ctx, "TLS握手失败", err)
+				return
+			}
+			log.Printf("[trace %s] TLS握手失败: %v", traceIDFrom(ctx), err)
+			return
+		}
+		// 审计日志不参与采样
+		if state := tlsConn.ConnectionState(); l.logHandshake {
+			log.Printf("[trace %s] TLS连接 %s: %s", traceIDFrom(ctx), conn.RemoteAddr(), describeTLSState(state))
+		} else if state.NegotiatedProtocol != "" {
+			s.logSampled(ctx, "TLS连接 %s 协商的ALPN协议: %s", conn.RemoteAddr(), state.NegotiatedProtocol)
+		}
+	}
+
+	// 通过带缓冲的连接预读首字节以识别协议版本，预读的数据不会丢失。
+	// 握手、认证与请求阶段都从同一个缓冲连接读取，客户端不等待方法回复
+	// 就连续发送的认证与请求数据（流水线）会留在缓冲区中供后续阶段读取
+	conn = &bufferedConn{Conn: conn, r: bufio.NewReader(conn)}
+	first, err := s.preRead(ctx, conn.(*bufferedConn), deadline)
+	if err != nil {
+		if errors.Is(err, errProbe) {
+			s.debugf(ctx, "拒绝来自 %s 的探测: %v", conn.RemoteAddr(), err)
+			return
+		}
+		s.logFailure(ctx, fmt.Sprintf("拒绝来自 %s 的连接", conn.RemoteAddr()), handshakeErr(err))
+		return
+	}
+	if first == Version4 {
+		// SOCKS4 请求在握手截止时间内读取，授权与连接目标前才清除截止时间
+		req, userID, err := readSOCKS4Request(conn)
+		endHandshake()
+		if err != nil {
+			s.logFailure(ctx, "SOCKS4请求处理失败", handshakeErr(err))
+			return
+		}
+		if err := s.handleSOCKS4(ctx, conn, l, req, userID); err != nil {
+			s.logFailure(ctx, "SOCKS4请求处理失败", err)
+		}
+		return
+	}
+
+	if s.cfg().RequestTimeAuth {
+		ctx = withAuthContext(ctx)
+	}
+	// 认证后端与能力协商收到的 ctx 同样在握手截止时间到达时取消
+	handshakeCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		handshakeCtx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	// 能力协商可能替换请求阶段使用的连接，conn 仍用于日志与 panic 恢复
+	reqConn, username, err := s.handleHandshake(handshakeCtx, conn, l)
+	endHandshake()
+	if err != nil {
+		s.logFailure(ctx, "握手失败", handshakeErr(err))
+		return
+	}
+
+	if err := s.handleRequest(ctx, reqConn, username); err != nil {
+		s.logFailure(ctx, "请求处理失败", err)
+		return
+	}
+}
+
+// preRead reads the first byte of the connection, bounded by
+// first_byte_timeout, and rejects it unless it is a supported SOCKS
+// version. The byte stays buffered for the handshake. Afterwards the
+// read deadline is restored to the handshake deadline (zero for none).
+func (s *Server) preRead(ctx context.Context, conn *bufferedConn, handshakeDeadline time.Time) (byte, error) {
+	if d := time.Duration(s.cfg().FirstByteTimeout) * time.Millisecond; d > 0 {
+		firstByte := time.Now().Add(d)
+		if !handshakeDeadline.IsZero() && handshakeDeadline.Before(firstByte) {
+			firstByte = handshakeDeadline
+		}
+		conn.SetReadDeadline(firstByte)
+		defer conn.SetReadDeadline(handshakeDeadline)
+	}
+	first, err := conn.r.Peek(1)
+	if err != nil {
+		return 0, fmt.Errorf("读取首字节失败: %w", err)
+	}
+	if first[0] == Version4 || first[0] == Version5 {
+		return first[0], nil
+	}
+
+	// 探测识别只使用已随首字节到达的数据，不为此等待更多数据
+	metricProtocolMismatch.Add(s.metrics(), 1)
+	if s.cfg().RejectProbes && conn.r.Buffered() >= 2 {
+		header, _ := conn.r.Peek(2)
+		if err := rejectProbe(conn, header); err != nil {
+			return 0, err
+		}
+	}
+	s.debugf(ctx, "首字节: %02x", first[0])
+	return 0, fmt.Errorf("%w: %d", ErrUnsupportedVersion, first[0])
 }
 
-// handleHandshake performs the SOCKS5 handshake
-func (s *Server) handleHandshake(conn net.Conn) error {
+// handleHandshake performs the SOCKS5 handshake using the listener's auth
+// policy and returns the connection to use for the request phase (replaced
+// by a capability negotiator, if any) and the authenticated username (empty
+// when no authentication was performed)
+func (s *Server) handleHandshake(ctx context.Context, conn net.Conn, l *listener) (net.Conn, string, error) {
 	// Read version and number of methods
 	header := make([]byte, 2)
 	if _, err := io.ReadFull(conn, header); err != nil {
-		return fmt.Errorf("读取握手头部失败: %v", err)
-	}
-
-	version := header[0]
-	if version != Version5 {
-		return fmt.Errorf("不支持的SOCKS版本: %d", version)
+		return nil, "", fmt.Errorf("读取握手头部失败: %w", err)
 	}
 
+	// preRead 只把首字节为 Version5 的连接交给握手
 	nmethods := header[1]
+	if int(nmethods) > s.cfg().MaxMethods {
+		return nil, "", fmt.Errorf("%w: 客户端 %s 提供了 %d 个认证方法, 超过上限 %d", ErrProtocolViolation, conn.RemoteAddr(), nmethods, s.cfg().MaxMethods)
+	}
 	methods := make([]byte, nmethods)
 	if _, err := io.ReadFull(conn, methods); err != nil {
-		return fmt.Errorf("读取认证方法列表失败: %v", err)
+		return nil, "", fmt.Errorf("读取认证方法列表失败: %w", err)
 	}
+	s.debugf(ctx, "握手字节: % x % x", header, methods)
 
-	// Check supported authentication methods
-	var method uint8 = MethodNoAcceptable
-	if s.authEnabled {
-		// If authentication is enabled, we only accept username/password
-		for _, m := range methods {
-			if m == MethodUserPass {
-				method = MethodUserPass
-				break
-			}
-		}
-	} else {
-		// If authentication is disabled, we accept no authentication
-		for _, m := range methods {
-			if m == MethodNoAuth {
-				method = MethodNoAuth
-				break
-			}
-		}
+	// Pick the highest-priority method offered by the client
+	method := l.selectMethod(methods)
+	if method == MethodUserPass && !s.authBackendHealthy() {
+		// 认证后端不可用时让客户端在握手阶段快速失败，或改用监听器接受的其他方法
+		metricAuthBackendUnavailable.Add(s.metrics(), 1)
+		method = l.selectMethod(withoutMethod(methods, MethodUserPass))
+		log.Printf("[trace %s] 认证后端不可用, 不选择用户名/密码认证 (客户端 %s)", traceIDFrom(ctx), conn.RemoteAddr())
 	}
 
 	// Send selected method
-	if _, err := conn.Write([]byte{Version5, method}); err != nil {
-		return fmt.Errorf("failed to send auth method: %v", err)
+	s.greetingJitter(ctx)
+	if err := writeFull(conn, []byte{Version5, method}); err != nil {
+		return nil, "", fmt.Errorf("failed to send auth method: %w", err)
 	}
 
+	// 没有可用的方法时关闭写方向，让客户端在读到 0xFF 后收到干净的 EOF（TLS 为 close_notify）
 	if method == MethodNoAcceptable {
-		return errors.New("no supported authentication methods")
+		closeWrite(conn)
+		return nil, "", fmt.Errorf("%w: 客户端 %s 提供的方法 [% x], 监听器接受 [% x]", ErrNoAcceptableMethod, conn.RemoteAddr(), methods, l.methods)
 	}
 
 	// Perform authentication if required
+	var username string
 	if method == MethodUserPass {
-		return s.handleUserPassAuth(conn)
+		var err error
+		if username, err = s.handleUserPassAuth(ctx, conn); err != nil {
+			return nil, "", err
+		}
 	}
 
+	// 客户端提供了已注册的私有方法时，认证后进行能力协商
+	for _, m := range methods {
+		if negotiate := s.negotiatorFor(m); negotiate != nil {
+			negotiated, err := negotiate(ctx, conn, username)
+			if err != nil {
+				return nil, "", fmt.Errorf("能力协商失败: %w", err)
+			}
+			if negotiated != nil {
+				conn = negotiated
+			}
+			break
+		}
+	}
+
+	return conn, username, nil
+}
+
+// negotiatorFor returns the capability negotiator for a private method,
+// preferring handlers registered in Negotiators over built-in ones
+func (s *Server) negotiatorFor(method uint8) func(ctx context.Context, conn net.Conn, username string) (net.Conn, error) {
+	if method < MethodPrivateMin {
+		return nil
+	}
+	if negotiate, ok := s.Negotiators[method]; ok {
+		return negotiate
+	}
+	if method == MethodCompression && s.cfg().Compression {
+		return negotiateCompression
+	}
 	return nil
 }
 
-// handleUserPassAuth handles username/password authentication
-func (s *Server) handleUserPassAuth(conn net.Conn) error {
+// handleUserPassAuth handles username/password authentication and
+// returns the authenticated username
+func (s *Server) handleUserPassAuth(ctx context.Context, conn net.Conn) (string, error) {
 	header := make([]byte, 2)
 	if _, err := io.ReadFull(conn, header); err != nil {
-		return fmt.Errorf("failed to read auth header: %v", err)
+		return "", fmt.Errorf("failed to read auth header: %w", err)
 	}
 
 	version := header[0]
 	if version != AuthUserPassVersion {
-		return fmt.Errorf("unsupported auth version: %d", version)
+		return "", fmt.Errorf("%w: unsupported auth version: %d", ErrAuthFailed, version)
 	}
 
 	// Read username
 	userLen := int(header[1])
 	username := make([]byte, userLen)
 	if _, err := io.ReadFull(conn, username); err != nil {
-		return fmt.Errorf("failed to read username: %v", err)
+		return "", fmt.Errorf("failed to read username: %w", err)
 	}
 
 	// Read password
 	passLenBuf := make([]byte, 1)
 	if _, err := io.ReadFull(conn, passLenBuf); err != nil {
-		return fmt.Errorf("failed to read password length: %v", err)
+		return "", fmt.Errorf("failed to read password length: %w", err)
 	}
 	passLen := int(passLenBuf[0])
 	password := make([]byte, passLen)
 	if _, err := io.ReadFull(conn, password); err != nil {
-		return fmt.Errorf("failed to read password: %v", err)
+		return "", fmt.Errorf("failed to read password: %w", err)
 	}
 
-	// Verify credentials
-	if s.verifyCredentials(string(username), string(password)) {
-		_, err := conn.Write([]byte{AuthUserPassVersion, AuthUserPassSuccess})
-		return err
+	// 超过配置上限的字段不做校验直接拒绝，仍完整读取以便按协议回复失败
+	if userLen > s.cfg().MaxUsernameLength {
+		writeFull(conn, []byte{AuthUserPassVersion, AuthUserPassFailure})
+		return "", fmt.Errorf("%w: 用户名长度 %d 超过上限 %d", ErrAuthFailed, userLen, s.cfg().MaxUsernameLength)
+	}
+	if passLen > s.cfg().MaxPasswordLength {
+		writeFull(conn, []byte{AuthUserPassVersion, AuthUserPassFailure})
+		return "", fmt.Errorf("%w: 用户 %q 的密码长度 %d 超过上限 %d", ErrAuthFailed, s.logUsername(string(username)), passLen, s.cfg().MaxPasswordLength)
 	}
 
-	conn.Write([]byte{AuthUserPassVersion, AuthUserPassFailure})
-	return errors.New("invalid credentials")
+	// Verify credentials，只统计凭据校验本身的耗时，不含读取客户端数据
+	start := time.Now()
+	ac := AuthContext{Username: string(username), Password: string(password), RemoteAddr: conn.RemoteAddr()}
+	ok := s.verifyCredentials(ctx, ac)
+	// 要求TLS的用户通过明文监听器认证时按认证失败处理，回复与密码错误相同
+	plaintextDenied := ok && s.requiresTLS(ctx, ac.Username) && !isTLSConn(conn)
+	if plaintextDenied {
+		ok = false
+	}
+	elapsed := time.Since(start)
+	metricAuthDuration.Observe(s.metrics(), float64(elapsed) / float64(time.Millisecond))
+	if s.OnAuth != nil {
+		s.OnAuth(ctx, string(username), ok, elapsed)
+	}
+
+	if ok {
+		saveAuthContext(ctx, ac)
+		err := writeFull(conn, []byte{AuthUserPassVersion, AuthUserPassSuccess})
+		return string(username), err
+	}
+
+	writeFull(conn, []byte{AuthUserPassVersion, AuthUserPassFailure})
+	if plaintextDenied {
+		return "", fmt.Errorf("%w: 用户 %q 只允许通过TLS连接", ErrAuthFailed, s.logUsername(string(username)))
+	}
+	return "", fmt.Errorf("%w: invalid credentials for user %q", ErrAuthFailed, s.logUsername(string(username)))
 }
 
-// verifyCredentials verifies the provided username and password
-func (s *Server) verifyCredentials(username, password string) bool {
-	if storedPass, ok := s.credentials[username]; ok {
-		return storedPass == password
+// requiresTLS reports whether the configured user may only authenticate
+// over a TLS listener
+func (s *Server) requiresTLS(ctx context.Context, username string) bool {
+	return s.policyFor(ctx).users[username].RequireTLS
+}
+
+// verifyCredentials verifies the provided username and password against
+// the Authenticator when set, otherwise against the configured users
+func (s *Server) verifyCredentials(ctx context.Context, ac AuthContext) bool {
+	if s.Authenticator != nil {
+		ok, err := s.Authenticator.Authenticate(ctx, ac)
+		if err != nil {
+			log.Printf("[trace %s] 认证后端校验用户 %s 失败: %v", traceIDFrom(ctx), s.logUsername(ac.Username), err)
+			return false
+		}
+		return ok
+	}
+	if user, ok := s.policyFor(ctx).users[ac.Username]; ok {
+		if user.hash != "" {
+			return verifyHtpasswd(user.hash, ac.Password)
+		}
+		return user.Password == ac.Password
 	}
 	return false
 }
 
+// allowsCommand reports whether the authenticated user may issue the command
+func (s *Server) allowsCommand(ctx context.Context, username string, command uint8) bool {
+	if username == "" {
+		return true
+	}
+	user, ok := s.policyFor(ctx).users[username]
+	if !ok {
+		// 由外部认证后端认证、未在配置中出现的用户不限制命令
+		return s.Authenticator != nil
+	}
+	return user.AllowsCommand(command)
+}
+
 // handleRequest processes the client's connection request
-func (s *Server) handleRequest(conn net.Conn) error {
+func (s *Server) handleRequest(ctx context.Context, conn net.Conn, username string) error {
+	// debug 级别下记录请求的原始字节
+	var raw bytes.Buffer
+	var r io.Reader = conn
+	if s.cfg().LogLevel == LogLevelDebug {
+		r = io.TeeReader(conn, &raw)
+	}
+
+	// 认证完成后客户端必须在 request_timeout 内发送完整的请求，
+	// 与预读首字节的 first_byte_timeout 分开计时
+	timeout := time.Duration(s.cfg().RequestTimeout) * time.Millisecond
+	if timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+
 	// Read version, command, reserved, and address type
 	header := make([]byte, 4)
-	if _, err := io.ReadFull(conn, header); err != nil {
-		return fmt.Errorf("读取请求失败: %v", err)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return fmt.Errorf("%w: 认证完成后 %s 内未收到请求", ErrRequestTimeout, timeout)
+		}
+		return fmt.Errorf("读取请求失败: %w", err)
 	}
 
 	version := header[0]
 	if version != Version5 {
-		return fmt.Errorf("不支持的版本: %d", version)
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
 	}
 
 	command := header[1]
@@ -297,100 +891,539 @@ func (s *Server) handleRequest(conn net.Conn) error {
 
 	switch addrType {
 	case TypeIPv4:
-		addr, err = s.readIPv4(conn)
+		addr, err = s.readIPv4(r)
 	case TypeDomain:
-		addr, err = s.readDomain(conn)
+		addr, err = s.readDomain(r)
 	case TypeIPv6:
-		addr, err = s.readIPv6(conn)
+		addr, err = s.readIPv6(r)
 	default:
 		s.sendReply(conn, RepAddressTypeNotSupported, nil)
-		return fmt.Errorf("不支持的地址类型: %d", addrType)
+		return fmt.Errorf("%w: %d", ErrAddressTypeNotSupported, addrType)
 	}
 
 	if err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return fmt.Errorf("%w: 认证完成后 %s 内未收到完整的请求", ErrRequestTimeout, timeout)
+		}
+		if errors.Is(err, ErrHostUnreachable) {
+			s.sendReply(conn, RepHostUnreachable, nil)
+			return err
+		}
+		if errors.Is(err, ErrAddressTypeNotSupported) {
+			s.sendReply(conn, RepAddressTypeNotSupported, nil)
+			return err
+		}
 		s.sendReply(conn, RepServerFailure, nil)
-		return fmt.Errorf("读取地址失败: %v", err)
+		return fmt.Errorf("读取地址失败: %w", err)
 	}
 
 	// 读取端口
 	var port uint16
-	if err := binary.Read(conn, binary.BigEndian, &port); err != nil {
+	if err := binary.Read(r, binary.BigEndian, &port); err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return fmt.Errorf("%w: 认证完成后 %s 内未收到完整的请求", ErrRequestTimeout, timeout)
+		}
 		s.sendReply(conn, RepServerFailure, nil)
-		return fmt.Errorf("读取端口失败: %v", err)
+		return fmt.Errorf("读取端口失败: %w", err)
+	}
+	if timeout > 0 {
+		conn.SetReadDeadline(time.Time{})
+	}
+	s.debugf(ctx, "请求字节: % x", raw.Bytes())
+
+	reply := func(rep uint8, addr *net.TCPAddr) error {
+		return s.sendReply(conn, rep, addr)
 	}
 
-	target := fmt.Sprintf("%s:%d", addr, port)
+	req, err := s.authorizeRequest(ctx, &Request{
+		Command:    command,
+		Host:       addr,
+		Port:       port,
+		Username:   username,
+		RemoteAddr: conn.RemoteAddr(),
+	}, reply)
+	if err != nil {
+		return err
+	}
 
 	// 根据命令类型处理请求
 	switch command {
 	case CmdConnect:
-		return s.handleConnect(conn, target)
+		return s.handleConnect(ctx, conn, req, reply)
 	case CmdUDPAssociate:
-		return s.handleUDPAssociate(conn)
+		return s.handleUDPAssociate(ctx, conn)
 	default:
 		s.sendReply(conn, RepCommandNotSupported, nil)
-		return fmt.Errorf("不支持的命令: %d", command)
+		return fmt.Errorf("%w: %d", ErrCommandNotSupported, command)
 	}
 }
 
-// handleConnect 处理 CONNECT 命令
-func (s *Server) handleConnect(conn net.Conn, target string) error {
-	// 连接目标服务器
-	dest, err := net.Dial("tcp", target)
+// replyFunc sends a protocol-specific reply (SOCKS5 or SOCKS4) to the client
+type replyFunc func(rep uint8, addr *net.TCPAddr) error
+
+// authorizeRequest applies the user's command allowlist, the OnRequest hook
+// and the routing rules, returning the possibly rewritten request. Denials
+// are answered through reply.
+func (s *Server) authorizeRequest(ctx context.Context, req *Request, reply replyFunc) (*Request, error) {
+	// 检查用户是否有权限使用该命令
+	if !s.allowsCommand(ctx, req.Username, req.Command) {
+		reply(RepCommandNotSupported, nil)
+		return nil, fmt.Errorf("%w: 用户 %s 无权使用命令 %d", ErrCommandNotSupported, s.logUsername(req.Username), req.Command)
+	}
+
+	// 调用请求钩子，允许拒绝或改写目标
+	if s.OnRequest != nil {
+		rewritten, err := s.OnRequest(ctx, req)
+		if err != nil {
+			return nil, s.deny(reply, fmt.Errorf("%w: %v", ErrConnectionNotAllowed, err))
+		}
+		if rewritten != nil {
+			req = rewritten
+		}
+	}
+
+	// 固定目标模式下所有 CONNECT 都改写为配置的目标，UDP 转发的目标
+	// 由各个数据报决定，无法固定，因此拒绝 UDP ASSOCIATE
+	if fixed := s.cfg().FixedDestination; fixed != "" {
+		if req.Command == CmdUDPAssociate {
+			return nil, s.deny(reply, fmt.Errorf("%w: 固定目标模式下不允许 UDP 转发", ErrConnectionNotAllowed))
+		}
+		host, port, _ := splitHostPort(fixed)
+		s.debugf(ctx, "固定目标模式: 请求的目标 %s 改写为 %s", net.JoinHostPort(req.Host, strconv.Itoa(int(req.Port))), fixed)
+		rewritten := *req
+		rewritten.Host, rewritten.Port = host, port
+		req = &rewritten
+	}
+
+	// 检查路由规则是否禁止访问该目标
+	p := s.policyFor(ctx)
+	if p.router.lookup(req.Host) == RouteBlock {
+		return nil, s.deny(reply, fmt.Errorf("%w: 路由规则禁止访问 %s", ErrConnectionNotAllowed, req.Host))
+	}
+
+	// 默认拒绝模式下只允许访问允许列表中的目标。UDP 转发的目标由各个数据报决定，
+	// 无法在此按目标校验，因此该模式下拒绝 UDP ASSOCIATE
+	if p.defaultDeny && req.Command == CmdUDPAssociate {
+		return nil, s.deny(reply, fmt.Errorf("%w: 默认拒绝模式下不允许 UDP 转发", ErrConnectionNotAllowed))
+	}
+	if !p.allows(req.Username, req.Host) {
+		return nil, s.deny(reply, fmt.Errorf("%w: 用户 %q 的允许列表不包含 %s", ErrConnectionNotAllowed, s.logUsername(req.Username), req.Host))
+	}
+
+	// 请求阶段认证：由外部认证后端按客户端地址与目标决定是否允许
+	if !s.authorizeDestination(ctx, req) {
+		return nil, s.deny(reply, fmt.Errorf("%w: 认证后端拒绝用户 %q 访问 %s", ErrConnectionNotAllowed, s.logUsername(req.Username), net.JoinHostPort(req.Host, strconv.Itoa(int(req.Port)))))
+	}
+
+	metricRequests.Add(s.metrics(), s.metricLabels(req, nil), 1)
+	return req, nil
+}
+
+// handleConnect 处理已授权的 CONNECT 请求，reply 用于发送协议相应的回复
+func (s *Server) handleConnect(ctx context.Context, conn net.Conn, req *Request, reply replyFunc) error {
+	target := net.JoinHostPort(req.Host, strconv.Itoa(int(req.Port)))
+	ctx = withClientInfo(ctx, clientInfo{src: req.RemoteAddr, dst: conn.LocalAddr(), username: req.Username})
+
+	// 到同一目标的连接数达到上限时拒绝，名额在会话结束后释放
+	release, ok := s.destinations.acquire(req.Host, req.Port)
+	if !ok {
+		metricDestinationRejected.Add(s.metrics(), 1)
+		err := fmt.Errorf("%w: 到 %s 的连接数已达上限 %d", ErrQuotaExceeded, target, s.destinations.max)
+		reply(replyCodeFor(err, RepHostUnreachable), nil)
+		return err
+	}
+	defer release()
+
+	// 用户及其所属用户组的连接数达到上限时拒绝，带宽限制在转发时生效
+	lease, err := s.shares.acquire(s.policyFor(ctx).shareLimits(req.Username, s.logUsername(req.Username)))
+	if err != nil {
+		reply(replyCodeFor(err, RepHostUnreachable), nil)
+		return err
+	}
+	defer lease.release()
+
+	// 连接目标服务器，超时只作用于建立连接（含上游握手）
+	dialCtx := ctx
+	if d := time.Duration(s.cfg().DialTimeout) * time.Second; d > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+	dest, err := s.dialTarget(dialCtx, s.cfg().Network, target)
 	if err != nil {
-		s.sendReply(conn, RepConnectionRefused, nil)
-		return fmt.Errorf("连接目标服务器失败: %v", err)
+		if errors.Is(err, ErrConnectionNotAllowed) {
+			return s.deny(reply, err)
+		}
+		// 未在本地预先解析时，域名解析失败由拨号返回
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) {
+			err = fmt.Errorf("%w: %w", ErrResolveFailed, err)
+		}
+		timeoutCode := RepHostUnreachable
+		if s.cfg().DialTimeoutReply == DialTimeoutReplyTTLExpired {
+			timeoutCode = RepTTLExpired
+		}
+		reply(replyCodeFor(err, timeoutCode), nil)
+		return fmt.Errorf("%w: %w", ErrDialFailed, err)
 	}
 	defer dest.Close()
 
-	// 发送成功响应
-	local := dest.LocalAddr().(*net.TCPAddr)
-	if err := s.sendReply(conn, RepSuccess, local); err != nil {
-		return fmt.Errorf("发送响应失败: %v", err)
+	// 发送成功响应。回复在开始转发前一次性写出：TLS 连接的 Write 立即封装成记录发送，
+	// 压缩连接每次写入后都会 Flush，因此客户端总是在任何目标数据之前收到完整回复。
+	// 自定义 Dial 可能返回非TCP连接，此时回复全零地址
+	local, _ := dest.LocalAddr().(*net.TCPAddr)
+	if err := reply(RepSuccess, s.advertisedAddr(local)); err != nil {
+		return fmt.Errorf("发送响应失败: %w", err)
+	}
+	opened := time.Now()
+	s.events.emit(s.connectionEvent(ctx, EventConnectionOpen, req, target, dest))
+
+	setNoDelay(conn, s.cfg().TCPNoDelay)
+	setNoDelay(dest, s.cfg().TCPNoDelay)
+	for _, c := range []net.Conn{conn, dest} {
+		if err := setBuffers(c, s.cfg().SocketReadBuffer, s.cfg().SocketWriteBuffer); err != nil {
+			s.debugf(ctx, "设置套接字缓冲区失败: %v", err)
+		}
+	}
+
+	// TLS 中间人检查：解密 SNI 命中允许列表的连接，其余连接原样转发
+	if s.mitm != nil && s.mitm.matchesPort(target) {
+		plainConn, plainDest, sni, err := s.mitm.intercept(ctx, conn, dest)
+		if err != nil {
+			return fmt.Errorf("TLS中间人检查失败 (SNI %q): %w", sni, err)
+		}
+		if plainDest != dest {
+			log.Printf("[trace %s] TLS中间人检查: 解密到 %s 的连接 (SNI %s)", traceIDFrom(ctx), target, sni)
+		}
+		conn, dest = plainConn, plainDest
+	}
+
+	// 没有待读取的缓冲数据时直接使用底层连接，以便使用TCP零拷贝转发
+	conn = unwrapConn(conn)
+
+	// 关闭两端时同时取消 session，使带宽限制的等待随会话一起结束
+	session, endSession := context.WithCancel(ctx)
+	defer endSession()
+	closeSession := func() {
+		endSession()
+		conn.Close()
+		dest.Close()
 	}
 
-	// 开始数据转发
-	errCh := make(chan error, 2)
-	go s.proxy(conn, dest, errCh)
-	go s.proxy(dest, conn, errCh)
+	// 会话到期后关闭两端，使转发立即结束
+	var expired atomic.Bool
+	if d := time.Duration(s.cfg().MaxSessionDuration) * time.Second; d > 0 {
+		timer := time.AfterFunc(d, func() {
+			expired.Store(true)
+			closeSession()
+		})
+		defer timer.Stop()
+	}
+
+	// 启用抓包时记录两个方向的原始数据
+	capture := s.newConnCapture(ctx)
+	defer capture.Close()
+
+	// 开始数据转发，启用流量配额、带宽限制或抓包时对应方向不使用零拷贝转发
+	quota := newByteQuota(s.cfg().MaxBytesPerConnection, s.cfg().QuotaDirection)
+	resultCh := make(chan proxyResult, 2)
+	go s.proxy(dest, lease.wrap(quota.wrap(capture.wrap(conn, true), true), session.Done()), true, resultCh)
+	go s.proxy(conn, lease.wrap(quota.wrap(capture.wrap(dest, false), false), session.Done()), false, resultCh)
 
-	// 等待连接关闭
-	err = <-errCh
+	// 等待任一方向结束，按 close_strategy 决定是否只关闭该方向对端的写方向，
+	// 让另一方向继续转发剩余数据；不半关闭或无法半关闭时立即关闭两端
+	first := <-resultCh
+	halfClosed := false
+	if s.halfCloses(first) {
+		peer := conn
+		if first.upload {
+			peer = dest
+		}
+		halfClosed = closeWrite(peer) == nil
+	}
+	if !halfClosed {
+		closeSession()
+	} else if s.cfg().CloseStrategy == CloseStrategyLinger {
+		timer := time.AfterFunc(time.Duration(s.cfg().CloseLinger)*time.Second, closeSession)
+		defer timer.Stop()
+	}
+	second := <-resultCh
+	closeSession()
+
+	var upload, download int64
+	for _, r := range []proxyResult{first, second} {
+		if r.upload {
+			upload = r.n
+		} else {
+			download = r.n
+		}
+	}
+	err = first.err
+	closed := "已关闭"
+	switch {
+	case expired.Load():
+		metricSessionsExpired.Add(s.metrics(), 1)
+		closed = fmt.Sprintf("超过最长会话时长 %ds 已关闭", s.cfg().MaxSessionDuration)
+		err = nil
+	case quota.isExceeded():
+		metricQuotaExceeded.Add(s.metrics(), 1)
+		closed = fmt.Sprintf("超过流量配额 %d 字节已关闭", s.cfg().MaxBytesPerConnection)
+		err = nil
+	}
+	// 会话以错误结束时始终记录，正常结束的会话按采样率记录
+	logf := log.Printf
+	if err == nil {
+		logf = func(format string, args ...any) { s.logSampled(ctx, format, args...) }
+	}
+	logf("[trace %s] 连接 %s %s, 出口 %s, 上行 %d 字节, 下行 %d 字节", traceIDFrom(ctx), target, closed, dest.LocalAddr(), upload, download)
+
+	labels := s.metricLabels(req, dest.LocalAddr())
+	metricSessionUpload.Add(s.metrics(), labels, upload)
+	metricSessionDownload.Add(s.metrics(), labels, download)
+
+	closeEvent := s.connectionEvent(ctx, EventConnectionClose, req, target, dest)
+	closeEvent.Upload, closeEvent.Download = upload, download
+	closeEvent.Duration = float64(time.Since(opened)) / float64(time.Millisecond)
+	s.events.emit(closeEvent)
+
+	if s.OnConnectionClose != nil {
+		s.OnConnectionClose(ctx, &ConnectionInfo{
+			TraceID:  traceIDFrom(ctx),
+			Target:   target,
+			Egress:   dest.LocalAddr(),
+			Upload:   upload,
+			Download: download,
+		})
+	}
+
+	return err
+}
+
+// halfCloses reports whether the close strategy keeps the other direction
+// open after the first direction finished with the given result
+func (s *Server) halfCloses(first proxyResult) bool {
+	switch s.cfg().CloseStrategy {
+	case CloseStrategyWaitBoth:
+		return true
+	case CloseStrategyHalfClose, CloseStrategyLinger:
+		return first.err == nil
+	}
+	return false
+}
+
+// advertisedAddr returns the BND.ADDR for a CONNECT reply, replacing the
+// outbound local IP with the configured advertised IP when set
+func (s *Server) advertisedAddr(local *net.TCPAddr) *net.TCPAddr {
+	advertised := s.settings.Load().advertisedIP
+	if advertised == nil {
+		return local
+	}
+	addr := &net.TCPAddr{IP: advertised}
+	if local != nil {
+		addr.Port = local.Port
+	}
+	return addr
+}
+
+// deny rejects a request denied by policy, either replying
+// RepConnectionNotAllowed or closing silently as configured
+func (s *Server) deny(reply replyFunc, err error) error {
+	metricDenied.Add(s.metrics(), 1)
+	if s.cfg().DenyAction == DenyActionDrop {
+		return fmt.Errorf("%w (静默丢弃)", err)
+	}
+	reply(RepConnectionNotAllowed, nil)
 	return err
 }
 
+// egressIP returns the source IP for the next outbound TCP connection,
+// or nil to let the system choose
+func (s *Server) egressIP() net.IP {
+	st := s.settings.Load()
+	if st.egress != nil {
+		return st.egress.next()
+	}
+	return st.outboundIP
+}
+
+// replyCodeFor maps a dial error to the SOCKS5 reply code sent to the client;
+// timeouts map to timeoutCode
+func replyCodeFor(err error, timeoutCode uint8) uint8 {
+	var upstreamErr *upstreamReplyError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrConnectionNotAllowed):
+		return RepConnectionNotAllowed
+	case errors.Is(err, ErrAddressTypeNotSupported):
+		return RepAddressTypeNotSupported
+	case errors.Is(err, ErrHostUnreachable):
+		return RepHostUnreachable
+	case errors.Is(err, ErrQuotaExceeded):
+		return RepServerFailure
+	case errors.As(err, &upstreamErr):
+		return upstreamErr.Code
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return timeoutCode
+	default:
+		return RepConnectionRefused
+	}
+}
+
+// dialTarget 按路由表建立出站连接，并记录耗时与慢连接告警
+func (s *Server) dialTarget(ctx context.Context, network, target string) (net.Conn, error) {
+	var dial dialFunc = s.Dial
+	if dial == nil {
+		dialer := &net.Dialer{}
+		if ip := s.egressIP(); ip != nil {
+			dialer.LocalAddr = &net.TCPAddr{IP: ip}
+		}
+		var dscp, reuseAddr controlFunc
+		if s.cfg().OutboundDSCP > 0 {
+			dscp = dscpControl(s.cfg().OutboundDSCP)
+		}
+		if s.cfg().OutboundReuseAddr {
+			reuseAddr = reuseAddrControl()
+		}
+		dialer.Control = chainControl(dscp, reuseAddr)
+		dial = dialer.DialContext
+
+		if linger := s.cfg().OutboundLinger; linger >= 0 {
+			dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+				conn, err := dialer.DialContext(ctx, network, address)
+				if tc, ok := conn.(*net.TCPConn); ok {
+					tc.SetLinger(linger)
+				}
+				return conn, err
+			}
+		}
+	}
+
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		host = target
+	}
+	p := s.policyFor(ctx)
+	via := p.router.lookup(host)
+	if via == RouteBlock {
+		return nil, fmt.Errorf("%w: 路由规则禁止访问 %s", ErrConnectionNotAllowed, target)
+	}
+
+	// 直接连接时按配置先解析并校验目标IP，然后固定连接该IP；
+	// 配置了自定义 Resolver 时也由其解析，而不是交给拨号器
+	if via == RouteDirect {
+		switch {
+		case (s.cfg().ResolveBeforeDial || s.cfg().BlockPrivateTargets || s.cfg().PublicTargetsOnly || s.Resolver != nil || s.prefersFamily()) && err == nil:
+			pinned, err := s.pinTarget(ctx, p, network, host, port)
+			if err != nil {
+				return nil, err
+			}
+			s.debugf(ctx, "目标 %s 解析并固定为 %s", target, pinned)
+			target = pinned
+			host, _, _ = net.SplitHostPort(pinned)
+		case net.ParseIP(host) != nil:
+			if err := s.checkTargetIP(p, net.ParseIP(host)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// 直接连接时拒绝与 network 地址族不符的IP目标，域名则由拨号器只解析对应地址族
+	if ip := net.ParseIP(host); ip != nil && via == RouteDirect && !ipMatchesNetwork(ip, network) {
+		return nil, fmt.Errorf("%w: %s 不能通过 %s 连接", ErrAddressTypeNotSupported, target, network)
+	}
+
+	// 上游配置了 resolve_locally 时在本地解析后向上游发送IP
+	if via != RouteDirect && p.upstreams[via].ResolveLocally {
+		if target, err = s.resolveTarget(ctx, target); err != nil {
+			return nil, err
+		}
+	}
+
+	start := time.Now()
+	var conn net.Conn
+	if via == RouteDirect {
+		conn, err = dial(ctx, network, target)
+	} else {
+		conn, err = s.dialViaUpstream(ctx, dial, via, p.upstreams[via], target)
+	}
+	elapsed := time.Since(start)
+
+	metricDialDuration.Observe(s.metrics(), float64(elapsed) / float64(time.Millisecond))
+	if threshold := time.Duration(s.cfg().SlowDialThreshold) * time.Millisecond; threshold > 0 && elapsed > threshold {
+		metricSlowDials.Add(s.metrics(), 1)
+		log.Printf("[trace %s] 警告: 连接目标 %s 耗时 %v, 超过阈值 %v", traceIDFrom(ctx), target, elapsed, threshold)
+	}
+
+	return conn, err
+}
+
+// ipMatchesNetwork 判断IP是否属于 network（tcp4/tcp6）限定的地址族
+func ipMatchesNetwork(ip net.IP, network string) bool {
+	switch network {
+	case "tcp4":
+		return ip.To4() != nil
+	case "tcp6":
+		return ip.To4() == nil
+	default:
+		return true
+	}
+}
+
 // handleUDPAssociate 处理 UDP ASSOCIATE 命令
-func (s *Server) handleUDPAssociate(conn net.Conn) error {
+func (s *Server) handleUDPAssociate(ctx context.Context, conn net.Conn) error {
 	// 检查是否启用了UDP支持
 	if s.udpHandler == nil {
 		s.sendReply(conn, RepCommandNotSupported, nil)
-		return fmt.Errorf("UDP支持未启用")
+		return fmt.Errorf("%w: UDP支持未启用", ErrCommandNotSupported)
 	}
 
+	// 登记UDP关联，控制连接断开时关闭其所有UDP会话。
+	// 关联的数据报按控制连接所在监听器的策略检查目标IP
+	clientIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	assoc, err := s.udpHandler.associate(clientIP, func(ip net.IP) error { return s.checkTargetIP(s.policyFor(ctx), ip) })
+	if err != nil {
+		s.sendReply(conn, RepConnectionNotAllowed, nil)
+		return err
+	}
+	defer s.udpHandler.release(assoc)
+
 	// 获取UDP监听地址
-	udpAddr := s.udpHandler.listener.LocalAddr().(*net.UDPAddr)
+	var bindAddr *net.TCPAddr
+	if udpAddr, ok := s.udpHandler.listener.LocalAddr().(*net.UDPAddr); ok {
+		bindAddr = &net.TCPAddr{IP: udpAddr.IP, Port: udpAddr.Port}
+	}
 
 	// 发送UDP服务器地址给客户端
-	if err := s.sendReply(conn, RepSuccess, &net.TCPAddr{
-		IP:   udpAddr.IP,
-		Port: udpAddr.Port,
-	}); err != nil {
-		return fmt.Errorf("发送UDP绑定地址失败: %v", err)
+	if err := s.sendReply(conn, RepSuccess, bindAddr); err != nil {
+		return fmt.Errorf("发送UDP绑定地址失败: %w", err)
 	}
 
 	// 保持TCP连接，直到客户端断开
-	// 这是必要的，因为UDP关联需要依赖于TCP控制连接
+	// 这是必要的，因为UDP关联需要依赖于TCP控制连接。
+	// 配置了 idle_timeout 时，关联超过该时间没有UDP数据报经过则关闭控制连接
+	idle := time.Duration(s.udpHandler.config.UDP.IdleTimeout) * time.Second
 	buffer := make([]byte, 1)
 	for {
+		if idle > 0 {
+			conn.SetReadDeadline(s.udpHandler.lastActive(assoc).Add(idle))
+		}
 		_, err := conn.Read(buffer)
 		if err != nil {
+			if idle > 0 && errors.Is(err, os.ErrDeadlineExceeded) {
+				if time.Since(s.udpHandler.lastActive(assoc)) < idle {
+					continue
+				}
+				metricUDPAssociationsReaped.Add(s.metrics(), 1)
+				log.Printf("[trace %s] UDP关联 %s 空闲超过 %v, 关闭控制连接", traceIDFrom(ctx), conn.RemoteAddr(), idle)
+				return nil
+			}
 			return nil // 客户端断开连接，正常退出
 		}
 	}
 }
 
 // readIPv4 reads an IPv4 address
-func (s *Server) readIPv4(conn net.Conn) (string, error) {
+func (s *Server) readIPv4(conn io.Reader) (string, error) {
 	addr := make([]byte, 4)
 	if _, err := io.ReadFull(conn, addr); err != nil {
 		return "", err
@@ -398,21 +1431,45 @@ func (s *Server) readIPv4(conn net.Conn) (string, error) {
 	return net.IP(addr).String(), nil
 }
 
-// readIPv6 reads an IPv6 address
-func (s *Server) readIPv6(conn net.Conn) (string, error) {
+// readIPv6 reads an IPv6 address.
+// IPv4-mapped addresses are normalized to IPv4. The SOCKS5 request cannot
+// carry an IPv6 zone, so link-local targets (which need a zone to pick the
+// outgoing interface) are rejected along with the unspecified address.
+func (s *Server) readIPv6(conn io.Reader) (string, error) {
 	addr := make([]byte, 16)
 	if _, err := io.ReadFull(conn, addr); err != nil {
 		return "", err
 	}
-	return net.IP(addr).String(), nil
+
+	ip := normalizeIP(net.IP(addr))
+	if ip.IsUnspecified() {
+		return "", fmt.Errorf("%w: 未指定的IPv6地址 %s", ErrHostUnreachable, ip)
+	}
+	if len(ip) == net.IPv6len && (ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast()) {
+		return "", fmt.Errorf("%w: 链路本地IPv6地址 %s 缺少zone", ErrHostUnreachable, ip)
+	}
+	return ip.String(), nil
+}
+
+// normalizeIP returns the 4-byte form of IPv4 and IPv4-mapped IPv6
+// addresses so they are dialed, matched and replied as IPv4
+func normalizeIP(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip
 }
 
 // readDomain reads a domain name
-func (s *Server) readDomain(conn net.Conn) (string, error) {
+func (s *Server) readDomain(conn io.Reader) (string, error) {
 	length := make([]byte, 1)
 	if _, err := io.ReadFull(conn, length); err != nil {
 		return "", err
 	}
+	// 长度为0的域名会被拼接成 ":port"，直接拒绝
+	if length[0] == 0 {
+		return "", fmt.Errorf("%w: 域名长度为0", ErrAddressTypeNotSupported)
+	}
 
 	domain := make([]byte, length[0])
 	if _, err := io.ReadFull(conn, domain); err != nil {
@@ -424,34 +1481,56 @@ func (s *Server) readDomain(conn net.Conn) (string, error) {
 
 // sendReply sends a reply to the client
 func (s *Server) sendReply(conn net.Conn, rep uint8, addr *net.TCPAddr) error {
-	response := make([]byte, 4)
-	response[0] = Version5
-	response[1] = rep
-	response[2] = 0x00 // Reserved
-
-	if addr == nil {
-		response[3] = TypeIPv4
-		response = append(response, make([]byte, 6)...)
-	} else {
-		ip := addr.IP.To4()
-		if ip != nil {
-			response[3] = TypeIPv4
-			response = append(response, ip...)
-		} else {
-			response[3] = TypeIPv6
-			response = append(response, addr.IP.To16()...)
+	// 失败回复以及没有有效地址时，BND 固定为全零 IPv4 地址块（ATYP=1，4字节地址+2字节端口），
+	// 保证任何回复码的帧长度与 ATYP 一致
+	atyp, ip, port := TypeIPv4, net.IP(make([]byte, net.IPv4len)), 0
+	if rep == RepSuccess && addr != nil {
+		switch v := normalizeIP(addr.IP); len(v) {
+		case net.IPv4len:
+			atyp, ip, port = TypeIPv4, v, addr.Port
+		case net.IPv6len:
+			atyp, ip, port = TypeIPv6, v, addr.Port
 		}
-		port := make([]byte, 2)
-		binary.BigEndian.PutUint16(port, uint16(addr.Port))
-		response = append(response, port...)
 	}
 
-	_, err := conn.Write(response)
-	return err
+	response := make([]byte, 0, 4+len(ip)+2)
+	response = append(response, Version5, rep, 0x00, atyp) // VER, REP, RSV, ATYP
+	response = append(response, ip...)
+	response = binary.BigEndian.AppendUint16(response, uint16(port))
+	return writeFull(conn, response)
+}
+
+// proxyResult holds the outcome of one proxy direction
+type proxyResult struct {
+	n      int64 // bytes copied
+	err    error
+	upload bool // true for client -> target
+}
+
+// copyBufPool 缓冲转发使用的缓冲区
+var copyBufPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 32*1024)
+		return &buf
+	},
 }
 
-// proxy copies data between two connections
-func (s *Server) proxy(dst io.Writer, src io.Reader, errCh chan error) {
-	_, err := io.Copy(dst, src)
-	errCh <- err
+// proxy copies data between two connections and reports the byte count.
+// When both ends are *net.TCPConn, ReadFrom lets the kernel splice the
+// data directly on Linux; otherwise a pooled buffer is used.
+func (s *Server) proxy(dst io.Writer, src io.Reader, upload bool, resultCh chan proxyResult) {
+	var n int64
+	var err error
+
+	tcpDst, dstOK := dst.(*net.TCPConn)
+	tcpSrc, srcOK := src.(*net.TCPConn)
+	if dstOK && srcOK {
+		n, err = tcpDst.ReadFrom(tcpSrc)
+	} else {
+		buf := copyBufPool.Get().(*[]byte)
+		n, err = io.CopyBuffer(dst, src, *buf)
+		copyBufPool.Put(buf)
+	}
+
+	resultCh <- proxyResult{n: n, err: err, upload: upload}
 }
\ No newline at end of file
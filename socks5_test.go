@@ -0,0 +1,1164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testConfig 解析测试用的 JSON 配置并补全默认值，未指定 address 时监听回环地址的随机端口
+func testConfig(t *testing.T, js string) *Config {
+	t.Helper()
+	fields := map[string]any{}
+	if js != "" {
+		if err := json.Unmarshal([]byte(js), &fields); err != nil {
+			t.Fatalf("测试配置不是有效的 JSON: %v", err)
+		}
+	}
+	if _, ok := fields["address"]; !ok {
+		fields["address"] = "127.0.0.1:0"
+	}
+	data, _ := json.Marshal(fields)
+	cfg, err := parseConfig(data)
+	if err != nil {
+		t.Fatalf("解析测试配置失败: %v", err)
+	}
+	return cfg
+}
+
+// startServer 创建并启动服务器，setup 可在启动前设置钩子等字段，测试结束时停止服务器
+func startServer(t *testing.T, cfg *Config, setup ...func(*Server)) *Server {
+	t.Helper()
+	s := NewServer(cfg)
+	for _, fn := range setup {
+		fn(s)
+	}
+	if err := s.Listen(); err != nil {
+		t.Fatalf("绑定监听器失败: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- s.Start() }()
+	t.Cleanup(func() {
+		s.Stop()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Errorf("Stop 后 Start 未返回")
+		}
+	})
+	return s
+}
+
+// dialServer 连接服务器的第一个监听器
+func dialServer(t *testing.T, s *Server) net.Conn {
+	t.Helper()
+	return dialAddr(t, s.Addr().String())
+}
+
+// dialAddr 连接 addr，测试结束时关闭
+func dialAddr(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatalf("连接服务器失败: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// greet 发送握手并完成认证，username 为空时只提供无认证方法
+func greet(t *testing.T, conn net.Conn, username, password string) {
+	t.Helper()
+	if username == "" {
+		mustWrite(t, conn, []byte{Version5, 1, MethodNoAuth})
+		expectBytes(t, conn, []byte{Version5, MethodNoAuth})
+		return
+	}
+	mustWrite(t, conn, []byte{Version5, 1, MethodUserPass})
+	expectBytes(t, conn, []byte{Version5, MethodUserPass})
+	mustWrite(t, conn, userPassAuth(username, password))
+	expectBytes(t, conn, []byte{AuthUserPassVersion, AuthUserPassSuccess})
+}
+
+// userPassAuth 构造用户名/密码认证子协商报文
+func userPassAuth(username, password string) []byte {
+	msg := []byte{AuthUserPassVersion, byte(len(username))}
+	msg = append(msg, username...)
+	msg = append(msg, byte(len(password)))
+	return append(msg, password...)
+}
+
+// requestBytes 构造请求报文，host 为IP时使用对应的地址类型，否则使用域名
+func requestBytes(cmd uint8, host string, port uint16) []byte {
+	msg := []byte{Version5, cmd, 0x00}
+	switch ip := net.ParseIP(host); {
+	case ip == nil:
+		msg = append(msg, TypeDomain, byte(len(host)))
+		msg = append(msg, host...)
+	case ip.To4() != nil:
+		msg = append(msg, TypeIPv4)
+		msg = append(msg, ip.To4()...)
+	default:
+		msg = append(msg, TypeIPv6)
+		msg = append(msg, ip.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(msg, port)
+}
+
+// readReply 读取一个完整的回复，返回回复码与 BND 地址
+func readReply(t *testing.T, conn net.Conn) (uint8, *net.TCPAddr) {
+	t.Helper()
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatalf("读取回复失败: %v", err)
+	}
+	if header[0] != Version5 || header[2] != 0 {
+		t.Fatalf("回复头部无效: % x", header)
+	}
+	var ip net.IP
+	switch header[3] {
+	case TypeIPv4:
+		ip = make(net.IP, net.IPv4len)
+	case TypeIPv6:
+		ip = make(net.IP, net.IPv6len)
+	default:
+		t.Fatalf("回复的 ATYP 无效: %d", header[3])
+	}
+	rest := make([]byte, len(ip)+2)
+	if _, err := io.ReadFull(conn, rest); err != nil {
+		t.Fatalf("读取回复地址失败: %v", err)
+	}
+	copy(ip, rest)
+	return header[1], &net.TCPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(rest[len(ip):]))}
+}
+
+// connect 完成握手后发送请求，返回回复码与 BND 地址
+func connect(t *testing.T, s *Server, username, password string, cmd uint8, target string) (net.Conn, uint8, *net.TCPAddr) {
+	t.Helper()
+	conn := dialServer(t, s)
+	rep, bnd := request(t, conn, username, password, cmd, target)
+	return conn, rep, bnd
+}
+
+// request 在已建立的连接（如TLS连接）上完成握手并发送请求，返回回复码与 BND 地址
+func request(t *testing.T, conn net.Conn, username, password string, cmd uint8, target string) (uint8, *net.TCPAddr) {
+	t.Helper()
+	greet(t, conn, username, password)
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		t.Fatalf("无效的目标 %q: %v", target, err)
+	}
+	port, _ := strconv.Atoi(portStr)
+	mustWrite(t, conn, requestBytes(cmd, host, uint16(port)))
+	return readReply(t, conn)
+}
+
+// expectClosed 断言服务器不再发送数据并关闭了连接
+func expectClosed(t *testing.T, conn net.Conn) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 16)
+	n, err := conn.Read(buf)
+	if err == nil {
+		t.Fatalf("期望连接被关闭, 读到 % x", buf[:n])
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatalf("期望连接被关闭, 但连接仍然打开")
+	}
+}
+
+func mustWrite(t *testing.T, conn net.Conn, b []byte) {
+	t.Helper()
+	if _, err := conn.Write(b); err != nil {
+		t.Fatalf("写入失败: %v", err)
+	}
+}
+
+func expectBytes(t *testing.T, conn net.Conn, want []byte) {
+	t.Helper()
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("读取失败: %v", err)
+	}
+	if string(got) != string(want) {
+		t.Fatalf("读到 % x, 期望 % x", got, want)
+	}
+}
+
+// startEcho 启动一个TCP回显服务，返回其地址
+func startEcho(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("启动回显服务失败: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestCommandAllowlist(t *testing.T) {
+	cfg := testConfig(t, `{
+		"users": {
+			"legacy": "secret",
+			"basic": {"password": "secret", "commands": ["connect"]},
+			"privileged": {"password": "secret", "commands": ["connect", "udp_associate"]}
+		},
+		"udp": {"enable": true, "timeout": 60, "buffer_size": 65535}
+	}`)
+	s := startServer(t, cfg)
+	echo := startEcho(t)
+
+	tests := []struct {
+		user string
+		cmd  uint8
+		want uint8
+	}{
+		{"basic", CmdConnect, RepSuccess},
+		{"basic", CmdUDPAssociate, RepCommandNotSupported},
+		{"basic", CmdBind, RepCommandNotSupported},
+		{"privileged", CmdConnect, RepSuccess},
+		{"privileged", CmdUDPAssociate, RepSuccess},
+		// 字符串写法的用户不限制命令，BIND 因服务器不支持而被拒绝
+		{"legacy", CmdConnect, RepSuccess},
+		{"legacy", CmdUDPAssociate, RepSuccess},
+		{"legacy", CmdBind, RepCommandNotSupported},
+	}
+	for _, tt := range tests {
+		t.Run(tt.user+"/"+commandName(tt.cmd), func(t *testing.T) {
+			_, rep, _ := connect(t, s, tt.user, "secret", tt.cmd, echo)
+			if rep != tt.want {
+				t.Fatalf("回复码 %#x, 期望 %#x", rep, tt.want)
+			}
+		})
+	}
+}
+
+func TestUserConfigStringForm(t *testing.T) {
+	cfg := testConfig(t, `{"users": {"alice": "pw", "bob": {"password": "pw2", "commands": ["udp_associate"]}}}`)
+	if got := cfg.Users["alice"]; got.Password != "pw" || len(got.Commands) != 0 {
+		t.Fatalf("字符串写法解析为 %+v", got)
+	}
+	bob := cfg.Users["bob"]
+	if bob.Password != "pw2" || bob.AllowsCommand(CmdConnect) || !bob.AllowsCommand(CmdUDPAssociate) {
+		t.Fatalf("结构体写法解析为 %+v", bob)
+	}
+
+	if _, err := parseConfig([]byte(`{"users": {"carol": {"password": "x", "commands": ["listen"]}}}`)); err == nil {
+		t.Fatalf("未知命令应被拒绝")
+	}
+}
+
+func TestProxyByteCounts(t *testing.T) {
+	tests := []struct {
+		name      string
+		upload    int
+		download  int
+		halfClose bool // 客户端发送完后半关闭，目标读到 EOF 后才回复
+	}{
+		{"request-response", 1000, 70000, false},
+		{"half-close", 123456, 4321, true},
+		{"upload-only", 50000, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 目标读取客户端的全部数据后回复 download 字节并关闭
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				if tt.halfClose {
+					io.Copy(io.Discard, conn)
+				} else {
+					io.CopyN(io.Discard, conn, int64(tt.upload))
+				}
+				conn.Write(make([]byte, tt.download))
+			}()
+
+			closed := make(chan *ConnectionInfo, 1)
+			s := startServer(t, testConfig(t, ""), func(s *Server) {
+				s.OnConnectionClose = func(_ context.Context, info *ConnectionInfo) { closed <- info }
+			})
+			conn, rep, _ := connect(t, s, "", "", CmdConnect, ln.Addr().String())
+			if rep != RepSuccess {
+				t.Fatalf("回复码 %#x", rep)
+			}
+			mustWrite(t, conn, make([]byte, tt.upload))
+			if tt.halfClose {
+				conn.(*net.TCPConn).CloseWrite()
+			}
+			n, err := io.Copy(io.Discard, conn)
+			if err != nil || n != int64(tt.download) {
+				t.Fatalf("客户端收到 %d 字节 (%v), 期望 %d", n, err, tt.download)
+			}
+			conn.Close()
+
+			select {
+			case info := <-closed:
+				if info.Upload != int64(tt.upload) || info.Download != int64(tt.download) {
+					t.Fatalf("统计为上行 %d 下行 %d, 期望上行 %d 下行 %d", info.Upload, info.Download, tt.upload, tt.download)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("会话结束后未调用 OnConnectionClose")
+			}
+		})
+	}
+}
+
+func TestAddr(t *testing.T) {
+	echo := startEcho(t)
+	tests := []struct {
+		name    string
+		address string
+	}{
+		{"IPv4回环", "127.0.0.1:0"},
+		{"所有地址", ":0"},
+		{"IPv6回环", "[::1]:0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(testConfig(t, `{"address": "`+tt.address+`"}`))
+			if addr := s.Addr(); addr != nil {
+				t.Fatalf("绑定前 Addr() = %v, 期望 nil", addr)
+			}
+			if err := s.Listen(); err != nil {
+				t.Skipf("无法绑定 %s: %v", tt.address, err)
+			}
+			done := make(chan error, 1)
+			go func() { done <- s.Start() }()
+			defer func() {
+				s.Stop()
+				<-done
+			}()
+
+			addr, ok := s.Addr().(*net.TCPAddr)
+			if !ok || addr.Port == 0 {
+				t.Fatalf("绑定后 Addr() = %v, 期望实际端口", s.Addr())
+			}
+			// 连接实际绑定的端口完成一次请求
+			if rep := connectAddr(t, addr.String(), "", "", echo); rep != RepSuccess {
+				t.Fatalf("连接 %s 回复码 %#x", addr, rep)
+			}
+		})
+	}
+}
+
+func TestTargetHalfClose(t *testing.T) {
+	const response = 200000
+	tests := []struct {
+		name     string
+		config   string
+		wait     time.Duration // 客户端收完响应后等待多久再发送
+		wantLate bool          // 目标半关闭后是否仍能收到客户端随后发送的数据
+	}{
+		{"默认半关闭", `{}`, 0, true},
+		{"关闭半关闭", `{"half_close": false}`, 0, false},
+		{"半关闭策略不限时", `{"close_strategy": "half_close"}`, 1500 * time.Millisecond, true},
+		{"立即关闭两端", `{"close_strategy": "close_both"}`, 0, false},
+		{"策略优先于half_close", `{"half_close": false, "close_strategy": "wait_both"}`, 0, true},
+		{"等待两个方向", `{"close_strategy": "wait_both"}`, 0, true},
+		{"宽限期内", `{"close_strategy": "linger", "close_linger": 2}`, 0, true},
+		{"超过宽限期", `{"close_strategy": "linger", "close_linger": 1}`, 1500 * time.Millisecond, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 目标先发送完整响应并半关闭，再读取客户端的全部数据
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			received := make(chan []byte, 1)
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				conn.Write(make([]byte, response))
+				conn.(*net.TCPConn).CloseWrite()
+				data, _ := io.ReadAll(conn)
+				received <- data
+			}()
+
+			s := startServer(t, testConfig(t, tt.config))
+			conn, rep, _ := connect(t, s, "", "", CmdConnect, ln.Addr().String())
+			if rep != RepSuccess {
+				t.Fatalf("回复码 %#x", rep)
+			}
+			// 响应不应被截断
+			if n, err := io.Copy(io.Discard, conn); err != nil || n != response {
+				t.Fatalf("客户端收到 %d 字节 (%v), 期望 %d", n, err, response)
+			}
+			time.Sleep(tt.wait)
+			conn.Write([]byte("late"))
+			conn.(*net.TCPConn).CloseWrite()
+
+			select {
+			case data := <-received:
+				if got := string(data) == "late"; got != tt.wantLate {
+					t.Fatalf("目标收到 %q, 期望收到后续数据为 %v", data, tt.wantLate)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("目标未读到 EOF")
+			}
+		})
+	}
+}
+
+func TestSendReplyFraming(t *testing.T) {
+	s := NewServer(testConfig(t, ""))
+	v4 := &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 0x1234}
+	v6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 0x1234}
+	mapped := &net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.10"), Port: 0x1234}
+	zero := []byte{TypeIPv4, 0, 0, 0, 0, 0, 0}
+
+	codes := []uint8{
+		RepSuccess, RepServerFailure, RepConnectionNotAllowed, RepNetworkUnreachable, RepHostUnreachable,
+		RepConnectionRefused, RepTTLExpired, RepCommandNotSupported, RepAddressTypeNotSupported,
+	}
+	for _, rep := range codes {
+		for _, tt := range []struct {
+			name string
+			addr *net.TCPAddr
+			bnd  []byte // ATYP、BND.ADDR 与 BND.PORT
+		}{
+			{"nil", nil, zero},
+			{"ipv4", v4, []byte{TypeIPv4, 192, 0, 2, 10, 0x12, 0x34}},
+			{"ipv4-mapped", mapped, []byte{TypeIPv4, 192, 0, 2, 10, 0x12, 0x34}},
+			{"ipv6", v6, append(append([]byte{TypeIPv6}, v6.IP.To16()...), 0x12, 0x34)},
+		} {
+			t.Run(fmt.Sprintf("%#x/%s", rep, tt.name), func(t *testing.T) {
+				// 失败回复总是使用全零的 IPv4 地址块
+				want := append([]byte{Version5, rep, 0x00}, zero...)
+				if rep == RepSuccess {
+					want = append([]byte{Version5, rep, 0x00}, tt.bnd...)
+				}
+				client, server := tcpPair(t)
+				if err := s.sendReply(server, rep, tt.addr); err != nil {
+					t.Fatal(err)
+				}
+				server.Close()
+				got, _ := io.ReadAll(client)
+				if string(got) != string(want) {
+					t.Fatalf("回复 % x, 期望 % x", got, want)
+				}
+			})
+		}
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	echo := startEcho(t)
+	host, portStr, _ := net.SplitHostPort(echo)
+	port, _ := strconv.Atoi(portStr)
+	request := requestBytes(CmdConnect, host, uint16(port))
+
+	tests := []struct {
+		name    string
+		config  string
+		user    string
+		partial int           // 认证后只发送请求的前 partial 字节
+		delay   time.Duration // 认证后等待多久再发送完整请求，0表示一直不发送
+		closed  bool
+	}{
+		{"认证后不发送请求", `{"users": {"alice": "secret"}, "request_timeout": 300}`, "alice", 0, 0, true},
+		{"无认证后不发送请求", `{"request_timeout": 300}`, "", 0, 0, true},
+		{"只发送请求头的一部分", `{"request_timeout": 300}`, "", 2, 0, true},
+		{"只发送请求头", `{"request_timeout": 300}`, "", 4, 0, true},
+		{"缺少端口", `{"request_timeout": 300}`, "", len(request) - 1, 0, true},
+		{"超时前发送请求", `{"users": {"alice": "secret"}, "request_timeout": 300}`, "alice", 0, 150 * time.Millisecond, false},
+		{"未配置", `{}`, "", 0, 600 * time.Millisecond, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLog(t)
+			s := startServer(t, testConfig(t, tt.config))
+			failures := failureCount(reasonRequestTimeout)
+			conn := dialServer(t, s)
+			greet(t, conn, tt.user, "secret")
+			start := time.Now()
+			if tt.partial > 0 {
+				mustWrite(t, conn, request[:tt.partial])
+			}
+
+			if tt.closed {
+				expectClosed(t, conn)
+				if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+					t.Fatalf("连接在认证后 %v 被关闭, 早于 request_timeout", elapsed)
+				}
+				waitLog(t, logs, "(reason="+reasonRequestTimeout+")")
+				if n := failureCount(reasonRequestTimeout) - failures; n != 1 {
+					t.Fatalf("reason=request_timeout 的失败数增加 %d, 期望1", n)
+				}
+				return
+			}
+
+			time.Sleep(tt.delay)
+			mustWrite(t, conn, request)
+			if rep, _ := readReply(t, conn); rep != RepSuccess {
+				t.Fatalf("回复码 %#x", rep)
+			}
+			// 开始转发前清除截止时间，之后空闲超过 request_timeout 不受影响
+			time.Sleep(500 * time.Millisecond)
+			mustWrite(t, conn, []byte("ping"))
+			expectBytes(t, conn, []byte("ping"))
+		})
+	}
+}
+
+func TestPipelinedHandshake(t *testing.T) {
+	echo := startEcho(t)
+	host, portStr, _ := net.SplitHostPort(echo)
+	port, _ := strconv.Atoi(portStr)
+	request := requestBytes(CmdConnect, host, uint16(port))
+
+	tests := []struct {
+		name   string
+		config string
+		write  []byte // 客户端一次写出的全部数据
+		expect []byte // 请求回复之前服务器的回复
+	}{
+		{
+			name:   "no-auth",
+			config: `{"first_byte_timeout": 1000, "request_timeout": 1000}`,
+			write:  append([]byte{Version5, 1, MethodNoAuth}, request...),
+			expect: []byte{Version5, MethodNoAuth},
+		},
+		{
+			name:   "user-pass",
+			config: `{"users": {"alice": "secret"}, "first_byte_timeout": 1000, "request_timeout": 1000}`,
+			write:  append(append([]byte{Version5, 1, MethodUserPass}, userPassAuth("alice", "secret")...), request...),
+			expect: []byte{Version5, MethodUserPass, AuthUserPassVersion, AuthUserPassSuccess},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startServer(t, testConfig(t, tt.config))
+			conn := dialServer(t, s)
+			// 请求之后紧跟要转发的数据，同样不能丢失
+			mustWrite(t, conn, append(append([]byte{}, tt.write...), "ping"...))
+			expectBytes(t, conn, tt.expect)
+			if rep, _ := readReply(t, conn); rep != RepSuccess {
+				t.Fatalf("回复码 %#x", rep)
+			}
+			expectBytes(t, conn, []byte("ping"))
+		})
+	}
+}
+
+func TestIPv6Targets(t *testing.T) {
+	s := startServer(t, testConfig(t, ""))
+	tests := []struct {
+		name string
+		ip   string
+		want string // readIPv6 的结果，为空表示拒绝
+	}{
+		{"全局地址", "2001:db8::1", "2001:db8::1"},
+		{"回环地址", "::1", "::1"},
+		{"未指定地址", "::", ""},
+		{"链路本地地址", "fe80::1", ""},
+		{"链路本地组播", "ff02::1", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.readIPv6(bytes.NewReader(net.ParseIP(tt.ip).To16()))
+			if tt.want == "" {
+				if !errors.Is(err, ErrHostUnreachable) {
+					t.Fatalf("readIPv6 = %q, %v, 期望 ErrHostUnreachable", got, err)
+				}
+				// 服务器不尝试连接，直接回复主机不可达
+				if _, rep, _ := connect(t, s, "", "", CmdConnect, net.JoinHostPort(tt.ip, "80")); rep != RepHostUnreachable {
+					t.Fatalf("回复码 %#x, 期望 %#x", rep, RepHostUnreachable)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("readIPv6 = %q, %v, 期望 %q", got, err, tt.want)
+			}
+		})
+	}
+
+	// 正常的 IPv6 目标可以连接
+	ln, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("本机不支持 IPv6 回环地址: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			conn.Write([]byte("v6"))
+			conn.Close()
+		}
+	}()
+	conn, rep, _ := connect(t, s, "", "", CmdConnect, ln.Addr().String())
+	if rep != RepSuccess {
+		t.Fatalf("连接 %s 的回复码 %#x", ln.Addr(), rep)
+	}
+	expectBytes(t, conn, []byte("v6"))
+}
+
+func TestIPv4MappedTargets(t *testing.T) {
+	echo := startEcho(t)
+	_, echoPort, _ := net.SplitHostPort(echo)
+	port, _ := strconv.Atoi(echoPort)
+	s := startServer(t, testConfig(t, `{"routes": [{"match": "192.0.2.0/24", "via": "block"}]}`))
+
+	tests := []struct {
+		name   string
+		ip     string
+		port   int
+		target string // readIPv6 的结果
+		rep    uint8
+	}{
+		{"IPv4路由规则生效", "::ffff:192.0.2.1", 80, "192.0.2.1", RepConnectionNotAllowed},
+		{"按IPv4连接并回复", "::ffff:127.0.0.1", port, "127.0.0.1", RepSuccess},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// requestBytes 会把映射地址写成 IPv4，这里手工构造 ATYP=IPv6 的请求
+			ip := net.ParseIP(tt.ip).To16()
+			if got, err := s.readIPv6(bytes.NewReader(ip)); err != nil || got != tt.target {
+				t.Fatalf("readIPv6 = %q, %v, 期望 %q", got, err, tt.target)
+			}
+
+			conn := dialServer(t, s)
+			greet(t, conn, "", "")
+			msg := append([]byte{Version5, CmdConnect, 0, TypeIPv6}, ip...)
+			mustWrite(t, conn, binary.BigEndian.AppendUint16(msg, uint16(tt.port)))
+			rep, bnd := readReply(t, conn)
+			if rep != tt.rep {
+				t.Fatalf("回复码 %#x, 期望 %#x", rep, tt.rep)
+			}
+			// 成功回复的 BND.ADDR 与实际连接的地址族一致
+			if rep == RepSuccess && len(bnd.IP) != net.IPv4len {
+				t.Fatalf("回复的 BND.ADDR %s 不是 IPv4", bnd.IP)
+			}
+		})
+	}
+}
+
+func TestSlowDialWarning(t *testing.T) {
+	echo := startEcho(t)
+	tests := []struct {
+		name      string
+		threshold int // slow_dial_threshold（毫秒）
+		delay     time.Duration
+		warn      bool
+	}{
+		{"超过阈值", 20, 100 * time.Millisecond, true},
+		{"未超过阈值", 1000, 0, false},
+		{"未配置阈值", 0, 100 * time.Millisecond, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLog(t)
+			rec := &recordingMetrics{}
+			s := startServer(t, testConfig(t, fmt.Sprintf(`{"slow_dial_threshold": %d}`, tt.threshold)), func(s *Server) {
+				s.Metrics = rec
+				s.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+					time.Sleep(tt.delay)
+					return (&net.Dialer{}).DialContext(ctx, network, address)
+				}
+			})
+			if _, rep, _ := connect(t, s, "", "", CmdConnect, echo); rep != RepSuccess {
+				t.Fatalf("回复码 %#x", rep)
+			}
+
+			warned := strings.Contains(logs.String(), "警告: 连接目标 "+echo+" 耗时")
+			counted := strings.Contains(strings.Join(rec.snapshot(), "\n"), "counter slow_dials_total 1")
+			if warned != tt.warn || counted != tt.warn {
+				t.Fatalf("警告日志 %v, slow_dials_total %v, 期望 %v; 日志:\n%s", warned, counted, tt.warn, logs)
+			}
+			if !strings.Contains(strings.Join(rec.snapshot(), "\n"), "histogram dial_duration_ms") {
+				t.Fatalf("未记录 dial_duration_ms: %v", rec.snapshot())
+			}
+		})
+	}
+}
+
+func TestAdvertisedAddress(t *testing.T) {
+	echo := startEcho(t)
+	tests := []struct {
+		name   string
+		config string
+		want   string // BND.ADDR
+	}{
+		{"配置的地址", `{"advertised_address": "203.0.113.7"}`, "203.0.113.7"},
+		{"出站连接的本地地址", `{}`, "127.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startServer(t, testConfig(t, tt.config))
+			_, rep, bnd := connect(t, s, "", "", CmdConnect, echo)
+			if rep != RepSuccess {
+				t.Fatalf("回复码 %#x", rep)
+			}
+			// 端口总是出站连接的本地端口
+			if bnd.IP.String() != tt.want || bnd.Port == 0 {
+				t.Fatalf("BND %s, 期望 %s 与非零端口", bnd, tt.want)
+			}
+		})
+	}
+}
+
+func TestOnRequestHook(t *testing.T) {
+	echo := startEcho(t)
+	echoHost, echoPort, _ := net.SplitHostPort(echo)
+	port, _ := strconv.Atoi(echoPort)
+
+	var mu sync.Mutex
+	var seen []string
+	s := startServer(t, testConfig(t, `{"users": {"alice": "secret"}}`), func(s *Server) {
+		s.OnRequest = func(ctx context.Context, req *Request) (*Request, error) {
+			mu.Lock()
+			seen = append(seen, req.Username+"@"+req.Host)
+			mu.Unlock()
+			switch req.Host {
+			case "denied.test":
+				return nil, errors.New("禁止访问")
+			case "redirect.test":
+				rewritten := *req
+				rewritten.Host, rewritten.Port = echoHost, uint16(port)
+				return &rewritten, nil
+			}
+			return nil, nil
+		}
+	})
+
+	tests := []struct {
+		name   string
+		target string
+		rep    uint8
+	}{
+		{"拒绝", "denied.test:80", RepConnectionNotAllowed},
+		{"改写目标", "redirect.test:80", RepSuccess},
+		{"不改写", echo, RepSuccess},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			seen = nil
+			mu.Unlock()
+			conn, rep, _ := connect(t, s, "alice", "secret", CmdConnect, tt.target)
+			if rep != tt.rep {
+				t.Fatalf("回复码 %#x, 期望 %#x", rep, tt.rep)
+			}
+			host, _, _ := net.SplitHostPort(tt.target)
+			mu.Lock()
+			defer mu.Unlock()
+			if len(seen) != 1 || seen[0] != "alice@"+host {
+				t.Fatalf("钩子收到 %v, 期望 alice@%s", seen, host)
+			}
+			if rep == RepSuccess {
+				mustWrite(t, conn, []byte("ping"))
+				expectBytes(t, conn, []byte("ping"))
+			}
+		})
+	}
+}
+
+func TestNonTCPDialedConn(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		bnd    string // 回复的 BND 地址
+	}{
+		{"全零地址", `{}`, "0.0.0.0:0"},
+		{"通告地址", `{"advertised_address": "203.0.113.7"}`, "203.0.113.7:0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 自定义 Dial 返回内存管道，其 LocalAddr 不是 *net.TCPAddr
+			s := startServer(t, testConfig(t, tt.config), func(s *Server) {
+				s.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+					client, target := net.Pipe()
+					go func() {
+						defer target.Close()
+						io.Copy(target, target)
+					}()
+					return client, nil
+				}
+			})
+			conn, rep, bnd := connect(t, s, "", "", CmdConnect, "192.0.2.1:80")
+			if rep != RepSuccess || bnd.String() != tt.bnd {
+				t.Fatalf("回复码 %#x, BND %s, 期望成功与 %s", rep, bnd, tt.bnd)
+			}
+			mustWrite(t, conn, []byte("ping"))
+			expectBytes(t, conn, []byte("ping"))
+		})
+	}
+}
+
+// proxyTransfer 通过 Server.proxy 在两对TCP连接之间单向转发 size 字节，返回 proxy
+// 统计的字节数。buffered 为 true 时隐藏 *net.TCPConn 类型，强制使用缓冲转发
+func proxyTransfer(tb testing.TB, s *Server, size int64, buffered bool) int64 {
+	tb.Helper()
+	sender, src := tcpPair(tb)
+	dst, receiver := tcpPair(tb)
+	for _, c := range []net.Conn{sender, src, dst, receiver} {
+		c.SetDeadline(time.Time{})
+	}
+
+	var r io.Reader = src
+	var w io.Writer = dst
+	if buffered {
+		r, w = struct{ io.Reader }{src}, struct{ io.Writer }{dst}
+	}
+	results := make(chan proxyResult, 1)
+	go s.proxy(w, r, true, results)
+	go func() {
+		io.CopyN(sender, zeroReader{}, size)
+		sender.(*net.TCPConn).CloseWrite()
+	}()
+
+	got, err := io.CopyN(io.Discard, receiver, size)
+	if err != nil {
+		tb.Fatalf("接收端收到 %d 字节: %v", got, err)
+	}
+	return (<-results).n
+}
+
+// zeroReader 无限产生零字节
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func TestProxyCopyPaths(t *testing.T) {
+	s := NewServer(testConfig(t, ""))
+	for _, buffered := range []bool{false, true} {
+		t.Run(fmt.Sprintf("buffered=%v", buffered), func(t *testing.T) {
+			const size = 8<<20 + 123
+			if n := proxyTransfer(t, s, size, buffered); n != size {
+				t.Fatalf("proxy 统计 %d 字节, 期望 %d", n, size)
+			}
+		})
+	}
+}
+
+// BenchmarkProxy 比较两端均为TCP时的零拷贝转发与缓冲转发的吞吐量
+func BenchmarkProxy(b *testing.B) {
+	s := NewServer(&Config{})
+	const size = 64 << 20
+	for _, bm := range []struct {
+		name     string
+		buffered bool
+	}{
+		{"splice", false},
+		{"buffered", true},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				proxyTransfer(b, s, size, bm.buffered)
+			}
+		})
+	}
+}
+
+func TestMaxSessionDuration(t *testing.T) {
+	echo := startEcho(t)
+	tests := []struct {
+		name     string
+		duration int           // max_session_duration（秒）
+		active   time.Duration // 客户端持续传输的时长
+		closed   bool
+	}{
+		{"到期关闭", 1, 3 * time.Second, true},
+		{"不限制", 0, 1300 * time.Millisecond, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLog(t)
+			done := make(chan struct{}, 1)
+			s := startServer(t, testConfig(t, fmt.Sprintf(`{"max_session_duration": %d}`, tt.duration)), func(s *Server) {
+				s.OnConnectionClose = func(context.Context, *ConnectionInfo) { done <- struct{}{} }
+			})
+			expired := counterValue("sessions_expired_total")
+			conn, rep, _ := connect(t, s, "", "", CmdConnect, echo)
+			if rep != RepSuccess {
+				t.Fatalf("回复码 %#x", rep)
+			}
+
+			// 持续收发数据，会话一直处于活跃状态
+			start := time.Now()
+			var err error
+			buf := make([]byte, 5)
+			for time.Since(start) < tt.active {
+				conn.SetDeadline(time.Now().Add(time.Second))
+				if _, err = conn.Write([]byte("hello")); err != nil {
+					break
+				}
+				if _, err = io.ReadFull(conn, buf); err != nil {
+					break
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+			elapsed := time.Since(start)
+
+			if !tt.closed {
+				if err != nil {
+					t.Fatalf("未限制会话时长时连接在 %v 后出错: %v", elapsed, err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("持续活跃的会话在 %v 内未被关闭", elapsed)
+			}
+			if elapsed < 900*time.Millisecond {
+				t.Fatalf("会话在 %v 后被关闭, 早于最长会话时长", elapsed)
+			}
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("会话未结束")
+			}
+			if got := counterValue("sessions_expired_total") - expired; got != 1 {
+				t.Fatalf("sessions_expired_total 增加了 %d, 期望 1", got)
+			}
+			if !strings.Contains(logs.String(), "超过最长会话时长 1s 已关闭") {
+				t.Fatalf("日志未区分会话到期:\n%s", logs)
+			}
+		})
+	}
+}
+
+func TestDomainTargets(t *testing.T) {
+	echo := startEcho(t)
+	var mu sync.Mutex
+	var dialed []string
+	s := startServer(t, testConfig(t, ""), func(s *Server) {
+		s.Dial = recordingDial(echo, &dialed, &mu)
+	})
+
+	domainRequest := func(domain string) []byte {
+		return append(append([]byte{Version5, CmdConnect, 0, TypeDomain, byte(len(domain))}, domain...), 0x1F, 0x90)
+	}
+	tests := []struct {
+		name    string
+		request []byte
+		rep     uint8
+		dialed  string // 拨号的地址，为空表示不拨号
+	}{
+		{"长度为0的域名", domainRequest(""), RepAddressTypeNotSupported, ""},
+		{"普通域名", domainRequest("localhost"), RepSuccess, "localhost:8080"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			dialed = nil
+			mu.Unlock()
+			logs := captureLog(t)
+
+			conn := dialServer(t, s)
+			greet(t, conn, "", "")
+			mustWrite(t, conn, tt.request)
+			if rep, _ := readReply(t, conn); rep != tt.rep {
+				t.Fatalf("回复码 %#x, 期望 %#x", rep, tt.rep)
+			}
+			if tt.rep != RepSuccess {
+				expectClosed(t, conn)
+				if !strings.Contains(logs.String(), "域名长度为0") {
+					t.Fatalf("日志未记录拒绝原因:\n%s", logs)
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if got := strings.Join(dialed, ","); got != tt.dialed {
+				t.Fatalf("拨号 %q, 期望 %q", got, tt.dialed)
+			}
+		})
+	}
+}
+
+// countingConn 统计经过包装连接读取的字节数
+type countingConn struct {
+	net.Conn
+	mu   sync.Mutex
+	read int
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.mu.Lock()
+	c.read += n
+	c.mu.Unlock()
+	return n, err
+}
+
+func TestNegotiators(t *testing.T) {
+	echo := startEcho(t)
+	const method = 0x90
+
+	tests := []struct {
+		name      string
+		offered   []byte
+		fail      bool // 协商处理函数返回错误
+		wrap      bool // 协商处理函数返回包装后的连接
+		negotiate bool // 客户端是否进行能力协商
+	}{
+		{"自定义客户端", []byte{MethodUserPass, method}, false, false, true},
+		{"返回包装连接", []byte{MethodUserPass, method}, false, true, true},
+		{"协商失败", []byte{MethodUserPass, method}, true, false, true},
+		{"标准客户端", []byte{MethodUserPass}, false, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var calls []string
+			var wrapped *countingConn
+			s := startServer(t, testConfig(t, `{"users": {"alice": "secret"}}`), func(s *Server) {
+				s.Negotiators = map[uint8]func(ctx context.Context, conn net.Conn, username string) (net.Conn, error){
+					method: func(ctx context.Context, conn net.Conn, username string) (net.Conn, error) {
+						mu.Lock()
+						calls = append(calls, username)
+						mu.Unlock()
+						// 读取客户端的能力字节，回复设置了最高位的同一字节
+						b := make([]byte, 1)
+						if _, err := io.ReadFull(conn, b); err != nil {
+							return nil, err
+						}
+						if tt.fail {
+							return nil, errors.New("不支持的能力")
+						}
+						if err := writeFull(conn, []byte{b[0] | 0x80}); err != nil {
+							return nil, err
+						}
+						if tt.wrap {
+							mu.Lock()
+							defer mu.Unlock()
+							wrapped = &countingConn{Conn: conn}
+							return wrapped, nil
+						}
+						return nil, nil
+					},
+				}
+			})
+
+			conn := dialServer(t, s)
+			mustWrite(t, conn, append([]byte{Version5, byte(len(tt.offered))}, tt.offered...))
+			expectBytes(t, conn, []byte{Version5, MethodUserPass})
+			mustWrite(t, conn, userPassAuth("alice", "secret"))
+			expectBytes(t, conn, []byte{AuthUserPassVersion, AuthUserPassSuccess})
+			if tt.negotiate {
+				mustWrite(t, conn, []byte{0x07})
+				if tt.fail {
+					expectClosed(t, conn)
+					return
+				}
+				expectBytes(t, conn, []byte{0x87})
+			}
+
+			host, port, _ := net.SplitHostPort(echo)
+			p, _ := strconv.Atoi(port)
+			mustWrite(t, conn, requestBytes(CmdConnect, host, uint16(p)))
+			if rep, _ := readReply(t, conn); rep != RepSuccess {
+				t.Fatalf("回复码 %#x", rep)
+			}
+			mustWrite(t, conn, []byte("hello"))
+			expectBytes(t, conn, []byte("hello"))
+
+			mu.Lock()
+			defer mu.Unlock()
+			want := ""
+			if tt.negotiate {
+				want = "alice"
+			}
+			if got := strings.Join(calls, ","); got != want {
+				t.Fatalf("协商处理函数的调用为 %q, 期望 %q", got, want)
+			}
+			// 请求与转发改用协商返回的连接
+			if tt.wrap {
+				wrapped.mu.Lock()
+				defer wrapped.mu.Unlock()
+				if wrapped.read == 0 {
+					t.Fatal("请求阶段未使用协商返回的连接")
+				}
+			}
+		})
+	}
+
+	// 只提供私有方法的客户端没有可用的认证方法
+	s := startServer(t, testConfig(t, `{"users": {"alice": "secret"}}`), func(s *Server) {
+		s.Negotiators = map[uint8]func(ctx context.Context, conn net.Conn, username string) (net.Conn, error){
+			method: func(ctx context.Context, conn net.Conn, username string) (net.Conn, error) { return nil, nil },
+		}
+	})
+	conn := dialServer(t, s)
+	mustWrite(t, conn, []byte{Version5, 1, method})
+	expectBytes(t, conn, []byte{Version5, MethodNoAcceptable})
+}
+
+func TestDialTargetFormatting(t *testing.T) {
+	echo := startEcho(t)
+	var mu sync.Mutex
+	var dialed []string
+	s := startServer(t, testConfig(t, ""), func(s *Server) {
+		s.Dial = recordingDial(echo, &dialed, &mu)
+	})
+
+	tests := []struct {
+		host string
+		port uint16
+		want string
+	}{
+		{"2001:db8::1", 443, "[2001:db8::1]:443"},
+		{"2001:db8:0:0:1::1", 8080, "[2001:db8::1:0:0:1]:8080"},
+		{"::ffff:192.0.2.1", 80, "192.0.2.1:80"},
+		{"192.0.2.1", 80, "192.0.2.1:80"},
+		{"example.com", 443, "example.com:443"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			mu.Lock()
+			dialed = nil
+			mu.Unlock()
+			conn := dialServer(t, s)
+			greet(t, conn, "", "")
+			mustWrite(t, conn, requestBytes(CmdConnect, tt.host, tt.port))
+			if rep, _ := readReply(t, conn); rep != RepSuccess {
+				t.Fatalf("回复码 %#x", rep)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if len(dialed) != 1 || dialed[0] != tt.want {
+				t.Fatalf("拨号 %v, 期望 %s", dialed, tt.want)
+			}
+			if _, _, err := net.SplitHostPort(dialed[0]); err != nil {
+				t.Fatalf("拨号地址 %s 无法解析: %v", dialed[0], err)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// certStore 保存当前使用的TLS证书，支持在不影响已建立连接的情况下原子替换
+type certStore struct {
+	certFile string
+	keyFile  string
+	cert     atomic.Pointer[tls.Certificate]
+}
+
+// newCertStore 加载证书并创建证书存储
+func newCertStore(certFile, keyFile string) (*certStore, error) {
+	c := &certStore{certFile: certFile, keyFile: keyFile}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload 重新从文件加载证书，加载失败时保留原证书
+func (c *certStore) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("加载TLS证书失败: %w", err)
+	}
+	c.cert.Store(&cert)
+	return nil
+}
+
+// GetCertificate 供 tls.Config 使用，新的握手总是使用最新的证书
+func (c *certStore) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.cert.Load(), nil
+}
+
+// ticketKeys 按固定间隔轮换会话票据密钥。每次轮换生成新密钥并保留上一个密钥用于解密，
+// 因此票据最长在两个间隔内可用于恢复会话，之后旧密钥被丢弃，保证前向安全
+type ticketKeys struct {
+	mu       sync.Mutex
+	interval time.Duration
+	rotated  time.Time
+	keys     [][32]byte // 第一个密钥用于加密新票据
+}
+
+// maybeRotate 在距上次轮换超过间隔时轮换密钥，在每次TLS握手前调用
+func (t *ticketKeys) maybeRotate(cfg *tls.Config) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if t.keys != nil && now.Sub(t.rotated) < t.interval {
+		return
+	}
+	var key [32]byte
+	rand.Read(key[:])
+	// 超过两个间隔没有握手时上一个密钥也已过期
+	if len(t.keys) > 0 && now.Sub(t.rotated) < 2*t.interval {
+		t.keys = [][32]byte{key, t.keys[0]}
+	} else {
+		t.keys = [][32]byte{key}
+	}
+	t.rotated = now
+	cfg.SetSessionTicketKeys(t.keys)
+}
+
+// applyClientAuth 按配置在 cfg 上设置客户端证书校验：配置 client_ca_file 时
+// 要求并按该CA校验客户端证书；配置 client_cert_fingerprints 时额外要求客户端
+// 证书的 SHA-256 指纹在列表中，即使证书由可信CA签发。只配置指纹时不校验签发者，
+// 用于固定自签名证书
+func (c TLSConfig) applyClientAuth(cfg *tls.Config) error {
+	if c.ClientCAFile != "" {
+		pem, err := os.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("读取 client_ca_file 失败: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("client_ca_file %s 中没有有效的证书", c.ClientCAFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	if len(c.ClientCertFingerprints) == 0 {
+		return nil
+	}
+	var allowed [][]byte
+	for _, fp := range c.ClientCertFingerprints {
+		b, err := hex.DecodeString(strings.ReplaceAll(fp, ":", ""))
+		if err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("无效的客户端证书指纹: %s", fp)
+		}
+		allowed = append(allowed, b)
+	}
+	if cfg.ClientAuth == tls.NoClientCert {
+		cfg.ClientAuth = tls.RequireAnyClientCert
+	}
+	// VerifyPeerCertificate 在CA校验（如果启用）通过后调用，rawCerts[0] 为客户端证书
+	cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("客户端未提供证书")
+		}
+		sum := sha256.Sum256(rawCerts[0])
+		for _, b := range allowed {
+			if bytes.Equal(b, sum[:]) {
+				return nil
+			}
+		}
+		return fmt.Errorf("客户端证书指纹 %x 不在允许列表中", sum)
+	}
+	return nil
+}
+
+// describeTLSState 返回握手协商结果的描述：版本、密码套件、是否恢复会话、
+// ALPN 协议以及客户端证书主题（mTLS 时）
+func describeTLSState(state tls.ConnectionState) string {
+	desc := fmt.Sprintf("版本 %s, 密码套件 %s, 会话恢复 %t", tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite), state.DidResume)
+	if state.NegotiatedProtocol != "" {
+		desc += ", ALPN " + state.NegotiatedProtocol
+	}
+	if len(state.PeerCertificates) > 0 {
+		desc += ", 客户端证书 " + state.PeerCertificates[0].Subject.String()
+	}
+	return desc
+}
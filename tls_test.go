@@ -0,0 +1,525 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCert 测试用的证书与私钥
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// newTestCert 生成 CN 为 cn 的证书，parent 为空时自签名并可作为CA
+func newTestCert(t *testing.T, cn string, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{cn},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// write 将证书与私钥以 PEM 格式写入文件
+func (c *testCert) write(t *testing.T, certFile, keyFile string) {
+	t.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// files 将证书写入临时目录，返回证书与私钥文件路径
+func (c *testCert) files(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	c.write(t, certFile, keyFile)
+	return certFile, keyFile
+}
+
+// tlsCertificate 返回可用于 tls.Config 的证书
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key, Leaf: c.cert}
+}
+
+// dialTLS 以 TLS 连接服务器，cfg 为空时不校验服务器证书
+func dialTLS(t *testing.T, addr string, cfg *tls.Config) *tls.Conn {
+	t.Helper()
+	if cfg == nil {
+		cfg = &tls.Config{InsecureSkipVerify: true}
+	}
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", addr, cfg)
+	if err != nil {
+		t.Fatalf("TLS连接 %s 失败: %v", addr, err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// peerCN 返回服务器证书的 CN
+func peerCN(conn *tls.Conn) string {
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestReloadCertificates(t *testing.T) {
+	echo := startEcho(t)
+	tests := []struct {
+		name    string
+		replace func(t *testing.T, certFile, keyFile string) // 替换证书文件
+		wantErr bool
+		wantCN  string // 重新加载后新连接看到的证书
+	}{
+		{
+			name:    "新证书",
+			replace: func(t *testing.T, certFile, keyFile string) { newTestCert(t, "new", nil).write(t, certFile, keyFile) },
+			wantCN:  "new",
+		},
+		{
+			name:    "无效证书保留原证书",
+			replace: func(t *testing.T, certFile, keyFile string) { os.WriteFile(certFile, []byte("garbage"), 0o600) },
+			wantErr: true,
+			wantCN:  "old",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			certFile, keyFile := newTestCert(t, "old", nil).files(t)
+			s := startServer(t, testConfig(t, `{"tls": {"enable": true, "cert_file": "`+certFile+`", "key_file": "`+keyFile+`"}}`))
+
+			existing := dialTLS(t, s.Addr().String(), nil)
+			if rep, _ := request(t, existing, "", "", CmdConnect, echo); rep != RepSuccess {
+				t.Fatalf("回复码 %#x", rep)
+			}
+
+			tt.replace(t, certFile, keyFile)
+			if err := s.ReloadCertificates(); (err != nil) != tt.wantErr {
+				t.Fatalf("ReloadCertificates() = %v, 期望出错 %v", err, tt.wantErr)
+			}
+
+			if cn := peerCN(dialTLS(t, s.Addr().String(), nil)); cn != tt.wantCN {
+				t.Fatalf("新连接的证书 CN 为 %s, 期望 %s", cn, tt.wantCN)
+			}
+			// 已建立的连接不受影响
+			mustWrite(t, existing, []byte("ping"))
+			expectBytes(t, existing, []byte("ping"))
+			if cn := peerCN(existing); cn != "old" {
+				t.Fatalf("已建立连接的证书 CN 为 %s", cn)
+			}
+		})
+	}
+}
+
+func TestTLSNextProtos(t *testing.T) {
+	certFile, keyFile := newTestCert(t, "server", nil).files(t)
+	s := startServer(t, testConfig(t, `{"tls": {"enable": true, "cert_file": "`+certFile+`", "key_file": "`+keyFile+`", "next_protos": ["socks5", "h2"]}}`))
+	echo := startEcho(t)
+
+	tests := []struct {
+		name    string
+		offered []string
+		want    string
+		fail    bool // 没有共同的协议时握手失败
+	}{
+		{"服务器优先", []string{"h2", "socks5"}, "socks5", false},
+		{"唯一的共同协议", []string{"h2"}, "h2", false},
+		{"客户端不使用 ALPN", nil, "", false},
+		// Go 对只提供 http/1.1 的客户端放宽了检查，这里使用其他协议
+		{"没有共同的协议", []string{"imap"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := tls.Dial("tcp", s.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: tt.offered})
+			if tt.fail {
+				if err == nil {
+					conn.Close()
+					t.Fatal("期望握手失败")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("握手失败: %v", err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if got := conn.ConnectionState().NegotiatedProtocol; got != tt.want {
+				t.Fatalf("协商的协议 %q, 期望 %q", got, tt.want)
+			}
+			// 协商结果不影响随后的 SOCKS5 会话
+			if rep, _ := request(t, conn, "", "", CmdConnect, echo); rep != RepSuccess {
+				t.Fatalf("回复码 %#x", rep)
+			}
+		})
+	}
+}
+
+func TestNoAcceptableMethodsCleanClose(t *testing.T) {
+	certFile, keyFile := newTestCert(t, "server", nil).files(t)
+	plain := startServer(t, testConfig(t, `{"users": {"alice": "secret"}}`))
+	secure := startServer(t, testConfig(t, `{"users": {"alice": "secret"}, "tls": {"enable": true, "cert_file": "`+certFile+`", "key_file": "`+keyFile+`"}}`))
+
+	tests := []struct {
+		name    string
+		dial    func(t *testing.T) net.Conn
+		offered []byte
+	}{
+		{"仅GSSAPI", func(t *testing.T) net.Conn { return dialServer(t, plain) }, []byte{MethodGSSAPI}},
+		{"TLS仅GSSAPI", func(t *testing.T) net.Conn { return dialTLS(t, secure.Addr().String(), nil) }, []byte{MethodGSSAPI}},
+		{"TLS仅无认证", func(t *testing.T) net.Conn { return dialTLS(t, secure.Addr().String(), nil) }, []byte{MethodNoAuth, 0x80}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLog(t)
+			conn := tt.dial(t)
+			mustWrite(t, conn, append([]byte{Version5, byte(len(tt.offered))}, tt.offered...))
+			// 0xFF 之后是干净的 EOF（TLS 为 close_notify），而不是连接重置或截断
+			out, err := io.ReadAll(conn)
+			if err != nil {
+				t.Fatalf("读到 % x 后出错: %v", out, err)
+			}
+			if string(out) != string([]byte{Version5, MethodNoAcceptable}) {
+				t.Fatalf("服务器回复 % x, 期望 05 ff", out)
+			}
+			waitLog(t, logs, fmt.Sprintf("提供的方法 [% x]", tt.offered))
+		})
+	}
+}
+
+func TestTLSReplyBeforeData(t *testing.T) {
+	certFile, keyFile := newTestCert(t, "server", nil).files(t)
+	// 目标在连接建立后立即发送欢迎信息，再回显收到的数据
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.WriteString(conn, "banner")
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	tests := []struct {
+		name       string
+		compressed bool          // 在 TLS 之上协商压缩
+		delay      time.Duration // 拨号耗时
+	}{
+		{"TLS", false, 0},
+		{"TLS拨号缓慢", false, 300 * time.Millisecond},
+		{"TLS与压缩", true, 300 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delay := tt.delay
+			config := `{"compression": ` + strconv.FormatBool(tt.compressed) + `, "tls": {"enable": true, "cert_file": "` + certFile + `", "key_file": "` + keyFile + `"}}`
+			s := startServer(t, testConfig(t, config), func(s *Server) {
+				s.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+					time.Sleep(delay)
+					var d net.Dialer
+					return d.DialContext(ctx, network, address)
+				}
+			})
+			var conn net.Conn = dialTLS(t, s.Addr().String(), nil)
+			if tt.compressed {
+				mustWrite(t, conn, []byte{Version5, 2, MethodNoAuth, MethodCompression, CompressionFlate})
+				expectBytes(t, conn, []byte{Version5, MethodNoAuth, CompressionFlate})
+				conn = newFlateConn(conn)
+			} else {
+				greet(t, conn, "", "")
+			}
+			mustWrite(t, conn, requestBytes(CmdConnect, "127.0.0.1", uint16(ln.Addr().(*net.TCPAddr).Port)))
+
+			// 成功回复在拨号完成后立即到达，且先于目标发送的任何数据
+			start := time.Now()
+			if rep, _ := readReply(t, conn); rep != RepSuccess {
+				t.Fatalf("回复码 %#x", rep)
+			}
+			if elapsed := time.Since(start); elapsed < delay || elapsed > delay+time.Second {
+				t.Fatalf("回复在 %v 后到达, 拨号耗时 %v", elapsed, delay)
+			}
+			expectBytes(t, conn, []byte("banner"))
+			mustWrite(t, conn, []byte("ping"))
+			expectBytes(t, conn, []byte("ping"))
+		})
+	}
+}
+
+// mtlsGreets 以客户端证书 cert（为空时不提供证书）连接 TLS 服务器并完成方法协商，返回是否成功。
+// TLS 1.3 中服务器在客户端握手完成后才校验客户端证书，因此以协商结果判断是否被接受
+func mtlsGreets(t *testing.T, addr string, cert *testCert) bool {
+	t.Helper()
+	cfg := &tls.Config{InsecureSkipVerify: true}
+	if cert != nil {
+		cfg.Certificates = []tls.Certificate{cert.tlsCertificate()}
+	}
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", addr, cfg)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte{Version5, 1, MethodNoAuth}); err != nil {
+		return false
+	}
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(conn, buf)
+	return err == nil && buf[1] == MethodNoAuth
+}
+
+func TestClientCertFingerprints(t *testing.T) {
+	certFile, keyFile := newTestCert(t, "server", nil).files(t)
+	ca := newTestCert(t, "client CA", nil)
+	caFile, _ := ca.files(t)
+	allowed := newTestCert(t, "allowed", ca)
+	other := newTestCert(t, "other", ca)
+	pinned := newTestCert(t, "pinned", nil) // 自签名
+	sum := sha256.Sum256(allowed.der)
+	pinnedSum := sha256.Sum256(pinned.der)
+	// 指纹可以使用带冒号的大写形式
+	var colons []string
+	for _, b := range pinnedSum {
+		colons = append(colons, fmt.Sprintf("%02X", b))
+	}
+
+	tests := []struct {
+		name   string
+		tls    string // 附加的 tls 配置字段
+		cert   *testCert
+		accept bool
+	}{
+		{"CA与指纹/允许的证书", `"client_ca_file": "` + caFile + `", "client_cert_fingerprints": ["` + hex.EncodeToString(sum[:]) + `"]`, allowed, true},
+		{"CA与指纹/CA签发但未列出", `"client_ca_file": "` + caFile + `", "client_cert_fingerprints": ["` + hex.EncodeToString(sum[:]) + `"]`, other, false},
+		{"CA与指纹/列出但非CA签发", `"client_ca_file": "` + caFile + `", "client_cert_fingerprints": ["` + hex.EncodeToString(pinnedSum[:]) + `"]`, pinned, false},
+		{"CA与指纹/无证书", `"client_ca_file": "` + caFile + `", "client_cert_fingerprints": ["` + hex.EncodeToString(sum[:]) + `"]`, nil, false},
+		{"仅指纹/自签名证书", `"client_cert_fingerprints": ["` + strings.Join(colons, ":") + `"]`, pinned, true},
+		{"仅指纹/其他证书", `"client_cert_fingerprints": ["` + strings.Join(colons, ":") + `"]`, other, false},
+		{"仅CA/CA签发", `"client_ca_file": "` + caFile + `"`, other, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startServer(t, testConfig(t, `{"tls": {"enable": true, "cert_file": "`+certFile+`", "key_file": "`+keyFile+`", `+tt.tls+`}}`))
+			if got := mtlsGreets(t, s.Addr().String(), tt.cert); got != tt.accept {
+				t.Fatalf("连接被接受为 %v, 期望 %v", got, tt.accept)
+			}
+		})
+	}
+
+	if _, err := parseConfig([]byte(`{"address": "127.0.0.1:0", "tls": {"enable": true, "cert_file": "` + certFile + `", "key_file": "` + keyFile + `", "client_cert_fingerprints": ["abcd"]}}`)); err == nil {
+		t.Fatal("无效的客户端证书指纹应被拒绝")
+	}
+}
+
+func TestTLSSessionTickets(t *testing.T) {
+	certFile, keyFile := newTestCert(t, "server", nil).files(t)
+	tests := []struct {
+		name    string
+		tls     string // tls 配置中追加的字段
+		version uint16
+		wait    time.Duration // 两次连接之间的间隔
+		resumed bool
+	}{
+		{"TLS1.2票据恢复", ``, tls.VersionTLS12, 0, true},
+		{"TLS1.3票据恢复", ``, tls.VersionTLS13, 0, true},
+		{"TLS1.2禁用票据", `, "session_tickets_disabled": true`, tls.VersionTLS12, 0, false},
+		{"TLS1.3禁用票据", `, "session_tickets_disabled": true`, tls.VersionTLS13, 0, false},
+		{"轮换一次后仍可用上一个密钥解密", `, "session_ticket_key_rotation": 1`, tls.VersionTLS13, 1200 * time.Millisecond, true},
+		{"两个间隔后旧密钥被丢弃", `, "session_ticket_key_rotation": 1`, tls.VersionTLS13, 2200 * time.Millisecond, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startServer(t, testConfig(t, `{"tls": {"enable": true, "cert_file": "`+certFile+`", "key_file": "`+keyFile+`"`+tt.tls+`}}`))
+			disabled := strings.Contains(tt.tls, "session_tickets_disabled")
+			if got := s.listeners[0].tlsConfig.SessionTicketsDisabled; got != disabled {
+				t.Fatalf("tls.Config.SessionTicketsDisabled 为 %v, 期望 %v", got, disabled)
+			}
+
+			cfg := &tls.Config{
+				InsecureSkipVerify: true,
+				MinVersion:         tt.version,
+				MaxVersion:         tt.version,
+				ClientSessionCache: tls.NewLRUClientSessionCache(1),
+			}
+			for i := 0; i < 2; i++ {
+				if i == 1 {
+					time.Sleep(tt.wait)
+				}
+				conn := dialTLS(t, s.Addr().String(), cfg)
+				// 完成一次SOCKS握手，TLS 1.3 的票据在握手后由服务器发送，读取回复时才被客户端处理
+				greet(t, conn, "", "")
+				resumed := conn.ConnectionState().DidResume
+				conn.Close()
+				if i == 1 && resumed != tt.resumed {
+					t.Fatalf("第二次连接恢复会话为 %v, 期望 %v", resumed, tt.resumed)
+				}
+			}
+		})
+	}
+}
+
+func TestUserRequireTLS(t *testing.T) {
+	certFile, keyFile := newTestCert(t, "server", nil).files(t)
+	plain, secure, proxied := freeAddr(t), freeAddr(t), freeAddr(t)
+	logs := captureLog(t)
+	startServer(t, testConfig(t, `{
+		"users": {"alice": {"password": "secret", "require_tls": true}, "bob": {"password": "secret"}},
+		"listeners": [
+			{"address": "`+plain+`", "auth": true},
+			{"address": "`+secure+`", "auth": true, "tls": {"enable": true, "cert_file": "`+certFile+`", "key_file": "`+keyFile+`"}},
+			{"address": "`+proxied+`", "auth": true, "tls": {"enable": true, "cert_file": "`+certFile+`", "key_file": "`+keyFile+`"}, "proxy_protocol": {"enable": true, "trusted": ["127.0.0.1/32"]}}
+		]
+	}`))
+
+	tests := []struct {
+		name     string
+		addr     string
+		tls      bool
+		proxy    bool // 在TLS之前发送 PROXY 协议头
+		user     string
+		password string
+		want     bool
+	}{
+		{"要求TLS的用户通过明文监听器", plain, false, false, "alice", "secret", false},
+		{"要求TLS的用户通过TLS监听器", secure, true, false, "alice", "secret", true},
+		{"PROXY协议之后的TLS监听器", proxied, true, true, "alice", "secret", true},
+		{"要求TLS的用户密码错误", secure, true, false, "alice", "wrong", false},
+		{"普通用户通过明文监听器", plain, false, false, "bob", "secret", true},
+		{"普通用户通过TLS监听器", secure, true, false, "bob", "secret", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.DialTimeout("tcp", tt.addr, 5*time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if tt.proxy {
+				mustWrite(t, conn, []byte("PROXY TCP4 203.0.113.7 192.0.2.1 5000 1080\r\n"))
+			}
+			if tt.tls {
+				conn = tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+			}
+			mustWrite(t, conn, []byte{Version5, 1, MethodUserPass})
+			expectBytes(t, conn, []byte{Version5, MethodUserPass})
+			mustWrite(t, conn, userPassAuth(tt.user, tt.password))
+			status := make([]byte, 2)
+			if _, err := io.ReadFull(conn, status); err != nil {
+				t.Fatalf("读取认证结果失败: %v", err)
+			}
+			if got := status[1] == AuthUserPassSuccess; got != tt.want {
+				t.Fatalf("认证结果 %v, 期望 %v", got, tt.want)
+			}
+		})
+	}
+	// 拒绝原因只记录在日志中，客户端收到的回复与密码错误相同
+	waitLog(t, logs, `用户 "alice" 只允许通过TLS连接`)
+}
+
+func TestTLSHandshakeLog(t *testing.T) {
+	certFile, keyFile := newTestCert(t, "server", nil).files(t)
+	ca := newTestCert(t, "client CA", nil)
+	caFile, _ := ca.files(t)
+	alice := newTestCert(t, "alice", ca)
+
+	tests := []struct {
+		name   string
+		tls    string // 附加的 tls 配置字段
+		client *tls.Config
+		cipher uint16 // 期望协商的密码套件，0表示只与客户端看到的结果比较
+		cert   string // 日志中的客户端证书主题，为空表示没有
+		logged bool
+	}{
+		{"TLS 1.3", `"log_handshake": true`, &tls.Config{MinVersion: tls.VersionTLS13}, 0, "", true},
+		{"TLS 1.2指定密码套件", `"log_handshake": true`, &tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305}}, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305, "", true},
+		{"mTLS", `"log_handshake": true, "client_ca_file": "` + caFile + `"`, &tls.Config{Certificates: []tls.Certificate{alice.tlsCertificate()}}, 0, "CN=alice", true},
+		{"未开启", `"client_ca_file": "` + caFile + `"`, &tls.Config{Certificates: []tls.Certificate{alice.tlsCertificate()}}, 0, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLog(t)
+			s := startServer(t, testConfig(t, `{"tls": {"enable": true, "cert_file": "`+certFile+`", "key_file": "`+keyFile+`", `+tt.tls+`}}`))
+			cfg := tt.client.Clone()
+			cfg.InsecureSkipVerify = true
+			conn := dialTLS(t, s.Addr().String(), cfg)
+			// 完成方法协商后服务器已写出握手日志
+			greet(t, conn, "", "")
+
+			state := conn.ConnectionState()
+			if tt.cipher != 0 && state.CipherSuite != tt.cipher {
+				t.Fatalf("协商的密码套件 %s, 期望 %s", tls.CipherSuiteName(state.CipherSuite), tls.CipherSuiteName(tt.cipher))
+			}
+			prefix := "TLS连接 " + conn.LocalAddr().String() + ": "
+			if !tt.logged {
+				if strings.Contains(logs.String(), prefix) {
+					t.Fatalf("未开启 log_handshake 时记录了握手参数:\n%s", logs)
+				}
+				return
+			}
+			want := prefix + "版本 " + tls.VersionName(state.Version) + ", 密码套件 " + tls.CipherSuiteName(state.CipherSuite) + ", 会话恢复 false"
+			if tt.cert != "" {
+				want += ", 客户端证书 " + tt.cert
+			}
+			waitLog(t, logs, want)
+			if tt.cert == "" && strings.Contains(logs.String(), "客户端证书") {
+				t.Fatalf("没有客户端证书时记录了证书主题:\n%s", logs)
+			}
+		})
+	}
+}
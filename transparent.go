@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// lookupOriginalDst 读取连接的原始目标，测试中可替换以模拟 SO_ORIGINAL_DST
+var lookupOriginalDst = originalDst
+
+// handleTransparent 处理透明代理监听器接受的连接：不解析SOCKS请求，
+// 而是取出被 iptables REDIRECT 重定向前的原始目标并直接转发
+func (s *Server) handleTransparent(ctx context.Context, conn net.Conn) error {
+	dst, err := lookupOriginalDst(conn)
+	if err != nil {
+		return fmt.Errorf("获取原始目标失败: %w", err)
+	}
+	// 未经重定向直接连接监听器时原始目标就是监听地址，转发会形成回环
+	if local, ok := conn.LocalAddr().(*net.TCPAddr); ok && local.IP.Equal(dst.IP) && local.Port == dst.Port {
+		return fmt.Errorf("%w: 连接 %s 未经重定向", ErrConnectionNotAllowed, conn.RemoteAddr())
+	}
+	s.debugf(ctx, "透明代理原始目标: %s", dst)
+
+	// 透明代理没有协议层的回复，拒绝或失败时直接关闭连接
+	reply := func(rep uint8, addr *net.TCPAddr) error { return nil }
+
+	req, err := s.authorizeRequest(ctx, &Request{
+		Command:    CmdConnect,
+		Host:       dst.IP.String(),
+		Port:       uint16(dst.Port),
+		RemoteAddr: conn.RemoteAddr(),
+	}, reply)
+	if err != nil {
+		return err
+	}
+
+	return s.handleConnect(ctx, conn, req, reply)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// soOriginalDst netfilter 保存重定向前目标地址的套接字选项（SO_ORIGINAL_DST / IP6T_SO_ORIGINAL_DST）
+const soOriginalDst = 80
+
+// transparentSupported 当前平台是否支持透明代理模式
+const transparentSupported = true
+
+// originalDst 通过 getsockopt(SO_ORIGINAL_DST) 读取被 iptables REDIRECT 前的原始目标地址
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, fmt.Errorf("不是TCP连接: %T", conn)
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	local, _ := tc.LocalAddr().(*net.TCPAddr)
+	ipv6 := local != nil && local.IP.To4() == nil
+
+	var addr *net.TCPAddr
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		addr, sockErr = getOriginalDst(int(fd), ipv6)
+	})
+	if err != nil {
+		return nil, err
+	}
+	// 连接没有对应的 NAT 记录（未经 REDIRECT）时内核返回 ENOENT
+	if sockErr == unix.ENOENT {
+		return nil, fmt.Errorf("连接未经 iptables 重定向: %w", sockErr)
+	}
+	return addr, sockErr
+}
+
+// getOriginalDst 读取套接字的原始目标。内核按地址族写入 sockaddr_in 或 sockaddr_in6，
+// 分别读入对应的 RawSockaddrInet4 与 RawSockaddrInet6
+func getOriginalDst(fd int, ipv6 bool) (*net.TCPAddr, error) {
+	if ipv6 {
+		var sa unix.RawSockaddrInet6
+		if err := getsockoptRaw(fd, unix.IPPROTO_IPV6, soOriginalDst, unsafe.Pointer(&sa), unsafe.Sizeof(sa)); err != nil {
+			return nil, err
+		}
+		return parseOriginalDst(sa.Port, sa.Addr[:]), nil
+	}
+
+	var sa unix.RawSockaddrInet4
+	if err := getsockoptRaw(fd, unix.IPPROTO_IP, soOriginalDst, unsafe.Pointer(&sa), unsafe.Sizeof(sa)); err != nil {
+		return nil, err
+	}
+	return parseOriginalDst(sa.Port, sa.Addr[:]), nil
+}
+
+// getsockoptRaw 调用 getsockopt 将选项值读入 p 指向的 size 字节
+func getsockoptRaw(fd, level, name int, p unsafe.Pointer, size uintptr) error {
+	n := uint32(size)
+	_, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(fd), uintptr(level), uintptr(name), uintptr(p), uintptr(unsafe.Pointer(&n)), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// parseOriginalDst 将 sockaddr_in/sockaddr_in6 中按网络字节序存放的端口与地址转换为 TCPAddr
+func parseOriginalDst(port uint16, ip []byte) *net.TCPAddr {
+	var p [2]byte
+	binary.NativeEndian.PutUint16(p[:], port)
+	return &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), ip...)),
+		Port: int(binary.BigEndian.Uint16(p[:])),
+	}
+}
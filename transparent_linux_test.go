@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestTransparentTarget(t *testing.T) {
+	echo := startEcho(t)
+	tests := []struct {
+		name   string
+		lookup func(listener net.Addr) (*net.TCPAddr, error) // 模拟的 SO_ORIGINAL_DST
+		dialed string                                        // 期望拨号的目标，为空表示连接被关闭
+		log    string
+	}{
+		{
+			name: "IPv4原始目标",
+			lookup: func(net.Addr) (*net.TCPAddr, error) {
+				return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 7), Port: 8080}, nil
+			},
+			dialed: "192.0.2.7:8080",
+		},
+		{
+			name: "IPv6原始目标",
+			lookup: func(net.Addr) (*net.TCPAddr, error) {
+				return &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 443}, nil
+			},
+			dialed: "[2001:db8::7]:443",
+		},
+		{
+			name: "未经重定向",
+			lookup: func(listener net.Addr) (*net.TCPAddr, error) {
+				return listener.(*net.TCPAddr), nil
+			},
+			log: "未经重定向",
+		},
+		{
+			name: "读取失败",
+			lookup: func(net.Addr) (*net.TCPAddr, error) {
+				return nil, errors.New("模拟的 getsockopt 错误")
+			},
+			log: "获取原始目标失败: 模拟的 getsockopt 错误",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLog(t)
+			lookup := tt.lookup
+			// 在服务器停止后恢复，清理函数按注册的逆序执行
+			t.Cleanup(func() { lookupOriginalDst = originalDst })
+			lookupOriginalDst = func(conn net.Conn) (*net.TCPAddr, error) { return lookup(conn.LocalAddr()) }
+
+			var mu sync.Mutex
+			var dialed []string
+			s := startServer(t, testConfig(t, `{"listeners": [{"address": "`+freeAddr(t)+`", "transparent": true}]}`), func(s *Server) {
+				s.Dial = recordingDial(echo, &dialed, &mu)
+			})
+
+			// 透明代理不解析SOCKS请求，客户端数据直接转发到原始目标
+			conn := dialServer(t, s)
+			mustWrite(t, conn, []byte("ping"))
+			if tt.dialed == "" {
+				expectClosed(t, conn)
+				waitLog(t, logs, tt.log)
+			} else {
+				expectBytes(t, conn, []byte("ping"))
+			}
+			var want []string
+			if tt.dialed != "" {
+				want = []string{tt.dialed}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if strings.Join(dialed, ",") != strings.Join(want, ",") {
+				t.Fatalf("拨号 %v, 期望 %v", dialed, want)
+			}
+		})
+	}
+}
+
+func TestOriginalDst(t *testing.T) {
+	// sockaddr_in 与 sockaddr_in6 中的端口按网络字节序存放，按本机字节序读出的 uint16 需要转换
+	port := binary.NativeEndian.Uint16([]byte{0x1f, 0x90})
+	ip := net.ParseIP("2001:db8::1")
+	if got := parseOriginalDst(port, ip); got.String() != "[2001:db8::1]:8080" {
+		t.Fatalf("parseOriginalDst = %s, 期望 [2001:db8::1]:8080", got)
+	}
+	if got := parseOriginalDst(port, []byte{192, 0, 2, 1}); got.String() != "192.0.2.1:8080" {
+		t.Fatalf("parseOriginalDst = %s, 期望 192.0.2.1:8080", got)
+	}
+
+	// 未经 iptables 重定向的连接没有原始目标
+	client, server := tcpPair(t)
+	for _, conn := range []net.Conn{client, server} {
+		if dst, err := originalDst(conn); err == nil {
+			t.Fatalf("未经重定向的连接 %s 读到原始目标 %s", conn.LocalAddr(), dst)
+		}
+	}
+}
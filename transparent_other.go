@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// transparentSupported 当前平台是否支持透明代理模式
+const transparentSupported = false
+
+// originalDst 透明代理依赖 Linux netfilter 的 SO_ORIGINAL_DST，其他平台不支持
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	return nil, errors.New("透明代理模式仅支持 Linux")
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,6 +17,27 @@ type UDPSession struct {
 	clientAddr *net.UDPAddr
 	targetConn *net.UDPConn
 	lastActive time.Time
+	created    time.Time       // 建立时间，用于 max_lifetime
+	done       chan struct{}   // 会话关闭时关闭
+	assoc      *udpAssociation // 所属的UDP关联（控制连接）
+	upload     atomic.Int64    // 客户端到目标的负载字节数
+	download   atomic.Int64    // 目标到客户端的负载字节数
+}
+
+// close 关闭会话的目标连接并通知读取协程退出，调用方需持有 sessionsLock
+func (s *UDPSession) close() {
+	close(s.done)
+	s.targetConn.Close()
+	delete(s.assoc.sessions, s.clientAddr.String())
+	log.Printf("UDP会话 %s -> %s 已关闭, 上行 %d 字节, 下行 %d 字节", s.clientAddr, s.targetConn.RemoteAddr(), s.upload.Load(), s.download.Load())
+}
+
+// udpAssociation 一个 UDP ASSOCIATE 控制连接，以及来自该客户端的UDP会话
+type udpAssociation struct {
+	clientIP    string
+	sessions    map[string]*UDPSession
+	lastActive  time.Time             // 最近一次有UDP数据报经过该关联的时间
+	checkTarget func(ip net.IP) error // 数据报目标IP的访问检查，为空时使用处理器的 checkTarget
 }
 
 // UDPAssociateRequest UDP关联请求的地址信息
@@ -28,39 +52,59 @@ type UDPHandler struct {
 	sessionsLock sync.RWMutex
 	config       *Config
 	listener     *net.UDPConn
+	outboundAddr *net.UDPAddr // 目标连接的源地址，为空则由系统选择
+	lookupIP     func(ctx context.Context, network, host string) ([]net.IP, error) // 域名解析，为空时使用系统解析器
+	dns          *udpResolver  // 目标域名的解析缓存
+	lookups      chan struct{} // 进行中的域名解析名额
+	lookupCtx    context.Context    // 域名解析使用的 context
+	stopLookups  context.CancelFunc // Stop 时取消进行中的域名解析
+	associations map[string][]*udpAssociation // 客户端IP -> UDP关联，受 sessionsLock 保护
+	trusted      []*net.IPNet                 // 无需关联即可转发的来源
+	checkTarget  func(ip net.IP) error        // 目标IP的访问检查（block 规则与私有/公网地址限制），为空时不检查
+	metrics      Metrics                      // 记录UDP指标，由 Server.Start 设置为服务器的指标实现
+	done         chan struct{}  // Stop 时关闭，通知后台协程退出
+	stopOnce     sync.Once      // 保证 Stop 只执行一次
+	wg           sync.WaitGroup // 跟踪所有后台协程，Stop 等待其全部退出
 }
 
 // NewUDPHandler 创建新的UDP处理器
 func NewUDPHandler(config *Config) *UDPHandler {
-	return &UDPHandler{
+	h := &UDPHandler{
 		sessions: make(map[string]*UDPSession),
 		config:   config,
+		dns:      newUDPResolver(),
+		lookups:  make(chan struct{}, maxUDPLookups),
+		associations: make(map[string][]*udpAssociation),
+		metrics:  ExpvarMetrics{},
+		done:     make(chan struct{}),
+	}
+	if ip := net.ParseIP(config.OutboundIP); ip != nil {
+		h.outboundAddr = &net.UDPAddr{IP: ip}
 	}
+	// CIDR 已在加载配置时校验
+	h.trusted, _ = parseCIDRs(config.UDP.TrustedSources)
+	h.lookupCtx, h.stopLookups = context.WithCancel(context.Background())
+	return h
 }
 
 // Start 启动UDP监听
 func (h *UDPHandler) Start() error {
-	addr := h.config.UDP.Address
-	if addr == "" {
-		addr = h.config.Address
-	}
-
+	addr, field := h.config.udpAddress()
 	udpAddr, err := net.ResolveUDPAddr("udp", addr)
 	if err != nil {
-		return fmt.Errorf("解析UDP地址失败: %v", err)
+		return fmt.Errorf("解析UDP地址失败（配置字段 %s）: %w", field, err)
 	}
 
 	h.listener, err = net.ListenUDP("udp", udpAddr)
 	if err != nil {
-		return fmt.Errorf("启动UDP监听失败: %v", err)
+		return fmt.Errorf("启动UDP监听失败: %w", err)
 	}
 
 	log.Printf("UDP服务器正在监听 %s", addr)
 
-	// 启动会话清理
+	// 启动会话清理和UDP数据处理
+	h.wg.Add(2)
 	go h.cleanSessions()
-
-	// 处理UDP数据
 	go h.handleUDP()
 
 	return nil
@@ -68,15 +112,34 @@ func (h *UDPHandler) Start() error {
 
 // cleanSessions 定期清理过期的会话
 func (h *UDPHandler) cleanSessions() {
-	ticker := time.NewTicker(time.Duration(h.config.UDP.Timeout) * time.Second)
+	defer h.wg.Done()
+	timeout := time.Duration(h.config.UDP.Timeout) * time.Second
+	lifetime := time.Duration(h.config.UDP.MaxLifetime) * time.Second
+	// 最长存活时间短于超时时间时按前者检查，避免会话超出上限过久
+	interval := timeout
+	if lifetime > 0 && lifetime < interval {
+		interval = lifetime
+	}
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
-	for range ticker.C {
+	for {
+		select {
+		case <-h.done:
+			return
+		case <-ticker.C:
+		}
+
 		h.sessionsLock.Lock()
 		now := time.Now()
 		for key, session := range h.sessions {
-			if now.Sub(session.lastActive) > time.Duration(h.config.UDP.Timeout)*time.Second {
-				session.targetConn.Close()
+			switch {
+			case lifetime > 0 && now.Sub(session.created) >= lifetime:
+				session.close()
+				delete(h.sessions, key)
+				log.Printf("UDP会话达到最长存活时间 %s, 关闭会话: %s", lifetime, key)
+			case now.Sub(session.lastActive) > timeout:
+				session.close()
 				delete(h.sessions, key)
 				log.Printf("清理过期UDP会话: %s", key)
 			}
@@ -87,10 +150,15 @@ func (h *UDPHandler) cleanSessions() {
 
 // handleUDP 处理UDP数据
 func (h *UDPHandler) handleUDP() {
+	defer h.wg.Done()
 	buffer := make([]byte, h.config.UDP.BufferSize)
+	fragments := newUDPFragments()
 	for {
 		n, clientAddr, err := h.listener.ReadFromUDP(buffer)
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			log.Printf("读取UDP数据失败: %v", err)
 			continue
 		}
@@ -106,8 +174,9 @@ func (h *UDPHandler) handleUDP() {
 			continue
 		}
 
-		// 跳过RSV和FRAG字段
+		// 跳过RSV字段，FRAG 在解析地址后处理
 		headerSize := 4
+		frag := buffer[2]
 		atyp := buffer[3]
 
 		var dstAddr string
@@ -145,45 +214,339 @@ func (h *UDPHandler) handleUDP() {
 			continue
 		}
 
+		// FRAG 的分片位置（低7位）为0时是独立数据报，否则按 frag_policy 丢弃或重组
 		sessionKey := clientAddr.String()
-		h.sessionsLock.Lock()
-		session, exists := h.sessions[sessionKey]
-		if !exists {
-			targetAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", dstAddr, dstPort))
-			if err != nil {
-				h.sessionsLock.Unlock()
+		payload := buffer[headerSize:n]
+		if frag&0x7F == 0 {
+			fragments.reset(sessionKey)
+		} else {
+			if h.config.UDP.FragPolicy != UDPFragReassemble || !h.acceptsSource(clientAddr) {
+				metricUDPFragmentsDropped.Add(h.metrics, 1)
 				continue
 			}
+			if payload = fragments.add(sessionKey, frag, payload); payload == nil {
+				continue
+			}
+		}
 
-			targetConn, err := net.DialUDP("udp", nil, targetAddr)
-			if err != nil {
-				h.sessionsLock.Unlock()
+		// 来源既没有会话也没有关联时直接丢弃，不为其解析域名
+		if !h.acceptsSource(clientAddr) {
+			metricUDPUnassociatedDropped.Add(h.metrics, 1)
+			continue
+		}
+
+		ip := net.ParseIP(dstAddr)
+		if ip == nil {
+			ip = h.dns.cached(dstAddr)
+		}
+		if ip == nil {
+			// 未缓存的域名在单独的协程中解析，慢速或恶意的域名不会阻塞其他会话的数据报
+			select {
+			case h.lookups <- struct{}{}:
+			default:
+				metricUDPLookupsDropped.Add(h.metrics, 1)
 				continue
 			}
+			h.wg.Add(1)
+			go h.resolveAndForward(clientAddr, dstAddr, dstPort, append([]byte(nil), payload...))
+			continue
+		}
+		h.forward(clientAddr, &net.UDPAddr{IP: ip, Port: int(dstPort)}, payload)
+	}
+}
 
-			session = &UDPSession{
-				clientAddr: clientAddr,
-				targetConn: targetConn,
-				lastActive: time.Now(),
+// resolveAndForward 解析目标域名后转发数据报，解析失败时丢弃
+func (h *UDPHandler) resolveAndForward(clientAddr *net.UDPAddr, host string, port uint16, payload []byte) {
+	defer h.wg.Done()
+	defer func() { <-h.lookups }()
+
+	lookup := h.lookupIP
+	if lookup == nil {
+		lookup = net.DefaultResolver.LookupIP
+	}
+	ctx, cancel := context.WithTimeout(h.lookupCtx, udpLookupTimeout)
+	defer cancel()
+	ip, err := h.dns.resolve(ctx, host, lookup)
+	if err != nil {
+		log.Printf("解析UDP目标 %s 失败: %v", host, err)
+		return
+	}
+	h.forward(clientAddr, &net.UDPAddr{IP: ip, Port: int(port)}, payload)
+}
+
+// forward 将数据报转发到目标，来自新客户端地址的第一个数据报会创建会话
+func (h *UDPHandler) forward(clientAddr, targetAddr *net.UDPAddr, payload []byte) {
+	sessionKey := clientAddr.String()
+
+	h.sessionsLock.Lock()
+	// 处理器已停止时不再创建会话，Stop 关闭 done 后才关闭已有会话
+	select {
+	case <-h.done:
+		h.sessionsLock.Unlock()
+		return
+	default:
+	}
+	session, exists := h.sessions[sessionKey]
+	var assoc *udpAssociation
+	if exists {
+		assoc = session.assoc
+	} else {
+		// 只为已通过控制连接建立关联的客户端或可信来源转发。
+		// 可信来源的会话属于不对应任何控制连接的独立关联，按 udp.timeout 过期
+		assocs := h.associations[clientAddr.IP.String()]
+		if len(assocs) == 0 {
+			if !h.isTrusted(clientAddr.IP) {
+				h.sessionsLock.Unlock()
+				metricUDPUnassociatedDropped.Add(h.metrics, 1)
+				return
 			}
-			h.sessions[sessionKey] = session
+			assocs = []*udpAssociation{{clientIP: clientAddr.IP.String(), sessions: make(map[string]*UDPSession), lastActive: time.Now()}}
+		}
+		assoc = assocs[len(assocs)-1]
+	}
 
-			// 启动目标数据读取协程
-			go h.handleTargetData(session)
+	// 每个数据报的目标IP都按访问规则检查，被拒绝的数据报直接丢弃
+	if check := h.checkFor(assoc); check != nil {
+		if err := check(targetAddr.IP); err != nil {
+			h.sessionsLock.Unlock()
+			metricUDPDatagramsDenied.Add(h.metrics, 1)
+			return
+		}
+	}
+
+	if !exists {
+
+		// 会话数达到上限时丢弃数据报或淘汰最久未活动的会话
+		if max := h.config.UDP.MaxSessions; max > 0 && len(h.sessions) >= max {
+			if !h.config.UDP.EvictOldest {
+				h.sessionsLock.Unlock()
+				metricUDPSessionsDropped.Add(h.metrics, 1)
+				return
+			}
+			h.evictOldestLocked()
 		}
-		session.lastActive = time.Now()
-		h.sessionsLock.Unlock()
 
-		// 转发数据到目标地址
-		_, err = session.targetConn.Write(buffer[headerSize:n])
+		targetConn, err := net.DialUDP("udp", h.outboundAddr, targetAddr)
 		if err != nil {
-			log.Printf("转发UDP数据失败: %v", err)
+			h.sessionsLock.Unlock()
+			return
+		}
+
+		session = &UDPSession{
+			clientAddr: clientAddr,
+			targetConn: targetConn,
+			lastActive: time.Now(),
+			created:    time.Now(),
+			done:       make(chan struct{}),
+			assoc:      assoc,
 		}
+		h.sessions[sessionKey] = session
+		session.assoc.sessions[sessionKey] = session
+
+		// 启动目标数据读取协程
+		h.wg.Add(1)
+		go h.handleTargetData(session)
+	}
+	session.lastActive = time.Now()
+	session.assoc.lastActive = session.lastActive
+	h.sessionsLock.Unlock()
+
+	// 转发数据到目标地址
+	if _, err := session.targetConn.Write(payload); err != nil {
+		log.Printf("转发UDP数据失败: %v", err)
+		return
+	}
+	session.upload.Add(int64(len(payload)))
+	metricUDPUploadBytes.Add(h.metrics, int64(len(payload)))
+}
+
+// checkFor 返回检查关联的数据报目标IP所用的函数
+func (h *UDPHandler) checkFor(a *udpAssociation) func(ip net.IP) error {
+	if a.checkTarget != nil {
+		return a.checkTarget
 	}
+	return h.checkTarget
+}
+
+// acceptsSource 判断是否转发来自 addr 的数据报：已有会话、有UDP关联或属于可信来源
+func (h *UDPHandler) acceptsSource(addr *net.UDPAddr) bool {
+	if h.isTrusted(addr.IP) {
+		return true
+	}
+	h.sessionsLock.RLock()
+	defer h.sessionsLock.RUnlock()
+	_, exists := h.sessions[addr.String()]
+	return exists || len(h.associations[addr.IP.String()]) > 0
+}
+
+// isTrusted 判断来源IP是否无需UDP关联即可转发：开启了 udp.allow_unassociated 或在 udp.trusted_sources 中
+func (h *UDPHandler) isTrusted(ip net.IP) bool {
+	if h.config.UDP.AllowUnassociated {
+		return true
+	}
+	for _, n := range h.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// UDP目标域名解析的参数
+const (
+	udpDNSCacheTTL   = time.Minute     // 解析结果的缓存时间
+	udpLookupTimeout = 5 * time.Second // 单次解析的超时时间
+	maxUDPLookups    = 64              // 同时进行的解析数上限，超过时丢弃需要解析的数据报
+)
+
+// udpDNSEntry 缓存的域名解析结果
+type udpDNSEntry struct {
+	ip      net.IP
+	expires time.Time
+}
+
+// udpLookup 一次进行中的域名解析，等待同一域名的调用共享其结果
+type udpLookup struct {
+	done chan struct{}
+	ip   net.IP
+	err  error
+}
+
+// udpResolver 缓存UDP目标域名的解析结果，同一域名同时只解析一次。
+// 使用独立的锁，解析期间不持有 sessionsLock
+type udpResolver struct {
+	mu       sync.Mutex
+	cache    map[string]udpDNSEntry
+	inflight map[string]*udpLookup
+}
+
+func newUDPResolver() *udpResolver {
+	return &udpResolver{cache: make(map[string]udpDNSEntry), inflight: make(map[string]*udpLookup)}
+}
+
+// cached 返回域名未过期的解析结果，没有时返回 nil
+func (r *udpResolver) cached(host string) net.IP {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if entry, ok := r.cache[host]; ok && time.Now().Before(entry.expires) {
+		return entry.ip
+	}
+	return nil
+}
+
+// resolve 通过 lookup 解析域名并缓存第一个地址。同一域名已在解析时等待其结果
+func (r *udpResolver) resolve(ctx context.Context, host string, lookup func(ctx context.Context, network, host string) ([]net.IP, error)) (net.IP, error) {
+	r.mu.Lock()
+	if entry, ok := r.cache[host]; ok && time.Now().Before(entry.expires) {
+		r.mu.Unlock()
+		return entry.ip, nil
+	}
+	if l, ok := r.inflight[host]; ok {
+		r.mu.Unlock()
+		select {
+		case <-l.done:
+			return l.ip, l.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	l := &udpLookup{done: make(chan struct{})}
+	r.inflight[host] = l
+	r.mu.Unlock()
+
+	ips, err := lookup(ctx, "ip", host)
+	if err == nil && len(ips) == 0 {
+		err = fmt.Errorf("%s 没有可用的地址", host)
+	}
+
+	r.mu.Lock()
+	delete(r.inflight, host)
+	if err == nil {
+		now := time.Now()
+		// 缓存过大时清理过期条目
+		if len(r.cache) >= 1024 {
+			for key, entry := range r.cache {
+				if now.After(entry.expires) {
+					delete(r.cache, key)
+				}
+			}
+		}
+		r.cache[host] = udpDNSEntry{ip: ips[0], expires: now.Add(udpDNSCacheTTL)}
+		l.ip = ips[0]
+	}
+	l.err = err
+	r.mu.Unlock()
+	close(l.done)
+	return l.ip, l.err
+}
+
+// associate 为来自 clientIP 的控制连接登记UDP关联，checkTarget 检查该关联数据报的目标IP。
+// 该客户端的关联数达到 max_associations 时返回错误
+func (h *UDPHandler) associate(clientIP string, checkTarget func(ip net.IP) error) (*udpAssociation, error) {
+	h.sessionsLock.Lock()
+	defer h.sessionsLock.Unlock()
+
+	if max := h.config.UDP.MaxAssociations; max > 0 && len(h.associations[clientIP]) >= max {
+		return nil, fmt.Errorf("%w: 客户端 %s 的UDP关联数已达上限 %d", ErrConnectionNotAllowed, clientIP, max)
+	}
+	a := &udpAssociation{clientIP: clientIP, sessions: make(map[string]*UDPSession), lastActive: time.Now(), checkTarget: checkTarget}
+	h.associations[clientIP] = append(h.associations[clientIP], a)
+	return a, nil
+}
+
+// lastActive 返回UDP关联最近一次有数据报经过的时间，没有数据报时为建立关联的时间
+func (h *UDPHandler) lastActive(a *udpAssociation) time.Time {
+	h.sessionsLock.RLock()
+	defer h.sessionsLock.RUnlock()
+	return a.lastActive
+}
+
+// release 在控制连接断开时移除UDP关联并关闭其所有会话
+func (h *UDPHandler) release(a *udpAssociation) {
+	h.sessionsLock.Lock()
+	defer h.sessionsLock.Unlock()
+
+	for key, session := range a.sessions {
+		session.close()
+		delete(h.sessions, key)
+	}
+
+	assocs := h.associations[a.clientIP]
+	for i, other := range assocs {
+		if other == a {
+			assocs = append(assocs[:i], assocs[i+1:]...)
+			break
+		}
+	}
+	if len(assocs) == 0 {
+		delete(h.associations, a.clientIP)
+	} else {
+		h.associations[a.clientIP] = assocs
+	}
+}
+
+// evictOldestLocked 淘汰最久未活动的会话，调用方需持有 sessionsLock
+func (h *UDPHandler) evictOldestLocked() {
+	var oldestKey string
+	var oldest *UDPSession
+	for key, session := range h.sessions {
+		if oldest == nil || session.lastActive.Before(oldest.lastActive) {
+			oldestKey, oldest = key, session
+		}
+	}
+	if oldest == nil {
+		return
+	}
+
+	oldest.close()
+	delete(h.sessions, oldestKey)
+	metricUDPSessionsEvicted.Add(h.metrics, 1)
+	log.Printf("UDP会话数达到上限, 淘汰会话: %s", oldestKey)
 }
 
 // handleTargetData 处理来自目标的数据
 func (h *UDPHandler) handleTargetData(session *UDPSession) {
+	defer h.wg.Done()
 	buffer := make([]byte, h.config.UDP.BufferSize)
 	for {
 		n, _, err := session.targetConn.ReadFromUDP(buffer[4:])
@@ -191,6 +554,13 @@ func (h *UDPHandler) handleTargetData(session *UDPSession) {
 			return
 		}
 
+		// 会话已被清理或处理器正在停止时不再写回客户端
+		select {
+		case <-session.done:
+			return
+		default:
+		}
+
 		// 构建响应头
 		// RSV(2) + FRAG(1) + ATYP(1) = 4 bytes
 		copy(buffer[0:4], []byte{0, 0, 0, 0x01})
@@ -201,23 +571,31 @@ func (h *UDPHandler) handleTargetData(session *UDPSession) {
 			log.Printf("发送UDP响应失败: %v", err)
 			return
 		}
+		session.download.Add(int64(n))
+		metricUDPDownloadBytes.Add(h.metrics, int64(n))
 
 		h.sessionsLock.Lock()
 		session.lastActive = time.Now()
+		session.assoc.lastActive = session.lastActive
 		h.sessionsLock.Unlock()
 	}
 }
 
-// Stop 停止UDP处理器
+// Stop 停止UDP处理器，并等待所有后台协程退出，可重复调用
 func (h *UDPHandler) Stop() {
-	if h.listener != nil {
-		h.listener.Close()
-	}
+	h.stopOnce.Do(func() {
+		close(h.done)
+		h.stopLookups()
+		if h.listener != nil {
+			h.listener.Close()
+		}
 
-	h.sessionsLock.Lock()
-	for _, session := range h.sessions {
-		session.targetConn.Close()
-	}
-	h.sessions = make(map[string]*UDPSession)
-	h.sessionsLock.Unlock()
+		h.sessionsLock.Lock()
+		for _, session := range h.sessions {
+			session.close()
+		}
+		h.sessions = make(map[string]*UDPSession)
+		h.sessionsLock.Unlock()
+	})
+	h.wg.Wait()
 }
\ No newline at end of file
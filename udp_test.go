@@ -0,0 +1,872 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// udpHeader 构造 SOCKS5 UDP 请求头（FRAG 为0），host 为IP时使用对应的地址类型，否则使用域名
+func udpHeader(host string, port uint16) []byte {
+	req := requestBytes(0, host, port)
+	// 请求报文为 VER CMD RSV ATYP ...，UDP 头为 RSV RSV FRAG ATYP ...
+	return append([]byte{0, 0, 0}, req[3:]...)
+}
+
+// associateUDP 建立UDP关联，返回控制连接与服务器的UDP转发地址
+func associateUDP(t *testing.T, s *Server, username, password string) (net.Conn, *net.UDPAddr) {
+	t.Helper()
+	ctrl, rep, bnd := connect(t, s, username, password, CmdUDPAssociate, "0.0.0.0:0")
+	if rep != RepSuccess {
+		t.Fatalf("UDP ASSOCIATE 回复码 %#x", rep)
+	}
+	// 控制连接需要一直保持，取消 dialServer 设置的读写超时
+	ctrl.SetDeadline(time.Time{})
+	return ctrl, &net.UDPAddr{IP: bnd.IP, Port: bnd.Port}
+}
+
+// dialUDP 创建发往服务器UDP转发地址的客户端套接字
+func dialUDP(t *testing.T, relay *net.UDPAddr) *net.UDPConn {
+	t.Helper()
+	conn, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// startUDPEcho 启动一个UDP回显服务，每个收到的数据报也会发送到 seen（如果非空）
+func startUDPEcho(t *testing.T, seen chan<- []byte) *net.UDPAddr {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if seen != nil {
+				select {
+				case seen <- append([]byte(nil), buf[:n]...):
+				default:
+				}
+			}
+			conn.WriteToUDP(buf[:n], from)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+// expectUDPReply 读取一个转发回来的数据报并断言其负载
+func expectUDPReply(t *testing.T, conn *net.UDPConn, payload []byte) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("未收到UDP回复: %v", err)
+	}
+	if !bytes.HasSuffix(buf[:n], payload) {
+		t.Fatalf("UDP回复 % x 不包含负载 %q", buf[:n], payload)
+	}
+}
+
+// expectNoUDPReply 断言一段时间内没有收到转发回来的数据报
+func expectNoUDPReply(t *testing.T, conn *net.UDPConn) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	buf := make([]byte, 65535)
+	if n, err := conn.Read(buf); err == nil {
+		t.Fatalf("期望数据报被丢弃, 收到 % x", buf[:n])
+	}
+}
+
+// counterValue 返回以 expvar 发布的计数器的当前值
+func counterValue(name string) int64 {
+	return expvar.Get(name).(*expvar.Int).Value()
+}
+
+// runningGoroutines 返回当前调用栈中包含任一函数名的协程，用于检查协程泄漏
+func runningGoroutines(funcs ...string) []string {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	var found []string
+	for _, g := range strings.Split(string(buf), "\n\n") {
+		for _, fn := range funcs {
+			if strings.Contains(g, fn) {
+				found = append(found, g)
+				break
+			}
+		}
+	}
+	return found
+}
+
+func TestStopWaitsForUDPGoroutines(t *testing.T) {
+	cfg := testConfig(t, `{"udp": {"enable": true, "timeout": 60, "buffer_size": 65535}}`)
+	s := NewServer(cfg)
+	if err := s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan error, 1)
+	go func() { started <- s.Start() }()
+
+	echo := startUDPEcho(t, nil)
+	_, relay := associateUDP(t, s, "", "")
+
+	// 多个客户端地址各建立一个会话，并在 Stop 期间持续发送数据报
+	var traffic sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		client := dialUDP(t, relay)
+		packet := append(udpHeader(echo.IP.String(), uint16(echo.Port)), "ping"...)
+		client.Write(packet)
+		expectUDPReply(t, client, []byte("ping"))
+
+		traffic.Add(1)
+		go func() {
+			defer traffic.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				client.Write(packet)
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+
+	s.Stop()
+	// Stop 返回时UDP处理器的所有协程都已退出，不需要等待
+	if leaked := runningGoroutines("(*UDPHandler).handleTargetData", "(*UDPHandler).handleUDP", "(*UDPHandler).cleanSessions"); len(leaked) > 0 {
+		t.Fatalf("Stop 后仍有 %d 个UDP协程:\n%s", len(leaked), strings.Join(leaked, "\n\n"))
+	}
+	close(stop)
+	traffic.Wait()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop 后 Start 未返回")
+	}
+}
+
+func TestStopTwice(t *testing.T) {
+	s := startServer(t, testConfig(t, `{"udp": {"enable": true, "timeout": 60, "buffer_size": 65535}}`))
+	// 嵌入方在 Start 失败（内部已调用 Stop）后再次调用 Stop 不会panic，测试清理时还会调用一次
+	s.Stop()
+	s.Stop()
+}
+
+// stubResolver 按固定表解析域名并统计每个域名的解析次数。
+// block 中的域名在对应的通道关闭前不返回
+type stubResolver struct {
+	mu    sync.Mutex
+	hosts map[string][]net.IP
+	block map[string]chan struct{}
+	calls map[string]int
+}
+
+func (r *stubResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	r.mu.Lock()
+	if r.calls == nil {
+		r.calls = make(map[string]int)
+	}
+	r.calls[host]++
+	ips, ok := r.hosts[host]
+	wait := r.block[host]
+	r.mu.Unlock()
+
+	if wait != nil {
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return append([]net.IP(nil), ips...), nil
+}
+
+// lookups 返回域名被解析的次数
+func (r *stubResolver) lookups(host string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.calls[host]
+}
+
+func TestUDPDomainThroughResolver(t *testing.T) {
+	resolver := &stubResolver{hosts: map[string][]net.IP{"echo.test": {net.IPv4(127, 0, 0, 1)}}}
+	s := startServer(t, testConfig(t, `{"udp": {"enable": true, "timeout": 60, "buffer_size": 65535}}`), func(s *Server) {
+		s.Resolver = resolver
+	})
+	echo := startUDPEcho(t, nil)
+	_, relay := associateUDP(t, s, "", "")
+
+	// 两个客户端地址向同一域名发送多个数据报，只解析一次
+	for i := 0; i < 2; i++ {
+		client := dialUDP(t, relay)
+		for j := 0; j < 3; j++ {
+			payload := []byte(fmt.Sprintf("ping %d-%d", i, j))
+			client.Write(append(udpHeader("echo.test", uint16(echo.Port)), payload...))
+			expectUDPReply(t, client, payload)
+		}
+	}
+	if n := resolver.lookups("echo.test"); n != 1 {
+		t.Fatalf("echo.test 被解析 %d 次, 期望缓存后只解析1次", n)
+	}
+}
+
+func TestUDPSlowLookupDoesNotBlockRelay(t *testing.T) {
+	release := make(chan struct{})
+	resolver := &stubResolver{
+		hosts: map[string][]net.IP{"slow.test": {net.IPv4(127, 0, 0, 1)}},
+		block: map[string]chan struct{}{"slow.test": release},
+	}
+	s := startServer(t, testConfig(t, `{"udp": {"enable": true, "timeout": 60, "buffer_size": 65535}}`), func(s *Server) {
+		s.Resolver = resolver
+	})
+	echo := startUDPEcho(t, nil)
+	_, relay := associateUDP(t, s, "", "")
+
+	// 发往慢速域名的数据报等待解析，同一域名的并发数据报共享一次解析
+	slow := dialUDP(t, relay)
+	for i := 0; i < 3; i++ {
+		slow.Write(append(udpHeader("slow.test", uint16(echo.Port)), "slow"...))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for resolver.lookups("slow.test") == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	// 解析进行中时其他客户端的数据报照常转发
+	fast := dialUDP(t, relay)
+	fast.Write(append(udpHeader(echo.IP.String(), uint16(echo.Port)), "fast"...))
+	expectUDPReply(t, fast, []byte("fast"))
+
+	close(release)
+	expectUDPReply(t, slow, []byte("slow"))
+	if n := resolver.lookups("slow.test"); n != 1 {
+		t.Fatalf("slow.test 被解析 %d 次, 期望1次", n)
+	}
+}
+
+func TestUDPTargetPolicy(t *testing.T) {
+	resolver := &stubResolver{hosts: map[string][]net.IP{"private.test": {net.IPv4(127, 0, 0, 1)}}}
+	tests := []struct {
+		name   string
+		config string // 追加到UDP配置之后的顶层字段
+		host   string // 为空时发往回显服务的IP
+		denied bool
+	}{
+		{"不限制", ``, "", false},
+		{"私有地址", `, "block_private_targets": true`, "", true},
+		{"解析为私有地址的域名", `, "block_private_targets": true`, "private.test", true},
+		{"非公网地址", `, "public_targets_only": true`, "", true},
+		{"block 路由", `, "routes": [{"match": "127.0.0.0/8", "via": "block"}]`, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, `{"udp": {"enable": true, "timeout": 60, "buffer_size": 65535}`+tt.config+`}`)
+			s := startServer(t, cfg, func(s *Server) { s.Resolver = resolver })
+			echo := startUDPEcho(t, nil)
+			_, relay := associateUDP(t, s, "", "")
+
+			host := tt.host
+			if host == "" {
+				host = echo.IP.String()
+			}
+			before := counterValue("udp_datagrams_denied_total")
+			client := dialUDP(t, relay)
+			client.Write(append(udpHeader(host, uint16(echo.Port)), "ping"...))
+			if !tt.denied {
+				expectUDPReply(t, client, []byte("ping"))
+				return
+			}
+			expectNoUDPReply(t, client)
+			if n := counterValue("udp_datagrams_denied_total") - before; n != 1 {
+				t.Fatalf("udp_datagrams_denied_total 增加 %d, 期望1", n)
+			}
+		})
+	}
+}
+
+// associations 返回客户端IP当前的UDP关联数
+func associations(h *UDPHandler, clientIP string) int {
+	h.sessionsLock.RLock()
+	defer h.sessionsLock.RUnlock()
+	return len(h.associations[clientIP])
+}
+
+// waitCounter 等待以 expvar 发布的计数器达到 want
+func waitCounter(t *testing.T, name string, want int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for counterValue(name) < want {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s 为 %d, 期望 %d", name, counterValue(name), want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestUDPPublicTargetsOnly(t *testing.T) {
+	// special_use_ranges 为空时只按地址类型拒绝，文档地址 192.0.2.1 可以充当公网地址，
+	// 测试不会向真实的公网地址发送数据报
+	s := startServer(t, testConfig(t, `{"public_targets_only": true, "special_use_ranges": [], "udp": {"enable": true, "timeout": 60, "buffer_size": 65535}}`))
+	_, relay := associateUDP(t, s, "", "")
+
+	tests := []struct {
+		name   string
+		target string
+		denied bool
+	}{
+		{"组播", "224.0.0.251", true},
+		{"IPv6 组播", "ff02::fb", true},
+		{"链路本地", "169.254.1.1", true},
+		{"私有地址", "10.0.0.1", true},
+		{"回环", "127.0.0.1", true},
+		{"公网地址", "192.0.2.1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := dialUDP(t, relay)
+			before := counterValue("udp_datagrams_denied_total")
+			client.Write(append(udpHeader(tt.target, 9), "ping"...))
+			// 数据报按顺序处理，随后发往回环地址的数据报被拒绝时前一个数据报已经处理完
+			client.Write(append(udpHeader("127.0.0.1", 9), "ping"...))
+			want := before + 1
+			if tt.denied {
+				want++
+			}
+			waitCounter(t, "udp_datagrams_denied_total", want)
+			if got := counterValue("udp_datagrams_denied_total"); got != want {
+				t.Fatalf("udp_datagrams_denied_total 增加 %d, 期望 %d", got-before, want-before)
+			}
+		})
+	}
+}
+
+func TestUDPAssociationCap(t *testing.T) {
+	s := startServer(t, testConfig(t, `{"udp": {"enable": true, "timeout": 60, "buffer_size": 65535, "max_associations": 2}}`))
+	first, _ := associateUDP(t, s, "", "")
+	associateUDP(t, s, "", "")
+
+	// 同一客户端IP的第三个关联超过上限
+	_, rep, _ := connect(t, s, "", "", CmdUDPAssociate, "0.0.0.0:0")
+	if rep != RepConnectionNotAllowed {
+		t.Fatalf("第三个 UDP ASSOCIATE 回复码 %#x, 期望 %#x", rep, RepConnectionNotAllowed)
+	}
+
+	// 关闭一个控制连接后名额释放
+	first.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, rep, _ := connect(t, s, "", "", CmdUDPAssociate, "0.0.0.0:0")
+		conn.Close()
+		if rep == RepSuccess {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("关闭控制连接后 UDP ASSOCIATE 回复码仍为 %#x", rep)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUDPUnassociatedSources(t *testing.T) {
+	tests := []struct {
+		name      string
+		udp       string // 追加到UDP配置的字段
+		forwarded bool
+	}{
+		{"默认丢弃", ``, false},
+		{"allow_unassociated", `, "allow_unassociated": true`, true},
+		{"trusted_sources", `, "trusted_sources": ["127.0.0.0/8"]`, true},
+		{"不在 trusted_sources 中", `, "trusted_sources": ["10.0.0.0/8"]`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startServer(t, testConfig(t, `{"udp": {"enable": true, "timeout": 60, "buffer_size": 65535`+tt.udp+`}}`))
+			echo := startUDPEcho(t, nil)
+
+			// 通过一个关联取得UDP转发地址，关闭控制连接并等待关联释放后，
+			// 以没有关联的来源直接向UDP转发端口发送数据报
+			ctrl, relay := associateUDP(t, s, "", "")
+			ctrl.Close()
+			deadline := time.Now().Add(5 * time.Second)
+			for associations(s.udpHandler, "127.0.0.1") > 0 {
+				if time.Now().After(deadline) {
+					t.Fatal("关闭控制连接后UDP关联未释放")
+				}
+				time.Sleep(time.Millisecond)
+			}
+			client := dialUDP(t, relay)
+			before := counterValue("udp_unassociated_dropped_total")
+			client.Write(append(udpHeader(echo.IP.String(), uint16(echo.Port)), "ping"...))
+			if tt.forwarded {
+				expectUDPReply(t, client, []byte("ping"))
+				return
+			}
+			expectNoUDPReply(t, client)
+			if n := counterValue("udp_unassociated_dropped_total") - before; n != 1 {
+				t.Fatalf("udp_unassociated_dropped_total 增加 %d, 期望1", n)
+			}
+		})
+	}
+}
+
+// sessionKeys 返回当前所有UDP会话的客户端地址
+func sessionKeys(h *UDPHandler) map[string]bool {
+	h.sessionsLock.RLock()
+	defer h.sessionsLock.RUnlock()
+	keys := make(map[string]bool, len(h.sessions))
+	for key := range h.sessions {
+		keys[key] = true
+	}
+	return keys
+}
+
+func TestUDPSessionCap(t *testing.T) {
+	tests := []struct {
+		name    string
+		evict   bool
+		dropped int64 // 第三个会话被丢弃的数据报数
+	}{
+		{"丢弃", false, 1},
+		{"淘汰最久未活动的会话", true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startServer(t, testConfig(t, fmt.Sprintf(`{"udp": {"enable": true, "timeout": 60, "buffer_size": 65535, "max_sessions": 2, "evict_oldest": %t}}`, tt.evict)))
+			echo := startUDPEcho(t, nil)
+			_, relay := associateUDP(t, s, "", "")
+			header := udpHeader(echo.IP.String(), uint16(echo.Port))
+
+			// 不同的客户端地址各自建立会话
+			var clients []*net.UDPConn
+			for i := 0; i < 2; i++ {
+				c := dialUDP(t, relay)
+				c.Write(append(header, "ping"...))
+				expectUDPReply(t, c, []byte("ping"))
+				clients = append(clients, c)
+			}
+
+			dropped := counterValue("udp_sessions_dropped_total")
+			evicted := counterValue("udp_sessions_evicted_total")
+			third := dialUDP(t, relay)
+			third.Write(append(header, "ping"...))
+			if tt.evict {
+				expectUDPReply(t, third, []byte("ping"))
+			} else {
+				expectNoUDPReply(t, third)
+			}
+
+			keys := sessionKeys(s.udpHandler)
+			if len(keys) != 2 {
+				t.Fatalf("会话数 %d, 期望不超过上限2", len(keys))
+			}
+			if n := counterValue("udp_sessions_dropped_total") - dropped; n != tt.dropped {
+				t.Fatalf("udp_sessions_dropped_total 增加 %d, 期望 %d", n, tt.dropped)
+			}
+			if tt.evict {
+				if keys[clients[0].LocalAddr().String()] || !keys[third.LocalAddr().String()] {
+					t.Fatalf("会话 %v, 期望淘汰最早的 %s", keys, clients[0].LocalAddr())
+				}
+				if n := counterValue("udp_sessions_evicted_total") - evicted; n != 1 {
+					t.Fatalf("udp_sessions_evicted_total 增加 %d, 期望1", n)
+				}
+			}
+		})
+	}
+}
+
+func TestUDPOutboundSource(t *testing.T) {
+	// 回环网段的其他地址仅在 Linux 上默认可用
+	if probe, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2)}); err != nil {
+		t.Skipf("无法绑定 127.0.0.2: %v", err)
+	} else {
+		probe.Close()
+	}
+
+	// 目标服务记录每个数据报的来源地址
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { target.Close() })
+	sources := make(chan *net.UDPAddr, 1)
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := target.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			sources <- from
+			target.WriteToUDP(buf[:n], from)
+		}
+	}()
+	targetPort := uint16(target.LocalAddr().(*net.UDPAddr).Port)
+
+	tests := []struct {
+		name     string
+		outbound string
+		want     string
+	}{
+		{"系统选择", "", "127.0.0.1"},
+		{"指定出口地址", "127.0.0.2", "127.0.0.2"},
+		{"另一个出口地址", "127.0.0.3", "127.0.0.3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startServer(t, testConfig(t, `{"outbound_ip": "`+tt.outbound+`", "udp": {"enable": true, "timeout": 60, "buffer_size": 65535}}`))
+			_, relay := associateUDP(t, s, "", "")
+			client := dialUDP(t, relay)
+
+			client.Write(append(udpHeader("127.0.0.1", targetPort), "ping"...))
+			expectUDPReply(t, client, []byte("ping"))
+			if from := <-sources; from.IP.String() != tt.want {
+				t.Fatalf("目标收到的数据报来自 %s, 期望 %s", from.IP, tt.want)
+			}
+		})
+	}
+}
+
+func TestUDPIdleReaper(t *testing.T) {
+	echo := startUDPEcho(t, nil)
+	tests := []struct {
+		name    string
+		idle    int           // idle_timeout（秒）
+		traffic time.Duration // 建立关联后持续发送数据报的时间
+		reaped  bool          // 停止发送后控制连接是否在 idle_timeout 后关闭
+	}{
+		{"空闲关联被关闭", 1, 0, true},
+		{"有数据报时保持", 1, 1500 * time.Millisecond, true},
+		{"未配置时不关闭", 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startServer(t, testConfig(t, `{"udp": {"enable": true, "timeout": 60, "buffer_size": 65535, "idle_timeout": `+strconv.Itoa(tt.idle)+`}}`))
+			reaped := counterValue("udp_associations_reaped_total")
+			ctrl, relay := associateUDP(t, s, "", "")
+			client := dialUDP(t, relay)
+
+			closed := make(chan time.Time, 1)
+			go func() {
+				io.Copy(io.Discard, ctrl)
+				closed <- time.Now()
+			}()
+
+			// 发送期间关联一直保持，last 为最后一次收到回复的时间
+			last := time.Now()
+			for start := time.Now(); time.Since(start) < tt.traffic; {
+				payload := []byte("keepalive")
+				if _, err := client.Write(append(udpHeader(echo.IP.String(), uint16(echo.Port)), payload...)); err != nil {
+					t.Fatal(err)
+				}
+				expectUDPReply(t, client, payload)
+				last = time.Now()
+				select {
+				case <-closed:
+					t.Fatalf("有数据报经过时控制连接在 %v 后被关闭", time.Since(start))
+				case <-time.After(300 * time.Millisecond):
+				}
+			}
+
+			select {
+			case at := <-closed:
+				if !tt.reaped {
+					t.Fatal("未配置 idle_timeout 时控制连接被关闭")
+				}
+				if elapsed := at.Sub(last); elapsed < time.Duration(tt.idle)*time.Second-200*time.Millisecond {
+					t.Fatalf("控制连接在空闲 %v 后被关闭, 早于 %ds", elapsed, tt.idle)
+				}
+				waitCounter(t, "udp_associations_reaped_total", reaped+1)
+			case <-time.After(time.Duration(tt.idle)*time.Second + 2*time.Second):
+				if tt.reaped {
+					t.Fatal("空闲关联的控制连接未被关闭")
+				}
+				ctrl.Close()
+			}
+		})
+	}
+}
+
+// sessionCreated 返回客户端地址 key 的UDP会话的建立时间，会话不存在时返回零值
+func sessionCreated(h *UDPHandler, key string) time.Time {
+	h.sessionsLock.RLock()
+	defer h.sessionsLock.RUnlock()
+	if session, ok := h.sessions[key]; ok {
+		return session.created
+	}
+	return time.Time{}
+}
+
+func TestUDPMaxLifetime(t *testing.T) {
+	echo := startUDPEcho(t, nil)
+	header := udpHeader(echo.IP.String(), uint16(echo.Port))
+	tests := []struct {
+		name     string
+		timeout  int           // udp.timeout（秒）
+		lifetime int           // udp.max_lifetime（秒）
+		traffic  time.Duration // 持续发送数据报的时间
+		log      string        // 会话关闭时的日志，为空表示会话应一直保持
+	}{
+		{"持续活动的会话到期关闭", 60, 1, 3 * time.Second, "UDP会话达到最长存活时间 1s, 关闭会话: "},
+		{"空闲会话按超时清理", 1, 0, 0, "清理过期UDP会话: "},
+		{"空闲超时先于最长存活时间", 1, 60, 0, "清理过期UDP会话: "},
+		{"未配置时保持", 60, 0, 2500 * time.Millisecond, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLog(t)
+			s := startServer(t, testConfig(t, fmt.Sprintf(`{"udp": {"enable": true, "timeout": %d, "buffer_size": 65535, "max_lifetime": %d}}`, tt.timeout, tt.lifetime)))
+			_, relay := associateUDP(t, s, "", "")
+			client := dialUDP(t, relay)
+			key := client.LocalAddr().String()
+			client.Write(append(header, "ping"...))
+			expectUDPReply(t, client, []byte("ping"))
+			created := sessionCreated(s.udpHandler, key)
+
+			for start := time.Now(); time.Since(start) < tt.traffic; time.Sleep(200 * time.Millisecond) {
+				client.Write(append(header, "keepalive"...))
+				if tt.log == "" {
+					expectUDPReply(t, client, []byte("keepalive"))
+					continue
+				}
+				// 会话关闭时正在转发的数据报可能丢失，只读走回复而不检查
+				client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+				client.Read(make([]byte, 65535))
+			}
+
+			if tt.log == "" {
+				if got := sessionCreated(s.udpHandler, key); !got.Equal(created) {
+					t.Fatalf("会话建立时间由 %v 变为 %v, 期望一直保持", created, got)
+				}
+				if strings.Contains(logs.String(), key) {
+					t.Fatalf("会话被关闭:\n%s", logs)
+				}
+				return
+			}
+			waitLog(t, logs, tt.log+key)
+			if tt.traffic > 0 {
+				// 关闭后的数据报在同一关联上建立新会话
+				client.Write(append(header, "again"...))
+				expectUDPReply(t, client, []byte("again"))
+				if got := sessionCreated(s.udpHandler, key); !got.After(created) {
+					t.Fatalf("会话建立时间 %v, 期望到期后重新建立", got)
+				}
+			}
+		})
+	}
+}
+
+func TestUDPFragPolicy(t *testing.T) {
+	echo := startUDPEcho(t, nil)
+	type datagram struct {
+		frag    byte
+		payload string
+	}
+	tests := []struct {
+		policy  string
+		sent    []datagram
+		want    string // 转发到目标的数据，为空表示没有转发
+		dropped int64  // 被丢弃的分片数
+	}{
+		{UDPFragDrop, []datagram{{0, "whole"}}, "whole", 0},
+		// 分片位置为0时最高位不表示分片，按独立数据报转发
+		{UDPFragDrop, []datagram{{0x80, "marked"}}, "marked", 0},
+		{UDPFragDrop, []datagram{{1, "ab"}, {0x82, "cd"}}, "", 2},
+		{UDPFragReassemble, []datagram{{0, "whole"}}, "whole", 0},
+		{UDPFragReassemble, []datagram{{0x80, "marked"}}, "marked", 0},
+		{UDPFragReassemble, []datagram{{1, "ab"}, {2, "cd"}, {0x83, "ef"}}, "abcdef", 0},
+		{UDPFragReassemble, []datagram{{1, "ab"}, {2, "cd"}}, "", 0},
+		// 位置不递增时丢弃之前的分片重新开始
+		{UDPFragReassemble, []datagram{{2, "stale"}, {1, "ab"}, {0x82, "cd"}}, "abcd", 0},
+		// 独立数据报丢弃正在重组的序列
+		{UDPFragReassemble, []datagram{{1, "stale"}, {0, "whole"}}, "whole", 0},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%d", tt.policy, i), func(t *testing.T) {
+			s := startServer(t, testConfig(t, `{"udp": {"enable": true, "timeout": 60, "buffer_size": 65535, "frag_policy": "`+tt.policy+`"}}`))
+			dropped := counterValue("udp_fragments_dropped_total")
+			_, relay := associateUDP(t, s, "", "")
+			client := dialUDP(t, relay)
+			header := udpHeader(echo.IP.String(), uint16(echo.Port))
+			for _, d := range append(tt.sent, datagram{0, "probe"}) {
+				h := append([]byte(nil), header...)
+				h[2] = d.frag
+				if _, err := client.Write(append(h, d.payload...)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// 探测数据报之前收到的回复就是序列转发的结果
+			if tt.want != "" {
+				expectUDPReply(t, client, []byte(tt.want))
+			}
+			expectUDPReply(t, client, []byte("probe"))
+			if got := counterValue("udp_fragments_dropped_total") - dropped; got != tt.dropped {
+				t.Fatalf("丢弃了 %d 个分片, 期望 %d", got, tt.dropped)
+			}
+		})
+	}
+}
+
+func TestUDPByteCounts(t *testing.T) {
+	echo := startUDPEcho(t, nil)
+	// 不回复任何数据报的目标
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	tests := []struct {
+		name     string
+		target   *net.UDPAddr
+		payloads []int // 依次发送的负载长度
+		download int64
+	}{
+		{"回显目标", echo, []int{5, 100, 1400}, 1505},
+		{"不回复的目标", silent.LocalAddr().(*net.UDPAddr), []int{10, 20}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLog(t)
+			metrics := &recordingMetrics{}
+			s := startServer(t, testConfig(t, `{"udp": {"enable": true, "timeout": 60, "buffer_size": 65535}}`), func(s *Server) { s.Metrics = metrics })
+			ctrl, relay := associateUDP(t, s, "", "")
+			client := dialUDP(t, relay)
+
+			var upload int64
+			for _, n := range tt.payloads {
+				payload := bytes.Repeat([]byte("x"), n)
+				if _, err := client.Write(append(udpHeader(tt.target.IP.String(), uint16(tt.target.Port)), payload...)); err != nil {
+					t.Fatal(err)
+				}
+				if tt.download > 0 {
+					expectUDPReply(t, client, payload)
+				}
+				upload += int64(n)
+			}
+
+			// 计数可能在数据报转发之后才更新，等待两个方向的计数到达期望值
+			sum := func(name string) int64 {
+				var total int64
+				for _, call := range metrics.snapshot() {
+					var got string
+					var delta int64
+					if _, err := fmt.Sscanf(call, "counter %s %d", &got, &delta); err == nil && got == name {
+						total += delta
+					}
+				}
+				return total
+			}
+			for deadline := time.Now().Add(5 * time.Second); (sum("udp_upload_bytes_total") < upload || sum("udp_download_bytes_total") < tt.download) && time.Now().Before(deadline); {
+				time.Sleep(time.Millisecond)
+			}
+			if got, want := sum("udp_upload_bytes_total"), upload; got != want {
+				t.Fatalf("udp_upload_bytes_total 增加 %d, 期望 %d", got, want)
+			}
+			if got, want := sum("udp_download_bytes_total"), tt.download; got != want {
+				t.Fatalf("udp_download_bytes_total 增加 %d, 期望 %d", got, want)
+			}
+
+			// 关闭控制连接后会话结束，记录该会话两个方向的字节数
+			ctrl.Close()
+			waitLog(t, logs, fmt.Sprintf("UDP会话 %s -> %s 已关闭, 上行 %d 字节, 下行 %d 字节", client.LocalAddr(), tt.target, upload, tt.download))
+		})
+	}
+}
+
+// freeUDPAddr 返回一个当前未被占用的本机UDP地址
+func freeUDPAddr(t *testing.T) *net.UDPAddr {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func TestUDPTrustedSources(t *testing.T) {
+	echo := startUDPEcho(t, nil)
+	header := udpHeader(echo.IP.String(), uint16(echo.Port))
+	tests := []struct {
+		name       string
+		standalone bool
+		trusted    string
+		relayed    bool
+	}{
+		{"仅UDP模式可信来源", true, "127.0.0.0/8", true},
+		{"仅UDP模式不可信来源", true, "192.0.2.0/24", false},
+		{"TCP模式下可信来源无需关联", false, "127.0.0.1/32", true},
+		{"TCP模式下未关联的来源", false, "192.0.2.0/24", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relay := freeUDPAddr(t)
+			s := startServer(t, testConfig(t, fmt.Sprintf(`{"udp": {"enable": true, "address": %q, "timeout": 60, "buffer_size": 65535, "standalone": %t, "trusted_sources": [%q]}}`, relay, tt.standalone, tt.trusted)))
+			if got := s.Addr() == nil; got != tt.standalone {
+				t.Fatalf("TCP监听器 %v, 期望仅UDP模式为 %v", s.Addr(), tt.standalone)
+			}
+			client := dialUDP(t, relay)
+
+			if !tt.relayed {
+				// 服务器启动后数据报才会被计为丢弃
+				dropped := counterValue("udp_unassociated_dropped_total")
+				deadline := time.Now().Add(5 * time.Second)
+				for counterValue("udp_unassociated_dropped_total") == dropped {
+					if time.Now().After(deadline) {
+						t.Fatal("未关联来源的数据报未被丢弃")
+					}
+					client.Write(append(header, "ping"...))
+					time.Sleep(10 * time.Millisecond)
+				}
+				expectNoUDPReply(t, client)
+				return
+			}
+			// 服务器在后台启动UDP监听，重发直到收到回复
+			buf := make([]byte, 65535)
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				client.Write(append(header, "ping"...))
+				client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+				if n, err := client.Read(buf); err == nil {
+					if !bytes.HasSuffix(buf[:n], []byte("ping")) {
+						t.Fatalf("UDP回复 % x 不包含负载", buf[:n])
+					}
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatal("可信来源的数据报未被转发")
+				}
+			}
+			// 可信来源的会话属于不对应控制连接的独立关联，不计入关联数
+			if !sessionKeys(s.udpHandler)[client.LocalAddr().String()] || associations(s.udpHandler, "127.0.0.1") != 0 {
+				t.Fatalf("会话 %v, 关联数 %d, 期望只有 %s 的会话", sessionKeys(s.udpHandler), associations(s.udpHandler, "127.0.0.1"), client.LocalAddr())
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"time"
+)
+
+// UDP 分片数据报的处理方式
+const (
+	UDPFragDrop       = "drop"       // 丢弃所有分片（FRAG 位置非0）
+	UDPFragReassemble = "reassemble" // 按 RFC 1928 重组后转发
+)
+
+// udpReassemblyTimeout 分片序列的重组超时，RFC 1928 要求不少于5秒
+const udpReassemblyTimeout = 5 * time.Second
+
+// udpMaxReassembled 重组后数据的最大长度（UDP 负载上限）
+const udpMaxReassembled = 65507
+
+// udpReassembly 一个客户端地址正在重组的分片序列
+type udpReassembly struct {
+	last    byte      // 最近收到的分片位置（1-127）
+	data    []byte    // 已按顺序拼接的数据
+	started time.Time // 收到第一个分片的时间
+}
+
+// udpFragments 按客户端地址保存正在重组的分片序列，只在 handleUDP 协程中使用
+type udpFragments struct {
+	pending   map[string]*udpReassembly
+	lastSweep time.Time
+}
+
+func newUDPFragments() *udpFragments {
+	return &udpFragments{pending: make(map[string]*udpReassembly), lastSweep: time.Now()}
+}
+
+// add 处理来自 key 的一个分片。FRAG 低7位为分片位置，最高位表示序列的最后一个分片。
+// 序列完整时返回拼接后的数据；位置不递增、超时或超长的序列被丢弃并从该分片重新开始
+func (f *udpFragments) add(key string, frag byte, payload []byte) []byte {
+	now := time.Now()
+	if now.Sub(f.lastSweep) > udpReassemblyTimeout {
+		for k, r := range f.pending {
+			if now.Sub(r.started) > udpReassemblyTimeout {
+				delete(f.pending, k)
+			}
+		}
+		f.lastSweep = now
+	}
+
+	pos := frag & 0x7F
+	r := f.pending[key]
+	if r == nil || pos <= r.last || now.Sub(r.started) > udpReassemblyTimeout ||
+		len(r.data)+len(payload) > udpMaxReassembled {
+		r = &udpReassembly{started: now}
+		f.pending[key] = r
+	}
+	r.last = pos
+	r.data = append(r.data, payload...)
+
+	if frag&0x80 == 0 {
+		return nil
+	}
+	delete(f.pending, key)
+	return r.data
+}
+
+// reset 丢弃 key 正在重组的序列。收到独立数据报（FRAG 为0）时调用
+func (f *udpFragments) reset(key string) {
+	if len(f.pending) > 0 {
+		delete(f.pending, key)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// UDPSessionState 导出的UDP会话状态，用于进程重启时交接UDP会话
+type UDPSessionState struct {
+	ClientAddr string    `json:"client_addr"`
+	TargetAddr string    `json:"target_addr"`
+	LastActive time.Time `json:"last_active"`
+	Created    time.Time `json:"created"`
+}
+
+// ExportSessions 返回当前所有UDP会话的状态
+func (h *UDPHandler) ExportSessions() []UDPSessionState {
+	h.sessionsLock.RLock()
+	defer h.sessionsLock.RUnlock()
+
+	states := make([]UDPSessionState, 0, len(h.sessions))
+	for _, session := range h.sessions {
+		states = append(states, UDPSessionState{
+			ClientAddr: session.clientAddr.String(),
+			TargetAddr: session.targetConn.RemoteAddr().String(),
+			LastActive: session.lastActive,
+			Created:    session.created,
+		})
+	}
+	return states
+}
+
+// ImportSessions 按导出的状态重新建立UDP会话，返回建立的会话数。已存在、
+// 地址无效、连接目标失败或超过 max_sessions 的会话被跳过。
+// 导入的会话不属于任何控制连接（原控制连接已随旧进程断开），
+// 来自该客户端地址的数据报可以继续转发，直到会话按 udp.timeout 或 udp.max_lifetime 过期；
+// 该客户端的新会话仍需要先通过控制连接建立关联
+func (h *UDPHandler) ImportSessions(states []UDPSessionState) (int, error) {
+	h.sessionsLock.Lock()
+	defer h.sessionsLock.Unlock()
+
+	select {
+	case <-h.done:
+		return 0, fmt.Errorf("UDP处理器已停止")
+	default:
+	}
+
+	now := time.Now()
+	detached := make(map[string]*udpAssociation)
+	imported := 0
+	for _, st := range states {
+		clientAddr, err := net.ResolveUDPAddr("udp", st.ClientAddr)
+		if err != nil {
+			continue
+		}
+		targetAddr, err := net.ResolveUDPAddr("udp", st.TargetAddr)
+		if err != nil {
+			continue
+		}
+		key := clientAddr.String()
+		if _, ok := h.sessions[key]; ok {
+			continue
+		}
+		if max := h.config.UDP.MaxSessions; max > 0 && len(h.sessions) >= max {
+			break
+		}
+
+		// 导出后规则可能已收紧，按当前的 block 规则与私有/公网地址限制重新检查目标
+		if h.checkTarget != nil {
+			if err := h.checkTarget(targetAddr.IP); err != nil {
+				log.Printf("跳过导入的UDP会话 %s -> %s: %v", key, targetAddr, err)
+				continue
+			}
+		}
+		targetConn, err := net.DialUDP("udp", h.outboundAddr, targetAddr)
+		if err != nil {
+			continue
+		}
+
+		clientIP := clientAddr.IP.String()
+		assoc := detached[clientIP]
+		if assoc == nil {
+			assoc = &udpAssociation{clientIP: clientIP, sessions: make(map[string]*UDPSession), lastActive: now}
+			detached[clientIP] = assoc
+		}
+		lastActive := st.LastActive
+		if lastActive.IsZero() || lastActive.After(now) {
+			lastActive = now
+		}
+		// 保留原建立时间，使 max_lifetime 不因交接而重新计时
+		created := st.Created
+		if created.IsZero() || created.After(now) {
+			created = now
+		}
+
+		session := &UDPSession{
+			clientAddr: clientAddr,
+			targetConn: targetConn,
+			lastActive: lastActive,
+			created:    created,
+			done:       make(chan struct{}),
+			assoc:      assoc,
+		}
+		h.sessions[key] = session
+		assoc.sessions[key] = session
+		h.wg.Add(1)
+		go h.handleTargetData(session)
+		imported++
+	}
+	return imported, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+const udpStateConfig = `{"udp": {"enable": true, "timeout": 60, "buffer_size": 65535, "max_sessions": 3}}`
+
+// startUDPServer 启动开启UDP的服务器，extra 为附加的顶层配置字段。Start 先启动UDP服务再开始接受连接，
+// 因此完成一次握手后即可直接使用 udpHandler
+func startUDPServer(t *testing.T, extra string) *Server {
+	t.Helper()
+	s := startServer(t, testConfig(t, udpStateConfig[:len(udpStateConfig)-1]+extra+"}"))
+	if !greetFrom(t, s.Addr().String(), net.IPv4(127, 0, 0, 1)) {
+		t.Fatal("服务器未完成握手")
+	}
+	return s
+}
+
+func TestUDPSessionHandoff(t *testing.T) {
+	echo := startUDPEcho(t, nil)
+	header := udpHeader(echo.IP.String(), uint16(echo.Port))
+
+	// 旧进程中建立会话并导出
+	old := startUDPServer(t, "")
+	_, relay := associateUDP(t, old, "", "")
+	client := dialUDP(t, relay)
+	client.Write(append(header, "before"...))
+	expectUDPReply(t, client, []byte("before"))
+
+	exported, err := old.ExportUDPSessions()
+	if err != nil || len(exported) != 1 {
+		t.Fatalf("导出了 %d 个会话 (%v), 期望 1", len(exported), err)
+	}
+	st := exported[0]
+	if st.ClientAddr != client.LocalAddr().String() || st.TargetAddr != echo.String() {
+		t.Fatalf("导出的会话 %+v, 期望客户端 %s 目标 %s", st, client.LocalAddr(), echo)
+	}
+	if time.Since(st.LastActive) > 5*time.Second || st.Created.After(st.LastActive) {
+		t.Fatalf("导出的时间不正确: %+v", st)
+	}
+
+	// 状态以 JSON 交给新进程
+	data, err := json.Marshal(exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var states []UDPSessionState
+	if err := json.Unmarshal(data, &states); err != nil {
+		t.Fatal(err)
+	}
+	// 旧进程的客户端套接字关闭后，由新进程接收同一客户端地址的数据报
+	clientAddr := client.LocalAddr().(*net.UDPAddr)
+	client.Close()
+
+	s := startUDPServer(t, "")
+	if n, err := s.ImportUDPSessions(states); err != nil || n != 1 {
+		t.Fatalf("导入了 %d 个会话 (%v), 期望 1", n, err)
+	}
+	reexported, _ := s.ExportUDPSessions()
+	if len(reexported) != 1 || reexported[0].ClientAddr != st.ClientAddr || reexported[0].TargetAddr != st.TargetAddr || !reexported[0].Created.Equal(st.Created) {
+		t.Fatalf("新进程导出 %+v, 期望与导入的 %+v 一致", reexported, st)
+	}
+
+	// 原客户端地址无需重新关联即可继续通过新进程转发
+	conn, err := net.ListenUDP("udp", clientAddr)
+	if err != nil {
+		t.Skipf("无法重新绑定客户端地址 %s: %v", clientAddr, err)
+	}
+	defer conn.Close()
+	newRelay := s.udpHandler.listener.LocalAddr().(*net.UDPAddr)
+	if _, err := conn.WriteToUDP(append(header, "after"...), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: newRelay.Port}); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 65535)
+	n, _, err := conn.ReadFromUDP(buf)
+	if err != nil || string(buf[n-len("after"):n]) != "after" {
+		t.Fatalf("交接后未收到回复: % x (%v)", buf[:n], err)
+	}
+}
+
+func TestUDPImportSessions(t *testing.T) {
+	echo := startUDPEcho(t, nil)
+	now := time.Now()
+	state := func(client string) UDPSessionState {
+		return UDPSessionState{ClientAddr: client, TargetAddr: echo.String(), LastActive: now, Created: now}
+	}
+	tests := []struct {
+		name   string
+		extra  string // 附加的顶层配置字段
+		states []UDPSessionState
+		want   int
+	}{
+		{"空列表", "", nil, 0},
+		{"有效会话", "", []UDPSessionState{state("127.0.0.1:40001"), state("127.0.0.1:40002")}, 2},
+		{"重复的客户端地址", "", []UDPSessionState{state("127.0.0.1:40001"), state("127.0.0.1:40001")}, 1},
+		{"无效地址", "", []UDPSessionState{state("127.0.0.1"), {ClientAddr: "127.0.0.1:40001", TargetAddr: "bad"}, state("127.0.0.1:40002")}, 1},
+		// max_sessions 为3
+		{"超过会话上限", "", []UDPSessionState{state("127.0.0.1:40001"), state("127.0.0.1:40002"), state("127.0.0.1:40003"), state("127.0.0.1:40004")}, 3},
+		// 导出后目标被规则禁止
+		{"目标被路由规则阻止", `, "routes": [{"match": "127.0.0.0/8", "via": "block"}]`, []UDPSessionState{state("127.0.0.1:40001")}, 0},
+		{"目标为私有地址", `, "block_private_targets": true`, []UDPSessionState{state("127.0.0.1:40001")}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startUDPServer(t, tt.extra)
+			if n, err := s.ImportUDPSessions(tt.states); err != nil || n != tt.want {
+				t.Fatalf("导入了 %d 个会话 (%v), 期望 %d", n, err, tt.want)
+			}
+			if exported, _ := s.ExportUDPSessions(); len(exported) != tt.want {
+				t.Fatalf("导入后导出 %d 个会话, 期望 %d", len(exported), tt.want)
+			}
+		})
+	}
+
+	// 未开启UDP或停止后不能导入
+	plain := NewServer(testConfig(t, ""))
+	if _, err := plain.ImportUDPSessions([]UDPSessionState{state("127.0.0.1:40001")}); err == nil {
+		t.Fatal("未开启UDP时导入应失败")
+	}
+	s := NewServer(testConfig(t, udpStateConfig))
+	if err := s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- s.Start() }()
+	if !greetFrom(t, s.Addr().String(), net.IPv4(127, 0, 0, 1)) {
+		t.Fatal("服务器未完成握手")
+	}
+	s.Stop()
+	<-done
+	if _, err := s.ImportUDPSessions([]UDPSessionState{state("127.0.0.1:40001")}); err == nil {
+		t.Fatal("UDP处理器停止后导入应失败")
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// 上游代理类型
+const (
+	UpstreamSOCKS5      = "socks5"
+	UpstreamHTTPConnect = "http-connect"
+)
+
+// UpstreamConfig 表示一个上游代理
+type UpstreamConfig struct {
+	// 上游类型：socks5 或 http-connect
+	Type string `json:"type"`
+	// 上游代理地址，格式为 "IP:端口"
+	Address string `json:"address"`
+	// 上游认证用户名，为空则不认证
+	Username string `json:"username"`
+	// 上游认证密码
+	Password string `json:"password"`
+	// http-connect 上游：将连接的追踪ID以该名称的请求头发送给上游，为空则不发送
+	TraceHeader string `json:"trace_header"`
+	// http-connect 上游：CONNECT 请求中附加的请求头，如 User-Agent
+	Headers map[string]string `json:"headers"`
+	// 是否在本地解析域名后向上游发送IP，默认直接发送域名由上游解析
+	ResolveLocally bool `json:"resolve_locally"`
+	// http-connect 上游：为每个访问过的目标在后台预建的空闲隧道数，0表示不预建
+	PoolSize int `json:"pool_size"`
+	// 预建隧道的空闲保留时间（秒），超时后关闭，默认30
+	PoolIdleTimeout int `json:"pool_idle_timeout"`
+	// 是否在握手前向上游发送 PROXY 协议 v2 头，携带客户端地址与认证用户名
+	ProxyProtocol bool `json:"proxy_protocol"`
+}
+
+// dialFunc 建立网络连接的函数
+type dialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// upstreamReplyError 上游代理拒绝了请求，Code 为应回复给客户端的回复码
+type upstreamReplyError struct {
+	Upstream string
+	Code     uint8
+	Status   string // HTTP CONNECT 上游的响应状态
+}
+
+func (e *upstreamReplyError) Error() string {
+	if e.Status != "" {
+		return fmt.Sprintf("上游代理 %s 拒绝请求: %s", e.Upstream, e.Status)
+	}
+	return fmt.Sprintf("上游代理 %s 拒绝请求, 回复码: %d", e.Upstream, e.Code)
+}
+
+// validateUpstream 校验上游代理配置
+func validateUpstream(name string, u UpstreamConfig) error {
+	if u.Type != UpstreamSOCKS5 && u.Type != UpstreamHTTPConnect {
+		return fmt.Errorf("上游代理 %s 类型不支持: %s", name, u.Type)
+	}
+	if _, _, err := net.SplitHostPort(u.Address); err != nil {
+		return fmt.Errorf("上游代理 %s 地址无效: %v", name, err)
+	}
+	if u.Type == UpstreamSOCKS5 && (len(u.Username) > 255 || len(u.Password) > 255) {
+		return fmt.Errorf("上游代理 %s 用户名或密码过长", name)
+	}
+	if len(u.Headers) > 0 && u.Type != UpstreamHTTPConnect {
+		return fmt.Errorf("上游代理 %s: headers 仅支持 http-connect 上游", name)
+	}
+	for key, value := range u.Headers {
+		if err := validateHeader(key, value); err != nil {
+			return fmt.Errorf("上游代理 %s: %w", name, err)
+		}
+	}
+	if u.PoolSize < 0 || u.PoolIdleTimeout < 0 {
+		return fmt.Errorf("上游代理 %s 的 pool_size 与 pool_idle_timeout 不能为负数", name)
+	}
+	if u.PoolSize > 0 && u.Type != UpstreamHTTPConnect {
+		return fmt.Errorf("上游代理 %s: pool_size 仅支持 http-connect 上游", name)
+	}
+	if u.PoolSize > 0 && u.ProxyProtocol {
+		return fmt.Errorf("上游代理 %s: 预建的隧道不属于任何客户端, pool_size 不能与 proxy_protocol 同时使用", name)
+	}
+	return nil
+}
+
+// dialViaUpstream 通过上游代理连接目标。http-connect 上游配置了 pool_size 时
+// 优先使用为该目标预建的隧道，并在后台补充新的隧道供后续请求使用
+func (s *Server) dialViaUpstream(ctx context.Context, dial dialFunc, name string, u UpstreamConfig, target string) (net.Conn, error) {
+	if u.Type != UpstreamHTTPConnect || u.PoolSize <= 0 {
+		return dialUpstream(ctx, dial, name, u, target)
+	}
+
+	key := poolKey(name, u, target)
+	conn := s.tunnels.get(key)
+	if conn != nil {
+		metricTunnelPoolHits.Add(s.metrics(), 1)
+		s.debugf(ctx, "使用上游 %s 预建的隧道连接 %s", name, target)
+	} else {
+		var err error
+		if conn, err = dialUpstream(ctx, dial, name, u, target); err != nil {
+			return nil, err
+		}
+	}
+
+	idleTimeout := time.Duration(u.PoolIdleTimeout) * time.Second
+	if idleTimeout == 0 {
+		idleTimeout = defaultPoolIdleTimeout
+	}
+	s.tunnels.refill(key, u.PoolSize, idleTimeout, func(ctx context.Context) (net.Conn, error) {
+		return dialUpstream(ctx, dial, name, u, target)
+	})
+	return conn, nil
+}
+
+// poolKey 返回预建隧道的分组键。重新加载配置后上游凭据或附加的请求头可能变化，
+// 以旧值建立的隧道不能交给新请求，因此它们也计入分组键；只计入摘要，避免密码出现在日志中
+func poolKey(name string, u UpstreamConfig, target string) string {
+	h := sha256.New()
+	io.WriteString(h, u.Username+"\x00"+u.Password)
+	keys := make([]string, 0, len(u.Headers))
+	for k := range u.Headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		io.WriteString(h, "\x00"+k+"\x00"+u.Headers[k])
+	}
+	return name + "|" + u.Address + "|" + target + "|" + hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// dialUpstream 通过上游代理连接目标
+func dialUpstream(ctx context.Context, dial dialFunc, name string, u UpstreamConfig, target string) (net.Conn, error) {
+	conn, err := dial(ctx, "tcp", u.Address)
+	if err != nil {
+		return nil, fmt.Errorf("连接上游代理 %s 失败: %w", name, err)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	if u.ProxyProtocol {
+		if err := writeFull(conn, proxyV2Header(clientInfoFrom(ctx))); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("向上游代理 %s 发送 PROXY 协议头失败: %w", name, err)
+		}
+	}
+
+	if u.Type == UpstreamHTTPConnect {
+		br, err := httpConnect(ctx, conn, name, u, target)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if br.Buffered() > 0 {
+			return &bufferedConn{Conn: conn, r: br}, nil
+		}
+		return conn, nil
+	}
+
+	if err := socks5Connect(conn, name, u, target); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// socks5Connect 在已建立的连接上完成 SOCKS5 握手并发送 CONNECT 请求
+func socks5Connect(conn net.Conn, name string, u UpstreamConfig, target string) error {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return fmt.Errorf("无效的目标地址 %s: %v", target, err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("无效的目标端口 %s: %v", portStr, err)
+	}
+
+	// 协商认证方法
+	methods := []byte{Version5, 1, MethodNoAuth}
+	if u.Username != "" {
+		methods = []byte{Version5, 2, MethodNoAuth, MethodUserPass}
+	}
+	if err := writeFull(conn, methods); err != nil {
+		return fmt.Errorf("发送上游握手失败: %w", err)
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("读取上游握手响应失败: %w", err)
+	}
+	if reply[0] != Version5 {
+		return fmt.Errorf("上游代理 %s 版本不支持: %d", name, reply[0])
+	}
+
+	switch reply[1] {
+	case MethodNoAuth:
+	case MethodUserPass:
+		auth := []byte{AuthUserPassVersion, byte(len(u.Username))}
+		auth = append(auth, u.Username...)
+		auth = append(auth, byte(len(u.Password)))
+		auth = append(auth, u.Password...)
+		if err := writeFull(conn, auth); err != nil {
+			return fmt.Errorf("发送上游认证失败: %w", err)
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return fmt.Errorf("读取上游认证响应失败: %w", err)
+		}
+		if reply[1] != AuthUserPassSuccess {
+			return fmt.Errorf("上游代理 %s 认证失败", name)
+		}
+	default:
+		return fmt.Errorf("上游代理 %s 没有可用的认证方法", name)
+	}
+
+	// 发送 CONNECT 请求
+	request := []byte{Version5, CmdConnect, 0x00}
+	if ip := net.ParseIP(host); ip != nil {
+		if v4 := ip.To4(); v4 != nil {
+			request = append(request, TypeIPv4)
+			request = append(request, v4...)
+		} else {
+			request = append(request, TypeIPv6)
+			request = append(request, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("目标域名过长: %s", host)
+		}
+		request = append(request, TypeDomain, byte(len(host)))
+		request = append(request, host...)
+	}
+	request = binary.BigEndian.AppendUint16(request, uint16(port))
+	if err := writeFull(conn, request); err != nil {
+		return fmt.Errorf("发送上游请求失败: %w", err)
+	}
+
+	// 读取响应并丢弃绑定地址
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return fmt.Errorf("读取上游响应失败: %w", err)
+	}
+	if header[1] != RepSuccess {
+		return &upstreamReplyError{Upstream: name, Code: header[1]}
+	}
+
+	var addrLen int
+	switch header[3] {
+	case TypeIPv4:
+		addrLen = net.IPv4len
+	case TypeIPv6:
+		addrLen = net.IPv6len
+	case TypeDomain:
+		if _, err := io.ReadFull(conn, reply[:1]); err != nil {
+			return fmt.Errorf("读取上游绑定地址失败: %w", err)
+		}
+		addrLen = int(reply[0])
+	default:
+		return errors.New("上游响应的地址类型不支持")
+	}
+	if _, err := io.ReadFull(conn, make([]byte, addrLen+2)); err != nil {
+		return fmt.Errorf("读取上游绑定地址失败: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestUpstreamResolveLocally(t *testing.T) {
+	echo := startEcho(t)
+	echoHost, echoPort, _ := net.SplitHostPort(echo)
+	port, _ := strconv.Atoi(echoPort)
+
+	// SOCKS5 上游记录收到的目标，并全部改写为回显服务
+	var mu sync.Mutex
+	var seen []string
+	socksUp := startServer(t, testConfig(t, ""), func(s *Server) {
+		s.OnRequest = func(ctx context.Context, req *Request) (*Request, error) {
+			mu.Lock()
+			seen = append(seen, net.JoinHostPort(req.Host, strconv.Itoa(int(req.Port))))
+			mu.Unlock()
+			rewritten := *req
+			rewritten.Host, rewritten.Port = echoHost, uint16(port)
+			return &rewritten, nil
+		}
+	})
+
+	tests := []struct {
+		name     string
+		upstream string // 上游类型
+		local    bool
+		want     string // 上游收到的目标
+	}{
+		{"SOCKS5上游解析", UpstreamSOCKS5, false, "echo.test:80"},
+		{"SOCKS5本地解析", UpstreamSOCKS5, true, "192.0.2.7:80"},
+		{"HTTP上游解析", UpstreamHTTPConnect, false, "echo.test:80"},
+		{"HTTP本地解析", UpstreamHTTPConnect, true, "192.0.2.7:80"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			seen = nil
+			mu.Unlock()
+			addr := socksUp.Addr().String()
+			var requests <-chan *http.Request
+			if tt.upstream == UpstreamHTTPConnect {
+				addr, requests = startHTTPProxy(t, http.StatusOK, echo, "")
+			}
+			resolver := &stubResolver{hosts: map[string][]net.IP{"echo.test": {net.IPv4(192, 0, 2, 7)}}}
+			s := startServer(t, testConfig(t, `{
+				"upstreams": {"up": {"type": "`+tt.upstream+`", "address": "`+addr+`", "resolve_locally": `+strconv.FormatBool(tt.local)+`}},
+				"routes": [{"match": "echo.test", "via": "up"}]
+			}`), func(s *Server) { s.Resolver = resolver })
+
+			conn, rep, _ := connect(t, s, "", "", CmdConnect, "echo.test:80")
+			if rep != RepSuccess {
+				t.Fatalf("回复码 %#x", rep)
+			}
+			mustWrite(t, conn, []byte("hello"))
+			expectBytes(t, conn, []byte("hello"))
+
+			var got string
+			if requests != nil {
+				got = (<-requests).Host
+			} else {
+				mu.Lock()
+				got = strings.Join(seen, ",")
+				mu.Unlock()
+			}
+			if got != tt.want {
+				t.Fatalf("上游收到的目标为 %q, 期望 %q", got, tt.want)
+			}
+			// 由上游解析时本地不解析域名，避免 DNS 泄露
+			if n := resolver.lookups("echo.test"); (n > 0) != tt.local {
+				t.Fatalf("本地解析了 %d 次", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// 连接事件类型
+const (
+	EventConnectionOpen  = "connection_open"
+	EventConnectionClose = "connection_close"
+)
+
+// webhook 的默认批量、发送间隔、队列长度与请求超时
+const (
+	defaultWebhookBatchSize     = 100
+	defaultWebhookFlushInterval = time.Second
+	defaultWebhookQueueSize     = 1000
+	defaultWebhookTimeout       = 5 * time.Second
+)
+
+// ConnectionEvent 发送到 webhook 的连接事件
+type ConnectionEvent struct {
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	TraceID  string    `json:"trace_id"`
+	Client   string    `json:"client"`
+	User     string    `json:"user,omitempty"` // 按 log_usernames 脱敏
+	Target   string    `json:"target"`
+	Egress   string    `json:"egress,omitempty"`
+	Upload   int64     `json:"upload,omitempty"`   // 仅 connection_close
+	Download int64     `json:"download,omitempty"` // 仅 connection_close
+	Duration float64   `json:"duration_ms,omitempty"`
+}
+
+// eventEmitter 异步批量发送连接事件。队列已满时丢弃事件，不阻塞转发
+type eventEmitter struct {
+	url           string
+	batchSize     int
+	flushInterval time.Duration
+	client        *http.Client
+	queue         chan ConnectionEvent
+	metrics       Metrics       // 由 Server.Start 设置为服务器的指标实现
+	done          chan struct{} // run 退出时关闭
+}
+
+// newEventEmitter 根据 webhook 配置创建事件发送器，未配置 URL 时返回 nil
+func newEventEmitter(c WebhookConfig) *eventEmitter {
+	if c.URL == "" {
+		return nil
+	}
+	e := &eventEmitter{
+		url:           c.URL,
+		batchSize:     c.BatchSize,
+		flushInterval: time.Duration(c.FlushInterval) * time.Millisecond,
+		client:        &http.Client{Timeout: time.Duration(c.Timeout) * time.Second},
+		queue:         make(chan ConnectionEvent, c.QueueSize),
+		metrics:       ExpvarMetrics{},
+		done:          make(chan struct{}),
+	}
+	if e.batchSize <= 0 {
+		e.batchSize = defaultWebhookBatchSize
+	}
+	if e.flushInterval <= 0 {
+		e.flushInterval = defaultWebhookFlushInterval
+	}
+	if c.QueueSize <= 0 {
+		e.queue = make(chan ConnectionEvent, defaultWebhookQueueSize)
+	}
+	if c.Timeout <= 0 {
+		e.client.Timeout = defaultWebhookTimeout
+	}
+	return e
+}
+
+// emit 将事件放入队列，队列已满时丢弃并计入指标
+func (e *eventEmitter) emit(ev ConnectionEvent) {
+	if e == nil {
+		return
+	}
+	select {
+	case e.queue <- ev:
+	default:
+		metricWebhookDropped.Add(e.metrics, 1)
+	}
+}
+
+// run 从队列中取出事件，攒满 batch_size 或每隔 flush_interval 发送一次。
+// ctx 取消后发送队列中剩余的事件再退出
+func (e *eventEmitter) run(ctx context.Context) {
+	defer close(e.done)
+	ticker := time.NewTicker(e.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]ConnectionEvent, 0, e.batchSize)
+	flush := func() {
+		if len(batch) > 0 {
+			e.post(batch)
+			batch = batch[:0]
+		}
+	}
+	for {
+		select {
+		case ev := <-e.queue:
+			if batch = append(batch, ev); len(batch) >= e.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-ctx.Done():
+			for {
+				select {
+				case ev := <-e.queue:
+					if batch = append(batch, ev); len(batch) >= e.batchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// post 以 JSON 数组发送一批事件，失败时记录日志并丢弃该批事件
+func (e *eventEmitter) post(batch []ConnectionEvent) {
+	err := func() error {
+		body, err := json.Marshal(batch)
+		if err != nil {
+			return err
+		}
+		resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("响应 %s", resp.Status)
+		}
+		return nil
+	}()
+	if err != nil {
+		metricWebhookFailed.Add(e.metrics, int64(len(batch)))
+		log.Printf("发送 %d 个连接事件到 webhook %s 失败: %v", len(batch), redactConfigURL(e.url), err)
+		return
+	}
+	metricWebhookSent.Add(e.metrics, int64(len(batch)))
+}
+
+// connectionEvent 构建 CONNECT 会话的连接事件
+func (s *Server) connectionEvent(ctx context.Context, typ string, req *Request, target string, dest net.Conn) ConnectionEvent {
+	ev := ConnectionEvent{
+		Type:    typ,
+		Time:    time.Now(),
+		TraceID: traceIDFrom(ctx),
+		User:    s.logUsername(req.Username),
+		Target:  target,
+		Egress:  dest.LocalAddr().String(),
+	}
+	if req.RemoteAddr != nil {
+		ev.Client = req.RemoteAddr.String()
+	}
+	return ev
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// startWebhook 启动桩 webhook，按 status 应答并把收到的每批事件发送到返回的通道
+func startWebhook(t *testing.T, status int) (string, <-chan []ConnectionEvent) {
+	t.Helper()
+	batches := make(chan []ConnectionEvent, 64)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch []ConnectionEvent
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("webhook 收到 %s 请求, Content-Type %q", r.Method, r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			t.Errorf("解析事件失败: %v", err)
+		}
+		batches <- batch
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, batches
+}
+
+func TestWebhookEvents(t *testing.T) {
+	echo := startEcho(t)
+	url, batches := startWebhook(t, http.StatusOK)
+	s := startServer(t, testConfig(t, `{"users": {"alice": "secret"}, "webhook": {"url": "`+url+`", "flush_interval": 20}}`))
+
+	conn, rep, _ := connect(t, s, "alice", "secret", CmdConnect, echo)
+	if rep != RepSuccess {
+		t.Fatalf("回复码 %#x", rep)
+	}
+	mustWrite(t, conn, []byte("hello"))
+	expectBytes(t, conn, []byte("hello"))
+	client := conn.LocalAddr().String()
+	conn.Close()
+
+	var events []ConnectionEvent
+	for len(events) < 2 {
+		select {
+		case batch := <-batches:
+			events = append(events, batch...)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("webhook 只收到 %d 个事件", len(events))
+		}
+	}
+	open, closed := events[0], events[1]
+	if open.Type != EventConnectionOpen || closed.Type != EventConnectionClose {
+		t.Fatalf("事件类型 %s, %s, 期望 %s, %s", open.Type, closed.Type, EventConnectionOpen, EventConnectionClose)
+	}
+	for _, ev := range events {
+		if ev.TraceID == "" || ev.TraceID != open.TraceID || ev.Client != client || ev.User != "alice" || ev.Target != echo || ev.Egress == "" {
+			t.Fatalf("事件 %+v 与会话不符", ev)
+		}
+	}
+	if open.Upload != 0 || open.Download != 0 || open.Duration != 0 {
+		t.Fatalf("打开事件携带了统计: %+v", open)
+	}
+	if closed.Upload != 5 || closed.Download != 5 || closed.Duration <= 0 || closed.Time.Before(open.Time) {
+		t.Fatalf("关闭事件统计 %+v, 期望上行与下行各5字节", closed)
+	}
+}
+
+func TestEventEmitter(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		batchSize int
+		queueSize int
+		events    int
+		batches   []int // 每批发送的事件数
+		sent      int64
+		failed    int64
+		dropped   int64
+	}{
+		{"攒满一批发送", http.StatusOK, 3, 10, 7, []int{3, 3, 1}, 7, 0, 0},
+		{"队列已满丢弃", http.StatusOK, 10, 2, 5, []int{2}, 2, 0, 3},
+		{"发送失败", http.StatusInternalServerError, 10, 10, 2, []int{2}, 0, 2, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url, batches := startWebhook(t, tt.status)
+			// 发送间隔足够长，只按批量与退出时发送
+			e := newEventEmitter(WebhookConfig{URL: url, BatchSize: tt.batchSize, FlushInterval: 3600000, QueueSize: tt.queueSize})
+			metrics := &recordingMetrics{}
+			e.metrics = metrics
+
+			// 发送器未运行时入队不会阻塞，队列满后直接丢弃
+			for i := 0; i < tt.events; i++ {
+				e.emit(ConnectionEvent{Type: EventConnectionOpen, TraceID: strconv.Itoa(i)})
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			e.run(ctx)
+
+			var got []int
+			next := 0
+			for len(got) < len(tt.batches) {
+				batch := <-batches
+				got = append(got, len(batch))
+				for _, ev := range batch {
+					if ev.TraceID != strconv.Itoa(next) {
+						t.Fatalf("事件顺序错误: 收到 %s, 期望 %d", ev.TraceID, next)
+					}
+					next++
+				}
+			}
+			if len(batches) > 0 || fmt.Sprint(got) != fmt.Sprint(tt.batches) {
+				t.Fatalf("发送批次 %v (另有 %d 批), 期望 %v", got, len(batches), tt.batches)
+			}
+			counts := map[string]int64{}
+			for _, call := range metrics.snapshot() {
+				var name string
+				var delta int64
+				if _, err := fmt.Sscanf(call, "counter %s %d", &name, &delta); err == nil {
+					counts[name] += delta
+				}
+			}
+			if counts["webhook_events_sent_total"] != tt.sent || counts["webhook_events_failed_total"] != tt.failed || counts["webhook_events_dropped_total"] != tt.dropped {
+				t.Fatalf("指标 %v, 期望发送 %d 失败 %d 丢弃 %d", counts, tt.sent, tt.failed, tt.dropped)
+			}
+		})
+	}
+}